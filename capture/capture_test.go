@@ -0,0 +1,118 @@
+package capture
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestRoundTrip(t *testing.T) {
+	frames := []struct {
+		ts   time.Time
+		data []byte
+		dir  Direction
+	}{
+		{time.Unix(1700000000, 123456789), []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 1, 2, 3, 4, 5, 6, 0x08, 0x06}, DirectionInbound},
+		{time.Unix(1700000001, 0), bytes.Repeat([]byte{0xab}, 61), DirectionOutbound}, // Padded to 64
+		{time.Unix(1700000002, 1), []byte{}, DirectionUnknown},
+	}
+
+	tests := []struct {
+		name      string
+		newWriter func(w io.Writer) (Writer, error)
+		keepsDir  bool
+	}{
+		{"pcap", func(w io.Writer) (Writer, error) { return NewPcapWriter(w) }, false},
+		{"pcapng", func(w io.Writer) (Writer, error) { return NewPcapngWriter(w, "veth0-peer") }, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+
+			w, err := tt.newWriter(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range frames {
+				if err := w.WriteFrame(f.ts, f.data, f.dir); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			r, err := NewReader(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i, want := range frames {
+				got, err := r.ReadFrame()
+				if err != nil {
+					t.Fatalf("frame %d: %v", i, err)
+				}
+				if !got.Timestamp.Equal(want.ts) {
+					t.Errorf("frame %d: timestamp %v, want %v", i, got.Timestamp, want.ts)
+				}
+				if !bytes.Equal(got.Data, want.data) {
+					t.Errorf("frame %d: data % x, want % x", i, got.Data, want.data)
+				}
+				if got.LinkType != LinkTypeEthernet {
+					t.Errorf("frame %d: link type %d", i, got.LinkType)
+				}
+				wantDir := DirectionUnknown
+				if tt.keepsDir {
+					wantDir = want.dir
+				}
+				if got.Direction != wantDir {
+					t.Errorf("frame %d: direction %s, want %s", i, got.Direction, wantDir)
+				}
+			}
+
+			if _, err := r.ReadFrame(); err != io.EOF {
+				t.Errorf("after the last frame: %v, want EOF", err)
+			}
+		})
+	}
+}
+
+func TestReaderErrors(t *testing.T) {
+	var pcap bytes.Buffer
+	w, _ := NewPcapWriter(&pcap)
+	w.WriteFrame(time.Unix(0, 0), []byte{1, 2, 3, 4}, DirectionUnknown)
+
+	var pcapng bytes.Buffer
+	wng, _ := NewPcapngWriter(&pcapng, "eth0")
+	wng.WriteFrame(time.Unix(0, 0), []byte{1, 2, 3, 4}, DirectionInbound)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		openErr bool
+	}{
+		{"empty", nil, true},
+		{"unknown magic", []byte{1, 2, 3, 4, 5, 6, 7, 8}, true},
+		{"truncated pcap header", pcap.Bytes()[:10], true},
+		{"truncated pcap record", pcap.Bytes()[:pcap.Len()-1], false},
+		{"truncated pcapng block", pcapng.Bytes()[:pcapng.Len()-1], false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewReader(bytes.NewReader(tt.data))
+			if tt.openErr {
+				if err == nil {
+					t.Fatal("NewReader succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := r.ReadFrame(); err == nil || err == io.EOF {
+				t.Errorf("ReadFrame returned %v, want an error", err)
+			}
+		})
+	}
+}
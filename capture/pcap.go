@@ -0,0 +1,81 @@
+package capture
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// +--------------------------------------------------------+
+// | pcap Global Header (24 bytes)                          |
+// |--------------------------------------------------------|
+// | Magic (4) | Major (2) | Minor (2) | Reserved (8)       |
+// | SnapLen (4) | LinkType (4)                             |
+// +--------------------------------------------------------+
+// | pcap Record Header (16 bytes) followed by the frame    |
+// |--------------------------------------------------------|
+// | Seconds (4) | Sub-seconds (4) | CapLen (4) | Len (4)   |
+// +--------------------------------------------------------+
+//
+// The magic gives both the byte order and the timestamp resolution
+// (0xA1B2C3D4 for microseconds, 0xA1B23C4D for nanoseconds).
+//
+// https://datatracker.ietf.org/doc/draft-ietf-opsawg-pcap/
+const (
+	pcapMagicMicro uint32 = 0xA1B2C3D4
+	pcapMagicNano  uint32 = 0xA1B23C4D
+)
+
+// Writer is implemented by both file formats.
+type Writer interface {
+	WriteFrame(ts time.Time, frame []byte, dir Direction) error
+}
+
+// PcapWriter writes frames in the classic pcap format. This format cannot
+// store the direction so it is dropped.
+type PcapWriter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	snapLen uint32
+}
+
+// NewPcapWriter writes the global header. Timestamps are recorded with a
+// nanosecond resolution.
+func NewPcapWriter(w io.Writer) (*PcapWriter, error) {
+	pw := &PcapWriter{
+		w:       w,
+		snapLen: DefaultSnapLen,
+	}
+
+	h := make([]byte, 24)
+	binary.LittleEndian.PutUint32(h[0:4], pcapMagicNano)
+	binary.LittleEndian.PutUint16(h[4:6], 2)
+	binary.LittleEndian.PutUint16(h[6:8], 4)
+	binary.LittleEndian.PutUint32(h[16:20], pw.snapLen)
+	binary.LittleEndian.PutUint32(h[20:24], uint32(LinkTypeEthernet))
+
+	if _, err := w.Write(h); err != nil {
+		return nil, fmt.Errorf("failed to write pcap header: %w", err)
+	}
+
+	return pw, nil
+}
+
+func (pw *PcapWriter) WriteFrame(ts time.Time, frame []byte, _ Direction) error {
+	capLen := min(uint32(len(frame)), pw.snapLen)
+
+	b := make([]byte, 16+capLen)
+	binary.LittleEndian.PutUint32(b[0:4], uint32(ts.Unix()))
+	binary.LittleEndian.PutUint32(b[4:8], uint32(ts.Nanosecond()))
+	binary.LittleEndian.PutUint32(b[8:12], capLen)
+	binary.LittleEndian.PutUint32(b[12:16], uint32(len(frame)))
+	copy(b[16:], frame[:capLen])
+
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	_, err := pw.w.Write(b)
+	return err
+}
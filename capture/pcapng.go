@@ -0,0 +1,168 @@
+// Package capture records frames in files that can be opened with Wireshark
+// or tcpdump.
+package capture
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// +--------------------------------------------------------+
+// | pcapng Block (all blocks share this layout)            |
+// |--------------------------------------------------------|
+// | Block Type (4) | Block Total Length (4)                |
+// | Block Body (variable, padded to 32 bits)               |
+// | Options: Code (2) | Length (2) | Value (padded)        |
+// | Block Total Length (4)                                 |
+// +--------------------------------------------------------+
+//
+// A file is a Section Header Block followed by one Interface Description
+// Block and then one Enhanced Packet Block per frame.
+//
+// https://datatracker.ietf.org/doc/draft-ietf-opsawg-pcapng/
+// https://www.ietf.org/archive/id/draft-ietf-opsawg-pcaplinktype-00.html
+const (
+	blockSHB uint32 = 0x0A0D0D0A // Section Header Block
+	blockIDB uint32 = 0x00000001 // Interface Description Block
+	blockEPB uint32 = 0x00000006 // Enhanced Packet Block
+
+	byteOrderMagic uint32 = 0x1A2B3C4D
+
+	optEndOfOpt uint16 = 0
+	optComment  uint16 = 1
+	optIfName   uint16 = 2 // if_name in IDB
+	optIfTsres  uint16 = 9 // if_tsresol in IDB
+	optEpbFlags uint16 = 2 // epb_flags in EPB
+
+	// LinkTypeEthernet is LINKTYPE_ETHERNET
+	LinkTypeEthernet uint16 = 1
+
+	// DefaultSnapLen is large enough to never truncate a frame
+	DefaultSnapLen uint32 = 262144
+)
+
+// Direction is stored in the two lowest bits of epb_flags.
+type Direction uint8
+
+const (
+	DirectionUnknown  Direction = 0
+	DirectionInbound  Direction = 1
+	DirectionOutbound Direction = 2
+)
+
+func (d Direction) String() string {
+	switch d {
+	case DirectionInbound:
+		return "inbound"
+	case DirectionOutbound:
+		return "outbound"
+	default:
+		return "unknown"
+	}
+}
+
+// PcapngWriter writes frames of a single Ethernet interface. It is safe to
+// use it from several goroutines.
+type PcapngWriter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	snapLen uint32
+}
+
+// NewPcapngWriter writes the section header and the description of the
+// interface ifName. Timestamps are recorded with a nanosecond resolution.
+func NewPcapngWriter(w io.Writer, ifName string) (*PcapngWriter, error) {
+	pw := &PcapngWriter{
+		w:       w,
+		snapLen: DefaultSnapLen,
+	}
+
+	// Section Header Block: byte order magic, version 1.0 and unknown
+	// section length (-1)
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:4], byteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[4:6], 1)
+	binary.LittleEndian.PutUint16(shb[6:8], 0)
+	binary.LittleEndian.PutUint64(shb[8:16], ^uint64(0))
+	shb = append(shb, pcapngOption(optComment, []byte("framespector"))...)
+	shb = append(shb, pcapngOption(optEndOfOpt, nil)...)
+
+	if err := pw.writeBlock(blockSHB, shb); err != nil {
+		return nil, fmt.Errorf("failed to write section header: %w", err)
+	}
+
+	// Interface Description Block: link type, reserved and snap length.
+	// if_tsresol 9 means 10^-9 so timestamps are in nanoseconds.
+	idb := make([]byte, 8)
+	binary.LittleEndian.PutUint16(idb[0:2], LinkTypeEthernet)
+	binary.LittleEndian.PutUint32(idb[4:8], pw.snapLen)
+	if ifName != "" {
+		idb = append(idb, pcapngOption(optIfName, []byte(ifName))...)
+	}
+	idb = append(idb, pcapngOption(optIfTsres, []byte{9})...)
+	idb = append(idb, pcapngOption(optEndOfOpt, nil)...)
+
+	if err := pw.writeBlock(blockIDB, idb); err != nil {
+		return nil, fmt.Errorf("failed to write interface description: %w", err)
+	}
+
+	return pw, nil
+}
+
+// WriteFrame records a frame seen at ts in the given direction.
+func (pw *PcapngWriter) WriteFrame(ts time.Time, frame []byte, dir Direction) error {
+	capLen := min(uint32(len(frame)), pw.snapLen)
+	ns := uint64(ts.UnixNano())
+
+	// Enhanced Packet Block: interface ID, timestamp (high, low), captured
+	// length, original length, data and options
+	epb := make([]byte, 20, 20+pad4(int(capLen))+16)
+	binary.LittleEndian.PutUint32(epb[0:4], 0)
+	binary.LittleEndian.PutUint32(epb[4:8], uint32(ns>>32))
+	binary.LittleEndian.PutUint32(epb[8:12], uint32(ns))
+	binary.LittleEndian.PutUint32(epb[12:16], capLen)
+	binary.LittleEndian.PutUint32(epb[16:20], uint32(len(frame)))
+	epb = append(epb, frame[:capLen]...)
+	epb = append(epb, make([]byte, pad4(int(capLen))-int(capLen))...)
+
+	if dir != DirectionUnknown {
+		flags := make([]byte, 4)
+		binary.LittleEndian.PutUint32(flags, uint32(dir))
+		epb = append(epb, pcapngOption(optEpbFlags, flags)...)
+		epb = append(epb, pcapngOption(optEndOfOpt, nil)...)
+	}
+
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	return pw.writeBlock(blockEPB, epb)
+}
+
+func (pw *PcapngWriter) writeBlock(blockType uint32, body []byte) error {
+	total := uint32(12 + len(body))
+
+	b := make([]byte, total)
+	binary.LittleEndian.PutUint32(b[0:4], blockType)
+	binary.LittleEndian.PutUint32(b[4:8], total)
+	copy(b[8:], body)
+	binary.LittleEndian.PutUint32(b[total-4:], total)
+
+	_, err := pw.w.Write(b)
+	return err
+}
+
+func pcapngOption(code uint16, value []byte) []byte {
+	b := make([]byte, 4+pad4(len(value)))
+	binary.LittleEndian.PutUint16(b[0:2], code)
+	binary.LittleEndian.PutUint16(b[2:4], uint16(len(value)))
+	copy(b[4:], value)
+	return b
+}
+
+// pad4 rounds n up to a multiple of 4
+func pad4(n int) int {
+	return (n + 3) &^ 3
+}
@@ -0,0 +1,312 @@
+package capture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"time"
+)
+
+// Frame is a frame read from a capture file.
+type Frame struct {
+	Timestamp time.Time
+	Data      []byte
+	Direction Direction // Always DirectionUnknown for pcap files
+	LinkType  uint16
+}
+
+// Reader returns the frames of a capture file. ReadFrame returns io.EOF when
+// there is no more frame.
+type Reader interface {
+	ReadFrame() (*Frame, error)
+}
+
+// NewReader detects the format (pcap or pcapng) from the first bytes of r.
+func NewReader(r io.Reader) (Reader, error) {
+	br := bufio.NewReader(r)
+
+	magic, err := br.Peek(4)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read capture magic: %w", err)
+	}
+
+	// Both byte orders give the same value for the pcapng block type
+	if binary.LittleEndian.Uint32(magic) == blockSHB {
+		return newPcapngReader(br)
+	}
+
+	return newPcapReader(br)
+}
+
+// ------------------------------------------------------------------------------
+// pcap
+
+type pcapReader struct {
+	r        io.Reader
+	order    binary.ByteOrder
+	nano     bool
+	linkType uint16
+}
+
+func newPcapReader(r io.Reader) (*pcapReader, error) {
+	h := make([]byte, 24)
+	if _, err := io.ReadFull(r, h); err != nil {
+		return nil, fmt.Errorf("failed to read pcap header: %w", err)
+	}
+
+	pr := &pcapReader{r: r}
+
+	switch {
+	case binary.LittleEndian.Uint32(h[0:4]) == pcapMagicMicro:
+		pr.order = binary.LittleEndian
+	case binary.LittleEndian.Uint32(h[0:4]) == pcapMagicNano:
+		pr.order, pr.nano = binary.LittleEndian, true
+	case binary.BigEndian.Uint32(h[0:4]) == pcapMagicMicro:
+		pr.order = binary.BigEndian
+	case binary.BigEndian.Uint32(h[0:4]) == pcapMagicNano:
+		pr.order, pr.nano = binary.BigEndian, true
+	default:
+		return nil, fmt.Errorf("unknown capture format: magic 0x%08X", binary.BigEndian.Uint32(h[0:4]))
+	}
+
+	// Link type is in the lower 16 bits, upper bits are FCS information
+	pr.linkType = uint16(pr.order.Uint32(h[20:24]))
+
+	return pr, nil
+}
+
+func (pr *pcapReader) ReadFrame() (*Frame, error) {
+	h := make([]byte, 16)
+	if _, err := io.ReadFull(pr.r, h); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, fmt.Errorf("truncated pcap record header")
+		}
+		return nil, err
+	}
+
+	sec := int64(pr.order.Uint32(h[0:4]))
+	sub := int64(pr.order.Uint32(h[4:8]))
+	capLen := pr.order.Uint32(h[8:12])
+
+	if capLen > DefaultSnapLen {
+		return nil, fmt.Errorf("pcap record too large: %d bytes", capLen)
+	}
+
+	if !pr.nano {
+		sub *= 1000
+	}
+
+	data := make([]byte, capLen)
+	if _, err := io.ReadFull(pr.r, data); err != nil {
+		return nil, fmt.Errorf("truncated pcap record: %w", err)
+	}
+
+	return &Frame{
+		Timestamp: time.Unix(sec, sub),
+		Data:      data,
+		LinkType:  pr.linkType,
+	}, nil
+}
+
+// ------------------------------------------------------------------------------
+// pcapng
+
+const blockSPB uint32 = 0x00000003 // Simple Packet Block
+
+type pcapngInterface struct {
+	linkType uint16
+	snapLen  uint32
+	tsresol  uint8
+}
+
+type pcapngReader struct {
+	r      io.Reader
+	order  binary.ByteOrder
+	ifaces []pcapngInterface
+}
+
+func newPcapngReader(r io.Reader) (*pcapngReader, error) {
+	return &pcapngReader{r: r, order: binary.LittleEndian}, nil
+}
+
+func (pr *pcapngReader) ReadFrame() (*Frame, error) {
+	for {
+		blockType, body, err := pr.readBlock()
+		if err != nil {
+			return nil, err
+		}
+
+		switch blockType {
+		case blockSHB:
+			// A new section resets the interfaces
+			pr.ifaces = nil
+		case blockIDB:
+			if len(body) < 8 {
+				return nil, fmt.Errorf("truncated interface description block")
+			}
+			iface := pcapngInterface{
+				linkType: pr.order.Uint16(body[0:2]),
+				snapLen:  pr.order.Uint32(body[4:8]),
+				tsresol:  6,
+			}
+			pr.walkOptions(body[8:], func(code uint16, value []byte) {
+				if code == optIfTsres && len(value) == 1 {
+					iface.tsresol = value[0]
+				}
+			})
+			pr.ifaces = append(pr.ifaces, iface)
+		case blockEPB:
+			return pr.parseEPB(body)
+		case blockSPB:
+			return pr.parseSPB(body)
+		default:
+			// Statistics, name resolution, custom blocks... are skipped
+		}
+	}
+}
+
+// readBlock returns the type and the body of the next block. Byte order is
+// updated when a section header is read.
+func (pr *pcapngReader) readBlock() (uint32, []byte, error) {
+	h := make([]byte, 12)
+	if _, err := io.ReadFull(pr.r, h[:8]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return 0, nil, fmt.Errorf("truncated pcapng block header")
+		}
+		return 0, nil, err
+	}
+
+	blockType := pr.order.Uint32(h[0:4])
+
+	if blockType == blockSHB {
+		// Byte order magic is the first field of the body
+		if _, err := io.ReadFull(pr.r, h[8:12]); err != nil {
+			return 0, nil, fmt.Errorf("truncated section header: %w", err)
+		}
+		switch {
+		case binary.LittleEndian.Uint32(h[8:12]) == byteOrderMagic:
+			pr.order = binary.LittleEndian
+		case binary.BigEndian.Uint32(h[8:12]) == byteOrderMagic:
+			pr.order = binary.BigEndian
+		default:
+			return 0, nil, fmt.Errorf("invalid pcapng byte order magic")
+		}
+	}
+
+	total := pr.order.Uint32(h[4:8])
+	if total < 12 || total%4 != 0 || total > 2*DefaultSnapLen {
+		return 0, nil, fmt.Errorf("invalid pcapng block length %d", total)
+	}
+
+	rest := make([]byte, total-8)
+	read := 0
+	if blockType == blockSHB {
+		copy(rest, h[8:12])
+		read = 4
+	}
+	if _, err := io.ReadFull(pr.r, rest[read:]); err != nil {
+		return 0, nil, fmt.Errorf("truncated pcapng block: %w", err)
+	}
+
+	if pr.order.Uint32(rest[len(rest)-4:]) != total {
+		return 0, nil, fmt.Errorf("pcapng block lengths do not match")
+	}
+
+	return blockType, rest[:len(rest)-4], nil
+}
+
+func (pr *pcapngReader) parseEPB(body []byte) (*Frame, error) {
+	if len(body) < 20 {
+		return nil, fmt.Errorf("truncated enhanced packet block")
+	}
+
+	ifID := pr.order.Uint32(body[0:4])
+	if int(ifID) >= len(pr.ifaces) {
+		return nil, fmt.Errorf("enhanced packet block references unknown interface %d", ifID)
+	}
+	iface := pr.ifaces[ifID]
+
+	ts := uint64(pr.order.Uint32(body[4:8]))<<32 | uint64(pr.order.Uint32(body[8:12]))
+	capLen := int(pr.order.Uint32(body[12:16]))
+	if 20+capLen > len(body) {
+		return nil, fmt.Errorf("enhanced packet block data exceeds block")
+	}
+
+	f := &Frame{
+		Timestamp: pcapngTime(ts, iface.tsresol),
+		Data:      append([]byte(nil), body[20:20+capLen]...),
+		LinkType:  iface.linkType,
+	}
+
+	pr.walkOptions(body[min(20+pad4(capLen), len(body)):], func(code uint16, value []byte) {
+		if code == optEpbFlags && len(value) == 4 {
+			f.Direction = Direction(pr.order.Uint32(value) & 0x3)
+		}
+	})
+
+	return f, nil
+}
+
+func (pr *pcapngReader) parseSPB(body []byte) (*Frame, error) {
+	if len(pr.ifaces) == 0 || len(body) < 4 {
+		return nil, fmt.Errorf("invalid simple packet block")
+	}
+	iface := pr.ifaces[0]
+
+	capLen := int(pr.order.Uint32(body[0:4]))
+	if iface.snapLen != 0 {
+		capLen = min(capLen, int(iface.snapLen))
+	}
+	capLen = min(capLen, len(body)-4)
+
+	return &Frame{
+		Data:     append([]byte(nil), body[4:4+capLen]...),
+		LinkType: iface.linkType,
+	}, nil
+}
+
+func (pr *pcapngReader) walkOptions(opts []byte, fn func(code uint16, value []byte)) {
+	for len(opts) >= 4 {
+		code := pr.order.Uint16(opts[0:2])
+		l := int(pr.order.Uint16(opts[2:4]))
+		if code == optEndOfOpt || 4+l > len(opts) {
+			return
+		}
+		fn(code, opts[4:4+l])
+		opts = opts[min(4+pad4(l), len(opts)):]
+	}
+}
+
+// pcapngTime converts a timestamp in if_tsresol units. If the most significant
+// bit of tsresol is 0 the unit is 10^-n seconds, otherwise it is 2^-n.
+func pcapngTime(ts uint64, tsresol uint8) time.Time {
+	n := uint(tsresol & 0x7F)
+
+	if tsresol&0x80 == 0 {
+		// 10^20 does not fit in 64 bits
+		n = min(n, 19)
+		div := uint64(1)
+		for range n {
+			div *= 10
+		}
+		sec, frac := ts/div, ts%div
+		for ; n < 9; n++ {
+			frac *= 10
+		}
+		for ; n > 9; n-- {
+			frac /= 10
+		}
+		return time.Unix(int64(sec), int64(frac))
+	}
+
+	if n == 0 || n >= 64 {
+		return time.Unix(int64(ts>>min(n, 63)), 0)
+	}
+
+	sec, frac := ts>>n, ts&(1<<n-1)
+	hi, lo := bits.Mul64(frac, uint64(time.Second))
+	return time.Unix(int64(sec), int64(hi<<(64-n)|lo>>n))
+}
@@ -0,0 +1,391 @@
+// Package framespectortest runs the emulated peer for Go tests. Each Env has
+// its own veth pair whose host side is moved into a new network namespace, so
+// tests do not touch the network of the machine and can run in parallel.
+//
+// The test plays the host side: it sends frames with the Send methods and
+// waits for the frames of the peer with the Expect methods. InHost runs code
+// inside the namespace to test the behaviour of the kernel with regular
+// sockets.
+//
+//	func TestPing(t *testing.T) {
+//		env := framespectortest.New(t, network.Config{})
+//		env.SendICMPEcho(env.PeerIP, 1, 1, []byte("hello"))
+//		env.ExpectICMPEchoReply(1, 1)
+//	}
+//
+// Creating interfaces and namespaces needs root (CAP_NET_ADMIN), tests are
+// skipped without it.
+package framespectortest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"example.com/framespector/network"
+)
+
+// DefaultTimeout is how long the Expect methods wait for a frame.
+const DefaultTimeout = 2 * time.Second
+
+// Env is an emulated peer and the host side of its link.
+type Env struct {
+	Stack *network.Stack
+	Netns string // Network namespace of the host side
+
+	HostName string // Host side of the veth pair, in Netns
+	HostMAC  net.HardwareAddr
+	HostIP   net.IP
+	PeerMAC  net.HardwareAddr
+	PeerIP   net.IP
+
+	// Timeout of the Expect methods, DefaultTimeout by default
+	Timeout time.Duration
+
+	t      testing.TB
+	conn   *network.PacketConn
+	frames chan []byte
+	ipID   uint16
+}
+
+// Frame is a frame received by the host side with its decoded layers.
+type Frame struct {
+	Data   []byte
+	Layers []network.DissectLayer
+}
+
+// Predicate selects frames for Expect.
+type Predicate func(f *Frame) bool
+
+// New starts the peer with conf and returns once it is ready. The veth name,
+// the namespace and the addresses (192.168.35.2 and .3 by default) of conf
+// are filled if empty. Everything is removed when the test ends.
+func New(t testing.TB, conf network.Config) *Env {
+	t.Helper()
+
+	if os.Geteuid() != 0 {
+		t.Skip("framespectortest needs root to create interfaces")
+	}
+
+	// A random name avoids clashes between tests run in parallel, with the
+	// "-peer" suffix it stays below the 15 characters of an interface name
+	suffix := make([]byte, 3)
+	rand.Read(suffix)
+	name := "fst" + hex.EncodeToString(suffix)
+
+	if conf.Veth.Name == "" {
+		conf.Veth.Name = name
+	}
+	if conf.Veth.Netns == "" {
+		conf.Veth.Netns = name
+	}
+	if conf.Veth.PeerIPStr == "" {
+		conf.Veth.HostIPStr = "192.168.35.2/24"
+		conf.Veth.PeerIPStr = "192.168.35.3/24"
+	}
+	if conf.Logger == nil {
+		conf.Logger = slog.New(slog.DiscardHandler)
+	}
+
+	env := &Env{
+		Netns:    conf.Veth.Netns,
+		HostName: conf.Veth.Name,
+		Timeout:  DefaultTimeout,
+		t:        t,
+		frames:   make(chan []byte, 1024),
+	}
+	env.HostIP, _, _ = net.ParseCIDR(conf.Veth.HostIPStr)
+	env.PeerIP, _, _ = net.ParseCIDR(conf.Veth.PeerIPStr)
+
+	// Run gives the stack through Start
+	ready := make(chan *network.Stack, 1)
+	start := conf.Start
+	conf.Start = func(s *network.Stack) (func(), error) {
+		var stop func()
+		if start != nil {
+			var err error
+			if stop, err = start(s); err != nil {
+				return nil, err
+			}
+		}
+		ready <- s
+		return stop, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- network.Run(ctx, conf)
+	}()
+
+	select {
+	case env.Stack = <-ready:
+	case err := <-done:
+		cancel()
+		t.Fatalf("failed to start the peer: %v", err)
+	}
+
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("peer stopped with an error: %v", err)
+		}
+	})
+
+	env.PeerMAC = env.Stack.Link().HardwareAddr()
+
+	err := network.DoInNetns(env.Netns, func() error {
+		iface, err := net.InterfaceByName(env.HostName)
+		if err != nil {
+			return err
+		}
+		env.HostMAC = iface.HardwareAddr
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to get the host side: %v", err)
+	}
+
+	if env.conn, err = network.ListenPacket(env.HostName, env.Netns); err != nil {
+		t.Fatalf("failed to open the host side: %v", err)
+	}
+
+	// Frames are read in the background so none is lost between Expect
+	// calls. The reader stops when the connection is closed, cleanup waits
+	// for it so it does not outlive the test.
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		buf := make([]byte, 65536)
+		for {
+			n, err := env.conn.ReadFrame(buf, 100*time.Millisecond)
+			if errors.Is(err, network.ErrLinkTimeout) {
+				continue
+			}
+			if err != nil {
+				close(env.frames)
+				return
+			}
+			select {
+			case env.frames <- append([]byte(nil), buf[:n]...):
+			default:
+				// Nobody expects frames, drop the oldest
+				<-env.frames
+				env.frames <- append([]byte(nil), buf[:n]...)
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		env.conn.Close()
+		<-stopped
+	})
+
+	return env
+}
+
+// InHost runs fn inside the network namespace of the host side, sockets
+// created by fn use the host side of the veth pair.
+func (e *Env) InHost(fn func() error) error {
+	return network.DoInNetns(e.Netns, fn)
+}
+
+// ------------------------------------------------------------------------------
+// Expectations
+
+// Expect waits for a frame received by the host side that matches pred and
+// returns it. Frames that do not match are discarded. The test fails if none
+// comes before the timeout.
+func (e *Env) Expect(pred Predicate) *Frame {
+	e.t.Helper()
+
+	f, err := e.next(pred, e.Timeout)
+	if err != nil {
+		e.t.Fatalf("expected frame not received: %v", err)
+	}
+	return f
+}
+
+// ExpectNone fails the test if a frame matching pred is received during d.
+func (e *Env) ExpectNone(pred Predicate, d time.Duration) {
+	e.t.Helper()
+
+	if f, err := e.next(pred, d); err == nil {
+		e.t.Fatalf("unexpected frame received:\n%s", f)
+	}
+}
+
+// ExpectARPReply waits for the ARP reply giving the MAC address of ip.
+func (e *Env) ExpectARPReply(ip net.IP) *Frame {
+	e.t.Helper()
+	return e.Expect(Match("ARP", "opcode", "reply (2)", "sender IP", ip.String()))
+}
+
+// ExpectICMPEchoReply waits for the reply to the echo request with this
+// identifier and sequence number.
+func (e *Env) ExpectICMPEchoReply(id, seq uint16) *Frame {
+	e.t.Helper()
+	return e.Expect(Match("ICMP", "type", "0", "identifier", fmt.Sprint(id), "sequence", fmt.Sprint(seq)))
+}
+
+func (e *Env) next(pred Predicate, timeout time.Duration) (*Frame, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case data, ok := <-e.frames:
+			if !ok {
+				return nil, fmt.Errorf("host side closed")
+			}
+			f := &Frame{Data: data, Layers: network.Dissect(data)}
+			if pred(f) {
+				return f, nil
+			}
+		case <-timer.C:
+			return nil, fmt.Errorf("timeout after %s", timeout)
+		}
+	}
+}
+
+// Match returns a predicate true for frames that have the layer with the
+// fields given as name, value pairs. Values are the ones of the dissection,
+// see network.Dissect.
+func Match(layer string, fields ...string) Predicate {
+	return func(f *Frame) bool {
+		for i := 0; i+1 < len(fields); i += 2 {
+			if v, found := f.Field(layer, fields[i]); !found || v != fields[i+1] {
+				return false
+			}
+		}
+		return f.Layer(layer) != nil
+	}
+}
+
+// Layer returns the first layer with this name, nil if there is none.
+func (f *Frame) Layer(name string) *network.DissectLayer {
+	for i := range f.Layers {
+		if f.Layers[i].Name == name {
+			return &f.Layers[i]
+		}
+	}
+	return nil
+}
+
+// Field returns the value of a field of the first layer with this name.
+func (f *Frame) Field(layer, name string) (string, bool) {
+	l := f.Layer(layer)
+	if l == nil {
+		return "", false
+	}
+	for _, field := range l.Fields {
+		if field.Name == name {
+			return field.Value, true
+		}
+	}
+	return "", false
+}
+
+func (f *Frame) String() string {
+	var sb strings.Builder
+	for _, l := range f.Layers {
+		fmt.Fprintf(&sb, "  %s [%d:%d]\n", l.Name, l.Offset, l.Offset+l.Length)
+		for _, field := range l.Fields {
+			fmt.Fprintf(&sb, "    %-26s %s\n", field.Name, field.Value)
+		}
+	}
+	return sb.String()
+}
+
+// ------------------------------------------------------------------------------
+// Frames sent by the host side
+
+// SendFrame sends a raw frame from the host side, the test fails on error.
+func (e *Env) SendFrame(frame []byte) {
+	e.t.Helper()
+
+	if err := e.conn.WriteFrame(frame); err != nil {
+		e.t.Fatalf("failed to send frame: %v", err)
+	}
+}
+
+// SendARPRequest asks for the MAC address of ip.
+func (e *Env) SendARPRequest(ip net.IP) {
+	e.t.Helper()
+
+	arp := make([]byte, 28)
+	binary.BigEndian.PutUint16(arp[0:2], 1) // Ethernet
+	binary.BigEndian.PutUint16(arp[2:4], uint16(network.EtherTypeIPv4))
+	arp[4], arp[5] = 6, 4
+	binary.BigEndian.PutUint16(arp[6:8], uint16(network.ARPRequest))
+	copy(arp[8:14], e.HostMAC)
+	copy(arp[14:18], e.HostIP.To4())
+	copy(arp[24:28], ip.To4())
+
+	e.SendFrame(e.frame(net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, network.EtherTypeARP, arp))
+}
+
+// SendICMPEcho sends an echo request to dst, through the peer.
+func (e *Env) SendICMPEcho(dst net.IP, id, seq uint16, data []byte) {
+	e.t.Helper()
+
+	icmp := make([]byte, 8+len(data))
+	icmp[0] = network.ICMPEchoRequest
+	binary.BigEndian.PutUint16(icmp[4:6], id)
+	binary.BigEndian.PutUint16(icmp[6:8], seq)
+	copy(icmp[8:], data)
+	binary.BigEndian.PutUint16(icmp[2:4], checksum(icmp))
+
+	e.SendIPv4(dst, network.ICMPProtocol, icmp)
+}
+
+// SendIPv4 sends payload to dst in an IPv4 packet, through the peer.
+func (e *Env) SendIPv4(dst net.IP, proto network.IPv4Protocol, payload []byte) {
+	e.t.Helper()
+
+	e.ipID++
+	ip := make([]byte, 20+len(payload))
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:4], uint16(len(ip)))
+	binary.BigEndian.PutUint16(ip[4:6], e.ipID)
+	ip[8] = 64
+	ip[9] = proto
+	copy(ip[12:16], e.HostIP.To4())
+	copy(ip[16:20], dst.To4())
+	binary.BigEndian.PutUint16(ip[10:12], checksum(ip[:20]))
+	copy(ip[20:], payload)
+
+	e.SendFrame(e.frame(e.PeerMAC, network.EtherTypeIPv4, ip))
+}
+
+func (e *Env) frame(dst net.HardwareAddr, etherType network.EtherType, payload []byte) []byte {
+	frame := make([]byte, 14+len(payload))
+	copy(frame[0:6], dst)
+	copy(frame[6:12], e.HostMAC)
+	binary.BigEndian.PutUint16(frame[12:14], uint16(etherType))
+	copy(frame[14:], payload)
+	return frame
+}
+
+// checksum is the internet checksum (RFC 1071) of IPv4 headers and ICMP.
+func checksum(data []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i : i+2]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xFFFF + sum>>16
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,50 @@
+package framespectortest
+
+import (
+	"testing"
+	"time"
+
+	"example.com/framespector/network"
+)
+
+func TestARP(t *testing.T) {
+	env := New(t, network.Config{})
+
+	env.SendARPRequest(env.PeerIP)
+	f := env.ExpectARPReply(env.PeerIP)
+	if v, _ := f.Field("ARP", "sender MAC"); v != env.PeerMAC.String() {
+		t.Errorf("sender MAC %s, want %s", v, env.PeerMAC)
+	}
+}
+
+func TestPing(t *testing.T) {
+	env := New(t, network.Config{})
+
+	env.SendICMPEcho(env.PeerIP, 1, 1, []byte("hello"))
+	env.ExpectICMPEchoReply(1, 1)
+
+	// Each request gets its own reply
+	env.SendICMPEcho(env.PeerIP, 1, 2, []byte("hello"))
+	env.ExpectICMPEchoReply(1, 2)
+	env.ExpectNone(Match("ICMP", "sequence", "1"), 200*time.Millisecond)
+}
+
+// Replies written to the TX ring are sent by batches and after a delay.
+func TestPingRing(t *testing.T) {
+	env := New(t, network.Config{Veth: network.VethConf{Ring: true}})
+
+	for seq := uint16(1); seq <= 100; seq++ {
+		env.SendICMPEcho(env.PeerIP, 2, seq, []byte("hello"))
+	}
+	for seq := uint16(1); seq <= 100; seq++ {
+		env.ExpectICMPEchoReply(2, seq)
+	}
+
+	// A single reply does not wait for others
+	start := time.Now()
+	env.SendICMPEcho(env.PeerIP, 2, 101, []byte("hello"))
+	env.ExpectICMPEchoReply(2, 101)
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("reply after %s", d)
+	}
+}
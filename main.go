@@ -2,18 +2,18 @@ package main
 
 import (
 	"context"
-	"errors"
 	"flag"
 	"fmt"
 	"log/slog"
 	"net"
 	"os"
 	"os/signal"
-	"sync"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"example.com/framespector/network"
-	"golang.org/x/sys/unix"
 )
 
 func main() {
@@ -22,145 +22,146 @@ func main() {
 	}
 	logger := slog.New(slog.NewTextHandler(os.Stderr, opts))
 
-	args := ReadArgs()
-	if args == nil {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		if err := runReplay(logger, os.Args[2:]); err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
 		return
 	}
 
-	vethConf := network.VethConf{
-		Name:      args.vethName,
-		HostIPStr: args.hostIPStr,
-		PeerIPStr: args.peerIPStr,
-	}
-
-	veth, err := network.NewVeth(logger, vethConf)
-	if err != nil {
-		logger.Error(err.Error())
-		os.Exit(1)
-	}
-
-	if err := veth.Setup(); err != nil {
-		logger.Error(err.Error())
-		os.Exit(1)
-	}
-	defer veth.Cleanup()
-
-	if err := veth.CreateSocket(); err != nil {
-		logger.Error(err.Error())
-		os.Exit(1)
+	args := ReadArgs()
+	if args == nil {
+		return
 	}
 
-	if err := veth.BindPeer(); err != nil {
+	if err := run(logger, args); err != nil {
 		logger.Error(err.Error())
 		os.Exit(1)
 	}
 
-	// At this point all fields of Veth are initialized
-	if veth.SAddr == nil {
-		panic("At this point SAddr should be initialized")
-	}
-
-	logger.Info("Setup network done")
-
-	// To be able to quit the loop using ctrl-c we create a channel
-	// of type os.Signal with a size of 1
-	sigChan := make(chan os.Signal, 1)
-	// If ctrl-c is hit sends it to the channel sigChan
-	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
-
-	logger.Info("Hit ctrl-c to quit")
-
-	// start a go routine that will listen on socket
-	ctx, cancel := context.WithCancel(context.Background())
-
-	// We need to wait for the go routine to end before closing
-	// socket. So we use WaitGroup to track the go routine
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go receiveLoop(ctx, &wg, veth)
-
-	// and block until ctrl-c is received
-	<-sigChan
-	logger.Info("ctrl-c received, shutting down...")
-
-	// Cancel go routine
-	cancel()
-
-	wg.Wait()
 	logger.Info("clean shutdown complete")
 }
 
-func receiveLoop(ctx context.Context, wg *sync.WaitGroup, veth *network.Veth) {
-	// When done signal it
-	defer wg.Done()
-
-	// We need to poll to avoid blocking on Recvfrom
-	pollFds := []unix.PollFd{
-		{
-			Fd:     int32(veth.FD),
-			Events: unix.POLLIN,
+// run emulates the peer with the configuration of the command line until
+// ctrl-c is hit.
+func run(logger *slog.Logger, args *Args) error {
+	conf := network.Config{
+		Logger:  logger,
+		Backend: args.backend,
+		Veth: network.VethConf{
+			Name:       args.vethName,
+			HostIPStr:  args.hostIPStr,
+			PeerIPStr:  args.peerIPStr,
+			HostIP6Str: args.hostIP6Str,
+			PeerIP6Str: args.peerIP6Str,
+			Netns:      args.netns,
+			Ring:       args.ring,
+		},
+		DissectFormat:  args.dissectFormat,
+		ImpairRules:    args.impairRules,
+		ImpairSeed:     args.impairSeed,
+		Hosts:          args.hosts,
+		IPv4Validation: args.ipv4Validation,
+		Start: func(stack *network.Stack) (func(), error) {
+			return startServices(logger, stack, args)
 		},
 	}
 
-	rawFrame := make([]byte, 4096)
-
-	for {
-		select {
-		case <-ctx.Done():
-			veth.Logger.Info("stop receiving frame")
-			return
-		default:
-			// Poll with a timeout of 100ms
-			n, err := unix.Poll(pollFds, 100)
-			if err != nil {
-				veth.Logger.Warn("poll error", "err", err)
-				continue
-			}
+	if args.backend == "tap" {
+		conf.Veth.Name = args.tapName
+	}
 
-			if n == 0 {
-				// We hit the timeout so just continue and we will be able to
-				// check ctx.Done
-				continue
-			}
+	// With DHCP the host side gets its address from us
+	if args.dhcp {
+		conf.Veth.HostIPStr = ""
+	}
 
-			n, _, err = unix.Recvfrom(veth.FD, rawFrame, 0)
-			if err == unix.EBADF || err == unix.EINVAL {
-				veth.Logger.Error("socket closed")
-				return
-			}
+	if args.scenario != "" {
+		sc, err := network.LoadScenario(args.scenario)
+		if err != nil {
+			return err
+		}
+		conf.Scenario = sc
+	}
 
-			if err != nil {
-				veth.Logger.Error("receive error", "err", err)
-				continue
-			}
+	if args.writeFile != "" {
+		f, err := os.Create(args.writeFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
 
-			veth.Logger.Info("frame received", "bytes", n)
+		conf.Capture = f
+		logger.Info("capturing frames", "file", args.writeFile)
+	}
 
-			reply, err := network.ProcessFrame(veth, rawFrame[:n])
+	// Dissect frames on stdout or in a file, logs stay on stderr
+	if args.dissect != "" {
+		conf.Dissect = os.Stdout
+		if args.dissectFile != "" {
+			f, err := os.Create(args.dissectFile)
 			if err != nil {
-				var todo *network.ToDoWarning
-				if errors.As(err, &todo) {
-					veth.Logger.Warn("todo", "what", todo.Msg, "type", todo.EtherType.String())
-				} else {
-					veth.Logger.Error("failed to process frame", "err", err)
-				}
-				continue
+				return err
 			}
+			defer f.Close()
 
-			// veth.SAddr cannot be nil after setup initialization
-			if err := unix.Sendto(veth.FD, reply, 0, veth.SAddr); err != nil {
-				veth.Logger.Error("failed to send reply", "err", err)
-			}
+			conf.Dissect = f
 		}
 	}
+
+	// Quit the loop when ctrl-c is hit
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	return network.Run(ctx, conf)
 }
 
 // ------------------------------------------------------------------------------
 // READ ARGUMENTS
 type Args struct {
-	vethName  string
-	hostIPStr string
-	peerIPStr string
+	vethName   string
+	hostIPStr  string
+	peerIPStr  string
+	hostIP6Str string
+	peerIP6Str string
+	netns      string
+	ring       bool
+	writeFile  string
+	backend    string
+	tapName    string
+	tcpEcho    uint16
+	httpPort   uint16
+	dhcp       bool
+	dhcpPool   string
+	dhcpRouter string
+	dhcpDNS    string
+	dhcpLease  time.Duration
+	dnsZone    string
+	scenario   string
+
+	impairRules []network.ImpairRule
+	impairSeed  uint64
+
+	hosts []network.Host
+
+	ipv4Validation network.IPv4Validation
+
+	dissect       string
+	dissectFormat network.DissectFormat
+	dissectFile   string
+}
+
+// stringList is a flag that can be repeated
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
 }
 
 func ReadArgs() *Args {
@@ -169,12 +170,38 @@ func ReadArgs() *Args {
 	vethName := flag.String("veth", "veth0", "Virtual Pair name")
 	hostIP := flag.String("ip", "192.168.35.2/24", "IP address with CIDR")
 	peerIP := flag.String("peer", "192.168.35.3/24", "IP address of the peer with CIDR")
+	hostIP6 := flag.String("ip6", "", "Optional IPv6 address with prefix length, e.g. fd00:35::2/64")
+	peerIP6 := flag.String("peer6", "", "Optional IPv6 address of the peer with prefix length, e.g. fd00:35::3/64")
+	netns := flag.String("netns", "", "Move the host side into this network namespace (created if needed)")
+	ring := flag.Bool("ring", false, "Exchange frames through memory mapped TPACKET_V3 rings (veth backend), for high rates")
+	writeFile := flag.String("write", "", "Write received frames and replies to this pcapng file")
+	backend := flag.String("backend", "veth", "Backend used to exchange frames: veth or tap")
+	tapName := flag.String("tap", "tap0", "TAP interface name when using the tap backend")
+	tcpEcho := flag.Uint("tcp-echo", 0, "Echo data received on this TCP port of the peer")
+	httpPort := flag.Uint("http", 0, "Serve a small HTTP page on this TCP port of the peer")
+	dhcp := flag.Bool("dhcp", false, "Serve DHCP on the peer, the host side gets its address from it instead of --ip")
+	dhcpPool := flag.String("dhcp-pool", "", "Range of leased addresses, e.g. 192.168.35.100-192.168.35.200 (default: the subnet of the peer)")
+	dhcpRouter := flag.String("dhcp-router", "", "Optional router given to DHCP clients")
+	dhcpDNS := flag.String("dhcp-dns", "", "Optional comma separated DNS servers given to DHCP clients")
+	dhcpLease := flag.Duration("dhcp-lease", time.Hour, "DHCP lease time")
+	dnsZone := flag.String("dns", "", "Serve the records of this zone file on UDP port 53 of the peer")
+	var impairs stringList
+	flag.Var(&impairs, "impair", "Impair matching frames, e.g. dir=out,proto=icmp,drop=0.3,delay=20ms (repeatable, first match wins)")
+	impairSeed := flag.Uint64("impair-seed", 1, "Seed of the random impairments")
+	dissect := flag.String("dissect", "", "Print the decoded layers of every frame: text or json (one object per line)")
+	dissectFile := flag.String("dissect-out", "", "Write the dissection to this file instead of stdout")
+	var vlans, hosts stringList
+	flag.Var(&vlans, "vlan", "Answer on a VLAN with another identity, e.g. id=10,ip=192.168.10.3,ip6=fd00:10::3,mac=02:00:00:00:00:10 (repeatable)")
+	flag.Var(&hosts, "host", "Emulate another host, e.g. ip=192.168.35.10,mac=02:00:00:00:00:0a[,ip6=...][,vlan=10] (repeatable)")
+	scenario := flag.String("scenario", "", "Apply the rules of this scenario file to received frames, quit once its steps are over")
+	ipv4Check := flag.String("ipv4-check", "strict", "What to do with invalid IPv4 headers: strict drops them, lenient logs and handles them")
 	help := flag.Bool("help", false, "Print help")
 
 	flag.Parse()
 
 	if *help {
-		fmt.Println("Usage: framespector --veth <veth-name> --ip <ip/cidr> --peer <ip/cidr>")
+		fmt.Println("Usage: framespector --veth <veth-name> --ip <ip/cidr> --peer <ip/cidr> [--ip6 <ip6/len> --peer6 <ip6/len>] [--backend veth|tap] [--netns <name>] [--ring] [--write <file.pcapng>] [--tcp-echo <port>] [--http <port>] [--dhcp [--dhcp-pool <start-end>]] [--dns <zone-file>] [--impair <rule>]... [--dissect text|json] [--vlan <host>]... [--host <host>]... [--ipv4-check strict|lenient] [--scenario <file>]")
+		fmt.Println("       framespector replay --in <capture> --out <capture> [--peer <ip/cidr>] [--peer6 <ip6/len>] [--mac <mac>]")
 		flag.PrintDefaults()
 		return nil
 	}
@@ -190,9 +217,142 @@ func ReadArgs() *Args {
 		return nil
 	}
 
+	for _, ip6 := range []string{*hostIP6, *peerIP6} {
+		if ip6 == "" {
+			continue
+		}
+		if ip, _, err := net.ParseCIDR(ip6); err != nil || ip.To4() != nil {
+			fmt.Printf("%s is not a valid IPv6 address with prefix length\n", ip6)
+			return nil
+		}
+	}
+
+	for _, port := range []uint{*tcpEcho, *httpPort} {
+		if port > 65535 {
+			fmt.Printf("%d is not a valid TCP port\n", port)
+			return nil
+		}
+	}
+
+	if *tcpEcho != 0 && *tcpEcho == *httpPort {
+		fmt.Println("--tcp-echo and --http must use different ports")
+		return nil
+	}
+
+	if *backend != "veth" && *backend != "tap" {
+		fmt.Printf("%s is not a valid backend, use veth or tap\n", *backend)
+		return nil
+	}
+
+	var impairRules []network.ImpairRule
+	for _, impair := range impairs {
+		rule, err := network.ParseImpairRule(impair)
+		if err != nil {
+			fmt.Println(err)
+			return nil
+		}
+		impairRules = append(impairRules, rule)
+	}
+
+	var emulated []network.Host
+	for i, s := range append(vlans, hosts...) {
+		h, err := parseHost(s)
+		if err == nil && i < len(vlans) && h.VLAN == 0 {
+			err = fmt.Errorf("VLAN host %q has no id", s)
+		}
+		if err != nil {
+			fmt.Println(err)
+			return nil
+		}
+		emulated = append(emulated, h)
+	}
+
+	ipv4Validation, err := network.ParseIPv4Validation(*ipv4Check)
+	if err != nil {
+		fmt.Println(err)
+		return nil
+	}
+
+	var dissectFormat network.DissectFormat
+	if *dissect != "" {
+		var err error
+		if dissectFormat, err = network.ParseDissectFormat(*dissect); err != nil {
+			fmt.Println(err)
+			return nil
+		}
+	}
+
 	return &Args{
-		vethName:  *vethName,
-		hostIPStr: *hostIP,
-		peerIPStr: *peerIP,
+		vethName:   *vethName,
+		hostIPStr:  *hostIP,
+		peerIPStr:  *peerIP,
+		hostIP6Str: *hostIP6,
+		peerIP6Str: *peerIP6,
+		netns:      *netns,
+		ring:       *ring,
+		writeFile:  *writeFile,
+		backend:    *backend,
+		tapName:    *tapName,
+		tcpEcho:    uint16(*tcpEcho),
+		httpPort:   uint16(*httpPort),
+		dhcp:       *dhcp,
+		dhcpPool:   *dhcpPool,
+		dhcpRouter: *dhcpRouter,
+		dhcpDNS:    *dhcpDNS,
+		dhcpLease:  *dhcpLease,
+		dnsZone:    *dnsZone,
+		scenario:   *scenario,
+
+		impairRules: impairRules,
+		impairSeed:  *impairSeed,
+
+		dissect:       *dissect,
+		dissectFormat: dissectFormat,
+		dissectFile:   *dissectFile,
+
+		hosts: emulated,
+
+		ipv4Validation: ipv4Validation,
 	}
 }
+
+// parseHost reads an emulated host from a comma separated list of key=value:
+// vlan (or id), ip and ip6 (with or without prefix length) and mac.
+func parseHost(s string) (network.Host, error) {
+	var h network.Host
+
+	for _, kv := range strings.Split(s, ",") {
+		key, value, found := strings.Cut(strings.TrimSpace(kv), "=")
+		if !found {
+			return h, fmt.Errorf("invalid host %q, expecting key=value", kv)
+		}
+
+		switch key {
+		case "id", "vlan":
+			id, err := strconv.ParseUint(value, 10, 12)
+			if err != nil {
+				return h, fmt.Errorf("invalid VLAN ID %s", value)
+			}
+			h.VLAN = uint16(id)
+		case "ip", "ip6":
+			ip := net.ParseIP(value)
+			if prefixed, _, err := net.ParseCIDR(value); err == nil {
+				ip = prefixed
+			}
+			if ip == nil || (key == "ip") != (ip.To4() != nil) {
+				return h, fmt.Errorf("invalid %s %s", key, value)
+			}
+			h.IPs = append(h.IPs, ip)
+		case "mac":
+			mac, err := net.ParseMAC(value)
+			if err != nil {
+				return h, err
+			}
+			h.MAC = mac
+		default:
+			return h, fmt.Errorf("unknown host key %s", key)
+		}
+	}
+
+	return h, nil
+}
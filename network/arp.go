@@ -51,12 +51,8 @@ type ARPPacket struct {
 	TargetPA net.IP           // Target protocol address
 }
 
-func parseARP(payload []byte, ourMAC net.HardwareAddr, ourIP net.IP) (*ARPPacket, error) {
-	p, err := parseARPPayload(payload)
-	if err != nil {
-		return nil, err
-	}
-
+// replyTo builds the reply to a request targeting ourIP.
+func (p *ARPPacket) replyTo(ourMAC net.HardwareAddr, ourIP net.IP) (*ARPPacket, error) {
 	if p.Oper != ARPRequest {
 		return nil, fmt.Errorf("only answer to ARP request")
 	}
@@ -80,6 +76,22 @@ func parseARP(payload []byte, ourMAC net.HardwareAddr, ourIP net.IP) (*ARPPacket
 	return reply, nil
 }
 
+// newARPRequest asks who has targetIP. It is a gratuitous ARP if targetIP is
+// ourIP.
+func newARPRequest(ourMAC net.HardwareAddr, ourIP net.IP, targetIP net.IP) *ARPPacket {
+	return &ARPPacket{
+		HWType:   1,
+		PType:    uint16(EtherTypeIPv4),
+		HWLen:    6,
+		PLen:     4,
+		Oper:     ARPRequest,
+		SenderHA: ourMAC,
+		SenderPA: ourIP,
+		TargetHA: make(net.HardwareAddr, 6),
+		TargetPA: targetIP,
+	}
+}
+
 func (p *ARPPacket) marshal() []byte {
 	b := make([]byte, 8+int(p.HWLen)*2+int(p.PLen)*2)
 
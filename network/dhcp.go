@@ -0,0 +1,612 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+// +--------------------------------------------------------+
+// | DHCP message (236 bytes + options), sent over UDP      |
+// |--------------------------------------------------------|
+// | Op (1) | HType (1) | HLen (1) | Hops (1)               |
+// | Transaction ID (4)                                     |
+// | Secs (2) | Flags (2)                                    |
+// | Client IP "ciaddr" (4)                                 |
+// | Your IP "yiaddr" (4)                                   |
+// | Server IP "siaddr" (4)                                 |
+// | Relay IP "giaddr" (4)                                  |
+// | Client hardware address "chaddr" (16)                  |
+// | Server name (64) | Boot file name (128)                |
+// | Magic cookie 99.130.83.99 (4) | Options (variable)     |
+// +--------------------------------------------------------+
+//
+// Options are Code (1) | Length (1) | Data, except Pad (0) and End (255).
+// Clients send to port 67 from port 68, usually to the broadcast address as
+// they do not have an address yet.
+//
+// [RFC 2131] https://datatracker.ietf.org/doc/html/rfc2131
+// [RFC 2132] https://datatracker.ietf.org/doc/html/rfc2132
+const (
+	dhcpServerPort = 67
+	dhcpClientPort = 68
+
+	dhcpOpRequest = 1
+	dhcpOpReply   = 2
+
+	dhcpFlagBroadcast = 0x8000
+	dhcpHeaderLen     = 236
+)
+
+var dhcpMagicCookie = []byte{99, 130, 83, 99}
+
+type DHCPMessageType uint8
+
+const (
+	DHCPDiscover DHCPMessageType = 1
+	DHCPOffer    DHCPMessageType = 2
+	DHCPRequest  DHCPMessageType = 3
+	DHCPDecline  DHCPMessageType = 4
+	DHCPAck      DHCPMessageType = 5
+	DHCPNak      DHCPMessageType = 6
+	DHCPRelease  DHCPMessageType = 7
+	DHCPInform   DHCPMessageType = 8
+)
+
+func (t DHCPMessageType) String() string {
+	switch t {
+	case DHCPDiscover:
+		return "DISCOVER"
+	case DHCPOffer:
+		return "OFFER"
+	case DHCPRequest:
+		return "REQUEST"
+	case DHCPDecline:
+		return "DECLINE"
+	case DHCPAck:
+		return "ACK"
+	case DHCPNak:
+		return "NAK"
+	case DHCPRelease:
+		return "RELEASE"
+	case DHCPInform:
+		return "INFORM"
+	default:
+		return fmt.Sprintf("DHCPMessageType(%d)", uint8(t))
+	}
+}
+
+// Options we are using
+const (
+	dhcpOptPad         uint8 = 0
+	dhcpOptSubnetMask  uint8 = 1
+	dhcpOptRouter      uint8 = 3
+	dhcpOptDNS         uint8 = 6
+	dhcpOptHostname    uint8 = 12
+	dhcpOptRequestedIP uint8 = 50
+	dhcpOptLeaseTime   uint8 = 51
+	dhcpOptMessageType uint8 = 53
+	dhcpOptServerID    uint8 = 54
+	dhcpOptMessage     uint8 = 56
+	dhcpOptRenewalT1   uint8 = 58
+	dhcpOptRebindingT2 uint8 = 59
+	dhcpOptEnd         uint8 = 255
+)
+
+type DHCPMessage struct {
+	Op      uint8
+	HType   uint8
+	HLen    uint8
+	Hops    uint8
+	XID     uint32
+	Secs    uint16
+	Flags   uint16
+	CIAddr  net.IP
+	YIAddr  net.IP
+	SIAddr  net.IP
+	GIAddr  net.IP
+	CHAddr  net.HardwareAddr
+	Options map[uint8][]byte
+}
+
+func parseDHCP(payload []byte) (*DHCPMessage, error) {
+	if len(payload) < dhcpHeaderLen+len(dhcpMagicCookie) {
+		return nil, fmt.Errorf("DHCP message too short: %d bytes", len(payload))
+	}
+
+	m := &DHCPMessage{
+		Op:      payload[0],
+		HType:   payload[1],
+		HLen:    payload[2],
+		Hops:    payload[3],
+		XID:     binary.BigEndian.Uint32(payload[4:8]),
+		Secs:    binary.BigEndian.Uint16(payload[8:10]),
+		Flags:   binary.BigEndian.Uint16(payload[10:12]),
+		CIAddr:  net.IP(payload[12:16]),
+		YIAddr:  net.IP(payload[16:20]),
+		SIAddr:  net.IP(payload[20:24]),
+		GIAddr:  net.IP(payload[24:28]),
+		Options: make(map[uint8][]byte),
+	}
+
+	if m.HType != 1 || m.HLen != 6 {
+		return nil, fmt.Errorf("only Ethernet DHCP clients are handled (htype %d, hlen %d)", m.HType, m.HLen)
+	}
+	m.CHAddr = net.HardwareAddr(payload[28:34])
+
+	if !bytes.Equal(payload[236:240], dhcpMagicCookie) {
+		return nil, fmt.Errorf("bad DHCP magic cookie % x", payload[236:240])
+	}
+
+	opts := payload[240:]
+	for len(opts) > 0 {
+		code := opts[0]
+		if code == dhcpOptEnd {
+			break
+		}
+		if code == dhcpOptPad {
+			opts = opts[1:]
+			continue
+		}
+
+		if len(opts) < 2 || int(opts[1])+2 > len(opts) {
+			return nil, fmt.Errorf("DHCP option %d truncated", code)
+		}
+		end := 2 + int(opts[1])
+
+		// Options longer than 255 bytes are split, data is concatenated
+		// (RFC 3396)
+		m.Options[code] = append(m.Options[code], opts[2:end]...)
+		opts = opts[end:]
+	}
+
+	return m, nil
+}
+
+// marshal serializes the message, options are written in the order of their
+// code.
+func (m *DHCPMessage) marshal() []byte {
+	b := make([]byte, dhcpHeaderLen, 300)
+
+	b[0] = m.Op
+	b[1] = m.HType
+	b[2] = m.HLen
+	b[3] = m.Hops
+	binary.BigEndian.PutUint32(b[4:8], m.XID)
+	binary.BigEndian.PutUint16(b[8:10], m.Secs)
+	binary.BigEndian.PutUint16(b[10:12], m.Flags)
+	copy(b[12:16], m.CIAddr.To4())
+	copy(b[16:20], m.YIAddr.To4())
+	copy(b[20:24], m.SIAddr.To4())
+	copy(b[24:28], m.GIAddr.To4())
+	copy(b[28:44], m.CHAddr)
+
+	b = append(b, dhcpMagicCookie...)
+
+	codes := make([]int, 0, len(m.Options))
+	for code := range m.Options {
+		codes = append(codes, int(code))
+	}
+	sort.Ints(codes)
+
+	for _, code := range codes {
+		data := m.Options[uint8(code)]
+		for len(data) > 255 {
+			b = append(b, uint8(code), 255)
+			b = append(b, data[:255]...)
+			data = data[255:]
+		}
+		b = append(b, uint8(code), uint8(len(data)))
+		b = append(b, data...)
+	}
+	b = append(b, dhcpOptEnd)
+
+	// BOOTP relays expect at least 300 bytes (RFC 1542 section 2.1)
+	for len(b) < 300 {
+		b = append(b, dhcpOptPad)
+	}
+
+	return b
+}
+
+func (m *DHCPMessage) messageType() DHCPMessageType {
+	if t := m.Options[dhcpOptMessageType]; len(t) == 1 {
+		return DHCPMessageType(t[0])
+	}
+	return 0
+}
+
+func (m *DHCPMessage) optionIP(code uint8) net.IP {
+	if ip := m.Options[code]; len(ip) == 4 {
+		return net.IP(ip)
+	}
+	return nil
+}
+
+// ------------------------------------------------------------------------------
+// Server
+
+// DHCPConf configures the DHCP server. The pool is a range of addresses in
+// the subnet of the peer, the peer address is never leased.
+type DHCPConf struct {
+	PoolStart net.IP
+	PoolEnd   net.IP
+	Mask      net.IPMask
+	Router    net.IP // Optional
+	DNS       []net.IP
+	LeaseTime time.Duration
+}
+
+// Default lease time, offers are kept for dhcpOfferTimeout so the client has
+// time to request them.
+const (
+	dhcpDefaultLeaseTime = time.Hour
+	dhcpOfferTimeout     = time.Minute
+)
+
+type DHCPLease struct {
+	MAC      net.HardwareAddr
+	IP       net.IP
+	Hostname string
+	Expires  time.Time
+	Bound    bool // False while the lease is only offered
+}
+
+// DHCPServer answers the DHCP clients of the untagged network of the link.
+// Addresses are allocated in order from the start of the pool and a client
+// always gets back its previous address if it is still free, so the behavior
+// is deterministic.
+type DHCPServer struct {
+	stack  *Stack
+	logger *slog.Logger
+	conf   DHCPConf
+	start  netip.Addr
+	end    netip.Addr
+
+	mu     sync.Mutex
+	leases map[netip.Addr]*DHCPLease
+}
+
+// ServeDHCP starts a DHCP server bound to UDP port 67 of the stack.
+func (s *Stack) ServeDHCP(conf DHCPConf) (*DHCPServer, error) {
+	ourIP := linkIPv4(s.link)
+	if ourIP == nil {
+		return nil, fmt.Errorf("link %s has no IPv4 address", s.link.Name())
+	}
+
+	start, ok1 := netip.AddrFromSlice(conf.PoolStart.To4())
+	end, ok2 := netip.AddrFromSlice(conf.PoolEnd.To4())
+	if !ok1 || !ok2 || end.Less(start) {
+		return nil, fmt.Errorf("invalid DHCP pool %s-%s", conf.PoolStart, conf.PoolEnd)
+	}
+
+	if conf.Mask == nil {
+		conf.Mask = ourIP.DefaultMask()
+	}
+	if conf.LeaseTime == 0 {
+		conf.LeaseTime = dhcpDefaultLeaseTime
+	}
+
+	d := &DHCPServer{
+		stack:  s,
+		logger: s.logger,
+		conf:   conf,
+		start:  start,
+		end:    end,
+		leases: make(map[netip.Addr]*DHCPLease),
+	}
+
+	if err := s.HandleUDP(dhcpServerPort, d.handle); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// Close releases UDP port 67.
+func (d *DHCPServer) Close() {
+	d.stack.UnhandleUDP(dhcpServerPort)
+}
+
+// Leases returns the offered and bound leases sorted by IP. Expired leases
+// are removed.
+func (d *DHCPServer) Leases() []DHCPLease {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.expire()
+
+	var leases []DHCPLease
+	for _, l := range d.leases {
+		leases = append(leases, *l)
+	}
+
+	sort.Slice(leases, func(i, j int) bool {
+		a, _ := netip.AddrFromSlice(leases[i].IP)
+		b, _ := netip.AddrFromSlice(leases[j].IP)
+		return a.Less(b)
+	})
+
+	return leases
+}
+
+func (d *DHCPServer) handle(req *UDPRequest) ([]UDPResponse, error) {
+	m, err := parseDHCP(req.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse DHCP message: %w", err)
+	}
+
+	if m.Op != dhcpOpRequest || req.VLAN != 0 {
+		return nil, nil
+	}
+
+	typ := m.messageType()
+	d.logger.Info("DHCP received", "type", typ.String(), "mac", m.CHAddr.String(), "xid", fmt.Sprintf("0x%08x", m.XID))
+
+	// Messages with the identifier of another server are for it
+	if id := m.optionIP(dhcpOptServerID); id != nil && !id.Equal(linkIPv4(d.stack.link)) {
+		return nil, nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.expire()
+
+	var reply *DHCPMessage
+	switch typ {
+	case DHCPDiscover:
+		reply = d.offer(m)
+	case DHCPRequest:
+		reply = d.request(m)
+	case DHCPDecline:
+		d.decline(m)
+	case DHCPRelease:
+		d.release(m)
+	case DHCPInform:
+		reply = d.reply(m, DHCPAck, net.IPv4zero)
+		reply.CIAddr = m.CIAddr
+		// No lease is given for INFORM
+		delete(reply.Options, dhcpOptLeaseTime)
+		delete(reply.Options, dhcpOptRenewalT1)
+		delete(reply.Options, dhcpOptRebindingT2)
+	default:
+		return nil, fmt.Errorf("unexpected DHCP message type %d", typ)
+	}
+
+	if reply == nil {
+		return nil, nil
+	}
+
+	d.logger.Info("DHCP sent", "type", reply.messageType().String(), "mac", m.CHAddr.String(), "ip", reply.YIAddr.String())
+	return []UDPResponse{d.response(m, reply)}, nil
+}
+
+// offer answers DISCOVER with the previous address of the client, the
+// requested one or the first free address of the pool.
+func (d *DHCPServer) offer(m *DHCPMessage) *DHCPMessage {
+	ip := d.leaseOf(m.CHAddr)
+	if !ip.IsValid() {
+		if requested, ok := netip.AddrFromSlice(m.optionIP(dhcpOptRequestedIP)); ok && d.isFree(requested) {
+			ip = requested
+		}
+	}
+	if !ip.IsValid() {
+		ip = d.firstFree()
+	}
+	if !ip.IsValid() {
+		d.logger.Warn("DHCP pool exhausted", "mac", m.CHAddr.String())
+		return nil
+	}
+
+	l := d.leases[ip]
+	if l == nil || !l.Bound {
+		d.leases[ip] = &DHCPLease{
+			MAC:      append(net.HardwareAddr(nil), m.CHAddr...),
+			IP:       net.IP(ip.AsSlice()),
+			Hostname: string(m.Options[dhcpOptHostname]),
+			Expires:  time.Now().Add(dhcpOfferTimeout),
+		}
+	}
+
+	return d.reply(m, DHCPOffer, net.IP(ip.AsSlice()))
+}
+
+// request answers REQUEST sent after an offer (SELECTING), at reboot
+// (INIT-REBOOT) or to extend the lease (RENEWING/REBINDING).
+func (d *DHCPServer) request(m *DHCPMessage) *DHCPMessage {
+	requested := m.optionIP(dhcpOptRequestedIP)
+	if requested == nil {
+		requested = m.CIAddr
+	}
+
+	ip, ok := netip.AddrFromSlice(requested.To4())
+	if !ok || ip.IsUnspecified() {
+		return d.nak(m, "no address requested")
+	}
+
+	if !d.inPool(ip) {
+		return d.nak(m, "requested address not in pool")
+	}
+
+	l := d.leases[ip]
+	if l != nil && !bytes.Equal(l.MAC, m.CHAddr) {
+		return d.nak(m, "requested address is leased to another client")
+	}
+
+	if l == nil {
+		l = &DHCPLease{MAC: append(net.HardwareAddr(nil), m.CHAddr...), IP: net.IP(ip.AsSlice())}
+		d.leases[ip] = l
+	}
+
+	// A client only has one lease
+	for other, ol := range d.leases {
+		if other != ip && bytes.Equal(ol.MAC, m.CHAddr) {
+			delete(d.leases, other)
+		}
+	}
+
+	if h := m.Options[dhcpOptHostname]; len(h) > 0 {
+		l.Hostname = string(h)
+	}
+	l.Bound = true
+	l.Expires = time.Now().Add(d.conf.LeaseTime)
+
+	return d.reply(m, DHCPAck, l.IP)
+}
+
+func (d *DHCPServer) nak(m *DHCPMessage, reason string) *DHCPMessage {
+	d.logger.Warn("DHCP request refused", "mac", m.CHAddr.String(), "reason", reason)
+
+	nak := &DHCPMessage{
+		Op:     dhcpOpReply,
+		HType:  1,
+		HLen:   6,
+		XID:    m.XID,
+		Flags:  m.Flags,
+		YIAddr: net.IPv4zero,
+		GIAddr: m.GIAddr,
+		CHAddr: m.CHAddr,
+		Options: map[uint8][]byte{
+			dhcpOptMessageType: {uint8(DHCPNak)},
+			dhcpOptServerID:    linkIPv4(d.stack.link),
+			dhcpOptMessage:     []byte(reason),
+		},
+	}
+
+	return nak
+}
+
+// decline marks the address as used by someone else for a lease time.
+func (d *DHCPServer) decline(m *DHCPMessage) {
+	ip, ok := netip.AddrFromSlice(m.optionIP(dhcpOptRequestedIP))
+	if !ok {
+		return
+	}
+
+	d.logger.Warn("DHCP address declined", "mac", m.CHAddr.String(), "ip", ip.String())
+	d.leases[ip] = &DHCPLease{
+		IP:      net.IP(ip.AsSlice()),
+		Expires: time.Now().Add(d.conf.LeaseTime),
+		Bound:   true,
+	}
+}
+
+func (d *DHCPServer) release(m *DHCPMessage) {
+	ip, ok := netip.AddrFromSlice(m.CIAddr.To4())
+	if !ok {
+		return
+	}
+
+	if l := d.leases[ip]; l != nil && bytes.Equal(l.MAC, m.CHAddr) {
+		delete(d.leases, ip)
+	}
+}
+
+// reply builds an OFFER or an ACK for yiaddr with the configured options.
+func (d *DHCPServer) reply(m *DHCPMessage, typ DHCPMessageType, yiaddr net.IP) *DHCPMessage {
+	ourIP := linkIPv4(d.stack.link)
+
+	opts := map[uint8][]byte{
+		dhcpOptMessageType: {uint8(typ)},
+		dhcpOptServerID:    ourIP,
+		dhcpOptSubnetMask:  d.conf.Mask,
+	}
+
+	lease := uint32(d.conf.LeaseTime / time.Second)
+	opts[dhcpOptLeaseTime] = binary.BigEndian.AppendUint32(nil, lease)
+	opts[dhcpOptRenewalT1] = binary.BigEndian.AppendUint32(nil, lease/2)
+	opts[dhcpOptRebindingT2] = binary.BigEndian.AppendUint32(nil, lease/8*7)
+
+	if d.conf.Router != nil {
+		opts[dhcpOptRouter] = d.conf.Router.To4()
+	}
+
+	if len(d.conf.DNS) > 0 {
+		var dns []byte
+		for _, ip := range d.conf.DNS {
+			dns = append(dns, ip.To4()...)
+		}
+		opts[dhcpOptDNS] = dns
+	}
+
+	return &DHCPMessage{
+		Op:      dhcpOpReply,
+		HType:   1,
+		HLen:    6,
+		XID:     m.XID,
+		Flags:   m.Flags,
+		YIAddr:  yiaddr,
+		SIAddr:  ourIP,
+		GIAddr:  m.GIAddr,
+		CHAddr:  m.CHAddr,
+		Options: opts,
+	}
+}
+
+// response chooses where to send the reply (RFC 2131 section 4.1): to the
+// address of a configured client, by broadcast if the client asked for it
+// or for a NAK, otherwise to the offered address and the client MAC.
+func (d *DHCPServer) response(m *DHCPMessage, reply *DHCPMessage) UDPResponse {
+	r := UDPResponse{
+		DstPort: dhcpClientPort,
+		SrcPort: dhcpServerPort,
+		Payload: reply.marshal(),
+	}
+
+	switch {
+	case !m.CIAddr.IsUnspecified():
+		r.DstIP = m.CIAddr
+	case m.Flags&dhcpFlagBroadcast != 0 || reply.messageType() == DHCPNak:
+		r.DstIP = net.IPv4bcast
+		r.DstMAC = broadcastMAC
+	default:
+		r.DstIP = reply.YIAddr
+		r.DstMAC = m.CHAddr
+	}
+
+	return r
+}
+
+func (d *DHCPServer) leaseOf(mac net.HardwareAddr) netip.Addr {
+	for ip, l := range d.leases {
+		if bytes.Equal(l.MAC, mac) {
+			return ip
+		}
+	}
+	return netip.Addr{}
+}
+
+// inPool tells if ip can be leased, addresses of the emulated hosts never are.
+func (d *DHCPServer) inPool(ip netip.Addr) bool {
+	return !ip.Less(d.start) && !d.end.Less(ip) && !d.stack.owns(0, ip.AsSlice())
+}
+
+func (d *DHCPServer) isFree(ip netip.Addr) bool {
+	_, used := d.leases[ip]
+	return d.inPool(ip) && !used
+}
+
+func (d *DHCPServer) firstFree() netip.Addr {
+	for ip := d.start; ip.IsValid() && !d.end.Less(ip); ip = ip.Next() {
+		if d.isFree(ip) {
+			return ip
+		}
+	}
+	return netip.Addr{}
+}
+
+func (d *DHCPServer) expire() {
+	now := time.Now()
+	for ip, l := range d.leases {
+		if now.After(l.Expires) {
+			delete(d.leases, ip)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package network
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestDHCPMarshalParse(t *testing.T) {
+	m := &DHCPMessage{
+		Op:     dhcpOpRequest,
+		HType:  1,
+		HLen:   6,
+		XID:    0x12345678,
+		Flags:  dhcpFlagBroadcast,
+		CIAddr: net.IPv4zero,
+		YIAddr: net.IPv4zero,
+		SIAddr: net.IPv4zero,
+		GIAddr: net.IPv4zero,
+		CHAddr: testHostMAC,
+		Options: map[uint8][]byte{
+			dhcpOptMessageType: {uint8(DHCPDiscover)},
+			dhcpOptHostname:    bytes.Repeat([]byte{'h'}, 300), // Split in two options
+		},
+	}
+
+	b := m.marshal()
+	if len(b) < 300 {
+		t.Errorf("message of %d bytes, want at least 300", len(b))
+	}
+
+	got, err := parseDHCP(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.XID != m.XID || got.Flags != m.Flags || got.CHAddr.String() != testHostMAC.String() {
+		t.Errorf("parsed %+v", got)
+	}
+	if got.messageType() != DHCPDiscover || !bytes.Equal(got.Options[dhcpOptHostname], m.Options[dhcpOptHostname]) {
+		t.Errorf("options %v", got.Options)
+	}
+
+	bad := func(f func(b []byte) []byte) []byte {
+		return f(append([]byte(nil), b...))
+	}
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"too short", b[:239]},
+		{"not ethernet", bad(func(b []byte) []byte { b[1] = 6; return b })},
+		{"bad cookie", bad(func(b []byte) []byte { b[236] = 0; return b })},
+		{"truncated option", append(append([]byte(nil), b[:240]...), dhcpOptHostname, 10, 'a')},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseDHCP(tt.data); err == nil {
+				t.Error("parse succeeded")
+			}
+		})
+	}
+}
+
+// dhcpTestRequest sends a message to the handler of the server and returns
+// the reply, nil if there is none.
+func dhcpTestRequest(t *testing.T, d *DHCPServer, mac net.HardwareAddr, typ DHCPMessageType, opts map[uint8][]byte) *DHCPMessage {
+	t.Helper()
+
+	m := &DHCPMessage{
+		Op:      dhcpOpRequest,
+		HType:   1,
+		HLen:    6,
+		XID:     1,
+		CIAddr:  net.IPv4zero,
+		CHAddr:  mac,
+		Options: map[uint8][]byte{dhcpOptMessageType: {uint8(typ)}},
+	}
+	for code, data := range opts {
+		m.Options[code] = data
+	}
+
+	responses, err := d.handle(&UDPRequest{SrcMAC: mac, SrcIP: net.IPv4zero, DstIP: net.IPv4bcast, Payload: m.marshal()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(responses) == 0 {
+		return nil
+	}
+
+	reply, err := parseDHCP(responses[0].Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+func TestDHCPServer(t *testing.T) {
+	stack, _ := newTestStack(t)
+
+	// The pool contains the address of the peer, it is never leased
+	d, err := stack.ServeDHCP(DHCPConf{PoolStart: net.IP{192, 168, 35, 3}, PoolEnd: net.IP{192, 168, 35, 5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	a := net.HardwareAddr{2, 0, 0, 0, 0, 0xa}
+	b := net.HardwareAddr{2, 0, 0, 0, 0, 0xb}
+	c := net.HardwareAddr{2, 0, 0, 0, 0, 0xc}
+
+	offer := dhcpTestRequest(t, d, a, DHCPDiscover, nil)
+	if offer.messageType() != DHCPOffer || !offer.YIAddr.Equal(net.IP{192, 168, 35, 4}) {
+		t.Fatalf("offer %s of %s", offer.messageType(), offer.YIAddr)
+	}
+	if !offer.optionIP(dhcpOptServerID).Equal(testPeerIP) {
+		t.Errorf("server identifier %v", offer.Options[dhcpOptServerID])
+	}
+
+	ack := dhcpTestRequest(t, d, a, DHCPRequest, map[uint8][]byte{dhcpOptRequestedIP: offer.YIAddr, dhcpOptServerID: testPeerIP})
+	if ack.messageType() != DHCPAck || !ack.YIAddr.Equal(offer.YIAddr) {
+		t.Fatalf("reply %s of %s", ack.messageType(), ack.YIAddr)
+	}
+
+	// The client gets its address back
+	if again := dhcpTestRequest(t, d, a, DHCPDiscover, nil); !again.YIAddr.Equal(offer.YIAddr) {
+		t.Errorf("second offer of %s", again.YIAddr)
+	}
+
+	// Another client cannot take it
+	nak := dhcpTestRequest(t, d, b, DHCPRequest, map[uint8][]byte{dhcpOptRequestedIP: offer.YIAddr})
+	if nak.messageType() != DHCPNak {
+		t.Errorf("reply %s to a request of a leased address", nak.messageType())
+	}
+
+	// Messages for another server are ignored
+	if r := dhcpTestRequest(t, d, b, DHCPRequest, map[uint8][]byte{dhcpOptServerID: {192, 168, 35, 99}}); r != nil {
+		t.Errorf("answered a message for another server: %s", r.messageType())
+	}
+
+	if offer := dhcpTestRequest(t, d, b, DHCPDiscover, nil); !offer.YIAddr.Equal(net.IP{192, 168, 35, 5}) {
+		t.Errorf("offer of %s to the second client", offer.YIAddr)
+	}
+
+	// Both addresses are taken
+	if r := dhcpTestRequest(t, d, c, DHCPDiscover, nil); r != nil {
+		t.Errorf("offer of %s from an exhausted pool", r.YIAddr)
+	}
+
+	if leases := d.Leases(); len(leases) != 2 || !leases[0].Bound || leases[1].Bound {
+		t.Errorf("leases %+v", leases)
+	}
+
+	// After a release the address is free again
+	release := &DHCPMessage{
+		Op: dhcpOpRequest, HType: 1, HLen: 6, CIAddr: offer.YIAddr, CHAddr: a,
+		Options: map[uint8][]byte{dhcpOptMessageType: {uint8(DHCPRelease)}},
+	}
+	if _, err := d.handle(&UDPRequest{SrcMAC: a, Payload: release.marshal()}); err != nil {
+		t.Fatal(err)
+	}
+	if r := dhcpTestRequest(t, d, c, DHCPDiscover, nil); r == nil || !r.YIAddr.Equal(offer.YIAddr) {
+		t.Errorf("released address not offered: %v", r)
+	}
+}
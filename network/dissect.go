@@ -0,0 +1,619 @@
+package network
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The dissector decodes a frame layer by layer without interpreting it: it
+// never fails, a layer that cannot be decoded is reported with an error and
+// ends the dissection. Offsets and lengths are in bytes from the start of the
+// frame, fields packed in the same bytes (IHL, flags...) share them.
+
+// DissectField is a decoded header field.
+type DissectField struct {
+	Name   string `json:"name"`
+	Offset int    `json:"offset"`
+	Length int    `json:"length"`
+	Value  string `json:"value"`
+}
+
+// DissectLayer is a decoded header, or the data after the last one.
+type DissectLayer struct {
+	Name   string         `json:"layer"`
+	Offset int            `json:"offset"`
+	Length int            `json:"length"`
+	Fields []DissectField `json:"fields"`
+	Error  string         `json:"error,omitempty"`
+}
+
+func (l *DissectLayer) field(name string, off, length int, format string, args ...any) {
+	l.Fields = append(l.Fields, DissectField{
+		Name:   name,
+		Offset: off,
+		Length: length,
+		Value:  fmt.Sprintf(format, args...),
+	})
+}
+
+// Dissection is the decoded frame with the direction it took on the link.
+type Dissection struct {
+	Time      time.Time      `json:"time"`
+	Direction string         `json:"dir,omitempty"`
+	Length    int            `json:"length"`
+	Layers    []DissectLayer `json:"layers"`
+}
+
+type dissector struct {
+	frame  []byte
+	layers []DissectLayer
+}
+
+// layer starts a new layer of length bytes at off. It returns nil after
+// recording an error if the frame is too short.
+func (d *dissector) layer(name string, off, length int) *DissectLayer {
+	d.layers = append(d.layers, DissectLayer{Name: name, Offset: off, Length: length})
+	l := &d.layers[len(d.layers)-1]
+
+	if off+length > len(d.frame) {
+		l.Length = max(len(d.frame)-off, 0)
+		l.Error = fmt.Sprintf("truncated: %d bytes, need %d", l.Length, length)
+		return nil
+	}
+
+	return l
+}
+
+// data records what follows the last decoded header.
+func (d *dissector) data(off, end int) {
+	if end <= off {
+		return
+	}
+
+	l := d.layer("Data", off, end-off)
+	l.field("data", off, end-off, "%s", hex.EncodeToString(d.frame[off:end]))
+}
+
+// Dissect decodes the layers of an Ethernet frame.
+func Dissect(frame []byte) []DissectLayer {
+	d := &dissector{frame: frame}
+	d.ethernet()
+	return d.layers
+}
+
+func (d *dissector) ethernet() {
+	l := d.layer("Ethernet", 0, 14)
+	if l == nil {
+		return
+	}
+
+	b := d.frame
+	l.field("destination", 0, 6, "%s", net.HardwareAddr(b[0:6]))
+	l.field("source", 6, 6, "%s", net.HardwareAddr(b[6:12]))
+	et := EtherType(binary.BigEndian.Uint16(b[12:14]))
+	l.field("type", 12, 2, "%s", etherTypeName(et))
+
+	// The EtherType of a tagged frame is after the tags
+	off := 14
+	for isVLANTPID(et) {
+		// The TPID of the tag is the type field that precedes
+		l := d.layer("VLAN", off, 4)
+		if l == nil {
+			return
+		}
+
+		tci := binary.BigEndian.Uint16(b[off : off+2])
+		l.field("priority", off, 2, "%d", tci>>13)
+		l.field("dei", off, 2, "%d", (tci>>12)&1)
+		l.field("id", off, 2, "%d", tci&0x0FFF)
+		et = EtherType(binary.BigEndian.Uint16(b[off+2 : off+4]))
+		l.field("type", off+2, 2, "%s", etherTypeName(et))
+		off += 4
+	}
+
+	switch et {
+	case EtherTypeARP:
+		d.arp(off)
+	case EtherTypeIPv4:
+		d.ipv4(off)
+	case EtherTypeIPv6:
+		d.ipv6(off)
+	default:
+		d.data(off, len(b))
+	}
+}
+
+func etherTypeName(et EtherType) string {
+	switch et {
+	case EtherTypeIPv4, EtherTypeARP, EtherTypeIPv6, EtherTypeVLAN, EtherTypeQinQ:
+		return et.String()
+	default:
+		return fmt.Sprintf("0x%04X", uint16(et))
+	}
+}
+
+func (d *dissector) arp(off int) {
+	b := d.frame
+	l := d.layer("ARP", off, 8)
+	if l == nil {
+		return
+	}
+
+	hlen, plen := int(b[off+4]), int(b[off+5])
+	l.field("hardware type", off, 2, "%d", binary.BigEndian.Uint16(b[off:off+2]))
+	l.field("protocol type", off+2, 2, "%s", etherTypeName(EtherType(binary.BigEndian.Uint16(b[off+2:off+4]))))
+	l.field("hardware size", off+4, 1, "%d", hlen)
+	l.field("protocol size", off+5, 1, "%d", plen)
+
+	oper := ARPOper(binary.BigEndian.Uint16(b[off+6 : off+8]))
+	switch oper {
+	case ARPRequest:
+		l.field("opcode", off+6, 2, "request (1)")
+	case ARPReply:
+		l.field("opcode", off+6, 2, "reply (2)")
+	default:
+		l.field("opcode", off+6, 2, "%d", oper)
+	}
+
+	size := 8 + 2*hlen + 2*plen
+	if off+size > len(b) {
+		l.Error = fmt.Sprintf("truncated: %d bytes, need %d", len(b)-off, size)
+		return
+	}
+	l.Length = size
+
+	addr := func(name string, at, n int, isHW bool) {
+		switch {
+		case isHW && n == 6:
+			l.field(name, at, n, "%s", net.HardwareAddr(b[at:at+n]))
+		case !isHW && n == 4:
+			l.field(name, at, n, "%s", net.IP(b[at:at+n]))
+		default:
+			l.field(name, at, n, "%s", hex.EncodeToString(b[at:at+n]))
+		}
+	}
+
+	at := off + 8
+	addr("sender MAC", at, hlen, true)
+	addr("sender IP", at+hlen, plen, false)
+	addr("target MAC", at+hlen+plen, hlen, true)
+	addr("target IP", at+2*hlen+plen, plen, false)
+
+	// Ethernet padding
+	d.data(off+size, len(b))
+}
+
+var ipProtocolNames = map[uint8]string{
+	ICMPProtocol:     "ICMP",
+	TCPProtocol:      "TCP",
+	UDPProtocol:      "UDP",
+	IPv6HopByHop:     "Hop-by-Hop",
+	IPv6Routing:      "Routing",
+	IPv6Fragment:     "Fragment",
+	IPv6ICMP:         "ICMPv6",
+	IPv6NoNextHeader: "No Next Header",
+	IPv6DestOptions:  "Destination Options",
+}
+
+func ipProtocolName(p uint8) string {
+	if name, ok := ipProtocolNames[p]; ok {
+		return fmt.Sprintf("%s (%d)", name, p)
+	}
+	return fmt.Sprintf("%d", p)
+}
+
+func (d *dissector) ipv4(off int) {
+	b := d.frame
+	l := d.layer("IPv4", off, 20)
+	if l == nil {
+		return
+	}
+
+	ihl := int(b[off]&0x0F) * 4
+	totalLen := int(binary.BigEndian.Uint16(b[off+2 : off+4]))
+	flags := binary.BigEndian.Uint16(b[off+6 : off+8])
+	proto := b[off+9]
+
+	l.field("version", off, 1, "%d", b[off]>>4)
+	l.field("header length", off, 1, "%d", ihl)
+	l.field("dscp", off+1, 1, "%d", b[off+1]>>2)
+	l.field("ecn", off+1, 1, "%d", b[off+1]&0x03)
+	l.field("total length", off+2, 2, "%d", totalLen)
+	l.field("identification", off+4, 2, "0x%04x", binary.BigEndian.Uint16(b[off+4:off+6]))
+
+	var names []string
+	if flags&0x4000 != 0 {
+		names = append(names, "DF")
+	}
+	if flags&0x2000 != 0 {
+		names = append(names, "MF")
+	}
+	l.field("flags", off+6, 2, "[%s]", strings.Join(names, " "))
+	l.field("fragment offset", off+6, 2, "%d", (flags&0x1FFF)*8)
+	l.field("ttl", off+8, 1, "%d", b[off+8])
+	l.field("protocol", off+9, 1, "%s", ipProtocolName(proto))
+	l.field("checksum", off+10, 2, "0x%04x", binary.BigEndian.Uint16(b[off+10:off+12]))
+	l.field("source", off+12, 4, "%s", net.IP(b[off+12:off+16]))
+	l.field("destination", off+16, 4, "%s", net.IP(b[off+16:off+20]))
+
+	if ihl < 20 || off+ihl > len(b) {
+		l.Error = fmt.Sprintf("invalid header length %d", ihl)
+		return
+	}
+	l.Length = ihl
+
+	if checksum(b[off:off+ihl]) != 0 {
+		l.Error = "bad header checksum"
+	}
+
+	if ihl > 20 {
+		opts, err := parseIPv4Options(b[off+20 : off+ihl])
+		for _, o := range opts {
+			l.field("option", off+20+o.Offset, 2+len(o.Data), "%s", o.String())
+		}
+		if err != nil && l.Error == "" {
+			l.Error = err.Error()
+		}
+	}
+
+	// Ethernet padding is not part of the packet
+	end := len(b)
+	if totalLen >= ihl && off+totalLen <= len(b) {
+		end = off + totalLen
+	}
+
+	// Only the first fragment has the upper layer header
+	if flags&0x1FFF != 0 {
+		d.data(off+ihl, end)
+		return
+	}
+
+	d.transport(proto, off+ihl, end)
+}
+
+func (d *dissector) ipv6(off int) {
+	b := d.frame
+	l := d.layer("IPv6", off, 40)
+	if l == nil {
+		return
+	}
+
+	vtf := binary.BigEndian.Uint32(b[off : off+4])
+	payloadLen := int(binary.BigEndian.Uint16(b[off+4 : off+6]))
+	next := b[off+6]
+
+	l.field("version", off, 1, "%d", vtf>>28)
+	l.field("traffic class", off, 2, "%d", (vtf>>20)&0xFF)
+	l.field("flow label", off+1, 3, "0x%05x", vtf&0xFFFFF)
+	l.field("payload length", off+4, 2, "%d", payloadLen)
+	l.field("next header", off+6, 1, "%s", ipProtocolName(next))
+	l.field("hop limit", off+7, 1, "%d", b[off+7])
+	l.field("source", off+8, 16, "%s", net.IP(b[off+8:off+24]))
+	l.field("destination", off+24, 16, "%s", net.IP(b[off+24:off+40]))
+
+	end := len(b)
+	if off+40+payloadLen <= len(b) {
+		end = off + 40 + payloadLen
+	}
+
+	off += 40
+	for {
+		switch next {
+		case IPv6HopByHop, IPv6Routing, IPv6DestOptions, IPv6Fragment:
+		default:
+			d.transport(next, off, end)
+			return
+		}
+
+		l := d.layer("IPv6 "+ipProtocolNames[next], off, 8)
+		if l == nil {
+			return
+		}
+
+		size := 8
+		if next != IPv6Fragment {
+			size = (int(b[off+1]) + 1) * 8
+		}
+		l.field("next header", off, 1, "%s", ipProtocolName(b[off]))
+		l.field("length", off+1, 1, "%d", size)
+
+		if off+size > end {
+			l.Error = fmt.Sprintf("truncated: %d bytes, need %d", end-off, size)
+			return
+		}
+		l.Length = size
+
+		if next == IPv6Fragment {
+			fo := binary.BigEndian.Uint16(b[off+2 : off+4])
+			l.field("fragment offset", off+2, 2, "%d", fo&0xFFF8)
+			l.field("more fragments", off+2, 2, "%t", fo&1 != 0)
+			l.field("identification", off+4, 4, "0x%08x", binary.BigEndian.Uint32(b[off+4:off+8]))
+			if fo&0xFFF8 != 0 {
+				d.data(off+size, end)
+				return
+			}
+		}
+
+		next = b[off]
+		off += size
+	}
+}
+
+func (d *dissector) transport(proto uint8, off, end int) {
+	// The length of the IP packet bounds the upper layer
+	frame := d.frame
+	d.frame = frame[:end]
+	defer func() { d.frame = frame }()
+
+	switch proto {
+	case ICMPProtocol:
+		d.icmp(off)
+	case IPv6ICMP:
+		d.icmpv6(off)
+	case UDPProtocol:
+		d.udp(off)
+	case TCPProtocol:
+		d.tcp(off)
+	default:
+		d.data(off, end)
+	}
+}
+
+func (d *dissector) icmp(off int) {
+	b := d.frame
+	l := d.layer("ICMP", off, 8)
+	if l == nil {
+		return
+	}
+
+	typ := b[off]
+	l.field("type", off, 1, "%d", typ)
+	l.field("code", off+1, 1, "%d", b[off+1])
+	l.field("checksum", off+2, 2, "0x%04x", binary.BigEndian.Uint16(b[off+2:off+4]))
+
+	switch typ {
+	case ICMPEchoRequest, ICMPEchoReply:
+		l.field("identifier", off+4, 2, "%d", binary.BigEndian.Uint16(b[off+4:off+6]))
+		l.field("sequence", off+6, 2, "%d", binary.BigEndian.Uint16(b[off+6:off+8]))
+	case ICMPDestUnreachable, ICMPTimeExceeded, ICMPParameterProblem:
+		if typ == ICMPParameterProblem {
+			l.field("pointer", off+4, 1, "%d", b[off+4])
+		}
+		// Errors quote the header and the start of the packet at fault
+		if off+8 < len(b) {
+			d.ipv4(off + 8)
+		}
+		return
+	default:
+		l.field("rest of header", off+4, 4, "%s", hex.EncodeToString(b[off+4:off+8]))
+	}
+
+	d.data(off+8, len(b))
+}
+
+func (d *dissector) icmpv6(off int) {
+	b := d.frame
+	l := d.layer("ICMPv6", off, 4)
+	if l == nil {
+		return
+	}
+
+	typ := b[off]
+	l.field("type", off, 1, "%d", typ)
+	l.field("code", off+1, 1, "%d", b[off+1])
+	l.field("checksum", off+2, 2, "0x%04x", binary.BigEndian.Uint16(b[off+2:off+4]))
+
+	body := off + 4
+	switch typ {
+	case ICMPv6EchoRequest, ICMPv6EchoReply:
+		if body+4 > len(b) {
+			l.Error = "truncated echo"
+			return
+		}
+		l.field("identifier", body, 2, "%d", binary.BigEndian.Uint16(b[body:body+2]))
+		l.field("sequence", body+2, 2, "%d", binary.BigEndian.Uint16(b[body+2:body+4]))
+		l.Length += 4
+		d.data(body+4, len(b))
+	case ICMPv6NeighborSolicitation, ICMPv6NeighborAdvertisement:
+		if body+20 > len(b) {
+			l.Error = "truncated neighbor discovery message"
+			return
+		}
+		if typ == ICMPv6NeighborAdvertisement {
+			flags := binary.BigEndian.Uint32(b[body : body+4])
+			l.field("router", body, 4, "%t", flags&ndpFlagRouter != 0)
+			l.field("solicited", body, 4, "%t", flags&ndpFlagSolicited != 0)
+			l.field("override", body, 4, "%t", flags&ndpFlagOverride != 0)
+		}
+		l.field("target", body+4, 16, "%s", net.IP(b[body+4:body+20]))
+		l.Length = len(b) - off
+
+		// Options are Type (1) | Length in units of 8 bytes (1) | Data
+		for at := body + 20; at < len(b); {
+			if at+2 > len(b) || b[at+1] == 0 || at+int(b[at+1])*8 > len(b) {
+				l.Error = "invalid option"
+				return
+			}
+			size := int(b[at+1]) * 8
+			switch b[at] {
+			case ndpOptSourceLLAddr:
+				l.field("source link-layer address", at, size, "%s", net.HardwareAddr(b[at+2:at+size]))
+			case ndpOptTargetLLAddr:
+				l.field("target link-layer address", at, size, "%s", net.HardwareAddr(b[at+2:at+size]))
+			default:
+				l.field(fmt.Sprintf("option %d", b[at]), at, size, "%s", hex.EncodeToString(b[at+2:at+size]))
+			}
+			at += size
+		}
+	default:
+		d.data(body, len(b))
+	}
+}
+
+func (d *dissector) udp(off int) {
+	b := d.frame
+	l := d.layer("UDP", off, 8)
+	if l == nil {
+		return
+	}
+
+	l.field("source port", off, 2, "%d", binary.BigEndian.Uint16(b[off:off+2]))
+	l.field("destination port", off+2, 2, "%d", binary.BigEndian.Uint16(b[off+2:off+4]))
+	l.field("length", off+4, 2, "%d", binary.BigEndian.Uint16(b[off+4:off+6]))
+	l.field("checksum", off+6, 2, "0x%04x", binary.BigEndian.Uint16(b[off+6:off+8]))
+
+	d.data(off+8, len(b))
+}
+
+func (d *dissector) tcp(off int) {
+	b := d.frame
+	l := d.layer("TCP", off, 20)
+	if l == nil {
+		return
+	}
+
+	dataOff := int(b[off+12]>>4) * 4
+	l.field("source port", off, 2, "%d", binary.BigEndian.Uint16(b[off:off+2]))
+	l.field("destination port", off+2, 2, "%d", binary.BigEndian.Uint16(b[off+2:off+4]))
+	l.field("sequence", off+4, 4, "%d", binary.BigEndian.Uint32(b[off+4:off+8]))
+	l.field("acknowledgment", off+8, 4, "%d", binary.BigEndian.Uint32(b[off+8:off+12]))
+	l.field("header length", off+12, 1, "%d", dataOff)
+	l.field("flags", off+13, 1, "%s", TCPFlags(b[off+13]))
+	l.field("window", off+14, 2, "%d", binary.BigEndian.Uint16(b[off+14:off+16]))
+	l.field("checksum", off+16, 2, "0x%04x", binary.BigEndian.Uint16(b[off+16:off+18]))
+	l.field("urgent pointer", off+18, 2, "%d", binary.BigEndian.Uint16(b[off+18:off+20]))
+
+	if dataOff < 20 || off+dataOff > len(b) {
+		l.Error = fmt.Sprintf("invalid header length %d", dataOff)
+		return
+	}
+	l.Length = dataOff
+
+	for at := off + 20; at < off+dataOff; {
+		switch b[at] {
+		case tcpOptEnd:
+			at = off + dataOff
+			continue
+		case tcpOptNop:
+			at++
+			continue
+		}
+
+		if at+2 > off+dataOff || b[at+1] < 2 || at+int(b[at+1]) > off+dataOff {
+			l.Error = "invalid option"
+			return
+		}
+		size := int(b[at+1])
+		switch {
+		case b[at] == tcpOptMSS && size == 4:
+			l.field("mss", at, size, "%d", binary.BigEndian.Uint16(b[at+2:at+4]))
+		case b[at] == 3 && size == 3:
+			l.field("window scale", at, size, "%d", b[at+2])
+		case b[at] == 4 && size == 2:
+			l.field("sack permitted", at, size, "true")
+		case b[at] == 8 && size == 10:
+			l.field("timestamps", at, size, "%d %d", binary.BigEndian.Uint32(b[at+2:at+6]), binary.BigEndian.Uint32(b[at+6:at+10]))
+		default:
+			l.field(fmt.Sprintf("option %d", b[at]), at, size, "%s", hex.EncodeToString(b[at+2:at+size]))
+		}
+		at += size
+	}
+
+	d.data(off+dataOff, len(b))
+}
+
+// ------------------------------------------------------------------------------
+// Output
+
+type DissectFormat int
+
+const (
+	DissectText DissectFormat = iota
+	DissectJSON               // One JSON object per line
+)
+
+func ParseDissectFormat(s string) (DissectFormat, error) {
+	switch s {
+	case "text":
+		return DissectText, nil
+	case "json":
+		return DissectJSON, nil
+	default:
+		return 0, fmt.Errorf("unknown dissect format %q, expecting text or json", s)
+	}
+}
+
+// Text output does not show the whole data of a layer
+const dissectTextMaxValue = 64
+
+// DissectWriter writes the dissection of frames. It is safe to use it from
+// several goroutines.
+type DissectWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format DissectFormat
+}
+
+func NewDissectWriter(w io.Writer, format DissectFormat) *DissectWriter {
+	return &DissectWriter{w: w, format: format}
+}
+
+// WriteFrame dissects frame and writes it. dir is a free form direction, for
+// example "in" or "out".
+func (d *DissectWriter) WriteFrame(t time.Time, dir string, frame []byte) error {
+	dis := Dissection{
+		Time:      t,
+		Direction: dir,
+		Length:    len(frame),
+		Layers:    Dissect(frame),
+	}
+
+	var out []byte
+	switch d.format {
+	case DissectJSON:
+		b, err := json.Marshal(dis)
+		if err != nil {
+			return err
+		}
+		out = append(b, '\n')
+	default:
+		out = []byte(dis.String())
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, err := d.w.Write(out)
+	return err
+}
+
+// String returns a human-readable representation, one line per field.
+func (dis *Dissection) String() string {
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, "%s %s %d bytes\n", dis.Time.Format("15:04:05.000000"), dis.Direction, dis.Length)
+	for _, l := range dis.Layers {
+		fmt.Fprintf(&sb, "  %s [%d:%d]", l.Name, l.Offset, l.Offset+l.Length)
+		if l.Error != "" {
+			fmt.Fprintf(&sb, " error: %s", l.Error)
+		}
+		sb.WriteByte('\n')
+
+		for _, f := range l.Fields {
+			value := f.Value
+			if len(value) > dissectTextMaxValue {
+				value = value[:dissectTextMaxValue] + "..."
+			}
+			fmt.Fprintf(&sb, "    %-4d %-26s %s\n", f.Offset, f.Name, value)
+		}
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,133 @@
+package network
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+type dissectTestLayer struct {
+	name   string
+	offset int
+	length int
+	err    bool
+}
+
+func TestDissectLayers(t *testing.T) {
+	udp := (&UDPDatagram{SrcPort: 1000, DstPort: 53, Payload: []byte("abcd")}).marshal(testHostIP, testPeerIP)
+	udpFrame := testIPv4(UDPProtocol, udp)
+
+	tcp := &TCPSegment{SrcPort: 1000, DstPort: 80, Flags: TCPSyn, Options: mssOption(1460)}
+	tcpFrame := testIPv4(TCPProtocol, tcp.marshal(testHostIP, testPeerIP))
+
+	// Service tag of VLAN 100 and customer tag of VLAN 10
+	qinq := append(append(udpFrame[:12:12], 0x88, 0xa8, 0x00, 0x64, 0x81, 0x00, 0x00, 0x0a), udpFrame[12:]...)
+
+	// Ethernet padding after the IPv4 packet
+	padded := append(append([]byte(nil), udpFrame...), 0, 0, 0, 0)
+
+	fragment := append([]byte(nil), udpFrame...)
+	fragment[14+6] = 0x00
+	fragment[14+7] = 0x02 // Offset 16
+	putTestChecksum(fragment[14:34], 10)
+
+	tests := []struct {
+		name   string
+		frame  []byte
+		layers []dissectTestLayer
+	}{
+		{"udp", udpFrame, []dissectTestLayer{{"Ethernet", 0, 14, false}, {"IPv4", 14, 20, false}, {"UDP", 34, 8, false}, {"Data", 42, 4, false}}},
+		{"tcp", tcpFrame, []dissectTestLayer{{"Ethernet", 0, 14, false}, {"IPv4", 14, 20, false}, {"TCP", 34, 24, false}}},
+		{"qinq", qinq, []dissectTestLayer{{"Ethernet", 0, 14, false}, {"VLAN", 14, 4, false}, {"VLAN", 18, 4, false}, {"IPv4", 22, 20, false}, {"UDP", 42, 8, false}, {"Data", 50, 4, false}}},
+		{"padding", padded, []dissectTestLayer{{"Ethernet", 0, 14, false}, {"IPv4", 14, 20, false}, {"UDP", 34, 8, false}, {"Data", 42, 4, false}}},
+		{"fragment", fragment, []dissectTestLayer{{"Ethernet", 0, 14, false}, {"IPv4", 14, 20, false}, {"Data", 34, 12, false}}},
+		{"truncated ipv4", udpFrame[:24], []dissectTestLayer{{"Ethernet", 0, 14, false}, {"IPv4", 14, 10, true}}},
+		{"truncated ethernet", udpFrame[:10], []dissectTestLayer{{"Ethernet", 0, 10, true}}},
+		{"minimal tag", qinq[:18], []dissectTestLayer{{"Ethernet", 0, 14, false}, {"VLAN", 14, 4, false}, {"VLAN", 18, 0, true}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			layers := Dissect(tt.frame)
+
+			var got []dissectTestLayer
+			for _, l := range layers {
+				got = append(got, dissectTestLayer{l.Name, l.Offset, l.Length, l.Error != ""})
+			}
+			if len(got) != len(tt.layers) {
+				t.Fatalf("layers %v, want %v", got, tt.layers)
+			}
+			for i := range got {
+				if got[i] != tt.layers[i] {
+					t.Errorf("layer %d is %v, want %v", i, got[i], tt.layers[i])
+				}
+			}
+		})
+	}
+}
+
+func TestDissectFieldOffsets(t *testing.T) {
+	tcp := &TCPSegment{SrcPort: 1000, DstPort: 80, Flags: TCPSyn, Options: mssOption(1460)}
+	frame := testIPv4(TCPProtocol, tcp.marshal(testHostIP, testPeerIP))
+	layers := Dissect(frame)
+
+	tests := []struct {
+		layer, field string
+		offset       int
+		length       int
+		value        string
+	}{
+		{"Ethernet", "source", 6, 6, testHostMAC.String()},
+		{"IPv4", "ttl", 22, 1, "64"},
+		{"IPv4", "destination", 30, 4, testPeerIP.String()},
+		{"TCP", "destination port", 36, 2, "80"},
+		{"TCP", "flags", 47, 1, "SYN"},
+		{"TCP", "mss", 54, 4, "1460"},
+	}
+
+	for _, tt := range tests {
+		var found *DissectField
+		for _, l := range layers {
+			for i := range l.Fields {
+				if l.Name == tt.layer && l.Fields[i].Name == tt.field {
+					found = &l.Fields[i]
+				}
+			}
+		}
+		if found == nil {
+			t.Errorf("%s %s not found", tt.layer, tt.field)
+			continue
+		}
+		if found.Offset != tt.offset || found.Length != tt.length || found.Value != tt.value {
+			t.Errorf("%s %s is %+v, want offset %d length %d value %q", tt.layer, tt.field, *found, tt.offset, tt.length, tt.value)
+		}
+		if found.Offset+found.Length > len(frame) {
+			t.Errorf("%s %s is outside the frame", tt.layer, tt.field)
+		}
+	}
+}
+
+func TestDissectWriterJSON(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewDissectWriter(&buf, DissectJSON)
+
+	arp := make([]byte, 28)
+	arp[1], arp[2], arp[4], arp[5], arp[7] = 1, 0x08, 6, 4, 1
+	frame := testEthernet(EtherTypeARP, arp)
+	if err := w.WriteFrame(time.Unix(0, 0), "in", frame); err != nil {
+		t.Fatal(err)
+	}
+
+	var d Dissection
+	if err := json.Unmarshal(buf.Bytes(), &d); err != nil {
+		t.Fatal(err)
+	}
+	if d.Direction != "in" || d.Length != len(frame) || len(d.Layers) != 2 || d.Layers[1].Name != "ARP" {
+		t.Errorf("decoded %+v", d)
+	}
+	if strings.Count(buf.String(), "\n") != 1 {
+		t.Error("JSON output is not one line per frame")
+	}
+}
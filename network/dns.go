@@ -0,0 +1,377 @@
+package network
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+)
+
+// +--------------------------------------------------------+
+// | DNS Header (12 bytes)                                  |
+// |--------------------------------------------------------|
+// | ID (2)                                                 |
+// | QR|Opcode(4)|AA|TC|RD|RA|Z(3)|RCODE(4) (2)            |
+// | QDCOUNT (2) | ANCOUNT (2) | NSCOUNT (2) | ARCOUNT (2)  |
+// +--------------------------------------------------------+
+// | Question: Name | Type (2) | Class (2)                  |
+// | Resource record: Name | Type (2) | Class (2) |         |
+// |                  TTL (4) | RDLength (2) | RData        |
+// +--------------------------------------------------------+
+//
+// Names are sequences of labels (Length (1) | Label) ended by a zero length.
+// A length with the two high bits set is a pointer to a name earlier in the
+// message (compression).
+//
+// [RFC 1035] https://datatracker.ietf.org/doc/html/rfc1035
+const (
+	dnsPort       = 53
+	dnsHeaderLen  = 12
+	dnsMaxUDPSize = 512 // Without EDNS (RFC 1035 section 4.2.1)
+	dnsClassIN    = 1
+)
+
+type DNSType uint16
+
+const (
+	DNSTypeA    DNSType = 1
+	DNSTypeNS   DNSType = 2
+	DNSTypeSOA  DNSType = 6
+	DNSTypePTR  DNSType = 12
+	DNSTypeTXT  DNSType = 16
+	DNSTypeAAAA DNSType = 28
+	DNSTypeOPT  DNSType = 41
+	DNSTypeANY  DNSType = 255
+)
+
+func (t DNSType) String() string {
+	switch t {
+	case DNSTypeA:
+		return "A"
+	case DNSTypeNS:
+		return "NS"
+	case DNSTypeSOA:
+		return "SOA"
+	case DNSTypePTR:
+		return "PTR"
+	case DNSTypeTXT:
+		return "TXT"
+	case DNSTypeAAAA:
+		return "AAAA"
+	case DNSTypeOPT:
+		return "OPT"
+	case DNSTypeANY:
+		return "ANY"
+	default:
+		return fmt.Sprintf("TYPE%d", uint16(t))
+	}
+}
+
+// Header flags and response codes
+const (
+	dnsFlagQR     uint16 = 1 << 15
+	dnsFlagAA     uint16 = 1 << 10
+	dnsFlagTC     uint16 = 1 << 9
+	dnsFlagRD     uint16 = 1 << 8
+	dnsOpcodeMask uint16 = 0xF << 11
+
+	DNSRcodeNoError  uint8 = 0
+	DNSRcodeFormErr  uint8 = 1
+	DNSRcodeNXDomain uint8 = 3
+	DNSRcodeNotImp   uint8 = 4
+	DNSRcodeRefused  uint8 = 5
+)
+
+type DNSQuestion struct {
+	Name  string // Lower case without the final dot
+	Type  DNSType
+	Class uint16
+}
+
+// DNSRecord is a resource record, only the field matching Type is used.
+type DNSRecord struct {
+	Name   string
+	Type   DNSType
+	TTL    uint32
+	IP     net.IP   // A and AAAA
+	Target string   // PTR
+	Text   []string // TXT
+}
+
+type DNSMessage struct {
+	ID        uint16
+	Flags     uint16
+	Questions []DNSQuestion
+	Answers   []DNSRecord
+}
+
+func (m *DNSMessage) rcode() uint8 {
+	return uint8(m.Flags & 0xF)
+}
+
+// parseDNSQuery decodes the header and the questions, records of a query are
+// ignored.
+func parseDNSQuery(payload []byte) (*DNSMessage, error) {
+	if len(payload) < dnsHeaderLen {
+		return nil, fmt.Errorf("DNS message too short: %d bytes", len(payload))
+	}
+
+	m := &DNSMessage{
+		ID:    binary.BigEndian.Uint16(payload[0:2]),
+		Flags: binary.BigEndian.Uint16(payload[2:4]),
+	}
+
+	qdcount := int(binary.BigEndian.Uint16(payload[4:6]))
+	off := dnsHeaderLen
+
+	for range qdcount {
+		name, next, err := parseDNSName(payload, off)
+		if err != nil {
+			return nil, err
+		}
+
+		if next+4 > len(payload) {
+			return nil, fmt.Errorf("DNS question truncated")
+		}
+
+		m.Questions = append(m.Questions, DNSQuestion{
+			Name:  name,
+			Type:  DNSType(binary.BigEndian.Uint16(payload[next : next+2])),
+			Class: binary.BigEndian.Uint16(payload[next+2 : next+4]),
+		})
+		off = next + 4
+	}
+
+	return m, nil
+}
+
+// parseDNSName reads the name at off and returns it with the offset of the
+// data that follows it. The case is kept, resolvers using 0x20 randomization
+// expect it back in the question of the reply.
+func parseDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+
+	// Each pointer must go backward so the loop ends
+	limit := len(msg)
+	for {
+		if off >= len(msg) {
+			return "", 0, fmt.Errorf("DNS name truncated")
+		}
+
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, "."), next, nil
+		case l&0xC0 == 0xC0:
+			if off+2 > len(msg) {
+				return "", 0, fmt.Errorf("DNS name pointer truncated")
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			ptr := int(binary.BigEndian.Uint16(msg[off:off+2]) & 0x3FFF)
+			if ptr >= limit {
+				return "", 0, fmt.Errorf("invalid DNS name pointer %d", ptr)
+			}
+			limit = ptr
+			off = ptr
+		case l&0xC0 != 0:
+			return "", 0, fmt.Errorf("unknown DNS label type 0x%02x", l)
+		default:
+			if off+1+l > len(msg) {
+				return "", 0, fmt.Errorf("DNS label truncated")
+			}
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
+
+// marshal serializes the message without name compression.
+func (m *DNSMessage) marshal() ([]byte, error) {
+	b := make([]byte, dnsHeaderLen, dnsMaxUDPSize)
+
+	binary.BigEndian.PutUint16(b[0:2], m.ID)
+	binary.BigEndian.PutUint16(b[2:4], m.Flags)
+	binary.BigEndian.PutUint16(b[4:6], uint16(len(m.Questions)))
+	binary.BigEndian.PutUint16(b[6:8], uint16(len(m.Answers)))
+
+	var err error
+	for _, q := range m.Questions {
+		if b, err = appendDNSName(b, q.Name); err != nil {
+			return nil, err
+		}
+		b = binary.BigEndian.AppendUint16(b, uint16(q.Type))
+		b = binary.BigEndian.AppendUint16(b, q.Class)
+	}
+
+	for _, r := range m.Answers {
+		if b, err = appendDNSName(b, r.Name); err != nil {
+			return nil, err
+		}
+		b = binary.BigEndian.AppendUint16(b, uint16(r.Type))
+		b = binary.BigEndian.AppendUint16(b, dnsClassIN)
+		b = binary.BigEndian.AppendUint32(b, r.TTL)
+
+		rdata, err := r.rdata()
+		if err != nil {
+			return nil, err
+		}
+		b = binary.BigEndian.AppendUint16(b, uint16(len(rdata)))
+		b = append(b, rdata...)
+	}
+
+	return b, nil
+}
+
+func (r *DNSRecord) rdata() ([]byte, error) {
+	switch r.Type {
+	case DNSTypeA:
+		return r.IP.To4(), nil
+	case DNSTypeAAAA:
+		return r.IP.To16(), nil
+	case DNSTypePTR:
+		return appendDNSName(nil, r.Target)
+	case DNSTypeTXT:
+		var b []byte
+		for _, s := range r.Text {
+			b = append(b, uint8(len(s)))
+			b = append(b, s...)
+		}
+		return b, nil
+	default:
+		return nil, nil
+	}
+}
+
+// appendDNSName appends name as a sequence of labels. A label has 1 to 63
+// bytes, the two high bits of a longer length would read as a pointer, and
+// the whole name at most 255 bytes (RFC 1035 section 3.1).
+func appendDNSName(b []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if len(name) > 253 {
+		return nil, fmt.Errorf("DNS name %q longer than 255 bytes", name)
+	}
+
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return nil, fmt.Errorf("DNS name %q has a label of %d bytes", name, len(label))
+			}
+			b = append(b, uint8(len(label)))
+			b = append(b, label...)
+		}
+	}
+	return append(b, 0), nil
+}
+
+// ------------------------------------------------------------------------------
+// Server
+
+// DNSServer answers the queries for the names of its zone. It is
+// authoritative: unknown names get NXDOMAIN and nothing is forwarded.
+type DNSServer struct {
+	stack  *Stack
+	logger *slog.Logger
+	zone   *DNSZone
+}
+
+// ServeDNS starts a DNS server bound to UDP port 53 of the stack.
+func (s *Stack) ServeDNS(zone *DNSZone) (*DNSServer, error) {
+	d := &DNSServer{
+		stack:  s,
+		logger: s.logger,
+		zone:   zone,
+	}
+
+	if err := s.HandleUDP(dnsPort, d.handle); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// Close releases UDP port 53.
+func (d *DNSServer) Close() {
+	d.stack.UnhandleUDP(dnsPort)
+}
+
+func (d *DNSServer) handle(req *UDPRequest) ([]UDPResponse, error) {
+	q, err := parseDNSQuery(req.Payload)
+	if err != nil {
+		d.logger.Warn("DNS query dropped", "src", req.SrcIP.String(), "err", err, "frame", hex.EncodeToString(req.Frame))
+		return nil, nil
+	}
+
+	// Responses are not answered
+	if q.Flags&dnsFlagQR != 0 {
+		return nil, nil
+	}
+
+	reply := d.answer(q)
+
+	attrs := []any{"src", fmt.Sprintf("%s:%d", req.SrcIP, req.SrcPort), "id", q.ID, "rcode", reply.rcode(), "answers", len(reply.Answers)}
+	for _, question := range q.Questions {
+		attrs = append(attrs, "name", question.Name, "type", question.Type.String())
+	}
+	attrs = append(attrs, "frame", hex.EncodeToString(req.Frame))
+	d.logger.Info("DNS query", attrs...)
+
+	payload, err := reply.marshal()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build DNS reply: %w", err)
+	}
+	if len(payload) > dnsMaxUDPSize {
+		// The client has to retry over TCP
+		reply.Flags |= dnsFlagTC
+		reply.Answers = nil
+		if payload, err = reply.marshal(); err != nil {
+			return nil, fmt.Errorf("failed to build DNS reply: %w", err)
+		}
+	}
+
+	return []UDPResponse{{Payload: payload}}, nil
+}
+
+func (d *DNSServer) answer(q *DNSMessage) *DNSMessage {
+	reply := &DNSMessage{
+		ID: q.ID,
+		// Opcode and RD are copied from the query
+		Flags:     dnsFlagQR | dnsFlagAA | q.Flags&(dnsOpcodeMask|dnsFlagRD),
+		Questions: q.Questions,
+	}
+
+	switch {
+	case q.Flags&dnsOpcodeMask != 0:
+		reply.Flags |= uint16(DNSRcodeNotImp)
+	case len(q.Questions) != 1:
+		reply.Flags |= uint16(DNSRcodeFormErr)
+	default:
+		question := q.Questions[0]
+		if question.Class != dnsClassIN {
+			// The zone only has Internet records
+			reply.Flags |= uint16(DNSRcodeRefused)
+			break
+		}
+
+		records, found := d.zone.Lookup(question.Name, question.Type)
+		if !found {
+			reply.Flags |= uint16(DNSRcodeNXDomain)
+			break
+		}
+		// An existing name without record of the type is NOERROR with an
+		// empty answer (NODATA). Answers are for the name as it was asked.
+		for i := range records {
+			records[i].Name = question.Name
+		}
+		reply.Answers = records
+	}
+
+	return reply
+}
@@ -0,0 +1,242 @@
+package network
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+const testZone = `
+$TTL 60
+; Comment
+host.test.        A    192.168.35.10
+host.test         600 AAAA 2001:db8::10
+10.35.168.192.in-addr.arpa PTR host.test.
+text.test         TXT  "hello world" "second"
+plain.test        TXT  hello world
+`
+
+func TestParseDNSZone(t *testing.T) {
+	z, err := ParseDNSZone(strings.NewReader(testZone))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		typ   DNSType
+		count int
+		check func(r DNSRecord) bool
+	}{
+		{"HOST.test.", DNSTypeA, 1, func(r DNSRecord) bool { return r.IP.String() == "192.168.35.10" && r.TTL == 60 }},
+		{"host.test", DNSTypeAAAA, 1, func(r DNSRecord) bool { return r.IP.String() == "2001:db8::10" && r.TTL == 600 }},
+		{"host.test", DNSTypeANY, 2, nil},
+		{"10.35.168.192.in-addr.arpa", DNSTypePTR, 1, func(r DNSRecord) bool { return r.Target == "host.test" }},
+		{"text.test", DNSTypeTXT, 1, func(r DNSRecord) bool {
+			return len(r.Text) == 2 && r.Text[0] == "hello world" && r.Text[1] == "second"
+		}},
+		{"plain.test", DNSTypeTXT, 1, func(r DNSRecord) bool { return len(r.Text) == 1 && r.Text[0] == "hello world" }},
+	}
+
+	for _, tt := range tests {
+		records, found := z.Lookup(tt.name, tt.typ)
+		if !found || len(records) != tt.count {
+			t.Errorf("%s %s: %d records, found %v", tt.name, tt.typ, len(records), found)
+			continue
+		}
+		if tt.check != nil && !tt.check(records[0]) {
+			t.Errorf("%s %s: unexpected record %+v", tt.name, tt.typ, records[0])
+		}
+	}
+
+	invalid := []string{
+		"host.test A",
+		"host.test A 2001:db8::1",
+		"host.test AAAA 192.168.35.1",
+		"host.test MX mail.test",
+		"$TTL",
+		"$TTL soon",
+		`host.test TXT "unterminated`,
+		"host..test A 192.168.35.1",
+		strings.Repeat("x", 64) + ".test A 192.168.35.1",
+		"10.35.168.192.in-addr.arpa PTR .test",
+	}
+	for _, line := range invalid {
+		if _, err := ParseDNSZone(strings.NewReader(line)); err == nil {
+			t.Errorf("%q parsed without error", line)
+		}
+	}
+}
+
+// testDNSQuery builds a query with one question.
+func testDNSQuery(flags uint16, name string, typ DNSType, class uint16) []byte {
+	return mustMarshalDNS(&DNSMessage{ID: 0x1234, Flags: flags, Questions: []DNSQuestion{{Name: name, Type: typ, Class: class}}})
+}
+
+func mustMarshalDNS(m *DNSMessage) []byte {
+	b, err := m.marshal()
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestDNSServerAnswer(t *testing.T) {
+	stack, _ := newTestStack(t)
+	z, _ := ParseDNSZone(strings.NewReader(testZone))
+	d, err := stack.ServeDNS(z)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	twoQuestions := &DNSMessage{ID: 1, Questions: []DNSQuestion{
+		{Name: "host.test", Type: DNSTypeA, Class: dnsClassIN},
+		{Name: "host.test", Type: DNSTypeAAAA, Class: dnsClassIN},
+	}}
+
+	tests := []struct {
+		name    string
+		query   []byte
+		rcode   uint8
+		answers int
+	}{
+		{"A", testDNSQuery(dnsFlagRD, "Host.Test", DNSTypeA, dnsClassIN), DNSRcodeNoError, 1},
+		{"ANY", testDNSQuery(0, "host.test", DNSTypeANY, dnsClassIN), DNSRcodeNoError, 2},
+		{"no data", testDNSQuery(0, "host.test", DNSTypeTXT, dnsClassIN), DNSRcodeNoError, 0},
+		{"unknown name", testDNSQuery(0, "nope.test", DNSTypeA, dnsClassIN), DNSRcodeNXDomain, 0},
+		{"chaos class", testDNSQuery(0, "host.test", DNSTypeA, 3), DNSRcodeRefused, 0},
+		{"inverse query", testDNSQuery(1<<11, "host.test", DNSTypeA, dnsClassIN), DNSRcodeNotImp, 0},
+		{"two questions", mustMarshalDNS(twoQuestions), DNSRcodeFormErr, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			responses, err := d.handle(&UDPRequest{SrcIP: testHostIP, SrcPort: 5353, Payload: tt.query})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(responses) != 1 {
+				t.Fatalf("%d responses", len(responses))
+			}
+
+			r := responses[0].Payload
+			flags := binary.BigEndian.Uint16(r[2:4])
+			if binary.BigEndian.Uint16(r[0:2]) != binary.BigEndian.Uint16(tt.query[0:2]) {
+				t.Error("identifier not copied")
+			}
+			if flags&dnsFlagQR == 0 || flags&dnsFlagAA == 0 {
+				t.Errorf("flags 0x%04x without QR and AA", flags)
+			}
+			if rcode := uint8(flags & 0xF); rcode != tt.rcode {
+				t.Errorf("rcode %d, want %d", rcode, tt.rcode)
+			}
+			if n := int(binary.BigEndian.Uint16(r[6:8])); n != tt.answers {
+				t.Errorf("%d answers, want %d", n, tt.answers)
+			}
+		})
+	}
+
+	// Responses are ignored
+	if responses, _ := d.handle(&UDPRequest{Payload: testDNSQuery(dnsFlagQR, "host.test", DNSTypeA, dnsClassIN)}); len(responses) != 0 {
+		t.Error("response answered")
+	}
+}
+
+// Resolvers using 0x20 randomization drop replies whose question does not
+// have the case of the query.
+func TestDNSServerEchoesCase(t *testing.T) {
+	stack, _ := newTestStack(t)
+	z, _ := ParseDNSZone(strings.NewReader(testZone))
+	d, _ := stack.ServeDNS(z)
+	defer d.Close()
+
+	query := testDNSQuery(0, "hOsT.TeSt", DNSTypeA, dnsClassIN)
+	responses, err := d.handle(&UDPRequest{Payload: query})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := parseDNSQuery(responses[0].Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Questions[0].Name != "hOsT.TeSt" {
+		t.Errorf("question %q, want hOsT.TeSt", reply.Questions[0].Name)
+	}
+
+	// The answer follows the question, names are not compressed
+	name, _, err := parseDNSName(responses[0].Payload, len(query))
+	if err != nil || name != "hOsT.TeSt" {
+		t.Errorf("answer for %q, %v", name, err)
+	}
+}
+
+func TestAppendDNSName(t *testing.T) {
+	valid := []string{"", ".", "host.test", "host.test.", strings.Repeat("x", 63) + ".test"}
+	for _, name := range valid {
+		if _, err := appendDNSName(nil, name); err != nil {
+			t.Errorf("%q: %v", name, err)
+		}
+	}
+
+	long := strings.Repeat(strings.Repeat("x", 63)+".", 4) + "test"
+	invalid := []string{"host..test", ".test", strings.Repeat("x", 64) + ".test", long}
+	for _, name := range invalid {
+		if b, err := appendDNSName(nil, name); err == nil {
+			t.Errorf("%q appended as %v", name, b)
+		}
+	}
+}
+
+func TestDNSTruncated(t *testing.T) {
+	stack, _ := newTestStack(t)
+	z := NewDNSZone()
+	for range 40 {
+		z.Add(DNSRecord{Name: "big.test", Type: DNSTypeTXT, Text: []string{strings.Repeat("x", 20)}})
+	}
+	d, _ := stack.ServeDNS(z)
+	defer d.Close()
+
+	responses, err := d.handle(&UDPRequest{Payload: testDNSQuery(0, "big.test", DNSTypeTXT, dnsClassIN)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := responses[0].Payload
+	if len(r) > dnsMaxUDPSize || binary.BigEndian.Uint16(r[2:4])&dnsFlagTC == 0 || binary.BigEndian.Uint16(r[6:8]) != 0 {
+		t.Errorf("response of %d bytes not truncated", len(r))
+	}
+}
+
+func TestParseDNSName(t *testing.T) {
+	header := make([]byte, dnsHeaderLen)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		off     int
+		want    string
+		wantErr bool
+	}{
+		{"simple", append(header, 4, 'h', 'o', 's', 't', 4, 't', 'e', 's', 't', 0), 12, "host.test", false},
+		{"case kept", append(header, 4, 'H', 'o', 'S', 't', 4, 't', 'E', 's', 'T', 0), 12, "HoSt.tEsT", false},
+		{"root", append(header, 0), 12, "", false},
+		{"pointer", append(header, 4, 't', 'e', 's', 't', 0, 1, 'a', 0xC0, 12), 18, "a.test", false},
+		{"pointer loop", append(header, 0xC0, 12), 12, "", true},
+		{"truncated", append(header, 4, 'h', 'o'), 12, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _, err := parseDNSName(tt.data, tt.off)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parsed %q", got)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("parsed %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
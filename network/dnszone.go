@@ -0,0 +1,219 @@
+package network
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A zone file has one record per line:
+//
+//	name [ttl] type value
+//
+// Type is A, AAAA, PTR or TXT. TXT values are one or more quoted strings or
+// the rest of the line. Names are absolute, the final dot is optional.
+// Lines starting with '#' or ';' are comments and "$TTL <seconds>" changes the
+// TTL of the following records (300 by default). For example:
+//
+//	$TTL 60
+//	host.test.                  A    192.168.35.10
+//	host.test.             3600 AAAA fd00:35::10
+//	host.test.                  TXT  "v=spf1 -all" "second string"
+//	10.35.168.192.in-addr.arpa. PTR  host.test.
+const dnsDefaultTTL = 300
+
+// DNSZone holds the records served by DNSServer. Records can be added while
+// the server is running.
+type DNSZone struct {
+	mu      sync.RWMutex
+	records map[string][]DNSRecord
+}
+
+func NewDNSZone() *DNSZone {
+	return &DNSZone{records: make(map[string][]DNSRecord)}
+}
+
+// LoadDNSZone reads a zone file.
+func LoadDNSZone(path string) (*DNSZone, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	z, err := ParseDNSZone(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return z, nil
+}
+
+func ParseDNSZone(r io.Reader) (*DNSZone, error) {
+	z := NewDNSZone()
+	ttl := uint32(dnsDefaultTTL)
+
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+
+		fields := strings.Fields(line)
+
+		if fields[0] == "$TTL" {
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("line %d: $TTL expects a value", lineNum)
+			}
+			v, err := strconv.ParseUint(fields[1], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid TTL %s", lineNum, fields[1])
+			}
+			ttl = uint32(v)
+			continue
+		}
+
+		rec, err := parseDNSZoneRecord(line, fields, ttl)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+		z.Add(rec)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return z, nil
+}
+
+func parseDNSZoneRecord(line string, fields []string, ttl uint32) (DNSRecord, error) {
+	if len(fields) < 3 {
+		return DNSRecord{}, fmt.Errorf("expecting: name [ttl] type value")
+	}
+
+	rec := DNSRecord{Name: fields[0], TTL: ttl}
+	rest := fields[1:]
+	if _, err := appendDNSName(nil, rec.Name); err != nil {
+		return DNSRecord{}, err
+	}
+
+	if v, err := strconv.ParseUint(rest[0], 10, 32); err == nil {
+		rec.TTL = uint32(v)
+		rest = rest[1:]
+	}
+	if len(rest) < 2 {
+		return DNSRecord{}, fmt.Errorf("expecting: name [ttl] type value")
+	}
+
+	typ, value := strings.ToUpper(rest[0]), rest[1]
+
+	switch typ {
+	case "A":
+		rec.Type = DNSTypeA
+		if rec.IP = net.ParseIP(value).To4(); rec.IP == nil {
+			return DNSRecord{}, fmt.Errorf("invalid IPv4 %s", value)
+		}
+	case "AAAA":
+		rec.Type = DNSTypeAAAA
+		if rec.IP = net.ParseIP(value); rec.IP == nil || rec.IP.To4() != nil {
+			return DNSRecord{}, fmt.Errorf("invalid IPv6 %s", value)
+		}
+	case "PTR":
+		rec.Type = DNSTypePTR
+		rec.Target = value
+		if _, err := appendDNSName(nil, rec.Target); err != nil {
+			return DNSRecord{}, err
+		}
+	case "TXT":
+		rec.Type = DNSTypeTXT
+		// Keep the spaces of the value: it starts after the type
+		strs, err := parseTXTValue(skipFields(line, len(fields)-len(rest)+1))
+		if err != nil {
+			return DNSRecord{}, err
+		}
+		rec.Text = strs
+	default:
+		return DNSRecord{}, fmt.Errorf("unsupported record type %s", rest[0])
+	}
+
+	return rec, nil
+}
+
+// parseTXTValue splits quoted strings, an unquoted value is a single string.
+// Each string is at most 255 bytes.
+func parseTXTValue(text string) ([]string, error) {
+	var strs []string
+
+	if !strings.HasPrefix(text, `"`) {
+		strs = []string{text}
+	} else {
+		for text != "" {
+			quoted, err := strconv.QuotedPrefix(text)
+			if err != nil {
+				return nil, fmt.Errorf("invalid TXT value %s", text)
+			}
+
+			s, _ := strconv.Unquote(quoted)
+			strs = append(strs, s)
+			text = strings.TrimSpace(text[len(quoted):])
+		}
+	}
+
+	for _, s := range strs {
+		if len(s) > 255 {
+			return nil, fmt.Errorf("TXT string longer than 255 bytes")
+		}
+	}
+
+	return strs, nil
+}
+
+// skipFields returns what follows the first n fields of line.
+func skipFields(line string, n int) string {
+	for range n {
+		line = strings.TrimLeft(line, " \t")
+		if i := strings.IndexAny(line, " \t"); i >= 0 {
+			line = line[i:]
+		} else {
+			line = ""
+		}
+	}
+	return strings.TrimSpace(line)
+}
+
+func normalizeDNSName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// Add adds a record to the zone.
+func (z *DNSZone) Add(rec DNSRecord) {
+	rec.Name = normalizeDNSName(rec.Name)
+	rec.Target = normalizeDNSName(rec.Target)
+
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	z.records[rec.Name] = append(z.records[rec.Name], rec)
+}
+
+// Lookup returns the records of name with the given type, all of them for
+// ANY. found is false if the name does not exist in the zone.
+func (z *DNSZone) Lookup(name string, typ DNSType) (records []DNSRecord, found bool) {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+
+	all, found := z.records[normalizeDNSName(name)]
+	for _, r := range all {
+		if r.Type == typ || typ == DNSTypeANY {
+			records = append(records, r)
+		}
+	}
+
+	return records, found
+}
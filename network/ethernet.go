@@ -23,23 +23,13 @@ import (
 type EtherType uint16
 
 const (
-	EtherTypeIPv4    EtherType = 0x0800
-	EtherTypeARP     EtherType = 0x0806
-	EtherTypeIPv6    EtherType = 0x86DD
-	EtherTypeVLAN    EtherType = 0x8100
-	EtherTypeUnknown EtherType = 0xFFFF
+	EtherTypeIPv4 EtherType = 0x0800
+	EtherTypeARP  EtherType = 0x0806
+	EtherTypeIPv6 EtherType = 0x86DD
+	EtherTypeVLAN EtherType = 0x8100
+	EtherTypeQinQ EtherType = 0x88A8
 )
 
-func parseEtherType(v uint16) EtherType {
-	// Default to unknown
-	switch EtherType(v) {
-	case EtherTypeARP, EtherTypeIPv4, EtherTypeIPv6, EtherTypeVLAN:
-		return EtherType(v)
-	default:
-		return EtherTypeUnknown
-	}
-}
-
 func (e EtherType) String() string {
 	switch e {
 	case EtherTypeIPv4:
@@ -50,8 +40,8 @@ func (e EtherType) String() string {
 		return fmt.Sprintf("IPv6 (0x%04X)", uint16(e))
 	case EtherTypeVLAN:
 		return fmt.Sprintf("VLAN (0x%04X)", uint16(e))
-	case EtherTypeUnknown:
-		return fmt.Sprint("Custom Unknown (0x%04X)", uint16(e))
+	case EtherTypeQinQ:
+		return fmt.Sprintf("QinQ (0x%04X)", uint16(e))
 	default:
 		return fmt.Sprintf("0x%04X", uint16(e))
 	}
@@ -60,24 +50,53 @@ func (e EtherType) String() string {
 type EthernetFrame struct {
 	DestMAC   net.HardwareAddr
 	SrcMAC    net.HardwareAddr
+	VLANs     []VLANTag // Outermost first
 	EtherType EtherType
 	HeaderLen int
 	Payload   []byte
+	Raw       []byte // The whole frame
 }
 
-func handleARP(peerName string, peerIP net.IP, payload []byte) ([]byte, error) {
-	peerIface, err1 := net.InterfaceByName(peerName)
-	if err1 != nil {
-		return nil, fmt.Errorf("failed to peer interface %s: %w", peerName, err1)
+// broadcastMAC is used as destination of ARP requests
+var broadcastMAC = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+func (s *Stack) handleARP(eps []*endpoint, payload []byte) ([]byte, error) {
+	p, err := parseARPPayload(payload)
+	if err != nil {
+		return nil, fmt.Errorf("ARP request not handled: %w", err)
 	}
 
-	reply, err2 := parseARP(payload, peerIface.HardwareAddr, peerIP)
-	if err2 != nil {
-		return nil, fmt.Errorf("ARP request not handled: %w", err2)
+	ep := endpointOwning(eps, p.TargetPA)
+
+	// Whatever the operation is we learn the sender (RFC 826). Probes have
+	// no sender IP and are ignored by the table.
+	if p.PLen == 4 && p.HWLen == 6 {
+		ep.learn(p.SenderPA, p.SenderHA)
+	}
+
+	// Replies are only useful to fill the neighbor table
+	if p.Oper == ARPReply {
+		return nil, nil
+	}
+
+	// A host with several addresses answers for each of them
+	ourIP := ep.ipv4()
+	if ep.owns(p.TargetPA) {
+		ourIP = p.TargetPA
+	}
+
+	reply, err := p.replyTo(ep.mac, ourIP)
+	if err != nil {
+		return nil, fmt.Errorf("ARP request not handled: %w", err)
 	}
 
 	arpPayload := reply.marshal()
-	return buildEthernetFrame(reply.TargetHA, reply.SenderHA, EtherTypeARP, arpPayload), nil
+	return ep.frame(reply.TargetHA, EtherTypeARP, arpPayload), nil
+}
+
+func (ep *endpoint) sendARPRequest(ourIP net.IP, targetIP net.IP) error {
+	req := newARPRequest(ep.mac, ourIP, targetIP)
+	return ep.send(broadcastMAC, EtherTypeARP, req.marshal())
 }
 
 func parseEthernet(packet []byte) (*EthernetFrame, error) {
@@ -88,64 +107,37 @@ func parseEthernet(packet []byte) (*EthernetFrame, error) {
 	f := &EthernetFrame{
 		DestMAC: net.HardwareAddr(packet[0:6]),
 		SrcMAC:  net.HardwareAddr(packet[6:12]),
+		Raw:     packet,
 	}
 
-	// At offset we need to read etherType and check if it is vlan and
-	// handle VLAN tag (802.1Q)
+	// The EtherType is after the VLAN tags (802.1Q and 802.1ad)
 	offset := 12
 	et := binary.BigEndian.Uint16(packet[offset : offset+2])
-	if et == uint16(EtherTypeVLAN) {
-		offset += 4 // Skip 4-byte VLAN tag
-		if len(packet) < offset+2 {
-			return nil, fmt.Errorf("packet too small for VLAN: need at least %d bytes", offset+2)
+	for isVLANTPID(EtherType(et)) {
+		// The tag and the EtherType that follows it
+		if len(packet) < offset+6 {
+			return nil, fmt.Errorf("packet too small for VLAN: need at least %d bytes", offset+6)
 		}
+		tci := binary.BigEndian.Uint16(packet[offset+2 : offset+4])
+		f.VLANs = append(f.VLANs, parseVLANTag(EtherType(et), tci))
+		offset += 4
 		et = binary.BigEndian.Uint16(packet[offset : offset+2])
 	}
 
-	f.EtherType = parseEtherType(et)
+	f.EtherType = EtherType(et)
 	f.HeaderLen = offset + 2
 	f.Payload = packet[f.HeaderLen:]
 
-	// For debugging purpose print raw ARP frame
-	if f.EtherType == EtherTypeARP {
-		fmt.Println("--------- ARP FRAME ---------")
-		printHex(packet)
-		fmt.Println("-----------------------------")
-	}
-
 	return f, nil
 }
 
 func buildEthernetFrame(dst, src net.HardwareAddr, etherType EtherType, payload []byte) []byte {
-	frame := make([]byte, 14+len(payload))
-
-	// MAC addresses
-	copy(frame[0:6], dst)  // destination
-	copy(frame[6:12], src) // source
-
-	// EtherType in big-endian
-	binary.BigEndian.PutUint16(frame[12:14], uint16(etherType))
-
-	// Payload
-	copy(frame[14:], payload)
-
-	return frame
+	return buildTaggedFrame(dst, src, nil, etherType, payload)
 }
 
-// string returns a human-readable representation
-//func (f *EthernetFrame) string() string {
-//	return fmt.Sprintf("Ethernet: %s -> %s, Type: %s, Payload: %d bytes",
-//		f.SrcMAC, f.DestMAC, f.EtherType.string(), len(f.Payload))
-//}
-
-func printHex(buf []byte) {
-	for i := 0; i < len(buf); i += 10 {
-		end := min(i+10, len(buf))
-
-		for _, b := range buf[i:end] {
-			fmt.Printf("%02x ", b)
-		}
-
-		fmt.Println()
-	}
+// String returns a human-readable representation, see Dissect for the
+// details of the layers.
+func (f *EthernetFrame) String() string {
+	return fmt.Sprintf("Ethernet: %s -> %s, Type: %s, Payload: %d bytes",
+		f.SrcMAC, f.DestMAC, f.EtherType.String(), len(f.Payload))
 }
@@ -0,0 +1,56 @@
+package network
+
+import "testing"
+
+func TestParseEthernet(t *testing.T) {
+	single := []VLANTag{{TPID: EtherTypeVLAN, PCP: 5, VID: 10}}
+	double := []VLANTag{{TPID: EtherTypeQinQ, VID: 100}, {TPID: EtherTypeVLAN, DEI: true, VID: 20}}
+
+	tests := []struct {
+		name       string
+		frame      []byte
+		wantErr    bool
+		etherType  EtherType
+		headerLen  int
+		payloadLen int
+		tags       []VLANTag
+	}{
+		{"untagged", buildTaggedFrame(testPeerMAC, testHostMAC, nil, EtherTypeIPv4, make([]byte, 20)), false, EtherTypeIPv4, 14, 20, nil},
+		{"802.1Q", buildTaggedFrame(testPeerMAC, testHostMAC, single, EtherTypeARP, make([]byte, 28)), false, EtherTypeARP, 18, 28, single},
+		{"QinQ", buildTaggedFrame(testPeerMAC, testHostMAC, double, EtherTypeIPv6, make([]byte, 40)), false, EtherTypeIPv6, 22, 40, double},
+		// A tag and the inner EtherType without payload
+		{"minimal tagged", buildTaggedFrame(testPeerMAC, testHostMAC, single, EtherTypeARP, nil), false, EtherTypeARP, 18, 0, single},
+		{"too small", make([]byte, 13), true, 0, 0, 0, nil},
+		{"truncated tag", buildTaggedFrame(testPeerMAC, testHostMAC, single, EtherTypeARP, nil)[:17], true, 0, 0, 0, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := parseEthernet(tt.frame)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parsed %s", f)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if f.EtherType != tt.etherType || f.HeaderLen != tt.headerLen || len(f.Payload) != tt.payloadLen {
+				t.Errorf("parsed %s, header %d bytes", f, f.HeaderLen)
+			}
+			if f.SrcMAC.String() != testHostMAC.String() || f.DestMAC.String() != testPeerMAC.String() {
+				t.Errorf("addresses %s -> %s", f.SrcMAC, f.DestMAC)
+			}
+			if len(f.VLANs) != len(tt.tags) {
+				t.Fatalf("tags %v, want %v", f.VLANs, tt.tags)
+			}
+			for i := range tt.tags {
+				if f.VLANs[i] != tt.tags[i] {
+					t.Errorf("tag %d is %+v, want %+v", i, f.VLANs[i], tt.tags[i])
+				}
+			}
+		})
+	}
+}
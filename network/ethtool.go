@@ -0,0 +1,56 @@
+package network
+
+import (
+	"fmt"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// With checksum offload the kernel leaves UDP/TCP checksums of frames sent on
+// a veth incomplete, expecting the hardware to finish them. Our AF_PACKET
+// socket would then see invalid checksums, so it is disabled on the host side
+// like `ethtool -K <iface> tx off` does. It also disables segmentation
+// offload that depends on it, so we never receive frames larger than the MTU.
+//
+// On Linux: include/uapi/linux/ethtool.h
+
+// struct ethtool_value
+type ethtoolValue struct {
+	cmd  uint32
+	data uint32
+}
+
+// struct ifreq with ifr_data
+type ifreqData struct {
+	name [unix.IFNAMSIZ]byte
+	data uintptr
+	_    [24 - unsafe.Sizeof(uintptr(0))]byte
+}
+
+func disableTxChecksum(name string) error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("failed to create ethtool socket: %w", err)
+	}
+	defer unix.Close(fd)
+
+	// value is only referenced by an uintptr in ifr, pinning it keeps it
+	// alive and at the same address until the ioctl returns
+	value := &ethtoolValue{cmd: unix.ETHTOOL_STXCSUM}
+	var pinner runtime.Pinner
+	pinner.Pin(value)
+	defer pinner.Unpin()
+
+	var ifr ifreqData
+	copy(ifr.name[:unix.IFNAMSIZ-1], name)
+	ifr.data = uintptr(unsafe.Pointer(value))
+
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.SIOCETHTOOL, uintptr(unsafe.Pointer(&ifr)))
+	if errno != 0 {
+		return fmt.Errorf("failed to disable tx checksum offload on %s: %w", name, errno)
+	}
+
+	return nil
+}
@@ -0,0 +1,274 @@
+package network
+
+import (
+	"bytes"
+	"fmt"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+)
+
+// +--------------------------------------------------------+
+// | Flags/Fragment Offset (2 bytes of the IPv4 header)     |
+// |--------------------------------------------------------|
+// | 0 (1 bit) | DF (1 bit) | MF (1 bit) | Offset (13 bits) |
+// +--------------------------------------------------------+
+//
+// A datagram larger than the MTU is cut in fragments that share the
+// Identification of the datagram. The offset is in units of 8 bytes and MF
+// (More Fragments) is set on all of them but the last one. Only the options
+// with the copied flag are repeated in the fragments after the first one.
+//
+// The receiver gathers the fragments of a datagram by (source, destination,
+// protocol, identification). We also use the VLAN since hosts of different
+// VLANs are different networks. Fragments that overlap must carry the same
+// bytes, otherwise the whole datagram is dropped (as Linux does), and a
+// datagram not complete after fragmentTimeout is dropped with an ICMP Time
+// Exceeded.
+//
+// [RFC 791] https://datatracker.ietf.org/doc/html/rfc791#section-3.2
+// https://en.wikipedia.org/wiki/IP_fragmentation
+const (
+	ipv4FlagDF        = 0x4000
+	ipv4FlagMF        = 0x2000
+	ipv4FragOffsetMax = 0x1FFF
+)
+
+const (
+	// fragmentTimeout is the lifetime of an incomplete datagram, Linux uses
+	// the same (net.ipv4.ipfrag_time).
+	fragmentTimeout = 30 * time.Second
+	// maxReassemblies bounds the memory used by incomplete datagrams
+	maxReassemblies = 64
+)
+
+type fragmentKey struct {
+	vlan  uint16
+	src   netip.Addr
+	dst   netip.Addr
+	proto IPv4Protocol
+	id    uint16
+}
+
+// reassembly is a datagram being rebuilt from its fragments.
+type reassembly struct {
+	ep       *endpoint
+	first    *IPv4Packet // Fragment at offset 0, gives the header
+	data     []byte
+	received [][2]int // Sorted and merged [start, end) ranges of data
+	total    int      // Length of the data, -1 until the last fragment
+	timer    *time.Timer
+}
+
+type fragmentTable struct {
+	mu      sync.Mutex
+	pending map[fragmentKey]*reassembly
+}
+
+// IsFragment tells if the packet is a fragment of a bigger datagram.
+func (p *IPv4Packet) IsFragment() bool {
+	return p.FlagsFragOffset&(ipv4FlagMF|ipv4FragOffsetMax) != 0
+}
+
+// reassemble adds the fragment p received by ep to its datagram. It returns
+// the whole datagram once every fragment is received, nil until then.
+func (s *Stack) reassemble(ep *endpoint, p *IPv4Packet) (*IPv4Packet, error) {
+	src, _ := netip.AddrFromSlice(p.SourceIP.To4())
+	dst, _ := netip.AddrFromSlice(p.DestIP.To4())
+	key := fragmentKey{vlan: ep.vlan(), src: src, dst: dst, proto: p.Protocol, id: p.Identification}
+
+	headerLen := int(p.IHL()) * 4
+	data := p.Payload
+
+	offset := int(p.FlagsFragOffset&ipv4FragOffsetMax) * 8
+	end := offset + len(data)
+	last := p.FlagsFragOffset&ipv4FlagMF == 0
+	if end+headerLen > 0xFFFF {
+		return nil, fmt.Errorf("fragment at offset %d goes beyond the maximum datagram size", offset)
+	}
+	if !last && len(data)%8 != 0 {
+		return nil, fmt.Errorf("fragment at offset %d has %d bytes, not a multiple of 8", offset, len(data))
+	}
+
+	t := &s.fragments
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	r, found := t.pending[key]
+	if !found {
+		if len(t.pending) >= maxReassemblies {
+			return nil, fmt.Errorf("too many IPv4 datagrams being reassembled")
+		}
+		r = &reassembly{ep: ep, total: -1}
+		r.timer = time.AfterFunc(fragmentTimeout, func() { s.expireReassembly(key, r) })
+		if t.pending == nil {
+			t.pending = make(map[fragmentKey]*reassembly)
+		}
+		t.pending[key] = r
+	}
+
+	if err := r.add(offset, data, last); err != nil {
+		r.timer.Stop()
+		delete(t.pending, key)
+		return nil, fmt.Errorf("IPv4 datagram %d from %s dropped: %w", key.id, key.src, err)
+	}
+	if offset == 0 {
+		// The frame buffer is reused for the next frames
+		first := *p
+		first.SourceIP = slices.Clone(p.SourceIP)
+		first.DestIP = slices.Clone(p.DestIP)
+		first.Payload = slices.Clone(p.Payload[:min(8, len(p.Payload))])
+		r.first = &first
+	}
+
+	if !r.complete() {
+		return nil, nil
+	}
+	r.timer.Stop()
+	delete(t.pending, key)
+
+	whole := *r.first
+	whole.FlagsFragOffset &= ipv4FlagDF
+	whole.TotalLength = uint16(headerLen + r.total)
+	whole.HeaderChecksum = 0
+	whole.HeaderChecksum = checksum(whole.header())
+	whole.Payload = r.data[:r.total]
+
+	s.logger.Debug("IPv4 datagram reassembled", "src", key.src.String(), "id", key.id, "size", whole.TotalLength)
+
+	return &whole, nil
+}
+
+// stop drops the datagrams being reassembled.
+func (t *fragmentTable) stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for key, r := range t.pending {
+		r.timer.Stop()
+		delete(t.pending, key)
+	}
+}
+
+// expireReassembly drops a datagram still incomplete after fragmentTimeout.
+// If its first fragment was received the sender gets a Time Exceeded.
+func (s *Stack) expireReassembly(key fragmentKey, r *reassembly) {
+	t := &s.fragments
+	t.mu.Lock()
+	if t.pending[key] != r {
+		t.mu.Unlock()
+		return
+	}
+	delete(t.pending, key)
+	t.mu.Unlock()
+
+	s.logger.Warn("IPv4 reassembly timed out", "src", key.src.String(), "id", key.id, "vlan", key.vlan)
+
+	if r.first == nil || !icmpErrorAllowed(nil, r.first) {
+		return
+	}
+
+	msg := newICMPError(ICMPTimeExceeded, ICMPCodeReassemblyExceeded, 0, r.first)
+	if err := r.ep.sendIPv4(r.first.SourceIP, ICMPProtocol, msg.marshal()); err != nil {
+		s.logger.Error("failed to send ICMP error", "dst", key.src.String(), "err", err)
+	}
+}
+
+func (r *reassembly) add(offset int, data []byte, last bool) error {
+	end := offset + len(data)
+
+	if last {
+		if r.total >= 0 && r.total != end {
+			return fmt.Errorf("last fragment ends at %d, another one at %d", end, r.total)
+		}
+		if len(r.received) > 0 && r.received[len(r.received)-1][1] > end {
+			return fmt.Errorf("last fragment ends at %d before received data", end)
+		}
+		r.total = end
+	} else if r.total >= 0 && end > r.total {
+		return fmt.Errorf("fragment ends at %d after the last one", end)
+	}
+
+	// Overlapping parts are accepted only if they are retransmissions
+	for _, rg := range r.received {
+		start, stop := max(rg[0], offset), min(rg[1], end)
+		if start < stop && !bytes.Equal(r.data[start:stop], data[start-offset:stop-offset]) {
+			return fmt.Errorf("fragment at offset %d overlaps with different data", offset)
+		}
+	}
+
+	if end > len(r.data) {
+		r.data = append(r.data, make([]byte, end-len(r.data))...)
+	}
+	copy(r.data[offset:end], data)
+
+	r.received = mergeRange(r.received, [2]int{offset, end})
+	return nil
+}
+
+func (r *reassembly) complete() bool {
+	return r.total >= 0 && r.first != nil &&
+		len(r.received) == 1 && r.received[0] == [2]int{0, r.total}
+}
+
+// mergeRange inserts rg in the sorted ranges and merges the ones that touch.
+func mergeRange(ranges [][2]int, rg [2]int) [][2]int {
+	var merged [][2]int
+	for _, cur := range ranges {
+		switch {
+		case cur[1] < rg[0]:
+			merged = append(merged, cur)
+		case rg[1] < cur[0]:
+			merged = append(merged, rg)
+			rg = cur
+		default:
+			rg = [2]int{min(rg[0], cur[0]), max(rg[1], cur[1])}
+		}
+	}
+	return append(merged, rg)
+}
+
+// fragmentIPv4 cuts a marshaled packet in fragments that fit in mtu. The
+// packet is returned as is if it already fits.
+func fragmentIPv4(packet []byte, mtu int) ([][]byte, error) {
+	if len(packet) <= mtu {
+		return [][]byte{packet}, nil
+	}
+
+	p, err := parseIPv4Packet(packet)
+	if err != nil {
+		return nil, err
+	}
+	if p.FlagsFragOffset&ipv4FlagDF != 0 {
+		return nil, fmt.Errorf("packet of %d bytes exceeds MTU %d and cannot be fragmented", len(packet), mtu)
+	}
+
+	// Fragments after the first one only carry the copied options
+	otherOptions := copiedIPv4Options(p.Options)
+
+	var frags [][]byte
+	for offset := 0; offset < len(p.Payload); {
+		frag := *p
+		if offset > 0 {
+			frag.Options = otherOptions
+		}
+
+		size := (mtu - 20 - len(frag.Options)) &^ 7
+		if size <= 0 {
+			return nil, fmt.Errorf("MTU %d too small to fragment", mtu)
+		}
+
+		end := min(offset+size, len(p.Payload))
+		frag.Payload = p.Payload[offset:end]
+		frag.FlagsFragOffset = uint16(offset / 8)
+		if end < len(p.Payload) {
+			frag.FlagsFragOffset |= ipv4FlagMF
+		}
+
+		frags = append(frags, frag.marshal())
+		offset = end
+	}
+
+	return frags, nil
+}
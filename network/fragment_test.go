@@ -0,0 +1,188 @@
+package network
+
+import (
+	"bytes"
+	"testing"
+)
+
+// testFragments returns a datagram of 3000 bytes of UDP payload and its
+// fragments for an MTU of 1000.
+func testFragments(t *testing.T, id uint16) ([]byte, []*IPv4Packet) {
+	t.Helper()
+
+	payload := make([]byte, 3000)
+	for i := range payload {
+		payload[i] = byte(i * 7)
+	}
+	p := &IPv4Packet{Identification: id, TTL: 64, Protocol: UDPProtocol, SourceIP: testHostIP, DestIP: testPeerIP, Payload: payload}
+
+	frags, err := fragmentIPv4(p.marshal(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var packets []*IPv4Packet
+	for _, f := range frags {
+		if len(f) > 1000 {
+			t.Errorf("fragment of %d bytes", len(f))
+		}
+		fp, err := parseIPv4Packet(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, fp)
+	}
+
+	return payload, packets
+}
+
+func TestFragmentIPv4(t *testing.T) {
+	_, frags := testFragments(t, 1)
+	if len(frags) != 4 {
+		t.Fatalf("%d fragments, want 4", len(frags))
+	}
+
+	offset := 0
+	for i, f := range frags {
+		if got := int(f.FlagsFragOffset&ipv4FragOffsetMax) * 8; got != offset {
+			t.Errorf("fragment %d at offset %d, want %d", i, got, offset)
+		}
+		if more := f.FlagsFragOffset&ipv4FlagMF != 0; more != (i < len(frags)-1) {
+			t.Errorf("fragment %d: MF is %v", i, more)
+		}
+		offset += len(f.Payload)
+	}
+
+	// DF forbids fragmentation
+	p := &IPv4Packet{TTL: 64, FlagsFragOffset: ipv4FlagDF, SourceIP: testHostIP, DestIP: testPeerIP, Payload: make([]byte, 2000)}
+	if _, err := fragmentIPv4(p.marshal(), 1500); err == nil {
+		t.Error("packet with DF fragmented")
+	}
+}
+
+func TestReassemble(t *testing.T) {
+	tests := []struct {
+		name  string
+		order []int
+	}{
+		{"in order", []int{0, 1, 2, 3}},
+		{"reversed", []int{3, 2, 1, 0}},
+		{"shuffled", []int{2, 0, 3, 1}},
+		{"duplicates", []int{1, 1, 0, 3, 0, 2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stack, _ := newTestStack(t)
+			ep := stack.linkEndpoint()
+			payload, frags := testFragments(t, 2)
+
+			// The datagram is complete with the last fragment only
+			var whole *IPv4Packet
+			for i, n := range tt.order {
+				p, err := stack.reassemble(ep, frags[n])
+				if err != nil {
+					t.Fatal(err)
+				}
+				if p != nil && i != len(tt.order)-1 {
+					t.Fatalf("datagram complete after %d fragments", i+1)
+				}
+				whole = p
+			}
+
+			if whole == nil {
+				t.Fatal("datagram not reassembled")
+			}
+			if !bytes.Equal(whole.Payload, payload) || int(whole.TotalLength) != 20+len(payload) || whole.IsFragment() {
+				t.Errorf("reassembled %d bytes, flags 0x%04x", len(whole.Payload), whole.FlagsFragOffset)
+			}
+			if checksum(whole.header()) != 0 {
+				t.Error("bad header checksum")
+			}
+			if n := len(stack.fragments.pending); n != 0 {
+				t.Errorf("%d datagrams still pending", n)
+			}
+		})
+	}
+}
+
+func TestReassembleErrors(t *testing.T) {
+	stack, _ := newTestStack(t)
+	ep := stack.linkEndpoint()
+	_, frags := testFragments(t, 3)
+
+	// The same range with different bytes drops the datagram
+	if _, err := stack.reassemble(ep, frags[1]); err != nil {
+		t.Fatal(err)
+	}
+	changed := *frags[1]
+	changed.Payload = append([]byte(nil), frags[1].Payload...)
+	changed.Payload[10] ^= 0xFF
+	if _, err := stack.reassemble(ep, &changed); err == nil {
+		t.Error("overlap with different data accepted")
+	}
+	if n := len(stack.fragments.pending); n != 0 {
+		t.Errorf("%d datagrams pending after an overlap", n)
+	}
+
+	// A fragment after the end of the datagram
+	if _, err := stack.reassemble(ep, frags[3]); err != nil {
+		t.Fatal(err)
+	}
+	beyond := *frags[1]
+	beyond.FlagsFragOffset = ipv4FlagMF | 400 // 3200 bytes
+	if _, err := stack.reassemble(ep, &beyond); err == nil {
+		t.Error("fragment after the last one accepted")
+	}
+
+	// Only the last fragment can have a size that is not a multiple of 8
+	odd := *frags[0]
+	odd.Identification = 4
+	odd.Payload = odd.Payload[:13]
+	if _, err := stack.reassemble(ep, &odd); err == nil {
+		t.Error("fragment of 13 bytes accepted")
+	}
+}
+
+func TestReassemblyTimeout(t *testing.T) {
+	stack, host := newTestStack(t)
+	ep := stack.linkEndpoint()
+	stack.Neighbors().Learn(testHostIP, testHostMAC)
+	_, frags := testFragments(t, 5)
+
+	// Without the first fragment the sender is not told
+	stack.reassemble(ep, frags[1])
+	for key, r := range stack.fragments.pending {
+		stack.expireReassembly(key, r)
+	}
+	if f := readTestFrame(t, host); f != nil {
+		t.Errorf("ICMP error without the first fragment: % x", f)
+	}
+
+	stack.reassemble(ep, frags[0])
+	stack.reassemble(ep, frags[2])
+	for key, r := range stack.fragments.pending {
+		stack.expireReassembly(key, r)
+	}
+	if n := len(stack.fragments.pending); n != 0 {
+		t.Errorf("%d datagrams pending after the timeout", n)
+	}
+
+	f := readTestFrame(t, host)
+	if f == nil {
+		t.Fatal("no Time Exceeded")
+	}
+	p, err := parseIPv4Packet(f[14:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Protocol != ICMPProtocol || p.Payload[0] != ICMPTimeExceeded || p.Payload[1] != ICMPCodeReassemblyExceeded {
+		t.Errorf("unexpected ICMP % x", p.Payload[:8])
+	}
+
+	// The quote is the header of the first fragment and 8 bytes of its data
+	quote := p.Payload[8:]
+	if len(quote) != 20+8 || !bytes.Equal(quote[4:6], []byte{0, 5}) || !bytes.Equal(quote[20:], frags[0].Payload[:8]) {
+		t.Errorf("unexpected quote % x", quote)
+	}
+}
@@ -0,0 +1,162 @@
+package network
+
+import (
+	"fmt"
+	"sync"
+)
+
+// EtherTypeHandler handles the frames of an EtherType bound with
+// HandleEtherType. It returns the payload of the reply, sent back to the
+// source of the frame with the same EtherType and VLAN tags, or nil.
+type EtherTypeHandler func(f *EthernetFrame) ([]byte, error)
+
+// IPv4Handler handles the packets of an IP protocol bound with
+// HandleIPv4Protocol. Fragmented packets are given once reassembled. It
+// returns the payload of the reply, sent back to the source of the packet
+// with the same protocol, or nil.
+type IPv4Handler func(f *EthernetFrame, p *IPv4Packet) ([]byte, error)
+
+// UnhandledError is returned by ProcessFrame for a frame nobody handles.
+type UnhandledError struct {
+	EtherType EtherType
+	Protocol  IPv4Protocol // Only set for IPv4
+}
+
+func (e *UnhandledError) Error() string {
+	if e.EtherType == EtherTypeIPv4 {
+		return fmt.Sprintf("no handler for IP protocol %d", e.Protocol)
+	}
+	return fmt.Sprintf("no handler for EtherType %s", e.EtherType.String())
+}
+
+type handlerRegistry struct {
+	mu          sync.RWMutex
+	etherTypes  map[EtherType]EtherTypeHandler
+	ipProtocols map[IPv4Protocol]IPv4Handler
+}
+
+// HandleEtherType binds h to an EtherType. The ones handled by the stack
+// (ARP, IPv4, IPv6 and VLAN tags) cannot be bound.
+func (s *Stack) HandleEtherType(et EtherType, h EtherTypeHandler) error {
+	switch et {
+	case EtherTypeARP, EtherTypeIPv4, EtherTypeIPv6, EtherTypeVLAN, EtherTypeQinQ:
+		return fmt.Errorf("EtherType %s is handled by the stack", et.String())
+	}
+
+	s.handlers.mu.Lock()
+	defer s.handlers.mu.Unlock()
+
+	if s.handlers.etherTypes == nil {
+		s.handlers.etherTypes = make(map[EtherType]EtherTypeHandler)
+	}
+
+	if _, found := s.handlers.etherTypes[et]; found {
+		return fmt.Errorf("EtherType %s is already bound", et.String())
+	}
+
+	s.handlers.etherTypes[et] = h
+	return nil
+}
+
+// UnhandleEtherType releases the EtherType.
+func (s *Stack) UnhandleEtherType(et EtherType) {
+	s.handlers.mu.Lock()
+	defer s.handlers.mu.Unlock()
+
+	delete(s.handlers.etherTypes, et)
+}
+
+// HandleIPv4Protocol binds h to an IP protocol number. ICMP, TCP and UDP are
+// handled by the stack and cannot be bound.
+func (s *Stack) HandleIPv4Protocol(proto IPv4Protocol, h IPv4Handler) error {
+	switch proto {
+	case ICMPProtocol, TCPProtocol, UDPProtocol:
+		return fmt.Errorf("IP protocol %d is handled by the stack", proto)
+	}
+
+	s.handlers.mu.Lock()
+	defer s.handlers.mu.Unlock()
+
+	if s.handlers.ipProtocols == nil {
+		s.handlers.ipProtocols = make(map[IPv4Protocol]IPv4Handler)
+	}
+
+	if _, found := s.handlers.ipProtocols[proto]; found {
+		return fmt.Errorf("IP protocol %d is already bound", proto)
+	}
+
+	s.handlers.ipProtocols[proto] = h
+	return nil
+}
+
+// UnhandleIPv4Protocol releases the IP protocol.
+func (s *Stack) UnhandleIPv4Protocol(proto IPv4Protocol) {
+	s.handlers.mu.Lock()
+	defer s.handlers.mu.Unlock()
+
+	delete(s.handlers.ipProtocols, proto)
+}
+
+func (s *Stack) etherTypeHandler(et EtherType) (EtherTypeHandler, bool) {
+	s.handlers.mu.RLock()
+	defer s.handlers.mu.RUnlock()
+
+	h, found := s.handlers.etherTypes[et]
+	return h, found
+}
+
+func (s *Stack) ipv4Handler(proto IPv4Protocol) (IPv4Handler, bool) {
+	s.handlers.mu.RLock()
+	defer s.handlers.mu.RUnlock()
+
+	h, found := s.handlers.ipProtocols[proto]
+	return h, found
+}
+
+// handleEtherType gives the frame to the handler bound to its EtherType. The
+// reply comes from the default identity of the VLAN.
+func (s *Stack) handleEtherType(eps []*endpoint, f *EthernetFrame) ([]byte, error) {
+	h, found := s.etherTypeHandler(f.EtherType)
+	if !found {
+		return nil, &UnhandledError{EtherType: f.EtherType}
+	}
+
+	payload, err := h(f)
+	if err != nil {
+		return nil, fmt.Errorf("handler of EtherType %s failed: %w", f.EtherType.String(), err)
+	}
+	if payload == nil {
+		return nil, nil
+	}
+
+	return eps[0].frame(f.SrcMAC, f.EtherType, payload), nil
+}
+
+// handleIPv4Protocol gives the packet to the handler bound to its protocol,
+// without handler the sender gets a Protocol Unreachable.
+func (s *Stack) handleIPv4Protocol(ep *endpoint, f *EthernetFrame, p *IPv4Packet) ([]byte, error) {
+	h, found := s.ipv4Handler(p.Protocol)
+	if !found {
+		err := &UnhandledError{EtherType: EtherTypeIPv4, Protocol: p.Protocol}
+		return ep.icmpError(f, p, ICMPDestUnreachable, ICMPCodeProtocolUnreachable, 0, err)
+	}
+
+	payload, err := h(f, p)
+	if err != nil {
+		return nil, fmt.Errorf("handler of IP protocol %d failed: %w", p.Protocol, err)
+	}
+	if payload == nil {
+		return nil, nil
+	}
+
+	reply := &IPv4Packet{
+		Identification: uint16(s.ipID.Add(1)),
+		TTL:            defaultTTL,
+		Protocol:       p.Protocol,
+		SourceIP:       p.DestIP,
+		DestIP:         p.SourceIP,
+		Payload:        payload,
+	}
+
+	return ep.replyIPv4(f.SrcMAC, reply.marshal())
+}
@@ -0,0 +1,110 @@
+package network
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestHandleEtherType(t *testing.T) {
+	stack, _ := newTestStack(t)
+	const et EtherType = 0x88b5
+
+	for _, reserved := range []EtherType{EtherTypeARP, EtherTypeIPv4, EtherTypeIPv6, EtherTypeVLAN, EtherTypeQinQ} {
+		if err := stack.HandleEtherType(reserved, nil); err == nil {
+			t.Errorf("EtherType %s bound", reserved)
+		}
+	}
+
+	// Without handler the frame is reported as unhandled
+	frame := testEthernet(et, []byte("ping"))
+	var unhandled *UnhandledError
+	if _, err := stack.ProcessFrame(frame); !errors.As(err, &unhandled) || unhandled.EtherType != et {
+		t.Fatalf("error %v, want an UnhandledError", err)
+	}
+
+	err := stack.HandleEtherType(et, func(f *EthernetFrame) ([]byte, error) {
+		return append([]byte("re:"), f.Payload...), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stack.HandleEtherType(et, nil); err == nil {
+		t.Error("EtherType bound twice")
+	}
+
+	reply, err := stack.ProcessFrame(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := buildTaggedFrame(testHostMAC, testPeerMAC, nil, et, []byte("re:ping"))
+	if !bytes.Equal(reply, want) {
+		t.Errorf("reply % x, want % x", reply, want)
+	}
+
+	// The reply has the tags of the request
+	tags := []VLANTag{{TPID: EtherTypeVLAN, VID: 7}}
+	reply, _ = stack.ProcessFrame(buildTaggedFrame(testPeerMAC, testHostMAC, tags, et, []byte("ping")))
+	if f, err := parseEthernet(reply); err != nil || len(f.VLANs) != 1 || f.VLANs[0].VID != 7 {
+		t.Errorf("tagged reply % x", reply)
+	}
+
+	stack.UnhandleEtherType(et)
+	if _, err := stack.ProcessFrame(frame); !errors.As(err, &unhandled) {
+		t.Errorf("error %v after UnhandleEtherType", err)
+	}
+	if err := stack.HandleEtherType(et, func(f *EthernetFrame) ([]byte, error) { return nil, nil }); err != nil {
+		t.Errorf("EtherType not released: %v", err)
+	}
+}
+
+func TestHandleIPv4Protocol(t *testing.T) {
+	stack, _ := newTestStack(t)
+	const proto IPv4Protocol = 253 // Experimentation
+
+	for _, reserved := range []IPv4Protocol{ICMPProtocol, TCPProtocol, UDPProtocol} {
+		if err := stack.HandleIPv4Protocol(reserved, nil); err == nil {
+			t.Errorf("IP protocol %d bound", reserved)
+		}
+	}
+
+	err := stack.HandleIPv4Protocol(proto, func(f *EthernetFrame, p *IPv4Packet) ([]byte, error) {
+		if string(p.Payload) == "fail" {
+			return nil, errors.New("failed on purpose")
+		}
+		return append([]byte("re:"), p.Payload...), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stack.HandleIPv4Protocol(proto, nil); err == nil {
+		t.Error("IP protocol bound twice")
+	}
+
+	reply, err := stack.ProcessFrame(testIPv4(proto, []byte("ping")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := parseIPv4Packet(reply[14:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Protocol != proto || !p.DestIP.Equal(testHostIP) || string(p.Payload) != "re:ping" {
+		t.Errorf("reply %+v", p)
+	}
+
+	if _, err := stack.ProcessFrame(testIPv4(proto, []byte("fail"))); err == nil {
+		t.Error("error of the handler not returned")
+	}
+
+	// Without handler the sender gets a Protocol Unreachable
+	stack.UnhandleIPv4Protocol(proto)
+	reply, _ = stack.ProcessFrame(testIPv4(proto, []byte("ping")))
+	if reply == nil {
+		t.Fatal("no Protocol Unreachable")
+	}
+	p, _ = parseIPv4Packet(reply[14:])
+	if p.Protocol != ICMPProtocol || p.Payload[0] != ICMPDestUnreachable || p.Payload[1] != ICMPCodeProtocolUnreachable {
+		t.Errorf("unexpected reply % x", reply)
+	}
+}
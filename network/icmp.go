@@ -3,6 +3,7 @@ package network
 import (
 	"encoding/binary"
 	"fmt"
+	"net"
 )
 
 // https://datatracker.ietf.org/doc/html/rfc792
@@ -21,10 +22,20 @@ import (
 // 32 33 34 35 36 37
 type ICMPType = uint8
 
-// Focusing on responding to ping
 const (
-	ICMPEchoReply   ICMPType = 0
-	ICMPEchoRequest ICMPType = 8
+	ICMPEchoReply        ICMPType = 0
+	ICMPDestUnreachable  ICMPType = 3
+	ICMPEchoRequest      ICMPType = 8
+	ICMPTimeExceeded     ICMPType = 11
+	ICMPParameterProblem ICMPType = 12
+)
+
+// Codes of the error messages we send
+const (
+	ICMPCodeProtocolUnreachable uint8 = 2 // Destination Unreachable
+	ICMPCodePortUnreachable     uint8 = 3 // Destination Unreachable
+	ICMPCodeTTLExceeded         uint8 = 0 // Time Exceeded in transit
+	ICMPCodeReassemblyExceeded  uint8 = 1 // Time Exceeded while reassembling fragments
 )
 
 type ICMPPacket struct {
@@ -53,41 +64,147 @@ func parseICMP(packet *IPv4Packet) (*ICMPPacket, error) {
 		Data:           payload[8:],
 	}
 
+	// Checksum covers the whole ICMP message
+	if cs := checksum(payload); cs != 0 {
+		return nil, fmt.Errorf("bad ICMP checksum 0x%04X", p.Checksum)
+	}
+
 	return p, nil
 }
 
-//func (p *ICMPPacket) marshal() []byte {
-//	data := make([]byte, 8+len(p.Data))
-//
-//	data[0] = byte(p.Type)
-//	data[1] = p.Code
-//	binary.BigEndian.PutUint16(data[4:6], p.Identifier)
-//	binary.BigEndian.PutUint16(data[6:8], p.SequenceNumber)
-//	copy(data[8:], p.Data)
-//
-//	// compute checksum
-//	binary.BigEndian.PutUint16(data[2:4], 0)
-//	cs := checksum(data)
-//	binary.BigEndian.PutUint16(data[2:4], cs)
-//
-//	return data
-//}
+func (p *ICMPPacket) marshal() []byte {
+	data := make([]byte, 8+len(p.Data))
 
-//func checksum(data []byte) uint16 {
-//	var sum uint32
-//	n := len(data)
-//
-//	for i := 0; i < n-1; i += 2 {
-//		sum += uint32(binary.BigEndian.Uint16(data[i:]))
-//	}
-//
-//	if n%2 == 1 {
-//		sum += uint32(data[n-1]) << 8
-//	}
+	data[0] = byte(p.Type)
+	data[1] = p.Code
+	binary.BigEndian.PutUint16(data[4:6], p.Identifier)
+	binary.BigEndian.PutUint16(data[6:8], p.SequenceNumber)
+	copy(data[8:], p.Data)
+
+	// compute checksum
+	binary.BigEndian.PutUint16(data[2:4], 0)
+	cs := checksum(data)
+	binary.BigEndian.PutUint16(data[2:4], cs)
+
+	return data
+}
+
+// echoReply builds the reply to an echo request. Identifier, sequence number
+// and data must be returned unchanged (RFC 792).
+func (p *ICMPPacket) echoReply() *ICMPPacket {
+	return &ICMPPacket{
+		Type:           ICMPEchoReply,
+		Code:           0,
+		Identifier:     p.Identifier,
+		SequenceNumber: p.SequenceNumber,
+		Data:           p.Data,
+	}
+}
+
+// +--------------------------------------------------------+
+// | ICMP Error Message                                     |
+// |--------------------------------------------------------|
+// | Type (1) | Code (1) | Checksum (2)                     |
+// | Pointer (1, Parameter Problem only) | Unused (3)       |
+// | Original IPv4 header + first 8 bytes of its data       |
+// +--------------------------------------------------------+
 //
-//	for (sum >> 16) > 0 {
-//		sum = (sum >> 16) + (sum & 0xFFFF)
-//	}
+// The quoted bytes let the sender find the socket the error is for. No error
+// is sent about an ICMP error, a broadcast or multicast, a fragment that is
+// not the first one or a source that is not a single host, to avoid storms.
 //
-//	return ^uint16(sum)
-//}
+// [RFC 792]  https://datatracker.ietf.org/doc/html/rfc792
+// [RFC 1122] https://datatracker.ietf.org/doc/html/rfc1122#section-3.2.2
+func isICMPError(t ICMPType) bool {
+	switch t {
+	case ICMPDestUnreachable, 4, 5, ICMPTimeExceeded, ICMPParameterProblem:
+		// 4 (Source Quench) and 5 (Redirect) are errors we never send
+		return true
+	default:
+		return false
+	}
+}
+
+// newICMPError builds an error message about p. The word after the checksum
+// is stored in Identifier and SequenceNumber, only Parameter Problem uses it.
+func newICMPError(typ ICMPType, code, pointer uint8, p *IPv4Packet) *ICMPPacket {
+	return &ICMPPacket{
+		Type:       typ,
+		Code:       code,
+		Identifier: uint16(pointer) << 8,
+		Data:       p.quote(),
+	}
+}
+
+// icmpErrorAllowed tells if an ICMP error can be sent about p. dstMAC is the
+// destination of the frame p was received in, nil if unknown.
+func icmpErrorAllowed(dstMAC net.HardwareAddr, p *IPv4Packet) bool {
+	if len(dstMAC) > 0 && dstMAC[0]&0x01 != 0 {
+		// Link-layer broadcast or multicast
+		return false
+	}
+	if p.DestIP.Equal(net.IPv4bcast) || p.DestIP.IsMulticast() {
+		return false
+	}
+	if p.FlagsFragOffset&ipv4FragOffsetMax != 0 {
+		return false
+	}
+	src := p.SourceIP
+	if src.IsUnspecified() || src.IsLoopback() || src.IsMulticast() || src.Equal(net.IPv4bcast) {
+		return false
+	}
+	if p.Protocol == ICMPProtocol && len(p.Payload) > 0 && isICMPError(p.Payload[0]) {
+		return false
+	}
+	return true
+}
+
+// icmpError answers the packet p of frame f with an ICMP error. reason is
+// why the error is sent, it is logged, or returned if the error cannot be
+// sent.
+func (ep *endpoint) icmpError(f *EthernetFrame, p *IPv4Packet, typ ICMPType, code, pointer uint8, reason error) ([]byte, error) {
+	// A packet sent to one of our addresses is answered from it, one we
+	// forward from our first address
+	ourIP := ep.ipv4()
+	if ep.owns(p.DestIP) {
+		ourIP = p.DestIP
+	}
+	if ourIP == nil || !icmpErrorAllowed(f.DestMAC, p) {
+		return nil, reason
+	}
+
+	reply := &IPv4Packet{
+		Identification: uint16(ep.stack.ipID.Add(1)),
+		TTL:            defaultTTL,
+		Protocol:       ICMPProtocol,
+		SourceIP:       ourIP,
+		DestIP:         p.SourceIP,
+		Payload:        newICMPError(typ, code, pointer, p).marshal(),
+	}
+
+	ep.stack.logger.Info("ICMP error sent", "type", typ, "code", code, "dst", p.SourceIP.String(), "reason", reason)
+
+	return ep.replyIPv4(f.SrcMAC, reply.marshal())
+}
+
+// checksum computes the internet checksum (RFC 1071). It is used for IPv4
+// header and ICMP messages. Running it over data that already contains a
+// valid checksum returns 0.
+func checksum(data []byte) uint16 {
+	var sum uint32
+	n := len(data)
+
+	for i := 0; i < n-1; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+
+	if n%2 == 1 {
+		sum += uint32(data[n-1]) << 8
+	}
+
+	for (sum >> 16) > 0 {
+		sum = (sum >> 16) + (sum & 0xFFFF)
+	}
+
+	return ^uint16(sum)
+}
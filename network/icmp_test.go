@@ -0,0 +1,132 @@
+package network
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// testICMPError processes frame and returns the ICMP message of the reply,
+// nil if there is none.
+func testICMPError(t *testing.T, stack *Stack, frame []byte) []byte {
+	t.Helper()
+
+	reply, _ := stack.ProcessFrame(frame)
+	if reply == nil {
+		return nil
+	}
+
+	p, err := parseIPv4Packet(reply[14:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Protocol != ICMPProtocol || !p.DestIP.Equal(testHostIP) || !p.SourceIP.Equal(testPeerIP) {
+		t.Fatalf("unexpected reply % x", reply)
+	}
+	if _, err := parseICMP(p); err != nil {
+		t.Fatal(err)
+	}
+	return p.Payload
+}
+
+func TestICMPErrorQuote(t *testing.T) {
+	stack, _ := newTestStack(t)
+
+	udp := (&UDPDatagram{SrcPort: 4000, DstPort: 9, Payload: []byte("a payload longer than 8 bytes")}).marshal(testHostIP, testPeerIP)
+	withOptions := &IPv4Packet{
+		Identification: 0x1234,
+		TTL:            64,
+		Protocol:       UDPProtocol,
+		SourceIP:       testHostIP,
+		DestIP:         testPeerIP,
+		Options:        []byte{148, 4, 0, 0}, // Router Alert
+		Payload:        udp,
+	}
+
+	tests := []struct {
+		name   string
+		packet []byte
+		typ    ICMPType
+		code   uint8
+	}{
+		{"port unreachable", testIPv4(UDPProtocol, udp)[14:], ICMPDestUnreachable, ICMPCodePortUnreachable},
+		{"with options", withOptions.marshal(), ICMPDestUnreachable, ICMPCodePortUnreachable},
+		{"protocol unreachable", testIPv4(99, []byte("unknown protocol data"))[14:], ICMPDestUnreachable, ICMPCodeProtocolUnreachable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			icmp := testICMPError(t, stack, testEthernet(EtherTypeIPv4, tt.packet))
+			if icmp == nil {
+				t.Fatal("no ICMP error")
+			}
+			if icmp[0] != tt.typ || icmp[1] != tt.code {
+				t.Errorf("type %d code %d, want %d and %d", icmp[0], icmp[1], tt.typ, tt.code)
+			}
+
+			// The whole header, with its options, and 8 bytes of data
+			headerLen := int(tt.packet[0]&0x0F) * 4
+			want := tt.packet[:headerLen+8]
+			if !bytes.Equal(icmp[8:], want) {
+				t.Errorf("quote % x\nwant  % x", icmp[8:], want)
+			}
+		})
+	}
+}
+
+func TestICMPErrorAllowed(t *testing.T) {
+	unicast := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	broadcast := net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+	packet := func(src, dst net.IP, proto IPv4Protocol, flags uint16, payload ...byte) *IPv4Packet {
+		return &IPv4Packet{SourceIP: src, DestIP: dst, Protocol: proto, FlagsFragOffset: flags, Payload: payload}
+	}
+	multicast := net.IP{224, 0, 0, 1}
+
+	tests := []struct {
+		name string
+		mac  net.HardwareAddr
+		p    *IPv4Packet
+		want bool
+	}{
+		{"unicast", unicast, packet(testHostIP, testPeerIP, UDPProtocol, 0), true},
+		{"unknown MAC", nil, packet(testHostIP, testPeerIP, UDPProtocol, 0), true},
+		{"link broadcast", broadcast, packet(testHostIP, testPeerIP, UDPProtocol, 0), false},
+		{"IP broadcast", unicast, packet(testHostIP, net.IPv4bcast, UDPProtocol, 0), false},
+		{"IP multicast", unicast, packet(testHostIP, multicast, UDPProtocol, 0), false},
+		{"first fragment", unicast, packet(testHostIP, testPeerIP, UDPProtocol, ipv4FlagMF), true},
+		{"other fragment", unicast, packet(testHostIP, testPeerIP, UDPProtocol, 10), false},
+		{"unspecified source", unicast, packet(net.IPv4zero, testPeerIP, UDPProtocol, 0), false},
+		{"multicast source", unicast, packet(multicast, testPeerIP, UDPProtocol, 0), false},
+		{"echo request", unicast, packet(testHostIP, testPeerIP, ICMPProtocol, 0, ICMPEchoRequest), true},
+		{"ICMP error", unicast, packet(testHostIP, testPeerIP, ICMPProtocol, 0, ICMPDestUnreachable), false},
+	}
+
+	for _, tt := range tests {
+		if got := icmpErrorAllowed(tt.mac, tt.p); got != tt.want {
+			t.Errorf("%s: allowed = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// The peer used as a gateway answers a TTL of 1 with a Time Exceeded.
+func TestICMPTimeExceeded(t *testing.T) {
+	stack, _ := newTestStack(t)
+
+	p := &IPv4Packet{TTL: 1, Protocol: UDPProtocol, SourceIP: testHostIP, DestIP: net.IP{10, 0, 0, 1}, Payload: make([]byte, 8)}
+	packet := p.marshal()
+
+	icmp := testICMPError(t, stack, testEthernet(EtherTypeIPv4, packet))
+	if icmp == nil {
+		t.Fatal("no ICMP error")
+	}
+	if icmp[0] != ICMPTimeExceeded || icmp[1] != ICMPCodeTTLExceeded || !bytes.Equal(icmp[8:], packet[:28]) {
+		t.Errorf("unexpected ICMP % x", icmp)
+	}
+
+	// With a TTL left the packet is only dropped
+	p.TTL = 2
+	if icmp := testICMPError(t, stack, testEthernet(EtherTypeIPv4, p.marshal())); icmp != nil {
+		t.Errorf("ICMP error with a TTL of 2: % x", icmp)
+	}
+}
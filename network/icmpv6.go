@@ -0,0 +1,203 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// +--------------------------------------------------------+
+// | ICMPv6 Header (4 bytes) followed by the message body   |
+// |--------------------------------------------------------|
+// | Type (1) | Code (1) | Checksum (2)                     |
+// +--------------------------------------------------------+
+//
+// Unlike ICMP the checksum also covers the IPv6 pseudo-header.
+//
+// Echo body:                Identifier (2) | Sequence (2) | Data
+// Neighbor Solicitation:    Reserved (4) | Target Address (16) | Options
+// Neighbor Advertisement:   R|S|O flags + Reserved (4) | Target (16) | Options
+// Options:                  Type (1) | Length in units of 8 bytes (1) | Data
+//
+// [RFC 4443] https://datatracker.ietf.org/doc/html/rfc4443
+// [RFC 4861] https://datatracker.ietf.org/doc/html/rfc4861
+type ICMPv6Type = uint8
+
+const (
+	ICMPv6EchoRequest           ICMPv6Type = 128
+	ICMPv6EchoReply             ICMPv6Type = 129
+	ICMPv6RouterSolicitation    ICMPv6Type = 133
+	ICMPv6RouterAdvertisement   ICMPv6Type = 134
+	ICMPv6NeighborSolicitation  ICMPv6Type = 135
+	ICMPv6NeighborAdvertisement ICMPv6Type = 136
+)
+
+// Neighbor Discovery options
+const (
+	ndpOptSourceLLAddr uint8 = 1
+	ndpOptTargetLLAddr uint8 = 2
+)
+
+// Neighbor Advertisement flags
+const (
+	ndpFlagRouter    uint32 = 1 << 31
+	ndpFlagSolicited uint32 = 1 << 30
+	ndpFlagOverride  uint32 = 1 << 29
+)
+
+type ICMPv6Packet struct {
+	Type     ICMPv6Type
+	Code     uint8
+	Checksum uint16
+	Body     []byte
+}
+
+func parseICMPv6(p *IPv6Packet) (*ICMPv6Packet, error) {
+	payload := p.Payload
+
+	if len(payload) < 4 {
+		return nil, fmt.Errorf("ICMPv6 packet too short")
+	}
+
+	m := &ICMPv6Packet{
+		Type:     payload[0],
+		Code:     payload[1],
+		Checksum: binary.BigEndian.Uint16(payload[2:4]),
+		Body:     payload[4:],
+	}
+
+	if cs := pseudoHeaderChecksum6(p.SourceIP, p.DestIP, IPv6ICMP, payload); cs != 0 {
+		return nil, fmt.Errorf("bad ICMPv6 checksum 0x%04X", m.Checksum)
+	}
+
+	return m, nil
+}
+
+// marshal serializes the message, the checksum is computed for the given
+// source and destination.
+func (m *ICMPv6Packet) marshal(src, dst net.IP) []byte {
+	b := make([]byte, 4+len(m.Body))
+	b[0] = m.Type
+	b[1] = m.Code
+	copy(b[4:], m.Body)
+
+	binary.BigEndian.PutUint16(b[2:4], pseudoHeaderChecksum6(src, dst, IPv6ICMP, b))
+	return b
+}
+
+func (s *Stack) handleICMPv6(ep *endpoint, f *EthernetFrame, p *IPv6Packet, ourIPs []net.IP) ([]byte, error) {
+	m, err := parseICMPv6(p)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse ICMPv6 packet: %w", err)
+	}
+
+	switch m.Type {
+	case ICMPv6EchoRequest:
+		if len(m.Body) < 4 {
+			return nil, fmt.Errorf("ICMPv6 echo request too short")
+		}
+
+		// Identifier, sequence number and data are returned unchanged
+		reply := &ICMPv6Packet{Type: ICMPv6EchoReply, Body: m.Body}
+		src := sourceFor(p.DestIP, ourIPs)
+
+		return ep.buildIPv6Frame(f.SrcMAC, src, p.SourceIP, defaultHopLimit, reply), nil
+	case ICMPv6NeighborSolicitation:
+		return s.handleNeighborSolicitation(ep, f, p, m, ourIPs)
+	case ICMPv6NeighborAdvertisement:
+		if target, mac, ok := parseNeighborAdvertisement(p, m); ok {
+			ep.learn(target, mac)
+		}
+		return nil, nil
+	default:
+		return nil, &ToDoWarning{Msg: fmt.Sprintf("handle ICMPv6 type %d", m.Type), EtherType: EtherTypeIPv6}
+	}
+}
+
+func (s *Stack) handleNeighborSolicitation(ep *endpoint, f *EthernetFrame, p *IPv6Packet, m *ICMPv6Packet, ourIPs []net.IP) ([]byte, error) {
+	// RFC 4861 section 7.1.1: hop limit must be 255 so the message was not
+	// forwarded by a router
+	if p.HopLimit != ndpHopLimit || m.Code != 0 || len(m.Body) < 20 {
+		return nil, fmt.Errorf("invalid neighbor solicitation")
+	}
+
+	target := net.IP(m.Body[4:20])
+
+	var ours net.IP
+	for _, ip := range ourIPs {
+		if ip.Equal(target) {
+			ours = ip
+		}
+	}
+	if ours == nil {
+		return nil, fmt.Errorf("neighbor solicitation for %s is not for us", target.String())
+	}
+
+	srcMAC := f.SrcMAC
+	if mac := ndpLinkLayerOption(m.Body[20:], ndpOptSourceLLAddr); mac != nil {
+		srcMAC = mac
+		ep.learn(p.SourceIP, mac)
+	}
+
+	// Duplicate Address Detection uses the unspecified address as source,
+	// the answer is sent to all nodes and is not solicited.
+	flags := ndpFlagOverride | ndpFlagSolicited
+	dst, dstMAC := p.SourceIP, srcMAC
+	if p.SourceIP.IsUnspecified() {
+		flags = ndpFlagOverride
+		dst, dstMAC = ipv6AllNodes, multicastMAC(ipv6AllNodes)
+	}
+
+	body := make([]byte, 20, 28)
+	binary.BigEndian.PutUint32(body[0:4], flags)
+	copy(body[4:20], ours)
+	body = append(body, ndpOptTargetLLAddr, 1)
+	body = append(body, ep.mac...)
+
+	na := &ICMPv6Packet{Type: ICMPv6NeighborAdvertisement, Body: body}
+	return ep.buildIPv6Frame(dstMAC, ours, dst, ndpHopLimit, na), nil
+}
+
+func parseNeighborAdvertisement(p *IPv6Packet, m *ICMPv6Packet) (net.IP, net.HardwareAddr, bool) {
+	if p.HopLimit != ndpHopLimit || len(m.Body) < 20 {
+		return nil, nil, false
+	}
+
+	mac := ndpLinkLayerOption(m.Body[20:], ndpOptTargetLLAddr)
+	if mac == nil {
+		return nil, nil, false
+	}
+
+	return net.IP(m.Body[4:20]), mac, true
+}
+
+// ndpLinkLayerOption returns the Ethernet address of the first option of the
+// given type.
+func ndpLinkLayerOption(opts []byte, typ uint8) net.HardwareAddr {
+	for len(opts) >= 2 {
+		l := int(opts[1]) * 8
+		if l == 0 || l > len(opts) {
+			return nil
+		}
+
+		if opts[0] == typ && l >= 8 {
+			return net.HardwareAddr(opts[2:8])
+		}
+
+		opts = opts[l:]
+	}
+
+	return nil
+}
+
+func (ep *endpoint) buildIPv6Frame(dstMAC net.HardwareAddr, src, dst net.IP, hopLimit uint8, m *ICMPv6Packet) []byte {
+	p := &IPv6Packet{
+		HopLimit: hopLimit,
+		Protocol: IPv6ICMP,
+		SourceIP: src,
+		DestIP:   dst,
+		Payload:  m.marshal(src, dst),
+	}
+
+	return ep.frame(dstMAC, EtherTypeIPv6, p.marshal())
+}
@@ -0,0 +1,511 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ImpairDirection selects the frames received (in) or sent (out) by the stack.
+type ImpairDirection int
+
+const (
+	ImpairBoth ImpairDirection = iota
+	ImpairInbound
+	ImpairOutbound
+)
+
+func (d ImpairDirection) String() string {
+	switch d {
+	case ImpairInbound:
+		return "in"
+	case ImpairOutbound:
+		return "out"
+	default:
+		return "both"
+	}
+}
+
+// A reordered frame is released after the next frame or after this delay if
+// no frame follows.
+const impairReorderHold = 100 * time.Millisecond
+
+// ImpairRule selects frames by direction, EtherType and IP protocol and gives
+// the probability of each impairment. Zero values match everything and
+// impair nothing.
+type ImpairRule struct {
+	Direction ImpairDirection
+	EtherType EtherType    // 0 for any
+	Protocol  IPv4Protocol // IPv4 protocol or IPv6 next header, 0 for any
+
+	Drop      float64
+	Duplicate float64
+	Reorder   float64
+	Truncate  float64 // The frame is cut at a random length
+	BitFlip   float64 // One random bit is flipped
+	Delay     time.Duration
+	Jitter    time.Duration // Random extra delay up to Jitter
+}
+
+func (r *ImpairRule) matches(dir ImpairDirection, frame []byte) bool {
+	if r.Direction != ImpairBoth && r.Direction != dir {
+		return false
+	}
+
+	et, proto, ok := impairFrameTypes(frame)
+	if !ok {
+		return r.EtherType == 0 && r.Protocol == 0
+	}
+
+	if r.EtherType != 0 && r.EtherType != et {
+		return false
+	}
+
+	return r.Protocol == 0 || r.Protocol == proto
+}
+
+// impairFrameTypes returns the EtherType (after VLAN tags) and the IP protocol
+// of the frame. The protocol is 0 for non IP frames.
+func impairFrameTypes(frame []byte) (EtherType, IPv4Protocol, bool) {
+	if len(frame) < 14 {
+		return 0, 0, false
+	}
+
+	off := 12
+	et := EtherType(binary.BigEndian.Uint16(frame[off:]))
+	for isVLANTPID(et) && len(frame) >= off+6 {
+		off += 4
+		et = EtherType(binary.BigEndian.Uint16(frame[off:]))
+	}
+	payload := frame[off+2:]
+
+	switch {
+	case et == EtherTypeIPv4 && len(payload) >= 20:
+		return et, payload[9], true
+	case et == EtherTypeIPv6 && len(payload) >= 40:
+		return et, payload[6], true
+	default:
+		return et, 0, true
+	}
+}
+
+// ParseImpairRule reads a rule from a comma separated list of key=value:
+//
+//	dir=in|out|both  ethertype=arp|ipv4|ipv6|0x88b5  proto=icmp|tcp|udp|icmpv6|17
+//	drop=0.1 dup=0.1 reorder=0.1 truncate=0.1 flip=0.1 delay=50ms jitter=10ms
+func ParseImpairRule(s string) (ImpairRule, error) {
+	var r ImpairRule
+
+	for _, kv := range strings.Split(s, ",") {
+		key, value, found := strings.Cut(strings.TrimSpace(kv), "=")
+		if !found {
+			return r, fmt.Errorf("invalid impairment %q, expecting key=value", kv)
+		}
+
+		var err error
+		switch key {
+		case "dir":
+			switch value {
+			case "in":
+				r.Direction = ImpairInbound
+			case "out":
+				r.Direction = ImpairOutbound
+			case "both":
+				r.Direction = ImpairBoth
+			default:
+				err = fmt.Errorf("expecting in, out or both")
+			}
+		case "ethertype":
+			r.EtherType, err = parseEtherTypeName(value)
+		case "proto":
+			r.Protocol, err = parseProtocolName(value)
+		case "drop":
+			r.Drop, err = parseProbability(value)
+		case "dup":
+			r.Duplicate, err = parseProbability(value)
+		case "reorder":
+			r.Reorder, err = parseProbability(value)
+		case "truncate":
+			r.Truncate, err = parseProbability(value)
+		case "flip":
+			r.BitFlip, err = parseProbability(value)
+		case "delay":
+			r.Delay, err = time.ParseDuration(value)
+		case "jitter":
+			r.Jitter, err = time.ParseDuration(value)
+		default:
+			err = fmt.Errorf("unknown key")
+		}
+
+		if err != nil {
+			return r, fmt.Errorf("invalid impairment %q: %w", kv, err)
+		}
+	}
+
+	return r, nil
+}
+
+func parseEtherTypeName(s string) (EtherType, error) {
+	switch strings.ToLower(s) {
+	case "arp":
+		return EtherTypeARP, nil
+	case "ipv4":
+		return EtherTypeIPv4, nil
+	case "ipv6":
+		return EtherTypeIPv6, nil
+	}
+
+	v, err := strconv.ParseUint(s, 0, 16)
+	if err != nil {
+		return 0, fmt.Errorf("expecting arp, ipv4, ipv6 or a number")
+	}
+	return EtherType(v), nil
+}
+
+func parseProtocolName(s string) (IPv4Protocol, error) {
+	switch strings.ToLower(s) {
+	case "icmp":
+		return ICMPProtocol, nil
+	case "tcp":
+		return TCPProtocol, nil
+	case "udp":
+		return UDPProtocol, nil
+	case "icmpv6":
+		return IPv6ICMP, nil
+	}
+
+	v, err := strconv.ParseUint(s, 0, 8)
+	if err != nil {
+		return 0, fmt.Errorf("expecting icmp, tcp, udp, icmpv6 or a number")
+	}
+	return IPv4Protocol(v), nil
+}
+
+func parseProbability(s string) (float64, error) {
+	p, err := strconv.ParseFloat(s, 64)
+	if err != nil || p < 0 || p > 1 {
+		return 0, fmt.Errorf("expecting a probability between 0 and 1")
+	}
+	return p, nil
+}
+
+// ------------------------------------------------------------------------------
+// Link
+
+type impairedFrame struct {
+	at   time.Time
+	data []byte
+}
+
+// ImpairedLink wraps a link to misbehave on purpose. Each frame is matched
+// against the rules in order and the first matching rule decides what
+// happens to it: it can be dropped, delayed, duplicated, reordered (held
+// until the next frame in the same direction goes through), truncated or get
+// a flipped bit.
+//
+// Random decisions use a seeded generator so a run can be reproduced with the
+// same seed and the same traffic.
+//
+// Close drops the frames that are still delayed or held but does not close
+// the wrapped link.
+type ImpairedLink struct {
+	Link
+	rules  []ImpairRule
+	logger *slog.Logger
+
+	mu  sync.Mutex
+	rng *rand.Rand
+
+	// Inbound frames waiting to be read, sorted by time
+	inbound []impairedFrame
+	// Reordered frames waiting for the next frame of their direction
+	heldIn  [][]byte
+	heldOut [][]byte
+
+	// Pending delayed and reordered writes, stopped by Close
+	timers map[*time.Timer]struct{}
+	closed bool
+}
+
+func NewImpairedLink(logger *slog.Logger, link Link, seed uint64, rules []ImpairRule) *ImpairedLink {
+	return &ImpairedLink{
+		Link:   link,
+		rules:  rules,
+		logger: logger,
+		rng:    rand.New(rand.NewPCG(seed, seed)),
+		timers: make(map[*time.Timer]struct{}),
+	}
+}
+
+// Close stops the pending writes and drops the frames that were not
+// delivered yet. Reads and writes then return ErrLinkClosed.
+func (l *ImpairedLink) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for t := range l.timers {
+		t.Stop()
+	}
+	l.timers = nil
+	l.inbound = nil
+	l.heldIn = nil
+	l.heldOut = nil
+	l.closed = true
+
+	return nil
+}
+
+// afterFunc calls f after d unless the link is closed before. It must be
+// called with mu held.
+func (l *ImpairedLink) afterFunc(d time.Duration, f func()) {
+	if l.closed {
+		return
+	}
+
+	var t *time.Timer
+	t = time.AfterFunc(d, func() {
+		l.mu.Lock()
+		_, pending := l.timers[t]
+		delete(l.timers, t)
+		l.mu.Unlock()
+
+		if pending {
+			f()
+		}
+	})
+	l.timers[t] = struct{}{}
+}
+
+// impair applies the first matching rule to frame. It returns the copies of
+// the frame to deliver with their delay, none if the frame is dropped, and
+// whether the copies must be held for reordering instead (their delay is
+// ignored then).
+func (l *ImpairedLink) impair(dir ImpairDirection, frame []byte) (copies []impairedFrame, held bool) {
+	now := time.Now()
+
+	var rule *ImpairRule
+	for i := range l.rules {
+		if l.rules[i].matches(dir, frame) {
+			rule = &l.rules[i]
+			break
+		}
+	}
+	if rule == nil {
+		return []impairedFrame{{at: now, data: frame}}, false
+	}
+
+	// All the values are drawn for each frame so decisions do not shift
+	// when a probability changes
+	drop := l.rng.Float64() < rule.Drop
+	dup := l.rng.Float64() < rule.Duplicate
+	reorder := l.rng.Float64() < rule.Reorder
+	truncate := l.rng.Float64() < rule.Truncate
+	flip := l.rng.Float64() < rule.BitFlip
+	jitter := time.Duration(l.rng.Int64N(int64(rule.Jitter) + 1))
+	truncLen := l.rng.IntN(len(frame) + 1)
+	flipBit := l.rng.IntN(len(frame)*8 + 1)
+
+	if drop {
+		l.logger.Debug("impair: frame dropped", "dir", dir.String(), "bytes", len(frame))
+		return nil, false
+	}
+
+	if truncate && truncLen < len(frame) {
+		l.logger.Debug("impair: frame truncated", "dir", dir.String(), "bytes", len(frame), "to", truncLen)
+		frame = frame[:truncLen]
+	}
+
+	if flip && flipBit < len(frame)*8 {
+		l.logger.Debug("impair: bit flipped", "dir", dir.String(), "bit", flipBit)
+		frame[flipBit/8] ^= 1 << (flipBit % 8)
+	}
+
+	at := now.Add(rule.Delay + jitter)
+	copies = []impairedFrame{{at: at, data: frame}}
+
+	if dup {
+		l.logger.Debug("impair: frame duplicated", "dir", dir.String())
+		copies = append(copies, impairedFrame{at: at, data: append([]byte(nil), frame...)})
+	}
+
+	if reorder {
+		l.logger.Debug("impair: frame reordered", "dir", dir.String())
+	}
+
+	return copies, reorder
+}
+
+// WriteFrame sends the frame according to the outbound rules. Delayed frames
+// are sent in the background and their errors are only logged.
+func (l *ImpairedLink) WriteFrame(frame []byte) error {
+	frame = append([]byte(nil), frame...)
+
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return ErrLinkClosed
+	}
+
+	copies, held := l.impair(ImpairOutbound, frame)
+	if held {
+		for _, c := range copies {
+			l.heldOut = append(l.heldOut, c.data)
+		}
+		l.afterFunc(impairReorderHold, l.releaseOut)
+		l.mu.Unlock()
+		return nil
+	}
+	l.mu.Unlock()
+
+	for _, c := range copies {
+		if err := l.writeAt(c); err != nil {
+			return err
+		}
+	}
+
+	if len(copies) > 0 {
+		l.releaseOut()
+	}
+
+	return nil
+}
+
+func (l *ImpairedLink) writeAt(f impairedFrame) error {
+	wait := time.Until(f.at)
+	if wait <= 0 {
+		return l.Link.WriteFrame(f.data)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.afterFunc(wait, func() {
+		if err := l.Link.WriteFrame(f.data); err != nil {
+			l.logger.Error("impair: failed to send delayed frame", "err", err)
+		}
+	})
+	return nil
+}
+
+// releaseOut sends the frames held for reordering.
+func (l *ImpairedLink) releaseOut() {
+	l.mu.Lock()
+	held := l.heldOut
+	l.heldOut = nil
+	l.mu.Unlock()
+
+	for _, frame := range held {
+		if err := l.Link.WriteFrame(frame); err != nil {
+			l.logger.Error("impair: failed to send reordered frame", "err", err)
+		}
+	}
+}
+
+// ReadFrame returns the next frame according to the inbound rules.
+func (l *ImpairedLink) ReadFrame(buf []byte, timeout time.Duration) (int, error) {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		n, ok, err := l.nextInbound(buf)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			return n, nil
+		}
+
+		now := time.Now()
+		wait := deadline.Sub(now)
+		if next, ok := l.nextInboundTime(); ok && next.Sub(now) < wait {
+			wait = next.Sub(now)
+		}
+		if wait <= 0 {
+			if !now.Before(deadline) {
+				return 0, ErrLinkTimeout
+			}
+			continue
+		}
+
+		n, err = l.Link.ReadFrame(buf, wait)
+		if err == ErrLinkTimeout {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		frame := append([]byte(nil), buf[:n]...)
+
+		l.mu.Lock()
+		if l.closed {
+			l.mu.Unlock()
+			return 0, ErrLinkClosed
+		}
+		copies, held := l.impair(ImpairInbound, frame)
+		if held {
+			for _, c := range copies {
+				l.heldIn = append(l.heldIn, c.data)
+			}
+			l.inbound = append(l.inbound, impairedFrame{at: time.Now().Add(impairReorderHold)})
+		} else {
+			l.inbound = append(l.inbound, copies...)
+			if len(copies) > 0 {
+				// The held frames go right after this one
+				for _, h := range l.heldIn {
+					l.inbound = append(l.inbound, impairedFrame{at: copies[len(copies)-1].at, data: h})
+				}
+				l.heldIn = nil
+			}
+		}
+		sort.SliceStable(l.inbound, func(i, j int) bool { return l.inbound[i].at.Before(l.inbound[j].at) })
+		l.mu.Unlock()
+	}
+}
+
+// nextInbound copies the first due frame into buf. Empty entries are the
+// timeouts of held frames.
+func (l *ImpairedLink) nextInbound(buf []byte) (int, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return 0, false, ErrLinkClosed
+	}
+
+	now := time.Now()
+	for len(l.inbound) > 0 && !l.inbound[0].at.After(now) {
+		f := l.inbound[0]
+		l.inbound = l.inbound[1:]
+
+		if f.data == nil {
+			// Nothing came after the held frames
+			var released []impairedFrame
+			for _, h := range l.heldIn {
+				released = append(released, impairedFrame{at: now, data: h})
+			}
+			l.inbound = append(released, l.inbound...)
+			l.heldIn = nil
+			continue
+		}
+
+		return copy(buf, f.data), true, nil
+	}
+
+	return 0, false, nil
+}
+
+func (l *ImpairedLink) nextInboundTime() (time.Time, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.inbound) == 0 {
+		return time.Time{}, false
+	}
+	return l.inbound[0].at, true
+}
@@ -0,0 +1,169 @@
+package network
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestParseImpairRule(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    ImpairRule
+		wantErr bool
+	}{
+		{"drop=0.1", ImpairRule{Drop: 0.1}, false},
+		{"dir=out, proto=udp, dup=1", ImpairRule{Direction: ImpairOutbound, Protocol: UDPProtocol, Duplicate: 1}, false},
+		{"ethertype=0x88b5,delay=50ms,jitter=10ms", ImpairRule{EtherType: 0x88b5, Delay: 50 * time.Millisecond, Jitter: 10 * time.Millisecond}, false},
+		{"ethertype=ipv6,proto=58,reorder=0.5,truncate=0.2,flip=0.3", ImpairRule{EtherType: EtherTypeIPv6, Protocol: 58, Reorder: 0.5, Truncate: 0.2, BitFlip: 0.3}, false},
+		{"drop", ImpairRule{}, true},
+		{"drop=1.5", ImpairRule{}, true},
+		{"dir=up", ImpairRule{}, true},
+		{"proto=sctp", ImpairRule{}, true},
+		{"delay=soon", ImpairRule{}, true},
+		{"color=red", ImpairRule{}, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseImpairRule(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%q parsed as %+v", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%q parsed as %+v, %v, want %+v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestImpairRuleMatches(t *testing.T) {
+	udp := testIPv4(UDPProtocol, make([]byte, 8))
+	arp := testEthernet(EtherTypeARP, make([]byte, 28))
+	// 802.1Q tag of VLAN 10 after the MAC addresses
+	tagged := append(append(udp[:12:12], 0x81, 0x00, 0x00, 0x0a), udp[12:]...)
+
+	tests := []struct {
+		rule  ImpairRule
+		dir   ImpairDirection
+		frame []byte
+		want  bool
+	}{
+		{ImpairRule{}, ImpairInbound, arp, true},
+		{ImpairRule{Direction: ImpairOutbound}, ImpairInbound, udp, false},
+		{ImpairRule{EtherType: EtherTypeARP}, ImpairOutbound, arp, true},
+		{ImpairRule{EtherType: EtherTypeARP}, ImpairOutbound, udp, false},
+		{ImpairRule{Protocol: UDPProtocol}, ImpairInbound, udp, true},
+		{ImpairRule{Protocol: UDPProtocol}, ImpairInbound, tagged, true},
+		{ImpairRule{Protocol: TCPProtocol}, ImpairInbound, udp, false},
+		{ImpairRule{Protocol: UDPProtocol}, ImpairInbound, []byte{1, 2}, false},
+	}
+
+	for i, tt := range tests {
+		if got := tt.rule.matches(tt.dir, tt.frame); got != tt.want {
+			t.Errorf("test %d: matches = %v, want %v", i, got, tt.want)
+		}
+	}
+}
+
+// impairTestRun writes frames through an impaired pipe and returns what comes
+// out of the other end.
+func impairTestRun(t *testing.T, seed uint64) [][]byte {
+	t.Helper()
+
+	a, b := NewPipe(PipeConf{}, PipeConf{})
+	defer a.Close()
+
+	rules := []ImpairRule{{Drop: 0.2, Duplicate: 0.2, Truncate: 0.2, BitFlip: 0.2}}
+	l := NewImpairedLink(slog.New(slog.DiscardHandler), a, seed, rules)
+
+	for i := range 30 {
+		if err := l.WriteFrame(testEthernet(0x88b5, []byte(fmt.Sprintf("frame %02d", i)))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var out [][]byte
+	buf := make([]byte, 1500)
+	for {
+		n, err := b.ReadFrame(buf, 10*time.Millisecond)
+		if err != nil {
+			return out
+		}
+		out = append(out, append([]byte(nil), buf[:n]...))
+	}
+}
+
+func TestImpairDeterministic(t *testing.T) {
+	first := impairTestRun(t, 42)
+	second := impairTestRun(t, 42)
+	other := impairTestRun(t, 43)
+
+	same := func(a, b [][]byte) bool {
+		if len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !bytes.Equal(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	}
+
+	if !same(first, second) {
+		t.Error("two runs with the same seed differ")
+	}
+	if same(first, other) {
+		t.Error("two runs with different seeds are the same")
+	}
+
+	// With these probabilities 30 frames are not all delivered intact
+	intact := 0
+	for _, f := range first {
+		if len(f) == 14+8 {
+			intact++
+		}
+	}
+	if len(first) == 30 && intact == 30 {
+		t.Error("no frame impaired")
+	}
+}
+
+// Frames delayed or held for reordering are dropped by Close.
+func TestImpairedLinkClose(t *testing.T) {
+	a, b := NewPipe(PipeConf{}, PipeConf{})
+	defer a.Close()
+
+	rules := []ImpairRule{
+		{EtherType: EtherTypeARP, Reorder: 1},
+		{Delay: 20 * time.Millisecond},
+	}
+	l := NewImpairedLink(slog.New(slog.DiscardHandler), a, 1, rules)
+
+	// The held frame would be released by the next one, so it goes last
+	if err := l.WriteFrame(testEthernet(0x88b5, []byte("delayed"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.WriteFrame(testEthernet(EtherTypeARP, make([]byte, 28))); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1500)
+	if n, err := b.ReadFrame(buf, impairReorderHold+50*time.Millisecond); err != ErrLinkTimeout {
+		t.Errorf("received %d bytes after Close, %v", n, err)
+	}
+
+	if err := l.WriteFrame(testEthernet(0x88b5, []byte("late"))); err != ErrLinkClosed {
+		t.Errorf("write after Close: %v", err)
+	}
+	if _, err := l.ReadFrame(buf, time.Millisecond); err != ErrLinkClosed {
+		t.Errorf("read after Close: %v", err)
+	}
+}
@@ -1,7 +1,9 @@
 package network
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
 )
@@ -77,12 +79,65 @@ type IPv4Packet struct {
 	Payload []byte
 }
 
-func handleIPv4(peerIP net.IP, payload []byte) ([]byte, error) {
-	p, err := parseIPv4Packet(payload)
+// Default TTL used for packets we are sending
+const defaultTTL = 64
+
+func (s *Stack) handleIPv4(eps []*endpoint, f *EthernetFrame) ([]byte, error) {
+	p, err := parseIPv4Packet(f.Payload)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse IPv4 packet: %w", err)
 	}
 
+	ep := endpointOwning(eps, p.DestIP)
+
+	// Broadcast is only meaningful for UDP (DHCP...)
+	broadcast := p.DestIP.Equal(net.IPv4bcast) && p.Protocol == UDPProtocol
+	ours := ep.owns(p.DestIP) || broadcast
+
+	if err := checkIPv4Header(f.Payload, p); err != nil {
+		if s.ipv4Validation == IPv4Strict {
+			err = fmt.Errorf("invalid IPv4 header: %w", err)
+
+			// The first problem is reported. The checksum is checked first
+			// as a header with a bad one cannot be trusted, it is silently
+			// discarded (RFC 1812 5.2.2).
+			var hdrErr *IPv4HeaderError
+			if ours && errors.As(err, &hdrErr) && hdrErr.Offset != 10 {
+				return ep.icmpError(f, p, ICMPParameterProblem, 0, uint8(hdrErr.Offset), err)
+			}
+			return nil, err
+		}
+		s.logger.Warn("invalid IPv4 header accepted", "src", p.SourceIP.String(), "err", err)
+	}
+
+	if !ours {
+		err := fmt.Errorf("IP %s is not ours", p.DestIP.String())
+
+		// We are used as a gateway but the packet cannot go further
+		for _, gw := range eps {
+			if p.TTL <= 1 && bytes.Equal(f.DestMAC, gw.mac) {
+				return gw.icmpError(f, p, ICMPTimeExceeded, ICMPCodeTTLExceeded, 0, err)
+			}
+		}
+		return nil, err
+	}
+
+	if len(p.Options) > 0 {
+		if opts, err := p.ParsedOptions(); err == nil {
+			s.logger.Debug("IPv4 options", "src", p.SourceIP.String(), "options", fmt.Sprint(opts))
+		}
+	}
+
+	// The sender talks to us directly so its MAC is the source of the frame
+	ep.learn(p.SourceIP, f.SrcMAC)
+
+	if p.IsFragment() {
+		p, err = s.reassemble(ep, p)
+		if err != nil || p == nil {
+			return nil, err
+		}
+	}
+
 	switch p.Protocol {
 	case ICMPProtocol:
 		icmp, err := parseICMP(p)
@@ -94,9 +149,22 @@ func handleIPv4(peerIP net.IP, payload []byte) ([]byte, error) {
 			return nil, fmt.Errorf("only ICMP Echo request are handled")
 		}
 
-		return nil, fmt.Errorf("todo: handle ICMP echo request")
+		reply := &IPv4Packet{
+			Identification: p.Identification,
+			TTL:            defaultTTL,
+			Protocol:       ICMPProtocol,
+			SourceIP:       p.DestIP,
+			DestIP:         p.SourceIP,
+			Payload:        icmp.echoReply().marshal(),
+		}
+
+		return ep.replyIPv4(f.SrcMAC, reply.marshal())
+	case UDPProtocol:
+		return s.handleUDP(ep, f, p)
+	case TCPProtocol:
+		return s.handleTCP(ep, p)
 	default:
-		return nil, fmt.Errorf("only ICMP protocol is managed currently")
+		return s.handleIPv4Protocol(ep, f, p)
 	}
 }
 
@@ -138,14 +206,165 @@ func parseIPv4Packet(payload []byte) (*IPv4Packet, error) {
 		copy(p.Options, payload[20:headerLen])
 	}
 
-	// Extract payload
-	if len(payload) > headerLen {
-		p.Payload = payload[headerLen:]
+	// Extract payload, bytes after Total Length are Ethernet padding. A
+	// Total Length that does not fit is reported by checkIPv4Header.
+	end := len(payload)
+	if int(p.TotalLength) >= headerLen && int(p.TotalLength) <= end {
+		end = int(p.TotalLength)
+	}
+	if end > headerLen {
+		p.Payload = payload[headerLen:end]
 	}
 
 	return p, nil
 }
 
+// IPv4Validation tells what the stack does with IPv4 headers that can be
+// parsed but are not valid.
+type IPv4Validation int
+
+const (
+	IPv4Strict  IPv4Validation = iota // Drop the packet (default)
+	IPv4Lenient                       // Log the problems and handle the packet anyway
+)
+
+func ParseIPv4Validation(s string) (IPv4Validation, error) {
+	switch s {
+	case "strict":
+		return IPv4Strict, nil
+	case "lenient":
+		return IPv4Lenient, nil
+	default:
+		return 0, fmt.Errorf("unknown IPv4 validation %q, expecting strict or lenient", s)
+	}
+}
+
+// SetIPv4Validation sets what is done with invalid IPv4 headers.
+func (s *Stack) SetIPv4Validation(v IPv4Validation) {
+	s.ipv4Validation = v
+}
+
+// IPv4HeaderError is a problem found in an IPv4 header. Offset is the byte
+// at fault from the start of the header, as the pointer of an ICMP Parameter
+// Problem.
+type IPv4HeaderError struct {
+	Offset int
+	Reason string
+}
+
+func (e *IPv4HeaderError) Error() string {
+	return e.Reason
+}
+
+// checkIPv4Header returns the problems of the header of packet, p is the
+// result of its parsing. Errors are *IPv4HeaderError joined together.
+func checkIPv4Header(packet []byte, p *IPv4Packet) error {
+	var errs []error
+	report := func(offset int, format string, a ...any) {
+		errs = append(errs, &IPv4HeaderError{Offset: offset, Reason: fmt.Sprintf(format, a...)})
+	}
+
+	// Header checksum only covers the header
+	headerLen := int(p.IHL()) * 4
+	if cs := checksum(packet[:headerLen]); cs != 0 {
+		report(10, "bad header checksum 0x%04X", p.HeaderChecksum)
+	}
+
+	if int(p.TotalLength) < headerLen || int(p.TotalLength) > len(packet) {
+		report(2, "total length %d does not fit in %d bytes", p.TotalLength, len(packet))
+	}
+
+	if p.FlagsFragOffset&0x8000 != 0 {
+		report(6, "reserved flag is set")
+	}
+
+	// A packet with a TTL of 0 should not have been sent (RFC 1122 3.2.1.7)
+	if p.TTL == 0 {
+		report(8, "TTL is 0")
+	}
+
+	if p.SourceIP.IsMulticast() || p.SourceIP.Equal(net.IPv4bcast) {
+		report(12, "invalid source address %s", p.SourceIP)
+	}
+
+	if _, err := parseIPv4Options(p.Options); err != nil {
+		var optErr *IPv4OptionError
+		if errors.As(err, &optErr) {
+			report(20+optErr.Offset, "%s", optErr.Error())
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// header serializes the header with its fields as they are, without
+// computing anything.
+func (p *IPv4Packet) header() []byte {
+	b := make([]byte, 20+len(p.Options))
+
+	b[0] = p.VersionIHL
+	b[1] = p.DSCPECN
+	binary.BigEndian.PutUint16(b[2:4], p.TotalLength)
+	binary.BigEndian.PutUint16(b[4:6], p.Identification)
+	binary.BigEndian.PutUint16(b[6:8], p.FlagsFragOffset)
+	b[8] = p.TTL
+	b[9] = p.Protocol
+	binary.BigEndian.PutUint16(b[10:12], p.HeaderChecksum)
+	copy(b[12:16], p.SourceIP.To4())
+	copy(b[16:20], p.DestIP.To4())
+	copy(b[20:], p.Options)
+
+	return b
+}
+
+// quote returns the header and the first 8 bytes of data of a received
+// packet, as quoted by ICMP errors.
+func (p *IPv4Packet) quote() []byte {
+	return append(p.header(), p.Payload[:min(8, len(p.Payload))]...)
+}
+
+// ParsedOptions decodes the options of the header.
+func (p *IPv4Packet) ParsedOptions() ([]IPv4Option, error) {
+	return parseIPv4Options(p.Options)
+}
+
+// marshal serializes the packet. Version/IHL, TotalLength and HeaderChecksum
+// are computed from the content so they are ignored.
+func (p *IPv4Packet) marshal() []byte {
+	headerLen := 20 + len(p.Options)
+	b := make([]byte, headerLen+len(p.Payload))
+
+	b[0] = 0x40 | uint8(headerLen/4)
+	b[1] = p.DSCPECN
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+	binary.BigEndian.PutUint16(b[4:6], p.Identification)
+	binary.BigEndian.PutUint16(b[6:8], p.FlagsFragOffset)
+	b[8] = p.TTL
+	b[9] = byte(p.Protocol)
+	copy(b[12:16], p.SourceIP.To4())
+	copy(b[16:20], p.DestIP.To4())
+	copy(b[20:headerLen], p.Options)
+	copy(b[headerLen:], p.Payload)
+
+	binary.BigEndian.PutUint16(b[10:12], checksum(b[:headerLen]))
+
+	return b
+}
+
+// pseudoHeaderChecksum4 computes the checksum of an upper layer message (UDP,
+// TCP) including the IPv4 pseudo-header: source, destination, zero, protocol
+// and upper layer length.
+func pseudoHeaderChecksum4(src, dst net.IP, proto IPv4Protocol, data []byte) uint16 {
+	b := make([]byte, 12+len(data))
+	copy(b[0:4], src.To4())
+	copy(b[4:8], dst.To4())
+	b[9] = proto
+	binary.BigEndian.PutUint16(b[10:12], uint16(len(data)))
+	copy(b[12:], data)
+
+	return checksum(b)
+}
+
 // ------------------------------------------------------------------------------
 // Accessor methods for packed fields
 func (p *IPv4Packet) Version() uint8 {
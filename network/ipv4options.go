@@ -0,0 +1,227 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// +--------------------------------------------------------+
+// | IPv4 Option (after the 20 bytes of the fixed header)   |
+// |--------------------------------------------------------|
+// | Type (1) | Length (1) | Data (Length - 2)              |
+// +--------------------------------------------------------+
+//
+// Type is Copied (1 bit) | Class (2 bits) | Number (5 bits). End of Option
+// List and No Operation are a single byte without length.
+//
+// Record Route:  Pointer (1) | Route data (4 bytes per address)
+// Timestamp:     Pointer (1) | Overflow (4 bits) | Flag (4 bits) | Entries
+// Router Alert:  Value (2), 0 means "examine packet"
+//
+// The pointer is the offset (from the start of the option, starting at 1) of
+// the next free slot.
+//
+// [RFC 791]  https://datatracker.ietf.org/doc/html/rfc791#section-3.1
+// [RFC 2113] https://datatracker.ietf.org/doc/html/rfc2113
+type IPv4OptionType uint8
+
+const (
+	IPv4OptionEnd         IPv4OptionType = 0
+	IPv4OptionNOP         IPv4OptionType = 1
+	IPv4OptionRecordRoute IPv4OptionType = 7
+	IPv4OptionTimestamp   IPv4OptionType = 68
+	IPv4OptionRouterAlert IPv4OptionType = 148
+)
+
+func (t IPv4OptionType) String() string {
+	switch t {
+	case IPv4OptionEnd:
+		return "End of Option List"
+	case IPv4OptionNOP:
+		return "No Operation"
+	case IPv4OptionRecordRoute:
+		return "Record Route"
+	case IPv4OptionTimestamp:
+		return "Timestamp"
+	case IPv4OptionRouterAlert:
+		return "Router Alert"
+	default:
+		return fmt.Sprintf("Option %d", uint8(t))
+	}
+}
+
+// Copied tells if the option must be repeated in every fragment.
+func (t IPv4OptionType) Copied() bool {
+	return t&0x80 != 0
+}
+
+// IPv4Option is an option of the IPv4 header. The fields after Data are only
+// set for the options we decode.
+type IPv4Option struct {
+	Type   IPv4OptionType
+	Offset int    // From the start of the options
+	Data   []byte // Without type and length
+
+	Route       []net.IP       // Record Route: the recorded addresses
+	Timestamp   *IPv4Timestamp // Timestamp
+	RouterAlert uint16         // Router Alert
+}
+
+type IPv4Timestamp struct {
+	Overflow uint8 // Number of hosts that could not record their timestamp
+	Flag     uint8 // 0: timestamps only, 1: address and timestamp, 3: prespecified addresses
+	Entries  []IPv4TimestampEntry
+}
+
+type IPv4TimestampEntry struct {
+	IP   net.IP // nil when Flag is 0
+	Time uint32 // Milliseconds since midnight UT
+}
+
+func (o IPv4Option) String() string {
+	switch {
+	case o.Type == IPv4OptionRecordRoute:
+		return fmt.Sprintf("%s %v", o.Type.String(), o.Route)
+	case o.Type == IPv4OptionTimestamp:
+		s := fmt.Sprintf("%s flag=%d overflow=%d", o.Type.String(), o.Timestamp.Flag, o.Timestamp.Overflow)
+		for _, e := range o.Timestamp.Entries {
+			if e.IP != nil {
+				s += fmt.Sprintf(" %s", e.IP)
+			}
+			s += fmt.Sprintf(" %dms", e.Time)
+		}
+		return s
+	case o.Type == IPv4OptionRouterAlert:
+		return fmt.Sprintf("%s %d", o.Type.String(), o.RouterAlert)
+	case len(o.Data) > 0:
+		return fmt.Sprintf("%s % x", o.Type.String(), o.Data)
+	default:
+		return o.Type.String()
+	}
+}
+
+// IPv4OptionError is a malformed option, Offset is from the start of the
+// options.
+type IPv4OptionError struct {
+	Offset int
+	Reason string
+}
+
+func (e *IPv4OptionError) Error() string {
+	return fmt.Sprintf("option at offset %d: %s", e.Offset, e.Reason)
+}
+
+// parseIPv4Options decodes the options of a header. No Operation and End of
+// Option List are not returned.
+func parseIPv4Options(b []byte) ([]IPv4Option, error) {
+	var opts []IPv4Option
+
+	for i := 0; i < len(b); {
+		typ := IPv4OptionType(b[i])
+		if typ == IPv4OptionEnd {
+			break
+		}
+		if typ == IPv4OptionNOP {
+			i++
+			continue
+		}
+
+		if i+1 >= len(b) {
+			return opts, &IPv4OptionError{Offset: i, Reason: "missing length"}
+		}
+		length := int(b[i+1])
+		if length < 2 || i+length > len(b) {
+			return opts, &IPv4OptionError{Offset: i + 1, Reason: fmt.Sprintf("invalid length %d", length)}
+		}
+
+		o := IPv4Option{Type: typ, Offset: i, Data: b[i+2 : i+length]}
+		if err := o.decode(); err != nil {
+			err.Offset += i
+			return opts, err
+		}
+
+		opts = append(opts, o)
+		i += length
+	}
+
+	return opts, nil
+}
+
+// decode fills the fields of the options we know. The offset of the error is
+// from the start of the option.
+func (o *IPv4Option) decode() *IPv4OptionError {
+	length := len(o.Data) + 2
+
+	switch o.Type {
+	case IPv4OptionRecordRoute:
+		if length < 3 || (length-3)%4 != 0 {
+			return &IPv4OptionError{Offset: 1, Reason: fmt.Sprintf("invalid Record Route length %d", length)}
+		}
+		ptr := int(o.Data[0])
+		if ptr < 4 || (ptr-4)%4 != 0 || ptr > length+1 {
+			return &IPv4OptionError{Offset: 2, Reason: fmt.Sprintf("invalid Record Route pointer %d", ptr)}
+		}
+		for at := 3; at < ptr-1; at += 4 {
+			o.Route = append(o.Route, net.IP(o.Data[at-2:at+2]))
+		}
+
+	case IPv4OptionTimestamp:
+		if length < 4 {
+			return &IPv4OptionError{Offset: 1, Reason: fmt.Sprintf("invalid Timestamp length %d", length)}
+		}
+		ts := &IPv4Timestamp{Overflow: o.Data[1] >> 4, Flag: o.Data[1] & 0x0F}
+		size := 8
+		switch ts.Flag {
+		case 0:
+			size = 4
+		case 1, 3:
+		default:
+			return &IPv4OptionError{Offset: 3, Reason: fmt.Sprintf("invalid Timestamp flag %d", ts.Flag)}
+		}
+		if (length-4)%size != 0 {
+			return &IPv4OptionError{Offset: 1, Reason: fmt.Sprintf("invalid Timestamp length %d", length)}
+		}
+		ptr := int(o.Data[0])
+		if ptr < 5 || (ptr-5)%size != 0 || ptr > length+1 {
+			return &IPv4OptionError{Offset: 2, Reason: fmt.Sprintf("invalid Timestamp pointer %d", ptr)}
+		}
+		for at := 4; at < ptr-1; at += size {
+			var e IPv4TimestampEntry
+			entry := o.Data[at-2 : at-2+size]
+			if size == 8 {
+				e.IP = net.IP(entry[:4])
+				entry = entry[4:]
+			}
+			e.Time = binary.BigEndian.Uint32(entry)
+			ts.Entries = append(ts.Entries, e)
+		}
+		o.Timestamp = ts
+
+	case IPv4OptionRouterAlert:
+		if length != 4 {
+			return &IPv4OptionError{Offset: 1, Reason: fmt.Sprintf("invalid Router Alert length %d", length)}
+		}
+		o.RouterAlert = binary.BigEndian.Uint16(o.Data)
+	}
+
+	return nil
+}
+
+// copiedIPv4Options keeps the options with the copied flag, padded to a
+// multiple of 4 bytes.
+func copiedIPv4Options(options []byte) []byte {
+	opts, _ := parseIPv4Options(options)
+
+	var copied []byte
+	for _, o := range opts {
+		if o.Type.Copied() {
+			copied = append(copied, options[o.Offset:o.Offset+2+len(o.Data)]...)
+		}
+	}
+
+	for len(copied)%4 != 0 {
+		copied = append(copied, 0)
+	}
+	return copied
+}
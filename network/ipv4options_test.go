@@ -0,0 +1,123 @@
+package network
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestParseIPv4Options(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   []byte
+		want   []string // String of each option
+		errOff int      // -1 without error
+	}{
+		{"nop and end", []byte{1, 1, 0, 0}, nil, -1},
+		{"record route",
+			[]byte{7, 11, 8, 10, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0},
+			[]string{"Record Route [10.0.0.1]"}, -1},
+		{"timestamps only",
+			[]byte{68, 12, 9, 0x10, 0, 0, 0, 5, 0, 0, 0, 0},
+			[]string{"Timestamp flag=0 overflow=1 5ms"}, -1},
+		{"address and timestamp",
+			[]byte{68, 12, 13, 1, 10, 0, 0, 1, 0, 0, 0, 7},
+			[]string{"Timestamp flag=1 overflow=0 10.0.0.1 7ms"}, -1},
+		{"router alert", []byte{1, 148, 4, 0, 0, 0, 0, 0}, []string{"Router Alert 0"}, -1},
+		{"unknown", []byte{30, 4, 0xab, 0xcd}, []string{"Option 30 ab cd"}, -1},
+		{"missing length", []byte{1, 1, 1, 7}, nil, 3},
+		{"length too small", []byte{7, 1, 0, 0}, nil, 1},
+		{"length too large", []byte{1, 7, 12, 4, 0}, nil, 2},
+		{"record route pointer", []byte{7, 7, 5, 0, 0, 0, 0, 0}, nil, 2},
+		{"record route length", []byte{7, 6, 4, 0, 0, 0, 0, 0}, nil, 1},
+		{"timestamp flag", []byte{68, 8, 5, 2, 0, 0, 0, 0}, nil, 3},
+		{"router alert length", []byte{148, 3, 0, 0}, nil, 1},
+		// Options before the malformed one are returned
+		{"error after option", []byte{148, 4, 0, 1, 7, 2, 0, 0}, []string{"Router Alert 1"}, 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := parseIPv4Options(tt.data)
+
+			var got []string
+			for _, o := range opts {
+				got = append(got, o.String())
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("options %q, want %q", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("option %d is %q, want %q", i, got[i], tt.want[i])
+				}
+			}
+
+			var optErr *IPv4OptionError
+			switch {
+			case tt.errOff < 0 && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tt.errOff >= 0 && !errors.As(err, &optErr):
+				t.Errorf("error %v, want an option error", err)
+			case tt.errOff >= 0 && optErr.Offset != tt.errOff:
+				t.Errorf("error at offset %d, want %d: %v", optErr.Offset, tt.errOff, err)
+			}
+		})
+	}
+}
+
+func TestCopiedIPv4Options(t *testing.T) {
+	// Record Route is not copied, Router Alert is
+	options := []byte{7, 7, 4, 0, 0, 0, 0, 148, 4, 0, 0, 0}
+
+	got := copiedIPv4Options(options)
+	if !bytes.Equal(got, []byte{148, 4, 0, 0}) {
+		t.Errorf("copied options % x", got)
+	}
+
+	// Fragments after the first one only carry the copied options
+	p := &IPv4Packet{TTL: 64, Protocol: UDPProtocol, SourceIP: testHostIP, DestIP: testPeerIP, Options: options, Payload: make([]byte, 2000)}
+	frags, err := fragmentIPv4(p.marshal(), 1500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, f := range frags {
+		fp, err := parseIPv4Packet(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := options
+		if i > 0 {
+			want = got
+		}
+		if !bytes.Equal(fp.Options, want) {
+			t.Errorf("fragment %d has options % x, want % x", i, fp.Options, want)
+		}
+	}
+}
+
+// A malformed option is reported with a Parameter Problem pointing to it.
+func TestIPv4OptionParameterProblem(t *testing.T) {
+	stack, _ := newTestStack(t)
+	stack.SetIPv4Validation(IPv4Strict)
+
+	icmp := []byte{ICMPEchoRequest, 0, 0, 0, 0, 1, 0, 1}
+	putTestChecksum(icmp, 2)
+	p := &IPv4Packet{TTL: 64, Protocol: ICMPProtocol, SourceIP: testHostIP, DestIP: testPeerIP, Options: []byte{1, 7, 2, 0}, Payload: icmp}
+
+	reply, err := stack.ProcessFrame(testEthernet(EtherTypeIPv4, p.marshal()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply == nil {
+		t.Fatal("no reply")
+	}
+
+	rp, err := parseIPv4Packet(reply[14:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rp.Payload[0] != ICMPParameterProblem || rp.Payload[4] != 20+2 {
+		t.Errorf("unexpected ICMP % x", rp.Payload[:8])
+	}
+}
@@ -1,6 +1,309 @@
 package network
 
-func handleIPv6(payload []byte) ([]byte, error) {
-	_ = payload
-	return nil, &ToDoWarning{Msg: "handle IPv6 frame", EtherType: EtherTypeIPv6}
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"slices"
+)
+
+// +--------------------------------------------------------+
+// | IPv6 Header (40 bytes)                                 |
+// |--------------------------------------------------------|
+// | Version (4 bits) | Traffic Class (8 bits) |            |
+// | Flow Label (20 bits)                                   |
+// | Payload Length (2) | Next Header (1) | Hop Limit (1)   |
+// | Source Address (16)                                    |
+// | Destination Address (16)                               |
+// +--------------------------------------------------------+
+//
+// Extension headers are chained through Next Header before the upper layer:
+//
+// +--------------------------------------------------------+
+// | Next Header (1) | Hdr Ext Len (1) | Data (variable)    |
+// +--------------------------------------------------------+
+//
+// Hdr Ext Len is in units of 8 bytes not including the first 8 bytes, except
+// for the fragment header that has a fixed size of 8 bytes.
+//
+// [RFC 8200] https://datatracker.ietf.org/doc/html/rfc8200
+// https://en.wikipedia.org/wiki/IPv6_packet
+type IPv6NextHeader = uint8
+
+const (
+	IPv6HopByHop     IPv6NextHeader = 0
+	IPv6TCP          IPv6NextHeader = 6
+	IPv6UDP          IPv6NextHeader = 17
+	IPv6Routing      IPv6NextHeader = 43
+	IPv6Fragment     IPv6NextHeader = 44
+	IPv6ICMP         IPv6NextHeader = 58
+	IPv6NoNextHeader IPv6NextHeader = 59
+	IPv6DestOptions  IPv6NextHeader = 60
+)
+
+type IPv6ExtHeader struct {
+	Type IPv6NextHeader
+	Data []byte // Whole extension header including Next Header and length
+}
+
+type IPv6Packet struct {
+	TrafficClass  uint8
+	FlowLabel     uint32
+	PayloadLength uint16
+	// Next Header of the fixed header, it can be an extension header
+	NextHeader IPv6NextHeader
+	HopLimit   uint8
+	SourceIP   net.IP
+	DestIP     net.IP
+	// Extension headers in the order they appear
+	ExtHeaders []IPv6ExtHeader
+	// Upper layer protocol found after the extension headers and its data
+	Protocol IPv6NextHeader
+	Payload  []byte
+}
+
+// Default hop limit used for packets we are sending. Neighbor Discovery
+// messages always use 255.
+const (
+	defaultHopLimit = 64
+	ndpHopLimit     = 255
+)
+
+var (
+	ipv6AllNodes = net.ParseIP("ff02::1")
+)
+
+func (s *Stack) handleIPv6(eps []*endpoint, f *EthernetFrame) ([]byte, error) {
+	if !slices.ContainsFunc(eps, func(ep *endpoint) bool { return len(ep.ipv6s()) > 0 }) {
+		return nil, &ToDoWarning{Msg: "no IPv6 address configured", EtherType: EtherTypeIPv6}
+	}
+
+	p, err := parseIPv6Packet(f.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse IPv6 packet: %w", err)
+	}
+
+	ep := endpointOwning(eps, ipv6Target(p))
+	ourIPs := ep.ipv6s()
+	if len(ourIPs) == 0 {
+		return nil, fmt.Errorf("IP %s is not for us", p.DestIP.String())
+	}
+
+	if !isOurIPv6Dest(p.DestIP, ourIPs) {
+		// Hosts keep sending to multicast groups (MLD reports, router
+		// solicitations...) that we did not join, it is not an error.
+		if p.DestIP.IsMulticast() {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("IP %s is not for us", p.DestIP.String())
+	}
+
+	// Like IPv4 the sender talks to us directly. Unspecified source (DAD)
+	// is ignored by the table.
+	ep.learn(p.SourceIP, f.SrcMAC)
+
+	switch p.Protocol {
+	case IPv6ICMP:
+		return s.handleICMPv6(ep, f, p, ourIPs)
+	default:
+		return nil, fmt.Errorf("only ICMPv6 protocol is managed currently")
+	}
+}
+
+func parseIPv6Packet(payload []byte) (*IPv6Packet, error) {
+	if len(payload) < 40 {
+		return nil, fmt.Errorf("IPv6 packet too short: %d bytes (minimum 40)", len(payload))
+	}
+
+	vtf := binary.BigEndian.Uint32(payload[0:4])
+	if vtf>>28 != 6 {
+		return nil, fmt.Errorf("not IPv6: version=%d", vtf>>28)
+	}
+
+	p := &IPv6Packet{
+		TrafficClass:  uint8(vtf >> 20),
+		FlowLabel:     vtf & 0xFFFFF,
+		PayloadLength: binary.BigEndian.Uint16(payload[4:6]),
+		NextHeader:    payload[6],
+		HopLimit:      payload[7],
+		SourceIP:      net.IP(payload[8:24]),
+		DestIP:        net.IP(payload[24:40]),
+	}
+
+	// Ethernet padding is not part of the packet
+	end := 40 + int(p.PayloadLength)
+	if end > len(payload) {
+		return nil, fmt.Errorf("payload length %d exceeds packet of %d bytes", p.PayloadLength, len(payload)-40)
+	}
+	data := payload[40:end]
+
+	// Walk the extension headers until we reach the upper layer
+	next := p.NextHeader
+	for isIPv6ExtHeader(next) {
+		if len(data) < 8 {
+			return nil, fmt.Errorf("extension header %d truncated", next)
+		}
+
+		l := 8
+		if next != IPv6Fragment {
+			l = (int(data[1]) + 1) * 8
+		}
+		if l > len(data) {
+			return nil, fmt.Errorf("extension header %d truncated: need %d bytes, got %d", next, l, len(data))
+		}
+
+		// A fragment that is not the first one has no upper layer header
+		if next == IPv6Fragment && binary.BigEndian.Uint16(data[2:4])&0xFFF8 != 0 {
+			return nil, fmt.Errorf("IPv6 fragments are not handled")
+		}
+
+		p.ExtHeaders = append(p.ExtHeaders, IPv6ExtHeader{Type: next, Data: data[:l]})
+		next = data[0]
+		data = data[l:]
+	}
+
+	p.Protocol = next
+	p.Payload = data
+
+	return p, nil
+}
+
+// ipv6Target returns the address a packet is for. A neighbor solicitation is
+// sent to a multicast group shared by several addresses, its target tells
+// which one is asked.
+func ipv6Target(p *IPv6Packet) net.IP {
+	if p.Protocol == IPv6ICMP && len(p.Payload) >= 24 && p.Payload[0] == ICMPv6NeighborSolicitation {
+		return net.IP(p.Payload[8:24])
+	}
+	return p.DestIP
+}
+
+func isIPv6ExtHeader(h IPv6NextHeader) bool {
+	switch h {
+	case IPv6HopByHop, IPv6Routing, IPv6Fragment, IPv6DestOptions:
+		return true
+	default:
+		return false
+	}
+}
+
+// marshal serializes the packet without extension headers. Payload Length is
+// computed from the payload and Protocol is used as Next Header.
+func (p *IPv6Packet) marshal() []byte {
+	b := make([]byte, 40+len(p.Payload))
+
+	binary.BigEndian.PutUint32(b[0:4], 6<<28|uint32(p.TrafficClass)<<20|p.FlowLabel&0xFFFFF)
+	binary.BigEndian.PutUint16(b[4:6], uint16(len(p.Payload)))
+	b[6] = p.Protocol
+	b[7] = p.HopLimit
+	copy(b[8:24], p.SourceIP.To16())
+	copy(b[24:40], p.DestIP.To16())
+	copy(b[40:], p.Payload)
+
+	return b
+}
+
+// pseudoHeaderChecksum6 computes the checksum of an upper layer message
+// (ICMPv6, UDP, TCP) including the IPv6 pseudo-header (RFC 8200 section 8.1):
+// source, destination, upper layer length and next header.
+func pseudoHeaderChecksum6(src, dst net.IP, proto IPv6NextHeader, data []byte) uint16 {
+	b := make([]byte, 40+len(data))
+	copy(b[0:16], src.To16())
+	copy(b[16:32], dst.To16())
+	binary.BigEndian.PutUint32(b[32:36], uint32(len(data)))
+	b[39] = proto
+	copy(b[40:], data)
+
+	return checksum(b)
+}
+
+// ------------------------------------------------------------------------------
+// Addresses
+
+// ipv6s returns the IPv6 addresses of the endpoint. The link-local address
+// derived from the MAC address is always added when the endpoint has at least
+// one IPv6 address.
+func (ep *endpoint) ipv6s() []net.IP {
+	var ips []net.IP
+	for _, ip := range ep.ips {
+		if ip.To4() == nil && ip.To16() != nil {
+			ips = append(ips, ip.To16())
+		}
+	}
+
+	if len(ips) == 0 {
+		return nil
+	}
+
+	ll := linkLocalFromMAC(ep.mac)
+	for _, ip := range ips {
+		if ip.Equal(ll) {
+			return ips
+		}
+	}
+
+	return append(ips, ll)
+}
+
+// linkLocalFromMAC returns fe80::/64 with the modified EUI-64 identifier
+// (RFC 4291 appendix A).
+func linkLocalFromMAC(mac net.HardwareAddr) net.IP {
+	ip := make(net.IP, 16)
+	ip[0], ip[1] = 0xfe, 0x80
+
+	if len(mac) == 6 {
+		ip[8] = mac[0] ^ 0x02
+		ip[9], ip[10] = mac[1], mac[2]
+		ip[11], ip[12] = 0xff, 0xfe
+		ip[13], ip[14], ip[15] = mac[3], mac[4], mac[5]
+	}
+
+	return ip
+}
+
+// solicitedNodeMulticast returns ff02::1:ffXX:XXXX built from the last 24
+// bits of ip (RFC 4291 section 2.7.1).
+func solicitedNodeMulticast(ip net.IP) net.IP {
+	snm := net.ParseIP("ff02::1:ff00:0")
+	ip16 := ip.To16()
+	copy(snm[13:16], ip16[13:16])
+	return snm
+}
+
+// multicastMAC returns 33:33 followed by the last 32 bits of the IPv6
+// multicast address (RFC 2464 section 7).
+func multicastMAC(ip net.IP) net.HardwareAddr {
+	ip16 := ip.To16()
+	return net.HardwareAddr{0x33, 0x33, ip16[12], ip16[13], ip16[14], ip16[15]}
+}
+
+func isOurIPv6Dest(dst net.IP, ourIPs []net.IP) bool {
+	if dst.Equal(ipv6AllNodes) {
+		return true
+	}
+
+	for _, ip := range ourIPs {
+		if dst.Equal(ip) || dst.Equal(solicitedNodeMulticast(ip)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sourceFor returns the address we use to answer a packet sent to dst: dst
+// itself if it is unicast, otherwise our first address of the same scope.
+func sourceFor(dst net.IP, ourIPs []net.IP) net.IP {
+	if !dst.IsMulticast() {
+		return dst
+	}
+
+	linkLocal := dst.IsLinkLocalMulticast()
+	for _, ip := range ourIPs {
+		if ip.IsLinkLocalUnicast() == linkLocal {
+			return ip
+		}
+	}
+
+	return ourIPs[0]
 }
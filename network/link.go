@@ -0,0 +1,38 @@
+package network
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+var (
+	ErrLinkTimeout = errors.New("link read timeout")
+	ErrLinkClosed  = errors.New("link closed")
+)
+
+// Link is what the protocol stack is plugged on. It gives the identity of the
+// host we are emulating and a way to exchange raw Ethernet frames.
+type Link interface {
+	// Name of the link, used for logging and captures
+	Name() string
+	HardwareAddr() net.HardwareAddr
+	// IPs assigned to the emulated host
+	IPs() []net.IP
+	MTU() int
+	// ReadFrame copies the next frame into buf and returns its size. If no
+	// frame is received before timeout it returns ErrLinkTimeout.
+	ReadFrame(buf []byte, timeout time.Duration) (int, error)
+	WriteFrame(frame []byte) error
+	Close() error
+}
+
+// linkIPv4 returns the first IPv4 address of the link or nil.
+func linkIPv4(link Link) net.IP {
+	for _, ip := range link.IPs() {
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4
+		}
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package network
+
+import (
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The neighbor table maps IP addresses to MAC addresses. Entries are learned
+// from ARP frames (requests and replies, see the "merge" step of RFC 826) and
+// from the source of IPv4 packets. They expire after neighborTTL unless they
+// are refreshed.
+//
+// When the stack needs to send a packet to an unknown IP, the packet is queued
+// in an incomplete entry and an ARP request is sent. Packets are flushed when
+// the reply is learned or dropped after arpMaxRetries requests.
+const (
+	neighborTTL     = 5 * time.Minute
+	arpRetryDelay   = time.Second
+	arpMaxRetries   = 3
+	maxPendingPerIP = 16
+)
+
+type Neighbor struct {
+	IP      net.IP
+	MAC     net.HardwareAddr
+	Updated time.Time
+}
+
+type neighborEntry struct {
+	mac     net.HardwareAddr // nil while the entry is incomplete
+	updated time.Time
+	pending [][]byte // IP packets waiting for the resolution
+	retries int
+}
+
+type NeighborTable struct {
+	mu      sync.Mutex
+	entries map[netip.Addr]*neighborEntry
+	ttl     time.Duration
+}
+
+func NewNeighborTable() *NeighborTable {
+	return &NeighborTable{
+		entries: make(map[netip.Addr]*neighborEntry),
+		ttl:     neighborTTL,
+	}
+}
+
+func neighborKey(ip net.IP) (netip.Addr, bool) {
+	addr, ok := netip.AddrFromSlice(ip)
+	addr = addr.Unmap()
+	if !ok || addr.IsUnspecified() {
+		return netip.Addr{}, false
+	}
+	return addr, true
+}
+
+// Learn records the MAC address of ip. Packets that were waiting for this
+// resolution are returned so the caller can send them.
+func (t *NeighborTable) Learn(ip net.IP, mac net.HardwareAddr) [][]byte {
+	key, ok := neighborKey(ip)
+	if !ok || len(mac) != 6 {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, found := t.entries[key]
+	if !found {
+		e = &neighborEntry{}
+		t.entries[key] = e
+	}
+
+	e.mac = append(net.HardwareAddr(nil), mac...)
+	e.updated = time.Now()
+	e.retries = 0
+
+	pending := e.pending
+	e.pending = nil
+	return pending
+}
+
+// Lookup returns the MAC address of ip if it is known and not expired.
+func (t *NeighborTable) Lookup(ip net.IP) (net.HardwareAddr, bool) {
+	key, ok := neighborKey(ip)
+	if !ok {
+		return nil, false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, found := t.entries[key]
+	if !found || e.mac == nil {
+		return nil, false
+	}
+
+	if time.Since(e.updated) > t.ttl {
+		delete(t.entries, key)
+		return nil, false
+	}
+
+	return e.mac, true
+}
+
+// lookupOrQueue returns the MAC address of ip if it is known. Otherwise the
+// packet is stored until ip is resolved and start is true if a resolution
+// must be started, i.e. the entry was not already incomplete.
+func (t *NeighborTable) lookupOrQueue(ip net.IP, packet []byte) (mac net.HardwareAddr, start bool) {
+	key, ok := neighborKey(ip)
+	if !ok {
+		return nil, false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, found := t.entries[key]
+	if found && e.mac != nil {
+		if time.Since(e.updated) <= t.ttl {
+			return e.mac, false
+		}
+		found = false
+	}
+
+	if !found {
+		e = &neighborEntry{}
+		t.entries[key] = e
+	}
+
+	if len(e.pending) < maxPendingPerIP {
+		e.pending = append(e.pending, packet)
+	}
+
+	return nil, !found
+}
+
+// retry is called when an ARP request got no answer. It returns true if a new
+// request must be sent. After arpMaxRetries the entry is deleted and the
+// number of dropped packets is returned.
+func (t *NeighborTable) retry(ip net.IP) (bool, int) {
+	key, ok := neighborKey(ip)
+	if !ok {
+		return false, 0
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, found := t.entries[key]
+	if !found || e.mac != nil {
+		// Resolved
+		return false, 0
+	}
+
+	e.retries++
+	if e.retries >= arpMaxRetries {
+		delete(t.entries, key)
+		return false, len(e.pending)
+	}
+
+	return true, 0
+}
+
+// Entries returns the resolved neighbors sorted by IP. Expired entries are
+// removed.
+func (t *NeighborTable) Entries() []Neighbor {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var neighbors []Neighbor
+	for key, e := range t.entries {
+		if e.mac == nil {
+			continue
+		}
+
+		if time.Since(e.updated) > t.ttl {
+			delete(t.entries, key)
+			continue
+		}
+
+		neighbors = append(neighbors, Neighbor{
+			IP:      net.IP(key.AsSlice()),
+			MAC:     e.mac,
+			Updated: e.updated,
+		})
+	}
+
+	sort.Slice(neighbors, func(i, j int) bool {
+		a, _ := netip.AddrFromSlice(neighbors[i].IP)
+		b, _ := netip.AddrFromSlice(neighbors[j].IP)
+		return a.Less(b)
+	})
+
+	return neighbors
+}
@@ -0,0 +1,109 @@
+package network
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNeighborLearnLookup(t *testing.T) {
+	nt := NewNeighborTable()
+
+	if _, found := nt.Lookup(testHostIP); found {
+		t.Fatal("empty table has an entry")
+	}
+
+	nt.Learn(testHostIP, testHostMAC)
+
+	// IPv4 addresses in 16 bytes are the same key
+	mac, found := nt.Lookup(testHostIP.To16())
+	if !found || mac.String() != testHostMAC.String() {
+		t.Errorf("lookup gave %v, %v", mac, found)
+	}
+
+	// Unspecified addresses and bad MAC addresses are ignored
+	nt.Learn(net.IPv4zero, testHostMAC)
+	nt.Learn(net.IP{192, 168, 35, 9}, net.HardwareAddr{1, 2, 3})
+	if n := len(nt.Entries()); n != 1 {
+		t.Errorf("%d entries, want 1", n)
+	}
+
+	nt.ttl = 0
+	time.Sleep(time.Millisecond)
+	if _, found := nt.Lookup(testHostIP); found {
+		t.Error("expired entry found")
+	}
+	if n := len(nt.Entries()); n != 0 {
+		t.Errorf("%d entries after expiry, want 0", n)
+	}
+}
+
+func TestNeighborQueue(t *testing.T) {
+	nt := NewNeighborTable()
+
+	mac, start := nt.lookupOrQueue(testHostIP, []byte{1})
+	if mac != nil || !start {
+		t.Fatalf("first lookup gave %v, start %v", mac, start)
+	}
+
+	// The resolution is already started for the next packets
+	for i := range maxPendingPerIP + 4 {
+		if _, start := nt.lookupOrQueue(testHostIP, []byte{byte(i + 2)}); start {
+			t.Fatal("resolution started twice")
+		}
+	}
+
+	if entries := nt.Entries(); len(entries) != 0 {
+		t.Errorf("incomplete entry listed: %v", entries)
+	}
+
+	pending := nt.Learn(testHostIP, testHostMAC)
+	if len(pending) != maxPendingPerIP || pending[0][0] != 1 {
+		t.Errorf("%d pending packets flushed, want %d", len(pending), maxPendingPerIP)
+	}
+
+	if mac, _ := nt.lookupOrQueue(testHostIP, []byte{0}); mac == nil {
+		t.Error("resolved address queued")
+	}
+	if again, _ := nt.retry(testHostIP); again {
+		t.Error("retry of a resolved address")
+	}
+}
+
+func TestNeighborRetry(t *testing.T) {
+	nt := NewNeighborTable()
+	nt.lookupOrQueue(testHostIP, []byte{1})
+	nt.lookupOrQueue(testHostIP, []byte{2})
+
+	for i := 1; i < arpMaxRetries; i++ {
+		if again, dropped := nt.retry(testHostIP); !again || dropped != 0 {
+			t.Fatalf("retry %d gave %v, %d", i, again, dropped)
+		}
+	}
+
+	if again, dropped := nt.retry(testHostIP); again || dropped != 2 {
+		t.Errorf("last retry gave %v, %d dropped, want false, 2", again, dropped)
+	}
+
+	// The entry is gone, a new packet starts a new resolution
+	if _, start := nt.lookupOrQueue(testHostIP, []byte{3}); !start {
+		t.Error("resolution not restarted")
+	}
+}
+
+func TestNeighborEntriesSorted(t *testing.T) {
+	nt := NewNeighborTable()
+	for _, last := range []byte{30, 2, 10} {
+		nt.Learn(net.IP{192, 168, 35, last}, testHostMAC)
+	}
+
+	entries := nt.Entries()
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.IP.String())
+	}
+	want := []string{"192.168.35.2", "192.168.35.10", "192.168.35.30"}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+		t.Errorf("entries %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,334 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// Minimal rtnetlink client used to configure links and addresses without
+// relying on iproute2.
+//
+// Every message starts with a netlink header followed by a family specific
+// header (ifinfomsg for links, ifaddrmsg for addresses) and a list of
+// attributes:
+//
+// +--------------------------------------------------------+
+// | nlmsghdr (16) | ifinfomsg (16) or ifaddrmsg (8)        |
+// |--------------------------------------------------------|
+// | rtattr: Len (2) | Type (2) | Data (padded to 4 bytes)  |
+// | ...                                                    |
+// +--------------------------------------------------------+
+//
+// On Linux: man 7 netlink, man 7 rtnetlink
+
+// NetlinkError is returned when the kernel rejects a netlink request. Errno
+// is the error reported by the kernel in the NLMSG_ERROR message.
+type NetlinkError struct {
+	Op    string
+	Errno unix.Errno
+}
+
+func (e *NetlinkError) Error() string {
+	return fmt.Sprintf("netlink %s: %s (errno %d)", e.Op, e.Errno.Error(), int(e.Errno))
+}
+
+func (e *NetlinkError) Unwrap() error {
+	return e.Errno
+}
+
+// VETH_INFO_PEER from linux/veth.h, it is not exported by x/sys/unix
+const vethInfoPeer = 1
+
+type netlinkConn struct {
+	fd  int
+	seq uint32
+}
+
+func newNetlinkConn() (*netlinkConn, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create netlink socket: %w", err)
+	}
+
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to bind netlink socket: %w", err)
+	}
+
+	return &netlinkConn{fd: fd}, nil
+}
+
+func (c *netlinkConn) close() {
+	if c.fd >= 0 {
+		unix.Close(c.fd)
+		c.fd = -1
+	}
+}
+
+// request sends a message and waits for the acknowledgment of the kernel.
+// Payloads of the messages received before the acknowledgment are returned,
+// this is how we get the answer of RTM_GET* requests.
+func (c *netlinkConn) request(op string, msgType uint16, flags uint16, body []byte) ([][]byte, error) {
+	c.seq++
+
+	msg := make([]byte, unix.NLMSG_HDRLEN+len(body))
+	binary.NativeEndian.PutUint32(msg[0:4], uint32(len(msg)))
+	binary.NativeEndian.PutUint16(msg[4:6], msgType)
+	binary.NativeEndian.PutUint16(msg[6:8], flags|unix.NLM_F_REQUEST|unix.NLM_F_ACK)
+	binary.NativeEndian.PutUint32(msg[8:12], c.seq)
+	copy(msg[unix.NLMSG_HDRLEN:], body)
+
+	if err := unix.Sendto(c.fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, fmt.Errorf("failed to send netlink %s: %w", op, err)
+	}
+
+	var replies [][]byte
+	buf := make([]byte, unix.Getpagesize()*4)
+
+	for {
+		n, _, err := unix.Recvfrom(c.fd, buf, 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to receive netlink %s: %w", op, err)
+		}
+
+		data := buf[:n]
+		for len(data) >= unix.NLMSG_HDRLEN {
+			msgLen := int(binary.NativeEndian.Uint32(data[0:4]))
+			if msgLen < unix.NLMSG_HDRLEN || msgLen > len(data) {
+				return nil, fmt.Errorf("netlink %s: invalid message length %d", op, msgLen)
+			}
+
+			typ := binary.NativeEndian.Uint16(data[4:6])
+			seq := binary.NativeEndian.Uint32(data[8:12])
+			payload := data[unix.NLMSG_HDRLEN:msgLen]
+			data = data[min(nlmAlign(msgLen), len(data)):]
+
+			// Skip messages that are not answering our request
+			if seq != c.seq {
+				continue
+			}
+
+			switch typ {
+			case unix.NLMSG_ERROR:
+				if len(payload) < 4 {
+					return nil, fmt.Errorf("netlink %s: truncated error message", op)
+				}
+				// 0 is an acknowledgment, otherwise it is a negative errno
+				errno := int32(binary.NativeEndian.Uint32(payload[0:4]))
+				if errno != 0 {
+					return nil, &NetlinkError{Op: op, Errno: unix.Errno(-errno)}
+				}
+				return replies, nil
+			case unix.NLMSG_DONE:
+				return replies, nil
+			default:
+				replies = append(replies, append([]byte(nil), payload...))
+			}
+		}
+	}
+}
+
+// ------------------------------------------------------------------------------
+// Links
+
+// linkAddVeth creates a veth pair: RTM_NEWLINK with IFLA_INFO_KIND "veth" and
+// the name of the peer nested in IFLA_INFO_DATA.
+func (c *netlinkConn) linkAddVeth(name, peerName string) error {
+	peer := append(ifInfoMsg(0, 0, 0), nlAttrString(unix.IFLA_IFNAME, peerName)...)
+
+	linkInfo := nlAttrNested(unix.IFLA_LINKINFO,
+		nlAttrString(unix.IFLA_INFO_KIND, "veth"),
+		nlAttrNested(unix.IFLA_INFO_DATA,
+			nlAttr(vethInfoPeer, peer),
+		),
+	)
+
+	body := ifInfoMsg(0, 0, 0)
+	body = append(body, nlAttrString(unix.IFLA_IFNAME, name)...)
+	body = append(body, linkInfo...)
+
+	_, err := c.request("add link "+name, unix.RTM_NEWLINK, unix.NLM_F_CREATE|unix.NLM_F_EXCL, body)
+	return err
+}
+
+func (c *netlinkConn) linkSetUp(name string) error {
+	return c.linkSetFlags("set link "+name+" up", name, unix.IFF_UP)
+}
+
+func (c *netlinkConn) linkSetDown(name string) error {
+	return c.linkSetFlags("set link "+name+" down", name, 0)
+}
+
+// linkSetFlags only changes the IFF_UP flag, the link is found by its name.
+func (c *netlinkConn) linkSetFlags(op string, name string, flags uint32) error {
+	body := ifInfoMsg(0, flags, unix.IFF_UP)
+	body = append(body, nlAttrString(unix.IFLA_IFNAME, name)...)
+
+	_, err := c.request(op, unix.RTM_NEWLINK, 0, body)
+	return err
+}
+
+func (c *netlinkConn) linkDel(name string) error {
+	body := ifInfoMsg(0, 0, 0)
+	body = append(body, nlAttrString(unix.IFLA_IFNAME, name)...)
+
+	_, err := c.request("delete link "+name, unix.RTM_DELLINK, 0, body)
+	return err
+}
+
+// linkSetNetns moves the link into the network namespace referenced by nsFD.
+func (c *netlinkConn) linkSetNetns(name string, nsFD int) error {
+	fd := make([]byte, 4)
+	binary.NativeEndian.PutUint32(fd, uint32(nsFD))
+
+	body := ifInfoMsg(0, 0, 0)
+	body = append(body, nlAttrString(unix.IFLA_IFNAME, name)...)
+	body = append(body, nlAttr(unix.IFLA_NET_NS_FD, fd)...)
+
+	_, err := c.request("move link "+name+" to netns", unix.RTM_NEWLINK, 0, body)
+	return err
+}
+
+// linkIndex returns the index of the link as seen by the namespace of the
+// netlink socket.
+func (c *netlinkConn) linkIndex(name string) (int, error) {
+	body := ifInfoMsg(0, 0, 0)
+	body = append(body, nlAttrString(unix.IFLA_IFNAME, name)...)
+
+	replies, err := c.request("get link "+name, unix.RTM_GETLINK, 0, body)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, r := range replies {
+		if len(r) >= unix.SizeofIfInfomsg {
+			return int(int32(binary.NativeEndian.Uint32(r[4:8]))), nil
+		}
+	}
+
+	return 0, fmt.Errorf("netlink get link %s: no link in reply", name)
+}
+
+// linkMTU returns the MTU of the link as seen by the namespace of the netlink
+// socket.
+func (c *netlinkConn) linkMTU(name string) (int, error) {
+	body := ifInfoMsg(0, 0, 0)
+	body = append(body, nlAttrString(unix.IFLA_IFNAME, name)...)
+
+	replies, err := c.request("get link "+name, unix.RTM_GETLINK, 0, body)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, r := range replies {
+		if len(r) < unix.SizeofIfInfomsg {
+			continue
+		}
+		if mtu, ok := nlFindAttr(r[unix.SizeofIfInfomsg:], unix.IFLA_MTU); ok && len(mtu) == 4 {
+			return int(binary.NativeEndian.Uint32(mtu)), nil
+		}
+	}
+
+	return 0, fmt.Errorf("netlink get link %s: no MTU in reply", name)
+}
+
+// ------------------------------------------------------------------------------
+// Addresses
+
+// addrAdd assigns ip with the prefix length of ipNet to the link.
+func (c *netlinkConn) addrAdd(name string, ip net.IP, ipNet *net.IPNet) error {
+	index, err := c.linkIndex(name)
+	if err != nil {
+		return err
+	}
+
+	// Duplicate Address Detection is disabled for IPv6 otherwise the address
+	// stays tentative for a while and cannot be used
+	family, flags := unix.AF_INET6, uint8(unix.IFA_F_NODAD)
+	addr := ip.To16()
+	if ip4 := ip.To4(); ip4 != nil {
+		family, flags = unix.AF_INET, 0
+		addr = ip4
+	}
+
+	prefixLen, _ := ipNet.Mask.Size()
+
+	// struct ifaddrmsg
+	body := make([]byte, unix.SizeofIfAddrmsg)
+	body[0] = uint8(family)
+	body[1] = uint8(prefixLen)
+	body[2] = flags
+	body[3] = unix.RT_SCOPE_UNIVERSE
+	binary.NativeEndian.PutUint32(body[4:8], uint32(index))
+
+	body = append(body, nlAttr(unix.IFA_LOCAL, addr)...)
+	body = append(body, nlAttr(unix.IFA_ADDRESS, addr)...)
+
+	op := fmt.Sprintf("add address %s/%d to %s", ip.String(), prefixLen, name)
+	_, err = c.request(op, unix.RTM_NEWADDR, unix.NLM_F_CREATE|unix.NLM_F_EXCL, body)
+	return err
+}
+
+// ------------------------------------------------------------------------------
+// Helpers to build messages
+
+// ifInfoMsg returns a struct ifinfomsg
+func ifInfoMsg(index int32, flags uint32, change uint32) []byte {
+	b := make([]byte, unix.SizeofIfInfomsg)
+	b[0] = unix.AF_UNSPEC
+	binary.NativeEndian.PutUint32(b[4:8], uint32(index))
+	binary.NativeEndian.PutUint32(b[8:12], flags)
+	binary.NativeEndian.PutUint32(b[12:16], change)
+	return b
+}
+
+func nlAttr(typ uint16, data []byte) []byte {
+	l := unix.SizeofRtAttr + len(data)
+	b := make([]byte, rtaAlign(l))
+	binary.NativeEndian.PutUint16(b[0:2], uint16(l))
+	binary.NativeEndian.PutUint16(b[2:4], typ)
+	copy(b[unix.SizeofRtAttr:], data)
+	return b
+}
+
+func nlAttrString(typ uint16, s string) []byte {
+	// Strings are NUL terminated
+	return nlAttr(typ, append([]byte(s), 0))
+}
+
+func nlAttrNested(typ uint16, children ...[]byte) []byte {
+	var data []byte
+	for _, c := range children {
+		data = append(data, c...)
+	}
+	return nlAttr(typ|unix.NLA_F_NESTED, data)
+}
+
+// nlFindAttr returns the data of the first attribute of type typ.
+func nlFindAttr(attrs []byte, typ uint16) ([]byte, bool) {
+	for len(attrs) >= unix.SizeofRtAttr {
+		l := int(binary.NativeEndian.Uint16(attrs[0:2]))
+		if l < unix.SizeofRtAttr || l > len(attrs) {
+			return nil, false
+		}
+
+		if binary.NativeEndian.Uint16(attrs[2:4])&^unix.NLA_F_NESTED == typ {
+			return attrs[unix.SizeofRtAttr:l], true
+		}
+
+		attrs = attrs[min(rtaAlign(l), len(attrs)):]
+	}
+
+	return nil, false
+}
+
+func nlmAlign(l int) int {
+	return (l + unix.NLMSG_ALIGNTO - 1) & ^(unix.NLMSG_ALIGNTO - 1)
+}
+
+func rtaAlign(l int) int {
+	return (l + unix.RTA_ALIGNTO - 1) & ^(unix.RTA_ALIGNTO - 1)
+}
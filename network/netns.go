@@ -0,0 +1,188 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// Named network namespaces follow the iproute2 convention: the namespace is
+// kept alive by a bind mount of /proc/<tid>/ns/net on /run/netns/<name>. So
+// namespaces created here can be entered with `ip netns exec <name>`.
+//
+// On Linux: man 7 network_namespaces, man ip-netns
+const netnsRunDir = "/run/netns"
+
+type netns struct {
+	name    string
+	path    string
+	fd      int
+	created bool // true if we created it, so we must delete it
+}
+
+// openNetns opens the named namespace and creates it if it does not exist.
+func openNetns(name string) (*netns, error) {
+	if name == "" || name != filepath.Base(name) {
+		return nil, fmt.Errorf("invalid network namespace name %q", name)
+	}
+
+	ns := &netns{
+		name: name,
+		path: filepath.Join(netnsRunDir, name),
+		fd:   -1,
+	}
+
+	if _, err := os.Stat(ns.path); errors.Is(err, os.ErrNotExist) {
+		if err := ns.create(); err != nil {
+			return nil, err
+		}
+	}
+
+	fd, err := unix.Open(ns.path, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		ns.remove()
+		return nil, fmt.Errorf("failed to open network namespace %s: %w", ns.path, err)
+	}
+
+	ns.fd = fd
+	return ns, nil
+}
+
+func (ns *netns) create() error {
+	if err := os.MkdirAll(netnsRunDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", netnsRunDir, err)
+	}
+
+	f, err := os.OpenFile(ns.path, os.O_RDONLY|os.O_CREATE|os.O_EXCL, 0o444)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", ns.path, err)
+	}
+	f.Close()
+	ns.created = true
+
+	// unshare(2) only affects the calling thread. The goroutine never unlocks
+	// its thread so the runtime terminates it when the goroutine returns,
+	// instead of reusing a thread that lives in the new namespace.
+	errChan := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+
+		if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+			errChan <- fmt.Errorf("failed to unshare network namespace: %w", err)
+			return
+		}
+
+		if err := unix.Mount("/proc/thread-self/ns/net", ns.path, "none", unix.MS_BIND, ""); err != nil {
+			errChan <- fmt.Errorf("failed to bind mount network namespace on %s: %w", ns.path, err)
+			return
+		}
+
+		errChan <- nil
+	}()
+
+	if err := <-errChan; err != nil {
+		ns.remove()
+		return err
+	}
+
+	return nil
+}
+
+// do runs fn with the calling thread inside the namespace. Sockets created by
+// fn stay attached to the namespace after do returns.
+func (ns *netns) do(fn func() error) error {
+	errChan := make(chan error, 1)
+
+	go func() {
+		runtime.LockOSThread()
+
+		origin, err := unix.Open("/proc/thread-self/ns/net", unix.O_RDONLY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			runtime.UnlockOSThread()
+			errChan <- fmt.Errorf("failed to open current network namespace: %w", err)
+			return
+		}
+		defer unix.Close(origin)
+
+		if err := unix.Setns(ns.fd, unix.CLONE_NEWNET); err != nil {
+			runtime.UnlockOSThread()
+			errChan <- fmt.Errorf("failed to enter network namespace %s: %w", ns.name, err)
+			return
+		}
+
+		fnErr := fn()
+
+		// If we cannot go back the thread stays locked and will be dropped
+		if err := unix.Setns(origin, unix.CLONE_NEWNET); err != nil {
+			errChan <- fmt.Errorf("failed to leave network namespace %s: %w", ns.name, err)
+			return
+		}
+
+		runtime.UnlockOSThread()
+		errChan <- fnErr
+	}()
+
+	return <-errChan
+}
+
+// DoInNetns runs fn with the calling thread inside the named network
+// namespace, which must exist. Sockets created by fn (net.Dial...) stay in the
+// namespace after it returns.
+func DoInNetns(name string, fn func() error) error {
+	if _, err := os.Stat(filepath.Join(netnsRunDir, name)); err != nil {
+		return fmt.Errorf("network namespace %s: %w", name, err)
+	}
+
+	ns, err := openNetns(name)
+	if err != nil {
+		return err
+	}
+	defer ns.close()
+
+	return ns.do(fn)
+}
+
+// netlink returns a netlink connection that operates inside the namespace.
+func (ns *netns) netlink() (*netlinkConn, error) {
+	var nl *netlinkConn
+
+	err := ns.do(func() error {
+		var err error
+		nl, err = newNetlinkConn()
+		return err
+	})
+
+	return nl, err
+}
+
+// close releases the namespace and deletes it if we created it.
+func (ns *netns) close() error {
+	if ns.fd >= 0 {
+		unix.Close(ns.fd)
+		ns.fd = -1
+	}
+
+	if !ns.created {
+		return nil
+	}
+
+	return ns.remove()
+}
+
+func (ns *netns) remove() error {
+	// The mount may not exist if creation failed before mounting
+	if err := unix.Unmount(ns.path, unix.MNT_DETACH); err != nil && err != unix.EINVAL {
+		return fmt.Errorf("failed to unmount %s: %w", ns.path, err)
+	}
+
+	if err := os.Remove(ns.path); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", ns.path, err)
+	}
+
+	ns.created = false
+	return nil
+}
@@ -0,0 +1,107 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// PacketConn exchanges raw frames on an existing interface through an
+// AF_PACKET socket, like the peer side of a Veth. Frames sent by the
+// interface itself are not read, only the ones it receives. It is used to
+// play the host side in tests.
+type PacketConn struct {
+	iface string
+	addr  *unix.SockaddrLinklayer
+
+	// Reads and writes hold mu for reading so Close waits for them
+	mu sync.RWMutex
+	fd int
+}
+
+// ListenPacket opens a PacketConn on iface. If netns is not empty the
+// interface is in this network namespace.
+func ListenPacket(iface string, netns string) (*PacketConn, error) {
+	c := &PacketConn{iface: iface, fd: -1}
+
+	open := func() error {
+		i, err := net.InterfaceByName(iface)
+		if err != nil {
+			return fmt.Errorf("failed to get interface %s: %w", iface, err)
+		}
+
+		fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, int(htons(unix.ETH_P_ALL)))
+		if err != nil {
+			return fmt.Errorf("failed to create socket: %w", err)
+		}
+		c.fd = fd
+
+		if err := unix.SetsockoptInt(fd, unix.SOL_PACKET, unix.PACKET_AUXDATA, 1); err != nil {
+			return fmt.Errorf("failed to enable packet auxiliary data: %w", err)
+		}
+		if err := unix.SetsockoptInt(fd, unix.SOL_PACKET, unix.PACKET_IGNORE_OUTGOING, 1); err != nil {
+			return fmt.Errorf("failed to ignore outgoing frames: %w", err)
+		}
+
+		c.addr = &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ALL), Ifindex: i.Index}
+		if err := unix.Bind(fd, c.addr); err != nil {
+			return fmt.Errorf("failed to bind socket to %s: %w", iface, err)
+		}
+
+		return nil
+	}
+
+	var err error
+	if netns != "" {
+		err = DoInNetns(netns, open)
+	} else {
+		err = open()
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// ReadFrame copies the next frame received by the interface into buf. If no
+// frame is received before timeout it returns ErrLinkTimeout.
+func (c *PacketConn) ReadFrame(buf []byte, timeout time.Duration) (int, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.fd < 0 {
+		return 0, ErrLinkClosed
+	}
+	return readPacket(c.fd, buf, timeout)
+}
+
+// WriteFrame sends the frame as if the interface sent it.
+func (c *PacketConn) WriteFrame(frame []byte) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.fd < 0 {
+		return ErrLinkClosed
+	}
+	return unix.Sendto(c.fd, frame, 0, c.addr)
+}
+
+// Close closes the socket once pending reads and writes return, the next
+// ones return ErrLinkClosed.
+func (c *PacketConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.fd < 0 {
+		return nil
+	}
+
+	err := unix.Close(c.fd)
+	c.fd = -1
+	return err
+}
@@ -0,0 +1,94 @@
+package network
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// PipeConf is the identity of one end of a pipe.
+type PipeConf struct {
+	Name string
+	MAC  net.HardwareAddr
+	IPs  []net.IP
+	MTU  int // 1500 if not set
+}
+
+// Pipe is an in-memory Link. Frames written on one end are read on the other
+// one, so the stack can be used without any privilege.
+type Pipe struct {
+	conf PipeConf
+	rx   chan []byte
+	tx   chan []byte
+
+	done      chan struct{}
+	closeOnce *sync.Once
+}
+
+// pipeQueueLen is the number of frames that can be buffered in each direction
+// before WriteFrame blocks.
+const pipeQueueLen = 64
+
+// NewPipe returns both ends of a pipe. Closing one end closes the pipe.
+func NewPipe(a, b PipeConf) (*Pipe, *Pipe) {
+	ab := make(chan []byte, pipeQueueLen)
+	ba := make(chan []byte, pipeQueueLen)
+	done := make(chan struct{})
+	once := &sync.Once{}
+
+	for _, c := range []*PipeConf{&a, &b} {
+		if c.MTU == 0 {
+			c.MTU = 1500
+		}
+	}
+
+	return &Pipe{conf: a, rx: ba, tx: ab, done: done, closeOnce: once},
+		&Pipe{conf: b, rx: ab, tx: ba, done: done, closeOnce: once}
+}
+
+func (p *Pipe) Name() string {
+	return p.conf.Name
+}
+
+func (p *Pipe) HardwareAddr() net.HardwareAddr {
+	return p.conf.MAC
+}
+
+func (p *Pipe) IPs() []net.IP {
+	return p.conf.IPs
+}
+
+func (p *Pipe) MTU() int {
+	return p.conf.MTU
+}
+
+func (p *Pipe) ReadFrame(buf []byte, timeout time.Duration) (int, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case frame := <-p.rx:
+		return copy(buf, frame), nil
+	case <-p.done:
+		return 0, ErrLinkClosed
+	case <-timer.C:
+		return 0, ErrLinkTimeout
+	}
+}
+
+func (p *Pipe) WriteFrame(frame []byte) error {
+	// The reader owns the frame so we give it a copy
+	b := append([]byte(nil), frame...)
+
+	select {
+	case p.tx <- b:
+		return nil
+	case <-p.done:
+		return ErrLinkClosed
+	}
+}
+
+func (p *Pipe) Close() error {
+	p.closeOnce.Do(func() { close(p.done) })
+	return nil
+}
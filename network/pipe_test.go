@@ -0,0 +1,192 @@
+package network
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+)
+
+var (
+	testHostMAC = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02}
+	testPeerMAC = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x03}
+	testHostIP  = net.IP{192, 168, 35, 2}
+	testPeerIP  = net.IP{192, 168, 35, 3}
+)
+
+// newTestStack returns a stack on one end of a pipe and the other end, that
+// plays the host.
+func newTestStack(t *testing.T) (*Stack, *Pipe) {
+	t.Helper()
+
+	peer, host := NewPipe(
+		PipeConf{Name: "peer", MAC: testPeerMAC, IPs: []net.IP{testPeerIP}},
+		PipeConf{Name: "host", MAC: testHostMAC, IPs: []net.IP{testHostIP}},
+	)
+	t.Cleanup(func() { peer.Close() })
+
+	return NewStack(slog.New(slog.DiscardHandler), peer), host
+}
+
+// readTestFrame returns the next frame written by the stack, nil if there is
+// none.
+func readTestFrame(t *testing.T, host *Pipe) []byte {
+	t.Helper()
+
+	buf := make([]byte, 65536)
+	n, err := host.ReadFrame(buf, 100*time.Millisecond)
+	if errors.Is(err, ErrLinkTimeout) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf[:n]
+}
+
+// testEthernet builds a frame sent by the host to the peer.
+func testEthernet(etherType EtherType, payload []byte) []byte {
+	return buildEthernetFrame(testPeerMAC, testHostMAC, etherType, payload)
+}
+
+// testIPv4 builds a frame with an IPv4 packet sent by the host to the peer.
+func testIPv4(proto IPv4Protocol, payload []byte) []byte {
+	p := &IPv4Packet{
+		Identification: 1,
+		TTL:            64,
+		Protocol:       proto,
+		SourceIP:       testHostIP,
+		DestIP:         testPeerIP,
+		Payload:        payload,
+	}
+	return testEthernet(EtherTypeIPv4, p.marshal())
+}
+
+func TestPipe(t *testing.T) {
+	a, b := NewPipe(PipeConf{Name: "a"}, PipeConf{Name: "b", MTU: 9000})
+
+	if a.MTU() != 1500 || b.MTU() != 9000 {
+		t.Errorf("MTU %d and %d, want 1500 and 9000", a.MTU(), b.MTU())
+	}
+
+	frame := []byte{1, 2, 3}
+	if err := a.WriteFrame(frame); err != nil {
+		t.Fatal(err)
+	}
+	frame[0] = 9 // The pipe keeps its own copy
+
+	buf := make([]byte, 16)
+	n, err := b.ReadFrame(buf, time.Second)
+	if err != nil || !bytes.Equal(buf[:n], []byte{1, 2, 3}) {
+		t.Errorf("read % x, %v", buf[:n], err)
+	}
+
+	if _, err := a.ReadFrame(buf, 10*time.Millisecond); !errors.Is(err, ErrLinkTimeout) {
+		t.Errorf("read on an empty pipe: %v, want ErrLinkTimeout", err)
+	}
+
+	b.Close()
+	if _, err := a.ReadFrame(buf, time.Second); !errors.Is(err, ErrLinkClosed) {
+		t.Errorf("read on a closed pipe: %v, want ErrLinkClosed", err)
+	}
+	if err := a.WriteFrame(frame); err != nil && !errors.Is(err, ErrLinkClosed) {
+		t.Errorf("write on a closed pipe: %v", err)
+	}
+}
+
+func TestStackOverPipe(t *testing.T) {
+	stack, host := newTestStack(t)
+
+	icmp := []byte{ICMPEchoRequest, 0, 0, 0, 0, 1, 0, 7, 'h', 'i'}
+	putTestChecksum(icmp, 2)
+
+	reply, err := stack.ProcessFrame(testIPv4(ICMPProtocol, icmp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply == nil {
+		reply = readTestFrame(t, host)
+	}
+
+	p, err := parseIPv4Packet(reply[14:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.DestIP.Equal(testHostIP) || p.Payload[0] != ICMPEchoReply || !bytes.Equal(p.Payload[4:], icmp[4:]) {
+		t.Errorf("unexpected reply to the echo request: % x", reply)
+	}
+}
+
+// putTestChecksum computes the checksum of b and writes it at offset.
+func putTestChecksum(b []byte, offset int) {
+	b[offset], b[offset+1] = 0, 0
+	cs := checksum(b)
+	b[offset], b[offset+1] = byte(cs>>8), byte(cs)
+}
+
+// A host with several addresses answers from the one it was asked for.
+func TestStackHostAddresses(t *testing.T) {
+	stack, host := newTestStack(t)
+
+	mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x10}
+	first, second := net.IP{192, 168, 35, 10}, net.IP{192, 168, 35, 11}
+	if err := stack.AddHost(Host{MAC: mac, IPs: []net.IP{first, second}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := stack.HandleUDP(7, func(req *UDPRequest) ([]UDPResponse, error) {
+		return []UDPResponse{{Payload: req.Payload}}, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	l, err := stack.ListenTCP(80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	exchange := func(frame []byte) []byte {
+		t.Helper()
+		reply, err := stack.ProcessFrame(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply == nil {
+			reply = readTestFrame(t, host)
+		}
+		if reply == nil {
+			t.Fatal("no reply")
+		}
+		return reply
+	}
+	toIP := func(dst net.IP, proto IPv4Protocol, payload []byte) []byte {
+		p := &IPv4Packet{Identification: 1, TTL: 64, Protocol: proto, SourceIP: testHostIP, DestIP: dst, Payload: payload}
+		return buildEthernetFrame(mac, testHostMAC, EtherTypeIPv4, p.marshal())
+	}
+
+	for _, ip := range []net.IP{first, second} {
+		arp := newARPRequest(testHostMAC, testHostIP, ip)
+		reply, err := parseARPPayload(exchange(testEthernet(EtherTypeARP, arp.marshal()))[14:])
+		if err != nil || !reply.SenderPA.Equal(ip) || !bytes.Equal(reply.SenderHA, mac) {
+			t.Errorf("ARP reply for %s: %+v, %v", ip, reply, err)
+		}
+
+		icmp := []byte{ICMPEchoRequest, 0, 0, 0, 0, 1, 0, 1}
+		putTestChecksum(icmp, 2)
+		udp := &UDPDatagram{SrcPort: 5000, DstPort: 7, Payload: []byte("echo")}
+		syn := &TCPSegment{SrcPort: 40000, DstPort: 80, Seq: 1, Flags: TCPSyn, Window: 1024}
+
+		requests := map[string][]byte{
+			"ICMP": toIP(ip, ICMPProtocol, icmp),
+			"UDP":  toIP(ip, UDPProtocol, udp.marshal(testHostIP, ip)),
+			"TCP":  toIP(ip, TCPProtocol, syn.marshal(testHostIP, ip)),
+		}
+		for name, frame := range requests {
+			p, err := parseIPv4Packet(exchange(frame)[14:])
+			if err != nil || !p.SourceIP.Equal(ip) {
+				t.Errorf("%s reply to %s: %v, %v", name, ip, p, err)
+			}
+		}
+	}
+}
@@ -3,6 +3,7 @@ package network
 import (
 	"errors"
 	"fmt"
+	"log/slog"
 )
 
 var ErrDecodeData = errors.New("failed to decode data")
@@ -16,25 +17,50 @@ func (e *ToDoWarning) Error() string {
 	return fmt.Sprintf("todo: %s for %s", e.Msg, e.EtherType.String())
 }
 
-func ProcessFrame(veth *Veth, data []byte) ([]byte, error) {
+// LogProcessError logs an error returned by ProcessFrame, frames that are not
+// handled are only a warning.
+func LogProcessError(logger *slog.Logger, err error) {
+	var todo *ToDoWarning
+	var unhandled *UnhandledError
+	if errors.As(err, &todo) {
+		logger.Warn("todo", "what", todo.Msg, "type", todo.EtherType.String())
+	} else if errors.As(err, &unhandled) {
+		logger.Warn("unhandled frame", "err", err)
+	} else {
+		logger.Error("failed to process frame", "err", err)
+	}
+}
+
+// ProcessFrame returns the reply to a frame received on the link of the stack.
+// The identity of the emulated host is the one of the link. The reply is nil
+// if the frame was handled but there is nothing to answer. Some frames are
+// written directly to the link instead (UDP responses, fragments, TCP
+// segments, ARP requests), callers that do not serve the link must record
+// what is written to it.
+func (s *Stack) ProcessFrame(data []byte) ([]byte, error) {
+	if s.closed.Load() {
+		return nil, ErrLinkClosed
+	}
+
 	f, err := parseEthernet(data)
 	if err != nil {
 		return nil, fmt.Errorf("%w: %s", ErrDecodeData, err)
 	}
 
+	// The identities of the VLAN of the frame, the destination address
+	// decides which one answers
+	eps := s.endpointsFor(f.VLANs)
+
 	// Dispatch based on the ethernet type
 	switch f.EtherType {
 	case EtherTypeARP:
-		return handleARP(veth.PeerName, veth.PeerIP, f.Payload)
+		return s.handleARP(eps, f.Payload)
 	case EtherTypeIPv4:
-		return handleIPv4(veth.PeerIP, f.Payload)
+		return s.handleIPv4(eps, f)
 	case EtherTypeIPv6:
-		return handleIPv6(f.Payload)
-	case EtherTypeVLAN, EtherTypeUnknown:
-		return nil, &ToDoWarning{Msg: "should we handle this", EtherType: f.EtherType}
+		return s.handleIPv6(eps, f)
 	default:
-		// If you are here it is because you modified the EtherType enum and you
-		// don't handle it here.
-		panic(fmt.Sprintf("unhandled EtherType in switch: %s", f.EtherType.String()))
+		// Bound with HandleEtherType, or an *UnhandledError
+		return s.handleEtherType(eps, f)
 	}
 }
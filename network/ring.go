@@ -0,0 +1,341 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// +--------------------------------------------------------+
+// | RX ring: Block 0 | Block 1 | ... | Block N-1            |
+// |--------------------------------------------------------|
+// | Block: Descriptor | Packet | Packet | ...               |
+// |   Descriptor: Version (4) | Offset to priv (4) |       |
+// |     Status (4) | Packets (4) | Offset to first (4) |... |
+// |   Packet: tpacket3_hdr (48) | ... | Frame (at tp_mac)  |
+// |     tp_next_offset is the offset of the next packet    |
+// +--------------------------------------------------------+
+// | TX ring: Slot 0 | Slot 1 | ... | Slot N-1              |
+// |--------------------------------------------------------|
+// | Slot: tpacket3_hdr (48) | Frame                        |
+// +--------------------------------------------------------+
+//
+// The kernel fills the RX blocks in order and gives a block to us
+// (TP_STATUS_USER) when it is full or when the retire timeout expires. We give
+// it back (TP_STATUS_KERNEL) once all its packets are read. TX slots are
+// given to the kernel with TP_STATUS_SEND_REQUEST and sent together by an
+// empty send, when enough are ready, before waiting for RX blocks or after a
+// short delay.
+//
+// [packet_mmap] https://docs.kernel.org/networking/packet_mmap.html
+const (
+	ringBlockSize   = 1 << 17 // Must be a multiple of the page size
+	ringRxBlocks    = 64
+	ringTxBlocks    = 16
+	ringRxFrameSize = 2048 // Only used to check the size of the RX ring
+	ringTxFrameSize = 4096 // Larger frames are sent with sendto
+
+	// A block is given to us after this time even if it is not full, it is
+	// the latency added to a single frame
+	ringRetireTimeoutMs = 2
+
+	// TX slots are sent once this many are ready or after this delay, it is
+	// the latency added to a frame written outside of the read loop
+	ringTxBatch      = 64
+	ringTxFlushDelay = time.Millisecond
+
+	// Frames in TX slots start after the aligned header
+	ringTxDataOffset = (unix.SizeofTpacket3Hdr + unix.TPACKET_ALIGNMENT - 1) &^ (unix.TPACKET_ALIGNMENT - 1)
+)
+
+// errTxRingFull is returned when the kernel did not send the frames of the
+// TX ring in time.
+var errTxRingFull = errors.New("TX ring full")
+
+// packetRing is the memory shared with the kernel to receive and send frames
+// of an AF_PACKET socket without a system call per frame. The TX ring is
+// optional.
+type packetRing struct {
+	fd  int
+	mem []byte
+
+	rxMu      sync.Mutex
+	rx        []byte
+	block     int // Block being read
+	next      int // Offset of the next packet in the block
+	remaining int // Packets of the block not read yet
+
+	txMu      sync.Mutex
+	tx        []byte
+	txSlots   int
+	txNext    int
+	txPending int         // Slots given to the kernel but not sent yet
+	txTimer   *time.Timer // Sends the pending slots after ringTxFlushDelay
+	txErr     error       // Error of a send of the timer, for the next write
+}
+
+// newPacketRing sets the rings up on a socket that does not receive frames
+// yet (created with protocol 0 and not bound), so no frame is queued on the
+// socket instead of the ring. It fails if the kernel does not support
+// TPACKET_V3, the socket must then be used as is.
+func newPacketRing(fd int) (*packetRing, error) {
+	if ringBlockSize%os.Getpagesize() != 0 {
+		return nil, fmt.Errorf("block size %d is not a multiple of the page size", ringBlockSize)
+	}
+
+	if err := unix.SetsockoptInt(fd, unix.SOL_PACKET, unix.PACKET_VERSION, unix.TPACKET_V3); err != nil {
+		return nil, fmt.Errorf("failed to select TPACKET_V3: %w", err)
+	}
+
+	rxReq := unix.TpacketReq3{
+		Block_size:     ringBlockSize,
+		Block_nr:       ringRxBlocks,
+		Frame_size:     ringRxFrameSize,
+		Frame_nr:       ringBlockSize / ringRxFrameSize * ringRxBlocks,
+		Retire_blk_tov: ringRetireTimeoutMs,
+	}
+	if err := unix.SetsockoptTpacketReq3(fd, unix.SOL_PACKET, unix.PACKET_RX_RING, &rxReq); err != nil {
+		return nil, fmt.Errorf("failed to create RX ring: %w", err)
+	}
+	rxSize := ringBlockSize * ringRxBlocks
+
+	// TX rings need TPACKET_V3 support for sending (Linux 4.11), without it
+	// frames are sent with sendto
+	txReq := unix.TpacketReq3{
+		Block_size: ringBlockSize,
+		Block_nr:   ringTxBlocks,
+		Frame_size: ringTxFrameSize,
+		Frame_nr:   ringBlockSize / ringTxFrameSize * ringTxBlocks,
+	}
+	txSize := 0
+	if err := unix.SetsockoptTpacketReq3(fd, unix.SOL_PACKET, unix.PACKET_TX_RING, &txReq); err == nil {
+		txSize = ringBlockSize * ringTxBlocks
+	}
+
+	// The TX ring is mapped right after the RX ring
+	mem, err := unix.Mmap(fd, 0, rxSize+txSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		// Frames would go to the unmapped ring instead of the socket
+		unix.SetsockoptTpacketReq3(fd, unix.SOL_PACKET, unix.PACKET_RX_RING, &unix.TpacketReq3{})
+		unix.SetsockoptTpacketReq3(fd, unix.SOL_PACKET, unix.PACKET_TX_RING, &unix.TpacketReq3{})
+		return nil, fmt.Errorf("failed to map rings: %w", err)
+	}
+
+	return &packetRing{
+		fd:      fd,
+		mem:     mem,
+		rx:      mem[:rxSize],
+		tx:      mem[rxSize:],
+		txSlots: txSize / ringTxFrameSize,
+	}, nil
+}
+
+func (r *packetRing) hasTx() bool {
+	return r.txSlots > 0
+}
+
+// blockHeader returns the header of an RX block.
+func (r *packetRing) blockHeader(block int) *unix.TpacketHdrV1 {
+	desc := (*unix.TpacketBlockDesc)(unsafe.Pointer(&r.rx[block*ringBlockSize]))
+	return (*unix.TpacketHdrV1)(unsafe.Pointer(&desc.Hdr[0]))
+}
+
+// ReadFrame copies the next frame of the RX ring into buf, waiting at most
+// timeout for the kernel to give a block. VLAN tags stripped by the kernel
+// are put back.
+func (r *packetRing) ReadFrame(buf []byte, timeout time.Duration) (int, error) {
+	r.rxMu.Lock()
+	defer r.rxMu.Unlock()
+
+	if r.mem == nil {
+		return 0, ErrLinkClosed
+	}
+
+	if r.remaining == 0 {
+		hdr := r.blockHeader(r.block)
+
+		if atomic.LoadUint32(&hdr.Block_status)&unix.TP_STATUS_USER == 0 {
+			// Replies to the frames read so far are sent before waiting
+			r.txMu.Lock()
+			if err := r.flushTx(); err != nil {
+				r.txErr = err
+			}
+			r.txMu.Unlock()
+
+			pollFds := []unix.PollFd{{Fd: int32(r.fd), Events: unix.POLLIN}}
+			_, err := unix.Poll(pollFds, int(timeout.Milliseconds()))
+			if err != nil && err != unix.EINTR {
+				return 0, fmt.Errorf("poll error: %w", err)
+			}
+			if pollFds[0].Revents&unix.POLLNVAL != 0 {
+				return 0, ErrLinkClosed
+			}
+			if atomic.LoadUint32(&hdr.Block_status)&unix.TP_STATUS_USER == 0 {
+				return 0, ErrLinkTimeout
+			}
+		}
+
+		r.remaining = int(hdr.Num_pkts)
+		r.next = int(hdr.Offset_to_first_pkt)
+		if r.remaining == 0 {
+			r.releaseBlock()
+			return 0, ErrLinkTimeout
+		}
+	}
+
+	block := r.rx[r.block*ringBlockSize : (r.block+1)*ringBlockSize]
+	pkt := (*unix.Tpacket3Hdr)(unsafe.Pointer(&block[r.next]))
+
+	start := r.next + int(pkt.Mac)
+	n := copy(buf, block[start:start+int(pkt.Snaplen)])
+	if pkt.Status&unix.TP_STATUS_VLAN_VALID != 0 {
+		tpid := uint16(EtherTypeVLAN)
+		if pkt.Status&unix.TP_STATUS_VLAN_TPID_VALID != 0 {
+			tpid = pkt.Hv1.Vlan_tpid
+		}
+		n = insertVLANTag(buf, n, tpid, uint16(pkt.Hv1.Vlan_tci))
+	}
+
+	r.remaining--
+	if r.remaining == 0 {
+		r.releaseBlock()
+	} else {
+		r.next += int(pkt.Next_offset)
+	}
+
+	return n, nil
+}
+
+// releaseBlock gives the current block back to the kernel, rxMu must be held.
+func (r *packetRing) releaseBlock() {
+	atomic.StoreUint32(&r.blockHeader(r.block).Block_status, unix.TP_STATUS_KERNEL)
+	r.block = (r.block + 1) % ringRxBlocks
+}
+
+// WriteFrame copies the frame in the next slot of the TX ring, the kernel
+// sends it with the next batch. It returns false without error if the frame
+// does not fit in a slot.
+func (r *packetRing) WriteFrame(frame []byte) (bool, error) {
+	if len(frame) > ringTxFrameSize-ringTxDataOffset {
+		return false, nil
+	}
+
+	r.txMu.Lock()
+	defer r.txMu.Unlock()
+
+	if r.mem == nil {
+		return true, ErrLinkClosed
+	}
+	if err := r.txErr; err != nil {
+		r.txErr = nil
+		return true, err
+	}
+
+	slot := r.tx[r.txNext*ringTxFrameSize : (r.txNext+1)*ringTxFrameSize]
+	hdr := (*unix.Tpacket3Hdr)(unsafe.Pointer(&slot[0]))
+
+	// The slot is still waiting for the kernel when all the others are used
+	if atomic.LoadUint32(&hdr.Status)&(unix.TP_STATUS_SEND_REQUEST|unix.TP_STATUS_SENDING) != 0 {
+		if err := r.waitTx(&hdr.Status); err != nil {
+			return true, err
+		}
+	}
+
+	copy(slot[ringTxDataOffset:], frame)
+	hdr.Len = uint32(len(frame))
+	hdr.Snaplen = uint32(len(frame))
+	hdr.Next_offset = 0
+	atomic.StoreUint32(&hdr.Status, unix.TP_STATUS_SEND_REQUEST)
+
+	r.txNext = (r.txNext + 1) % r.txSlots
+
+	r.txPending++
+	if r.txPending >= ringTxBatch {
+		return true, r.flushTx()
+	}
+	if r.txPending == 1 {
+		if r.txTimer == nil {
+			r.txTimer = time.AfterFunc(ringTxFlushDelay, r.flushLater)
+		} else {
+			r.txTimer.Reset(ringTxFlushDelay)
+		}
+	}
+
+	return true, nil
+}
+
+// flushTx asks the kernel to send the pending slots without waiting for it,
+// txMu must be held.
+func (r *packetRing) flushTx() error {
+	if r.txPending == 0 || r.mem == nil {
+		return nil
+	}
+
+	r.txPending = 0
+	if r.txTimer != nil {
+		r.txTimer.Stop()
+	}
+
+	if err := unix.Sendto(r.fd, nil, unix.MSG_DONTWAIT, nil); err != nil && err != unix.EAGAIN {
+		if err == unix.EBADF {
+			return ErrLinkClosed
+		}
+		return fmt.Errorf("failed to send TX ring: %w", err)
+	}
+	return nil
+}
+
+// flushLater sends the slots written since the last send, when nobody reads
+// or writes enough frames to do it.
+func (r *packetRing) flushLater() {
+	r.txMu.Lock()
+	defer r.txMu.Unlock()
+
+	if err := r.flushTx(); err != nil {
+		r.txErr = err
+	}
+}
+
+// waitTx flushes the TX ring and waits for a slot to be available, txMu must
+// be held.
+func (r *packetRing) waitTx(status *uint32) error {
+	deadline := time.Now().Add(100 * time.Millisecond)
+
+	for atomic.LoadUint32(status)&(unix.TP_STATUS_SEND_REQUEST|unix.TP_STATUS_SENDING) != 0 {
+		if time.Now().After(deadline) {
+			return errTxRingFull
+		}
+
+		// A blocking send returns once the pending frames are sent
+		if err := unix.Sendto(r.fd, nil, 0, nil); err != nil && err != unix.EAGAIN {
+			return fmt.Errorf("failed to send TX ring: %w", err)
+		}
+		r.txPending = 0
+	}
+
+	return nil
+}
+
+// Close sends the pending slots and unmaps the rings, it waits for pending
+// reads and writes. The socket must be closed after.
+func (r *packetRing) Close() error {
+	r.rxMu.Lock()
+	defer r.rxMu.Unlock()
+	r.txMu.Lock()
+	defer r.txMu.Unlock()
+
+	if r.mem == nil {
+		return nil
+	}
+	r.flushTx()
+
+	err := unix.Munmap(r.mem)
+	r.mem, r.rx, r.tx = nil, nil, nil
+	return err
+}
@@ -0,0 +1,328 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"example.com/framespector/capture"
+)
+
+// Config is what Run needs to emulate a host. Only the addresses of Veth are
+// required, everything else is optional.
+type Config struct {
+	Logger *slog.Logger // slog.Default() if nil
+
+	// Backend creating the link: "veth" (default) or "tap". Veth.Name is the
+	// name of the pair or of the TAP interface, veth0 or tap0 if empty.
+	Backend string
+	Veth    VethConf
+	// Link is used instead of creating one from Backend and Veth, for
+	// example one end of a Pipe. It is not closed by Run.
+	Link Link
+
+	// Capture receives the frames in pcapng format
+	Capture io.Writer
+	// Dissect receives the dissection of the frames in DissectFormat
+	Dissect       io.Writer
+	DissectFormat DissectFormat
+
+	ImpairRules []ImpairRule
+	ImpairSeed  uint64
+
+	Hosts          []Host
+	IPv4Validation IPv4Validation
+
+	// Scenario applies its rules to the received frames. Run returns once
+	// its last step is over, with its failures.
+	Scenario *Scenario
+
+	// Start is called once the stack is ready, before frames are processed,
+	// to bind handlers and start services. The returned function stops them
+	// before the link is removed, it can be nil.
+	Start func(s *Stack) (stop func(), err error)
+}
+
+// Run sets the link up and emulates the host until ctx is cancelled. Whatever
+// happens, everything that was set up (network interfaces, services...) is
+// cleaned up when it returns. The error is nil if it stopped because of ctx.
+func Run(ctx context.Context, conf Config) error {
+	logger := conf.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	link := conf.Link
+	if link == nil {
+		var cleanup func()
+		var err error
+
+		switch conf.Backend {
+		case "", "veth":
+			link, cleanup, err = setupVeth(logger, conf.Veth)
+		case "tap":
+			link, cleanup, err = setupTap(logger, conf.Veth)
+		default:
+			err = fmt.Errorf("%s is not a valid backend, use veth or tap", conf.Backend)
+		}
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+
+		logger.Info("Setup network done")
+	}
+
+	// Record frames if requested. The link is wrapped so frames sent by the
+	// stack on its own (ARP requests...) are also recorded.
+	if conf.Capture != nil {
+		pcap, err := capture.NewPcapngWriter(conf.Capture, link.Name())
+		if err != nil {
+			return err
+		}
+		link = &capturedLink{Link: link, pcap: pcap, logger: logger}
+	}
+
+	if conf.Dissect != nil {
+		link = &dissectedLink{Link: link, dissect: NewDissectWriter(conf.Dissect, conf.DissectFormat), logger: logger}
+	}
+
+	// Impairments are applied after the capture so it shows what is on the
+	// wire
+	if len(conf.ImpairRules) > 0 {
+		impaired := NewImpairedLink(logger, link, conf.ImpairSeed, conf.ImpairRules)
+		// Delayed frames must not be sent once the link is removed
+		defer impaired.Close()
+		link = impaired
+		logger.Info("impairing frames", "rules", len(conf.ImpairRules), "seed", conf.ImpairSeed)
+	}
+
+	// The scenario sees the frames as the stack does
+	var scenario *scenarioLink
+	if conf.Scenario != nil {
+		scenario = conf.Scenario.wrap(logger, link)
+		link = scenario
+	}
+
+	stack := NewStack(logger, link)
+	// Deferred first so it runs once the services are stopped, before the
+	// link is removed
+	defer stack.Close()
+	stack.SetIPv4Validation(conf.IPv4Validation)
+
+	for _, h := range conf.Hosts {
+		if err := stack.AddHost(h); err != nil {
+			return err
+		}
+	}
+	for _, h := range stack.Hosts() {
+		logger.Info("host added", "vlan", h.VLAN, "mac", h.MAC.String(), "ips", fmt.Sprint(h.IPs))
+	}
+
+	// Let the host side know about us
+	if err := stack.AnnounceARP(); err != nil {
+		logger.Warn(err.Error())
+	}
+
+	if conf.Start != nil {
+		stop, err := conf.Start(stack)
+		if err != nil {
+			return err
+		}
+		if stop != nil {
+			defer stop()
+		}
+	}
+
+	if scenario != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+
+		// Stop once the scenario is over and the stack handled the frames
+		// it delayed
+		conf.Scenario.start(logger)
+		go func() {
+			select {
+			case <-scenario.over:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	err := stack.Serve(ctx)
+
+	for _, n := range stack.Neighbors().Entries() {
+		logger.Debug("neighbor", "ip", n.IP.String(), "mac", n.MAC.String())
+	}
+
+	if scenario != nil {
+		err = errors.Join(err, conf.Scenario.finish())
+	}
+
+	return err
+}
+
+// Serve processes the frames received on the link of the stack and sends the
+// replies until ctx is cancelled, then it returns nil. It also returns if the
+// link is closed.
+func (s *Stack) Serve(ctx context.Context) error {
+	rawFrame := make([]byte, 4096)
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.logger.Info("stop receiving frame")
+			return nil
+		default:
+		}
+
+		// Wait at most 100ms so we are able to check ctx.Done
+		n, err := s.link.ReadFrame(rawFrame, 100*time.Millisecond)
+		if errors.Is(err, ErrLinkTimeout) {
+			continue
+		}
+
+		if errors.Is(err, ErrLinkClosed) {
+			return err
+		}
+
+		if err != nil {
+			s.logger.Error("receive error", "err", err)
+			continue
+		}
+
+		s.logger.Info("frame received", "bytes", n)
+
+		reply, err := s.ProcessFrame(rawFrame[:n])
+		if err != nil {
+			LogProcessError(s.logger, err)
+			continue
+		}
+
+		if reply == nil {
+			continue
+		}
+
+		if err := s.writeFrame(reply); err != nil {
+			s.logger.Error("failed to send reply", "err", err)
+		}
+	}
+}
+
+// setupVeth creates the virtual pair and binds a socket on the peer side. The
+// returned function removes the pair.
+func setupVeth(logger *slog.Logger, vethConf VethConf) (Link, func(), error) {
+	if vethConf.Name == "" {
+		vethConf.Name = "veth0"
+	}
+
+	veth, err := NewVeth(logger, vethConf)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := veth.Setup(); err != nil {
+		return nil, nil, err
+	}
+
+	if err := veth.CreateSocket(); err != nil {
+		veth.Cleanup()
+		return nil, nil, err
+	}
+
+	if err := veth.BindPeer(); err != nil {
+		veth.Cleanup()
+		return nil, nil, err
+	}
+
+	// At this point all fields of Veth are initialized
+	if veth.SAddr == nil {
+		veth.Cleanup()
+		return nil, nil, fmt.Errorf("socket of %s is not bound", veth.PeerName)
+	}
+
+	return veth, veth.Cleanup, nil
+}
+
+// setupTap creates the TAP interface, the host side is the TAP interface
+// itself. The returned function removes it.
+func setupTap(logger *slog.Logger, vethConf VethConf) (Link, func(), error) {
+	if vethConf.Name == "" {
+		vethConf.Name = "tap0"
+	}
+
+	tap, err := NewTap(logger, vethConf)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := tap.Setup(); err != nil {
+		return nil, nil, err
+	}
+
+	return tap, tap.Cleanup, nil
+}
+
+// capturedLink records every frame read from or written to the link.
+type capturedLink struct {
+	Link
+	pcap   *capture.PcapngWriter
+	logger *slog.Logger
+}
+
+func (c *capturedLink) ReadFrame(buf []byte, timeout time.Duration) (int, error) {
+	n, err := c.Link.ReadFrame(buf, timeout)
+	if err == nil {
+		c.write(buf[:n], capture.DirectionInbound)
+	}
+	return n, err
+}
+
+func (c *capturedLink) WriteFrame(frame []byte) error {
+	err := c.Link.WriteFrame(frame)
+	if err == nil {
+		c.write(frame, capture.DirectionOutbound)
+	}
+	return err
+}
+
+func (c *capturedLink) write(frame []byte, dir capture.Direction) {
+	if err := c.pcap.WriteFrame(time.Now(), frame, dir); err != nil {
+		c.logger.Error("failed to write capture", "err", err)
+	}
+}
+
+// dissectedLink writes the dissection of every frame read from or written to
+// the link.
+type dissectedLink struct {
+	Link
+	dissect *DissectWriter
+	logger  *slog.Logger
+}
+
+func (d *dissectedLink) ReadFrame(buf []byte, timeout time.Duration) (int, error) {
+	n, err := d.Link.ReadFrame(buf, timeout)
+	if err == nil {
+		d.write(buf[:n], "in")
+	}
+	return n, err
+}
+
+func (d *dissectedLink) WriteFrame(frame []byte) error {
+	err := d.Link.WriteFrame(frame)
+	if err == nil {
+		d.write(frame, "out")
+	}
+	return err
+}
+
+func (d *dissectedLink) write(frame []byte, dir string) {
+	if err := d.dissect.WriteFrame(time.Now(), dir, frame); err != nil {
+		d.logger.Error("failed to write dissection", "err", err)
+	}
+}
@@ -0,0 +1,1073 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A scenario file describes how the peer behaves with the frames it receives,
+// one directive per line:
+//
+//	on <condition>... <action> [<argument>...]
+//	step <name> [timeout=<duration>]
+//
+// Conditions are key=value and a rule matches a frame when all of them are
+// true. src and dst are the sender and target addresses for ARP.
+//
+//	ethertype=arp|ipv4|ipv6|0x88b5  vlan=10  src-mac=<mac>  dst-mac=<mac>
+//	src=<ip or prefix>  dst=<ip or prefix>  proto=icmp|tcp|udp|icmpv6|17
+//	ttl=64  icmp-type=8  icmp-code=0  sport=53  dport=53  arp=request|reply
+//
+// Actions:
+//
+//	pass                   the stack handles the frame as usual
+//	drop                   the frame is ignored
+//	delay <duration>       the stack handles the frame later
+//	reply [<field>...]     a templated frame is sent instead of the stack reply
+//	assert <condition>...  the frame must also match these conditions
+//
+// Rules before the first step apply during the whole scenario. The rules of a
+// step only apply while it is the current one and they are checked first. The
+// first matching rule wins. A step is over once each of its rules matched a
+// frame, then the next one starts. The scenario fails if an assert is false or
+// if a step is not over before its timeout.
+//
+// The reply goes back to the sender with the same VLAN tags. IP requests are
+// answered with a packet of the same version from their destination (ports
+// are swapped for UDP, identifier and sequence number are kept for ICMP and
+// ICMPv6), other frames with a payload of the same EtherType. Fields change
+// the defaults:
+//
+//	ethertype=<type>  send a payload of this EtherType, even for IPv4
+//	proto=<proto> src=<ip> ttl=<ttl or hop limit> type=<icmp type> code=<icmp code>
+//	sport=<port> dport=<port>
+//	data=<text> or hex=<bytes>  payload, the one of the request by default
+//
+// data and hex can use the fields of the request: {src} {dst} {src-mac}
+// {dst-mac} {sport} {dport} and {payload}, written as text in data and as
+// bytes in hex. Values with spaces are quoted, lines starting with '#' are
+// comments. For example:
+//
+//	on proto=udp dport=9 drop
+//	on ethertype=0x88b5 reply hex=01{src-mac}
+//
+//	step resolve timeout=5s
+//	on proto=udp dport=53 assert ttl=64
+//
+//	step ping timeout=5s
+//	on proto=icmp icmp-type=8 reply data="pong from {dst}"
+type Scenario struct {
+	rules []*scenarioRule
+	steps []*scenarioStep
+
+	logger *slog.Logger
+
+	mu      sync.Mutex
+	current int // Index of the current step, len(steps) once over
+	timer   *time.Timer
+	errs    []error
+	done    chan struct{}
+}
+
+type scenarioStep struct {
+	name    string
+	line    int
+	timeout time.Duration // 0 for no timeout
+	rules   []*scenarioRule
+}
+
+type scenarioAction int
+
+const (
+	scenarioPass scenarioAction = iota
+	scenarioDrop
+	scenarioDelay
+	scenarioReplyAction
+	scenarioAssert
+)
+
+type scenarioRule struct {
+	line       int
+	conditions []scenarioCondition
+	action     scenarioAction
+	delay      time.Duration
+	asserts    []scenarioCondition
+	reply      *scenarioReply
+
+	matched bool // For the rules of a step
+}
+
+type scenarioCondition struct {
+	text  string
+	match func(f *scenarioFrame) bool
+}
+
+// LoadScenario reads a scenario file.
+func LoadScenario(path string) (*Scenario, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sc, err := ParseScenario(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return sc, nil
+}
+
+func ParseScenario(r io.Reader) (*Scenario, error) {
+	sc := &Scenario{done: make(chan struct{})}
+
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		fields, err := scenarioFields(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+
+		switch fields[0] {
+		case "step":
+			step, err := parseScenarioStep(fields[1:])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNum, err)
+			}
+			step.line = lineNum
+			sc.steps = append(sc.steps, step)
+		case "on":
+			rule, err := parseScenarioRule(fields[1:])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNum, err)
+			}
+			rule.line = lineNum
+			if len(sc.steps) == 0 {
+				sc.rules = append(sc.rules, rule)
+			} else {
+				step := sc.steps[len(sc.steps)-1]
+				step.rules = append(step.rules, rule)
+			}
+		default:
+			return nil, fmt.Errorf("line %d: unknown directive %s, expecting on or step", lineNum, fields[0])
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, step := range sc.steps {
+		if len(step.rules) == 0 {
+			return nil, fmt.Errorf("line %d: step %s has no rule", step.line, step.name)
+		}
+	}
+
+	return sc, nil
+}
+
+// scenarioFields splits a line on spaces, the value of a key can be a quoted
+// string: data="hello world".
+func scenarioFields(line string) ([]string, error) {
+	var fields []string
+
+	for line = strings.TrimSpace(line); line != ""; line = strings.TrimSpace(line) {
+		end := strings.IndexAny(line, " \t")
+		if end < 0 {
+			end = len(line)
+		}
+
+		if eq := strings.IndexByte(line[:end], '='); eq >= 0 && strings.HasPrefix(line[eq+1:], `"`) {
+			quoted, err := strconv.QuotedPrefix(line[eq+1:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid quoted value %s", line[eq+1:])
+			}
+			value, _ := strconv.Unquote(quoted)
+			fields = append(fields, line[:eq+1]+value)
+			line = line[eq+1+len(quoted):]
+			continue
+		}
+
+		fields = append(fields, line[:end])
+		line = line[end:]
+	}
+
+	return fields, nil
+}
+
+func parseScenarioStep(fields []string) (*scenarioStep, error) {
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("expecting: step <name> [timeout=<duration>]")
+	}
+
+	step := &scenarioStep{name: fields[0]}
+	for _, kv := range fields[1:] {
+		value, found := strings.CutPrefix(kv, "timeout=")
+		if !found {
+			return nil, fmt.Errorf("expecting: step <name> [timeout=<duration>]")
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid timeout %s", value)
+		}
+		step.timeout = d
+	}
+
+	return step, nil
+}
+
+func parseScenarioRule(fields []string) (*scenarioRule, error) {
+	rule := &scenarioRule{}
+
+	// Conditions go until the action
+	i := 0
+	for ; i < len(fields) && strings.Contains(fields[i], "="); i++ {
+		cond, err := parseScenarioCondition(fields[i])
+		if err != nil {
+			return nil, err
+		}
+		rule.conditions = append(rule.conditions, cond)
+	}
+	if i == len(fields) {
+		return nil, fmt.Errorf("missing action: pass, drop, delay, reply or assert")
+	}
+
+	action, args := fields[i], fields[i+1:]
+
+	switch action {
+	case "pass", "drop":
+		if len(args) > 0 {
+			return nil, fmt.Errorf("%s has no argument", action)
+		}
+		rule.action = scenarioPass
+		if action == "drop" {
+			rule.action = scenarioDrop
+		}
+	case "delay":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("expecting: delay <duration>")
+		}
+		d, err := time.ParseDuration(args[0])
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid delay %s", args[0])
+		}
+		rule.action = scenarioDelay
+		rule.delay = d
+	case "reply":
+		reply, err := parseScenarioReply(args)
+		if err != nil {
+			return nil, err
+		}
+		rule.action = scenarioReplyAction
+		rule.reply = reply
+	case "assert":
+		if len(args) == 0 {
+			return nil, fmt.Errorf("expecting: assert <condition>...")
+		}
+		for _, kv := range args {
+			cond, err := parseScenarioCondition(kv)
+			if err != nil {
+				return nil, err
+			}
+			rule.asserts = append(rule.asserts, cond)
+		}
+		rule.action = scenarioAssert
+	default:
+		return nil, fmt.Errorf("unknown action %s, expecting pass, drop, delay, reply or assert", action)
+	}
+
+	return rule, nil
+}
+
+func parseScenarioCondition(kv string) (scenarioCondition, error) {
+	cond := scenarioCondition{text: kv}
+	key, value, _ := strings.Cut(kv, "=")
+
+	var err error
+	switch key {
+	case "ethertype":
+		var et EtherType
+		et, err = parseEtherTypeName(value)
+		cond.match = func(f *scenarioFrame) bool { return f.eth.EtherType == et }
+	case "vlan":
+		var id uint64
+		id, err = strconv.ParseUint(value, 10, 12)
+		cond.match = func(f *scenarioFrame) bool { return uint64(vlanID(f.eth.VLANs)) == id }
+	case "src-mac", "dst-mac":
+		var mac net.HardwareAddr
+		mac, err = net.ParseMAC(value)
+		cond.match = func(f *scenarioFrame) bool {
+			if key == "src-mac" {
+				return bytes.Equal(f.eth.SrcMAC, mac)
+			}
+			return bytes.Equal(f.eth.DestMAC, mac)
+		}
+	case "src", "dst":
+		var prefix netip.Prefix
+		prefix, err = parseScenarioPrefix(value)
+		cond.match = func(f *scenarioFrame) bool {
+			if key == "src" {
+				return prefix.Contains(f.src)
+			}
+			return prefix.Contains(f.dst)
+		}
+	case "proto":
+		var proto IPv4Protocol
+		proto, err = parseProtocolName(value)
+		cond.match = func(f *scenarioFrame) bool { return f.ip && f.proto == proto }
+	case "ttl":
+		var ttl uint64
+		ttl, err = strconv.ParseUint(value, 10, 8)
+		cond.match = func(f *scenarioFrame) bool { return f.ip && uint64(f.ttl) == ttl }
+	case "icmp-type", "icmp-code":
+		var v uint64
+		v, err = strconv.ParseUint(value, 10, 8)
+		cond.match = func(f *scenarioFrame) bool {
+			if key == "icmp-type" {
+				return f.icmp && uint64(f.icmpType) == v
+			}
+			return f.icmp && uint64(f.icmpCode) == v
+		}
+	case "sport", "dport":
+		var port uint64
+		port, err = strconv.ParseUint(value, 10, 16)
+		cond.match = func(f *scenarioFrame) bool {
+			if key == "sport" {
+				return f.ports && uint64(f.sport) == port
+			}
+			return f.ports && uint64(f.dport) == port
+		}
+	case "arp":
+		var op ARPOper
+		switch value {
+		case "request":
+			op = ARPRequest
+		case "reply":
+			op = ARPReply
+		default:
+			var v uint64
+			v, err = strconv.ParseUint(value, 10, 16)
+			op = ARPOper(v)
+		}
+		cond.match = func(f *scenarioFrame) bool { return f.arp != nil && f.arp.Oper == op }
+	default:
+		err = fmt.Errorf("unknown key")
+	}
+
+	if err != nil {
+		return cond, fmt.Errorf("invalid condition %q: %w", kv, err)
+	}
+	return cond, nil
+}
+
+// parseScenarioPrefix reads an address or a prefix, an address is a prefix
+// of its full length.
+func parseScenarioPrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		return prefix.Masked(), err
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// ------------------------------------------------------------------------------
+// Frames
+
+// scenarioFrame holds the fields of a received frame used by the rules.
+// Flags tell which layers were found.
+type scenarioFrame struct {
+	eth *EthernetFrame
+	arp *ARPPacket
+	ip4 *IPv4Packet
+
+	ip       bool
+	src, dst netip.Addr
+	proto    IPv4Protocol
+	ttl      uint8
+
+	icmp               bool // ICMP or ICMPv6
+	icmpType, icmpCode uint8
+	ports              bool // TCP or UDP
+	sport, dport       uint16
+
+	l4      []byte // Data after the IP header
+	payload []byte // Data of the upper layer
+}
+
+func decodeScenarioFrame(frame []byte) (*scenarioFrame, error) {
+	eth, err := parseEthernet(frame)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &scenarioFrame{eth: eth, payload: eth.Payload}
+
+	switch eth.EtherType {
+	case EtherTypeARP:
+		if p, err := parseARPPayload(eth.Payload); err == nil && p.PLen == 4 {
+			f.arp = p
+			f.src, _ = netip.AddrFromSlice(p.SenderPA.To4())
+			f.dst, _ = netip.AddrFromSlice(p.TargetPA.To4())
+		}
+		return f, nil
+
+	case EtherTypeIPv4:
+		p, err := parseIPv4Packet(eth.Payload)
+		if err != nil {
+			return f, nil
+		}
+		f.ip4 = p
+		f.ip, f.proto, f.ttl, f.l4 = true, p.Protocol, p.TTL, p.Payload
+		f.src, _ = netip.AddrFromSlice(p.SourceIP.To4())
+		f.dst, _ = netip.AddrFromSlice(p.DestIP.To4())
+
+		// Only the first fragment has the upper layer header
+		if p.FlagsFragOffset&ipv4FragOffsetMax != 0 {
+			f.payload = f.l4
+			return f, nil
+		}
+
+	case EtherTypeIPv6:
+		p, err := parseIPv6Packet(eth.Payload)
+		if err != nil {
+			return f, nil
+		}
+		f.ip, f.proto, f.ttl, f.l4 = true, p.Protocol, p.HopLimit, p.Payload
+		f.src, _ = netip.AddrFromSlice(p.SourceIP)
+		f.dst, _ = netip.AddrFromSlice(p.DestIP)
+
+	default:
+		return f, nil
+	}
+
+	f.payload = f.l4
+
+	switch f.proto {
+	case ICMPProtocol, IPv6ICMP:
+		if len(f.l4) >= 8 {
+			f.icmp = true
+			f.icmpType, f.icmpCode = f.l4[0], f.l4[1]
+			f.payload = f.l4[8:]
+		}
+	case UDPProtocol, TCPProtocol:
+		if len(f.l4) >= 8 {
+			f.ports = true
+			f.sport = binary.BigEndian.Uint16(f.l4[0:2])
+			f.dport = binary.BigEndian.Uint16(f.l4[2:4])
+			f.payload = f.l4[8:]
+		}
+		if f.proto == TCPProtocol && len(f.l4) >= 20 {
+			if off := int(f.l4[12]>>4) * 4; off >= 20 && off <= len(f.l4) {
+				f.payload = f.l4[off:]
+			}
+		}
+	}
+
+	return f, nil
+}
+
+func (r *scenarioRule) matches(f *scenarioFrame) bool {
+	for _, c := range r.conditions {
+		if !c.match(f) {
+			return false
+		}
+	}
+	return true
+}
+
+// ------------------------------------------------------------------------------
+// Replies
+
+// scenarioReply is the template of a reply, negative values are the
+// defaults taken from the request.
+type scenarioReply struct {
+	etherType EtherType // 0 for the default
+	proto     int
+	src       net.IP
+	ttl       uint8
+	icmpType  int
+	icmpCode  int
+	sport     int
+	dport     int
+
+	data string
+	hex  bool
+}
+
+var scenarioVars = []string{"src", "dst", "src-mac", "dst-mac", "sport", "dport", "payload"}
+
+func parseScenarioReply(fields []string) (*scenarioReply, error) {
+	r := &scenarioReply{
+		proto: -1, ttl: defaultTTL, icmpType: -1, icmpCode: 0, sport: -1, dport: -1,
+		data: "{payload}",
+	}
+
+	for _, kv := range fields {
+		key, value, found := strings.Cut(kv, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid reply field %q, expecting key=value", kv)
+		}
+
+		var err error
+		switch key {
+		case "ethertype":
+			r.etherType, err = parseEtherTypeName(value)
+		case "proto":
+			var proto IPv4Protocol
+			proto, err = parseProtocolName(value)
+			r.proto = int(proto)
+		case "src":
+			if r.src = net.ParseIP(value); r.src == nil {
+				err = fmt.Errorf("expecting an IP address")
+			}
+		case "ttl":
+			r.ttl, err = parseScenarioUint8(value)
+		case "type", "code":
+			var v uint8
+			v, err = parseScenarioUint8(value)
+			if key == "type" {
+				r.icmpType = int(v)
+			} else {
+				r.icmpCode = int(v)
+			}
+		case "sport", "dport":
+			var v uint64
+			v, err = strconv.ParseUint(value, 10, 16)
+			if key == "sport" {
+				r.sport = int(v)
+			} else {
+				r.dport = int(v)
+			}
+		case "data", "hex":
+			r.data, r.hex = value, key == "hex"
+			// Check the template with an empty request
+			_, err = r.payload(&scenarioFrame{eth: &EthernetFrame{}})
+		default:
+			err = fmt.Errorf("unknown key")
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid reply field %q: %w", kv, err)
+		}
+	}
+
+	return r, nil
+}
+
+func parseScenarioUint8(s string) (uint8, error) {
+	v, err := strconv.ParseUint(s, 10, 8)
+	return uint8(v), err
+}
+
+// payload expands the template of the data with the fields of the request.
+func (r *scenarioReply) payload(f *scenarioFrame) ([]byte, error) {
+	var sb strings.Builder
+
+	for s := r.data; s != ""; {
+		start := strings.IndexByte(s, '{')
+		if start < 0 {
+			sb.WriteString(s)
+			break
+		}
+		end := strings.IndexByte(s[start:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("missing } after %s", s[start:])
+		}
+		end += start
+
+		value, err := f.templateValue(s[start+1:end], r.hex)
+		if err != nil {
+			return nil, err
+		}
+
+		sb.WriteString(s[:start])
+		sb.WriteString(value)
+		s = s[end+1:]
+	}
+
+	if !r.hex {
+		return []byte(sb.String()), nil
+	}
+
+	// Bytes can be separated for readability: 01:02 or "01 02"
+	digits := strings.NewReplacer(" ", "", ":", "").Replace(sb.String())
+	b, err := hex.DecodeString(digits)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex %s", digits)
+	}
+	return b, nil
+}
+
+// templateValue returns the value of a field of the request as text or as
+// hex digits.
+func (f *scenarioFrame) templateValue(name string, asHex bool) (string, error) {
+	var b []byte
+	var text string
+
+	switch name {
+	case "src", "dst":
+		addr := f.src
+		if name == "dst" {
+			addr = f.dst
+		}
+		if addr.IsValid() {
+			b, text = addr.AsSlice(), addr.String()
+		}
+	case "src-mac", "dst-mac":
+		mac := f.eth.SrcMAC
+		if name == "dst-mac" {
+			mac = f.eth.DestMAC
+		}
+		b, text = mac, mac.String()
+	case "sport", "dport":
+		port := f.sport
+		if name == "dport" {
+			port = f.dport
+		}
+		b, text = binary.BigEndian.AppendUint16(nil, port), strconv.Itoa(int(port))
+	case "payload":
+		b, text = f.payload, string(f.payload)
+	default:
+		return "", fmt.Errorf("unknown field {%s}, expecting one of %s", name, strings.Join(scenarioVars, " "))
+	}
+
+	if asHex {
+		return hex.EncodeToString(b), nil
+	}
+	return text, nil
+}
+
+// build returns the frames of the reply to f. mac is the source when the
+// request was not sent to a unicast address. IPv4 replies larger than mtu are
+// fragmented, IPv6 ones are an error.
+func (r *scenarioReply) build(f *scenarioFrame, mac net.HardwareAddr, id uint16, mtu int) ([][]byte, error) {
+	payload, err := r.payload(f)
+	if err != nil {
+		return nil, err
+	}
+
+	src := f.eth.DestMAC
+	if len(src) != 6 || src[0]&1 != 0 {
+		src = mac
+	}
+
+	var et EtherType
+	var packets [][]byte
+
+	switch {
+	case r.etherType != 0 || !f.ip:
+		et = r.etherType
+		if et == 0 {
+			et = f.eth.EtherType
+		}
+		packets = [][]byte{payload}
+	case f.ip4 != nil:
+		et = EtherTypeIPv4
+		packets, err = r.buildIPv4(f, payload, id, mtu)
+	default:
+		et = EtherTypeIPv6
+		var packet []byte
+		packet, err = r.buildIPv6(f, payload, mtu)
+		packets = [][]byte{packet}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	frames := make([][]byte, len(packets))
+	for i, packet := range packets {
+		frames[i] = buildTaggedFrame(f.eth.SrcMAC, src, f.eth.VLANs, et, packet)
+	}
+	return frames, nil
+}
+
+// buildIPv4 returns the fragments of the IPv4 reply.
+func (r *scenarioReply) buildIPv4(f *scenarioFrame, payload []byte, id uint16, mtu int) ([][]byte, error) {
+	p := &IPv4Packet{
+		Identification: id,
+		TTL:            r.ttl,
+		Protocol:       f.proto,
+		SourceIP:       f.ip4.DestIP,
+		DestIP:         f.ip4.SourceIP,
+	}
+	if r.proto >= 0 {
+		p.Protocol = IPv4Protocol(r.proto)
+	}
+	if r.src != nil {
+		if p.SourceIP = r.src.To4(); p.SourceIP == nil {
+			return nil, fmt.Errorf("source %s of the reply is not an IPv4 address", r.src)
+		}
+	}
+
+	switch p.Protocol {
+	case ICMPProtocol:
+		icmp := &ICMPPacket{Code: uint8(r.icmpCode), Data: payload}
+		if f.icmp {
+			icmp.Type = f.icmpType
+			if f.icmpType == ICMPEchoRequest {
+				icmp.Type = ICMPEchoReply
+			}
+			icmp.Identifier = binary.BigEndian.Uint16(f.l4[4:6])
+			icmp.SequenceNumber = binary.BigEndian.Uint16(f.l4[6:8])
+		}
+		if r.icmpType >= 0 {
+			icmp.Type = ICMPType(r.icmpType)
+		}
+		payload = icmp.marshal()
+
+	case UDPProtocol:
+		payload = r.udp(f, payload).marshal(p.SourceIP, p.DestIP)
+	}
+	p.Payload = payload
+
+	return fragmentIPv4(p.marshal(), mtu)
+}
+
+// buildIPv6 returns the IPv6 reply, without extension headers.
+func (r *scenarioReply) buildIPv6(f *scenarioFrame, payload []byte, mtu int) ([]byte, error) {
+	p := &IPv6Packet{
+		HopLimit: r.ttl,
+		Protocol: f.proto,
+		SourceIP: net.IP(f.dst.AsSlice()),
+		DestIP:   net.IP(f.src.AsSlice()),
+	}
+	if r.proto >= 0 {
+		p.Protocol = IPv6NextHeader(r.proto)
+	}
+	if r.src != nil {
+		if r.src.To4() != nil {
+			return nil, fmt.Errorf("source %s of the reply is not an IPv6 address", r.src)
+		}
+		p.SourceIP = r.src
+	}
+
+	switch p.Protocol {
+	case IPv6ICMP:
+		// Identifier and sequence number of echo messages start the body
+		m := &ICMPv6Packet{Code: uint8(r.icmpCode), Body: make([]byte, 4+len(payload))}
+		if f.icmp {
+			m.Type = f.icmpType
+			if f.icmpType == ICMPv6EchoRequest {
+				m.Type = ICMPv6EchoReply
+			}
+			copy(m.Body[0:4], f.l4[4:8])
+		}
+		if r.icmpType >= 0 {
+			m.Type = ICMPv6Type(r.icmpType)
+		}
+		copy(m.Body[4:], payload)
+		payload = m.marshal(p.SourceIP, p.DestIP)
+
+	case IPv6UDP:
+		// The checksum is mandatory with IPv6 (RFC 8200 section 8.1)
+		payload = r.udp(f, payload).marshal(p.SourceIP, p.DestIP)
+		binary.BigEndian.PutUint16(payload[6:8], 0)
+		cs := pseudoHeaderChecksum6(p.SourceIP, p.DestIP, IPv6UDP, payload)
+		if cs == 0 {
+			cs = 0xFFFF
+		}
+		binary.BigEndian.PutUint16(payload[6:8], cs)
+	}
+	p.Payload = payload
+
+	if 40+len(payload) > mtu {
+		return nil, fmt.Errorf("IPv6 reply of %d bytes larger than the MTU %d", 40+len(payload), mtu)
+	}
+	return p.marshal(), nil
+}
+
+// udp returns the datagram of the reply, the ports of the request are swapped
+// by default.
+func (r *scenarioReply) udp(f *scenarioFrame, payload []byte) *UDPDatagram {
+	d := &UDPDatagram{Payload: payload}
+	if f.ports {
+		d.SrcPort, d.DstPort = f.dport, f.sport
+	}
+	if r.sport >= 0 {
+		d.SrcPort = uint16(r.sport)
+	}
+	if r.dport >= 0 {
+		d.DstPort = uint16(r.dport)
+	}
+	return d
+}
+
+// ------------------------------------------------------------------------------
+// Progress
+
+// start begins the first step.
+func (sc *Scenario) start(logger *slog.Logger) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	sc.logger = logger
+	logger.Info("scenario started", "rules", len(sc.rules), "steps", len(sc.steps))
+	sc.startStep()
+}
+
+// startStep arms the timeout of the current step, sc.mu must be held.
+func (sc *Scenario) startStep() {
+	if sc.current >= len(sc.steps) {
+		return
+	}
+
+	step := sc.steps[sc.current]
+	sc.logger.Info("scenario: step started", "step", step.name)
+
+	if step.timeout > 0 {
+		current := sc.current
+		sc.timer = time.AfterFunc(step.timeout, func() {
+			sc.mu.Lock()
+			defer sc.mu.Unlock()
+
+			if sc.current == current {
+				sc.fail(fmt.Errorf("step %s: nothing matched line %d after %s", step.name, step.pending().line, step.timeout))
+				sc.end()
+			}
+		})
+	}
+}
+
+// pending returns the first rule of the step that did not match yet, nil
+// once the step is over.
+func (step *scenarioStep) pending() *scenarioRule {
+	for _, r := range step.rules {
+		if !r.matched {
+			return r
+		}
+	}
+	return nil
+}
+
+// fail records an error, sc.mu must be held.
+func (sc *Scenario) fail(err error) {
+	sc.logger.Error("scenario: " + err.Error())
+	sc.errs = append(sc.errs, err)
+}
+
+// end stops the scenario, sc.mu must be held.
+func (sc *Scenario) end() {
+	sc.current = len(sc.steps)
+	if sc.timer != nil {
+		sc.timer.Stop()
+	}
+	close(sc.done)
+}
+
+// match returns the rule that applies to the frame, nil if none does, and
+// moves to the next step when the current one is over.
+func (sc *Scenario) match(f *scenarioFrame) *scenarioRule {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	var step *scenarioStep
+	rules := sc.rules
+	if sc.current < len(sc.steps) {
+		step = sc.steps[sc.current]
+		rules = append(step.rules[:len(step.rules):len(step.rules)], rules...)
+	}
+
+	for i, r := range rules {
+		if !r.matches(f) {
+			continue
+		}
+
+		sc.logger.Debug("scenario: rule matched", "line", r.line)
+
+		for _, c := range r.asserts {
+			if !c.match(f) {
+				sc.fail(fmt.Errorf("line %d: assert %s failed", r.line, c.text))
+			}
+		}
+
+		if step != nil && i < len(step.rules) {
+			r.matched = true
+			if step.pending() == nil {
+				sc.nextStep()
+			}
+		}
+
+		return r
+	}
+
+	return nil
+}
+
+// nextStep ends the current step, sc.mu must be held.
+func (sc *Scenario) nextStep() {
+	if sc.timer != nil {
+		sc.timer.Stop()
+		sc.timer = nil
+	}
+
+	sc.logger.Info("scenario: step over", "step", sc.steps[sc.current].name)
+
+	sc.current++
+	if sc.current == len(sc.steps) {
+		sc.end()
+		return
+	}
+	sc.startStep()
+}
+
+// Done is closed when the last step is over or when a step timed out. It is
+// never closed for a scenario without steps.
+func (sc *Scenario) Done() <-chan struct{} {
+	return sc.done
+}
+
+// Err returns the failures of the scenario so far.
+func (sc *Scenario) Err() error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	return errors.Join(sc.errs...)
+}
+
+// finish returns the result of the scenario once the peer stops. Stopping
+// before the last step is over is a failure.
+func (sc *Scenario) finish() error {
+	sc.mu.Lock()
+	if sc.current < len(sc.steps) {
+		step := sc.steps[sc.current]
+		sc.fail(fmt.Errorf("step %s: stopped before line %d matched", step.name, step.pending().line))
+		sc.end()
+	}
+	err := errors.Join(sc.errs...)
+	sc.mu.Unlock()
+
+	if err == nil {
+		sc.logger.Info("scenario passed")
+	}
+	return err
+}
+
+// ------------------------------------------------------------------------------
+// Link
+
+type scenarioFrameAt struct {
+	at   time.Time
+	data []byte
+}
+
+// scenarioLink applies the rules of a scenario to the frames read by the
+// stack. Replies of the scenario are written directly on the link.
+type scenarioLink struct {
+	Link
+	sc     *Scenario
+	logger *slog.Logger
+
+	// Delayed frames sorted by time, only used by ReadFrame
+	delayed []scenarioFrameAt
+	ipID    uint16
+
+	// Closed once the scenario is done and the delayed frames are read
+	over     chan struct{}
+	overDone bool
+}
+
+func (sc *Scenario) wrap(logger *slog.Logger, link Link) *scenarioLink {
+	return &scenarioLink{Link: link, sc: sc, logger: logger, over: make(chan struct{})}
+}
+
+// ReadFrame returns the next frame the stack must handle.
+func (l *scenarioLink) ReadFrame(buf []byte, timeout time.Duration) (int, error) {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		if !l.overDone && len(l.delayed) == 0 {
+			select {
+			case <-l.sc.done:
+				close(l.over)
+				l.overDone = true
+			default:
+			}
+		}
+
+		now := time.Now()
+		if len(l.delayed) > 0 && !l.delayed[0].at.After(now) {
+			n := copy(buf, l.delayed[0].data)
+			l.delayed = l.delayed[1:]
+			return n, nil
+		}
+
+		wait := deadline.Sub(now)
+		if wait <= 0 {
+			return 0, ErrLinkTimeout
+		}
+		if len(l.delayed) > 0 {
+			wait = min(wait, l.delayed[0].at.Sub(now))
+		}
+
+		n, err := l.Link.ReadFrame(buf, wait)
+		if errors.Is(err, ErrLinkTimeout) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		f, err := decodeScenarioFrame(buf[:n])
+		if err != nil {
+			// The stack reports it
+			return n, nil
+		}
+
+		r := l.sc.match(f)
+		if r == nil {
+			return n, nil
+		}
+
+		switch r.action {
+		case scenarioDrop:
+			l.logger.Debug("scenario: frame dropped", "line", r.line)
+		case scenarioDelay:
+			l.delayed = append(l.delayed, scenarioFrameAt{at: now.Add(r.delay), data: append([]byte(nil), buf[:n]...)})
+			sort.SliceStable(l.delayed, func(i, j int) bool { return l.delayed[i].at.Before(l.delayed[j].at) })
+		case scenarioReplyAction:
+			l.reply(r, f)
+		default:
+			return n, nil
+		}
+	}
+}
+
+func (l *scenarioLink) reply(r *scenarioRule, f *scenarioFrame) {
+	l.ipID++
+	frames, err := r.reply.build(f, l.HardwareAddr(), l.ipID, l.MTU())
+	if err != nil {
+		l.logger.Error("scenario: failed to build reply", "line", r.line, "err", err)
+		return
+	}
+
+	for _, frame := range frames {
+		if err := l.Link.WriteFrame(frame); err != nil {
+			l.logger.Error("scenario: failed to send reply", "line", r.line, "err", err)
+			return
+		}
+	}
+	l.logger.Info("scenario: reply sent", "line", r.line, "frames", len(frames))
+}
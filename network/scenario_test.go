@@ -0,0 +1,340 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+)
+
+var (
+	testHostIP6 = net.ParseIP("fd00::2")
+	testPeerIP6 = net.ParseIP("fd00::3")
+)
+
+// testIPv6 builds a frame with an IPv6 packet sent by the host to the peer.
+func testIPv6(proto IPv6NextHeader, payload []byte) []byte {
+	p := &IPv6Packet{HopLimit: 64, Protocol: proto, SourceIP: testHostIP6, DestIP: testPeerIP6, Payload: payload}
+	return testEthernet(EtherTypeIPv6, p.marshal())
+}
+
+func TestParseScenario(t *testing.T) {
+	tests := []struct {
+		name   string
+		text   string
+		rules  int
+		steps  []int // Rules of each step
+		errMsg string
+	}{
+		{"empty", "# nothing\n\n", 0, nil, ""},
+		{"rules", "on proto=udp dport=9 drop\non ethertype=0x88b5 reply hex=01{src-mac}\non pass", 3, nil, ""},
+		{"steps", `
+on arp=request pass
+step resolve timeout=5s
+on proto=udp dport=53 assert ttl=64
+step ping
+on proto=icmp icmp-type=8 reply data="pong from {dst}"
+on src=192.168.35.0/24 delay 10ms
+`, 1, []int{1, 2}, ""},
+		{"unknown directive", "when proto=udp drop", 0, nil, "line 1: unknown directive"},
+		{"missing action", "\non proto=udp", 0, nil, "line 2: missing action"},
+		{"unknown action", "on proto=udp reject", 0, nil, "unknown action reject"},
+		{"unknown key", "on port=53 drop", 0, nil, `invalid condition "port=53"`},
+		{"invalid vlan", "on vlan=4096 drop", 0, nil, `invalid condition "vlan=4096"`},
+		{"invalid prefix", "on src=10.0.0.0/33 drop", 0, nil, `invalid condition "src=10.0.0.0/33"`},
+		{"drop argument", "on drop now", 0, nil, "drop has no argument"},
+		{"negative delay", "on delay -1s", 0, nil, "invalid delay"},
+		{"empty assert", "on proto=udp assert", 0, nil, "expecting: assert"},
+		{"step without name", "step", 0, nil, "expecting: step"},
+		{"step timeout", "step a timeout=0s\non pass", 0, nil, "invalid timeout"},
+		{"empty step", "step a\nstep b\non pass", 0, nil, "line 1: step a has no rule"},
+		{"unquoted value", `on reply data="open`, 0, nil, "invalid quoted value"},
+		{"reply field", "on reply ttl=300", 0, nil, `invalid reply field "ttl=300"`},
+		{"reply src", "on reply src=host", 0, nil, `invalid reply field "src=host"`},
+		{"reply template", "on reply data={mac}", 0, nil, "unknown field {mac}"},
+		{"reply hex", "on reply hex=0g", 0, nil, "invalid hex"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, err := ParseScenario(strings.NewReader(tt.text))
+			if tt.errMsg != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+					t.Fatalf("error %v, want %q", err, tt.errMsg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(sc.rules) != tt.rules || len(sc.steps) != len(tt.steps) {
+				t.Fatalf("%d rules and %d steps, want %d and %d", len(sc.rules), len(sc.steps), tt.rules, len(tt.steps))
+			}
+			for i, n := range tt.steps {
+				if len(sc.steps[i].rules) != n {
+					t.Errorf("step %s has %d rules, want %d", sc.steps[i].name, len(sc.steps[i].rules), n)
+				}
+			}
+		})
+	}
+}
+
+func TestScenarioFields(t *testing.T) {
+	fields, err := scenarioFields(`on  proto=udp	reply data="a \"quoted\" text" hex=01`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"on", "proto=udp", "reply", `data=a "quoted" text`, "hex=01"}
+	if strings.Join(fields, "|") != strings.Join(want, "|") {
+		t.Errorf("fields %q, want %q", fields, want)
+	}
+}
+
+func TestScenarioConditions(t *testing.T) {
+	udp := (&UDPDatagram{SrcPort: 4000, DstPort: 53}).marshal(testHostIP, testPeerIP)
+	echo := []byte{ICMPEchoRequest, 0, 0, 0, 0, 1, 0, 1}
+	echo6 := (&ICMPv6Packet{Type: ICMPv6EchoRequest, Body: []byte{0, 1, 0, 1}}).marshal(testHostIP6, testPeerIP6)
+	arp := (&ARPPacket{
+		HWType: 1, PType: uint16(EtherTypeIPv4), HWLen: 6, PLen: 4, Oper: ARPRequest,
+		SenderHA: testHostMAC, SenderPA: testHostIP, TargetHA: make(net.HardwareAddr, 6), TargetPA: testPeerIP,
+	}).marshal()
+	tagged := buildTaggedFrame(testPeerMAC, testHostMAC, []VLANTag{{TPID: EtherTypeVLAN, VID: 10}}, EtherTypeIPv4, udp)
+
+	tests := []struct {
+		cond  string
+		frame []byte
+		want  bool
+	}{
+		{"ethertype=ipv4", testIPv4(UDPProtocol, udp), true},
+		{"ethertype=arp", testIPv4(UDPProtocol, udp), false},
+		{"vlan=10", tagged, true},
+		{"vlan=0", testIPv4(UDPProtocol, udp), true},
+		{"src-mac=02:00:00:00:00:02", testIPv4(UDPProtocol, udp), true},
+		{"dst-mac=02:00:00:00:00:02", testIPv4(UDPProtocol, udp), false},
+		{"src=192.168.35.0/24", testIPv4(UDPProtocol, udp), true},
+		{"dst=192.168.35.2", testIPv4(UDPProtocol, udp), false},
+		{"dst=fd00::/64", testIPv6(IPv6ICMP, echo6), true},
+		{"proto=udp", testIPv4(UDPProtocol, udp), true},
+		{"proto=icmpv6", testIPv6(IPv6ICMP, echo6), true},
+		{"ttl=64", testIPv4(UDPProtocol, udp), true},
+		{"icmp-type=8", testIPv4(ICMPProtocol, echo), true},
+		{"icmp-type=128", testIPv6(IPv6ICMP, echo6), true},
+		{"icmp-code=0", testIPv4(UDPProtocol, udp), false},
+		{"sport=4000", testIPv4(UDPProtocol, udp), true},
+		{"dport=4000", testIPv4(UDPProtocol, udp), false},
+		{"arp=request", testEthernet(EtherTypeARP, arp), true},
+		{"arp=reply", testEthernet(EtherTypeARP, arp), false},
+		{"src=192.168.35.2", testEthernet(EtherTypeARP, arp), true},
+	}
+
+	for _, tt := range tests {
+		cond, err := parseScenarioCondition(tt.cond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := decodeScenarioFrame(tt.frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := cond.match(f); got != tt.want {
+			t.Errorf("%s on % x: %v, want %v", tt.cond, tt.frame, got, tt.want)
+		}
+	}
+}
+
+// testScenarioReply builds the reply of the rule to frame.
+func testScenarioReply(t *testing.T, rule string, frame []byte, mtu int) [][]byte {
+	t.Helper()
+
+	sc, err := ParseScenario(strings.NewReader(rule))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := decodeScenarioFrame(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frames, err := sc.rules[0].reply.build(f, testPeerMAC, 7, mtu)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frames
+}
+
+func TestScenarioReplyIPv4(t *testing.T) {
+	echo := []byte{ICMPEchoRequest, 0, 0, 0, 0, 1, 0, 2, 'h', 'i'}
+	putTestChecksum(echo, 2)
+
+	frames := testScenarioReply(t, `on reply data="pong from {dst}"`, testIPv4(ICMPProtocol, echo), 1500)
+	p, err := parseIPv4Packet(frames[0][14:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.SourceIP.Equal(testPeerIP) || !p.DestIP.Equal(testHostIP) || p.Identification != 7 {
+		t.Errorf("unexpected reply %+v", p)
+	}
+	icmp, err := parseICMP(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if icmp.Type != ICMPEchoReply || icmp.Identifier != 1 || icmp.SequenceNumber != 2 || string(icmp.Data) != "pong from 192.168.35.3" {
+		t.Errorf("unexpected ICMP %+v", icmp)
+	}
+
+	// Large replies are fragmented
+	udp := (&UDPDatagram{SrcPort: 4000, DstPort: 9, Payload: make([]byte, 2000)}).marshal(testHostIP, testPeerIP)
+	frames = testScenarioReply(t, "on reply", testIPv4(UDPProtocol, udp), 1500)
+	if len(frames) != 2 {
+		t.Errorf("%d frames, want 2 fragments", len(frames))
+	}
+
+	// A source of the other version is an error
+	sc, _ := ParseScenario(strings.NewReader("on reply src=fd00::9"))
+	f, _ := decodeScenarioFrame(testIPv4(UDPProtocol, udp))
+	if _, err := sc.rules[0].reply.build(f, testPeerMAC, 7, 1500); err == nil {
+		t.Error("IPv4 reply built with an IPv6 source")
+	}
+}
+
+func TestScenarioReplyIPv6(t *testing.T) {
+	echo := (&ICMPv6Packet{Type: ICMPv6EchoRequest, Body: []byte{0, 1, 0, 2, 'h', 'i'}}).marshal(testHostIP6, testPeerIP6)
+
+	frames := testScenarioReply(t, "on reply", testIPv6(IPv6ICMP, echo), 1500)
+	eth, err := parseEthernet(frames[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if eth.EtherType != EtherTypeIPv6 || !bytes.Equal(eth.DestMAC, testHostMAC) {
+		t.Fatalf("unexpected frame %s", eth)
+	}
+	p, err := parseIPv6Packet(eth.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.SourceIP.Equal(testPeerIP6) || !p.DestIP.Equal(testHostIP6) || p.HopLimit != defaultHopLimit {
+		t.Errorf("unexpected reply %+v", p)
+	}
+	m, err := parseICMPv6(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Type != ICMPv6EchoReply || !bytes.Equal(m.Body, []byte{0, 1, 0, 2, 'h', 'i'}) {
+		t.Errorf("unexpected ICMPv6 %+v", m)
+	}
+
+	// UDP with the ports swapped and a checksum over the IPv6 pseudo-header
+	udp := (&UDPDatagram{SrcPort: 4000, DstPort: 53, Payload: []byte("query")}).marshal(testHostIP6, testPeerIP6)
+	frames = testScenarioReply(t, "on reply src=fd00::9 data=answer", testIPv6(IPv6UDP, udp), 1500)
+	p, err = parseIPv6Packet(frames[0][14:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.SourceIP.Equal(net.ParseIP("fd00::9")) || p.Protocol != IPv6UDP {
+		t.Errorf("unexpected reply %+v", p)
+	}
+	if cs := pseudoHeaderChecksum6(p.SourceIP, p.DestIP, IPv6UDP, p.Payload); cs != 0 {
+		t.Errorf("bad UDP checksum, % x", p.Payload)
+	}
+	if binary.BigEndian.Uint16(p.Payload[0:2]) != 53 || binary.BigEndian.Uint16(p.Payload[2:4]) != 4000 || string(p.Payload[8:]) != "answer" {
+		t.Errorf("unexpected datagram % x", p.Payload)
+	}
+
+	// IPv6 replies are not fragmented
+	sc, _ := ParseScenario(strings.NewReader("on reply"))
+	f, _ := decodeScenarioFrame(testIPv6(IPv6UDP, (&UDPDatagram{Payload: make([]byte, 1500)}).marshal(testHostIP6, testPeerIP6)))
+	if _, err := sc.rules[0].reply.build(f, testPeerMAC, 7, 1500); err == nil {
+		t.Error("IPv6 reply larger than the MTU built")
+	}
+}
+
+func TestScenarioReplyEtherType(t *testing.T) {
+	tags := []VLANTag{{TPID: EtherTypeVLAN, VID: 10}}
+	request := buildTaggedFrame(net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, testHostMAC, tags, 0x88b5, []byte("hello"))
+
+	// From the MAC of the peer since the request was broadcast, with the tags
+	frames := testScenarioReply(t, "on reply hex=01{src-mac}", request, 1500)
+	want := buildTaggedFrame(testHostMAC, testPeerMAC, tags, 0x88b5, append([]byte{1}, testHostMAC...))
+	if len(frames) != 1 || !bytes.Equal(frames[0], want) {
+		t.Errorf("reply % x, want % x", frames, want)
+	}
+
+	// An IP request answered with another EtherType
+	frames = testScenarioReply(t, "on reply ethertype=0x88b6 data={payload}", testIPv4(99, []byte("raw")), 1500)
+	want = buildTaggedFrame(testHostMAC, testPeerMAC, nil, 0x88b6, []byte("raw"))
+	if !bytes.Equal(frames[0], want) {
+		t.Errorf("reply % x, want % x", frames[0], want)
+	}
+}
+
+func TestScenarioSteps(t *testing.T) {
+	sc, err := ParseScenario(strings.NewReader(`
+on proto=udp dport=9 drop
+step first
+on proto=udp dport=53 assert ttl=32
+on proto=icmp pass
+step second
+on proto=udp dport=9 pass
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc.start(slog.New(slog.DiscardHandler))
+
+	decode := func(proto IPv4Protocol, dport uint16) *scenarioFrame {
+		payload := make([]byte, 8)
+		binary.BigEndian.PutUint16(payload[2:4], dport)
+		f, err := decodeScenarioFrame(testIPv4(proto, payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+
+	// Rules of the current step come first, the other steps are ignored
+	if r := sc.match(decode(UDPProtocol, 9)); r == nil || r.action != scenarioDrop {
+		t.Errorf("rule %+v, want the global drop", r)
+	}
+	if r := sc.match(decode(UDPProtocol, 53)); r == nil || r.action != scenarioAssert {
+		t.Errorf("rule %+v, want the assert", r)
+	}
+	if sc.Err() == nil {
+		t.Error("assert on the TTL did not fail")
+	}
+	if sc.current != 0 {
+		t.Fatal("step over before all its rules matched")
+	}
+
+	sc.match(decode(ICMPProtocol, 0))
+	if sc.current != 1 {
+		t.Fatal("second step not started")
+	}
+	if r := sc.match(decode(UDPProtocol, 9)); r == nil || r.action != scenarioPass {
+		t.Errorf("rule %+v, want the pass of the step", r)
+	}
+
+	select {
+	case <-sc.Done():
+	default:
+		t.Error("scenario not done after the last step")
+	}
+	if err := sc.finish(); err == nil || !strings.Contains(err.Error(), "assert ttl=32 failed") {
+		t.Errorf("result %v, want the failed assert", err)
+	}
+}
+
+func TestScenarioStoppedEarly(t *testing.T) {
+	sc, err := ParseScenario(strings.NewReader("step wait\non proto=udp pass"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc.start(slog.New(slog.DiscardHandler))
+
+	if err := sc.finish(); err == nil || !strings.Contains(err.Error(), "stopped before line 2") {
+		t.Errorf("result %v, want a failure", err)
+	}
+}
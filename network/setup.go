@@ -1,10 +1,13 @@
 package network
 
 import (
+	"encoding/binary"
 	"fmt"
 	"log/slog"
 	"net"
-	"os/exec"
+	"sync"
+	"time"
+	"unsafe"
 
 	"golang.org/x/sys/unix"
 )
@@ -16,9 +19,23 @@ type Veth struct {
 	HostNet  *net.IPNet
 	PeerIP   net.IP
 	PeerNet  *net.IPNet
+	HostIP6  net.IP // Optional IPv6 of the host side
+	HostNet6 *net.IPNet
+	PeerIP6  net.IP           // Optional IPv6 of the peer
+	PeerMAC  net.HardwareAddr // Set by BindPeer
+	PeerMTU  int              // Set by BindPeer
+	Netns    string           // Namespace of the host side, empty for the current one
 	FD       int
 	SAddr    *unix.SockaddrLinklayer
 	Logger   *slog.Logger
+	Ring     bool // Exchange frames through TPACKET_V3 rings, see CreateSocket
+
+	netns *netns
+
+	// Reads and writes hold mu for reading so Close waits for them, it
+	// guards FD and ring
+	mu   sync.RWMutex
+	ring *packetRing
 }
 
 // htons() function converts the unsigned short integer "hostshort"
@@ -27,6 +44,34 @@ func htons(i uint16) uint16 {
 	return (i<<8 | i>>8)
 }
 
+// stringToIPv6 returns nil values for an empty string as IPv6 is optional.
+func stringToIPv6(ipStr string) (net.IP, *net.IPNet, error) {
+	if ipStr == "" {
+		return nil, nil, nil
+	}
+
+	ip, ipNet, err := net.ParseCIDR(ipStr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid IPv6 %s: %w", ipStr, err)
+	}
+
+	if ip.To4() != nil {
+		return nil, nil, fmt.Errorf("invalid IPv6 %s", ipStr)
+	}
+
+	return ip, ipNet, nil
+}
+
+// stringToOptionalIPv4 is like stringToIPv4 but returns nil values for an
+// empty string.
+func stringToOptionalIPv4(ipStr string) (net.IP, *net.IPNet, error) {
+	if ipStr == "" {
+		return nil, nil, nil
+	}
+
+	return stringToIPv4(ipStr)
+}
+
 func stringToIPv4(ipStr string) (net.IP, *net.IPNet, error) {
 	ip, ipNet, err := net.ParseCIDR(ipStr)
 	if err != nil {
@@ -42,14 +87,25 @@ func stringToIPv4(ipStr string) (net.IP, *net.IPNet, error) {
 }
 
 type VethConf struct {
-	Name      string
+	Name string
+	// HostIPStr can be empty when the host side gets its address from our
+	// DHCP server
 	HostIPStr string
 	PeerIPStr string
+	// IPv6 addresses with prefix length are optional
+	HostIP6Str string
+	PeerIP6Str string
+	// If set the host side is moved into this network namespace. It is
+	// created if it does not exist and deleted by Cleanup in that case.
+	Netns string
+	// Use memory mapped rings instead of a system call per frame, for high
+	// rates. Only the veth backend has them.
+	Ring bool
 }
 
 func NewVeth(logger *slog.Logger, vc VethConf) (*Veth, error) {
 
-	HostIP, HostNet, err1 := stringToIPv4(vc.HostIPStr)
+	HostIP, HostNet, err1 := stringToOptionalIPv4(vc.HostIPStr)
 	if err1 != nil {
 		return nil, err1
 	}
@@ -59,6 +115,16 @@ func NewVeth(logger *slog.Logger, vc VethConf) (*Veth, error) {
 		return nil, err2
 	}
 
+	HostIP6, HostNet6, err3 := stringToIPv6(vc.HostIP6Str)
+	if err3 != nil {
+		return nil, err3
+	}
+
+	PeerIP6, _, err4 := stringToIPv6(vc.PeerIP6Str)
+	if err4 != nil {
+		return nil, err4
+	}
+
 	return &Veth{
 		HostName: vc.Name,
 		PeerName: vc.Name + "-peer",
@@ -66,6 +132,11 @@ func NewVeth(logger *slog.Logger, vc VethConf) (*Veth, error) {
 		HostNet:  HostNet,
 		PeerIP:   PeerIP,
 		PeerNet:  PeerNet,
+		HostIP6:  HostIP6,
+		HostNet6: HostNet6,
+		PeerIP6:  PeerIP6,
+		Netns:    vc.Netns,
+		Ring:     vc.Ring,
 		FD:       -1,
 		SAddr:    nil,
 		Logger:   logger,
@@ -74,61 +145,170 @@ func NewVeth(logger *slog.Logger, vc VethConf) (*Veth, error) {
 
 // On Linux: man veth
 func (v *Veth) Setup() error {
-	cmd := exec.Command("ip", "link", "add", v.HostName, "type", "veth", "peer", "name", v.PeerName)
+	nl, err := newNetlinkConn()
+	if err != nil {
+		return err
+	}
+	defer nl.close()
+
+	if err := nl.linkAddVeth(v.HostName, v.PeerName); err != nil {
+		return fmt.Errorf("failed to create veth pair %s/%s: %w", v.HostName, v.PeerName, err)
+	}
 
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to run command %q, error: %w, output: %s", cmd.String(), err, output)
+	// By default the host side is configured in our namespace
+	hostNl := nl
+
+	if v.Netns != "" {
+		if hostNl, err = v.moveHostToNetns(nl); err != nil {
+			v.Cleanup()
+			return err
+		}
+		defer hostNl.close()
 	}
 
 	// Just return in case of error when setting links up.
 
-	if exec.Command("ip", "link", "set", v.HostName, "up").Run() != nil {
+	if err := hostNl.linkSetUp(v.HostName); err != nil {
 		v.Cleanup()
-		return fmt.Errorf("failed to set link %s up", v.HostName)
+		return fmt.Errorf("failed to set link %s up: %w", v.HostName, err)
 	}
 
-	if exec.Command("ip", "link", "set", v.PeerName, "up").Run() != nil {
+	// The ioctl works on the namespace of the calling thread
+	disableCsum := func() error { return disableTxChecksum(v.HostName) }
+	if v.netns != nil {
+		err = v.netns.do(disableCsum)
+	} else {
+		err = disableCsum()
+	}
+	if err != nil {
 		v.Cleanup()
-		return fmt.Errorf("failed to set link %s up", v.PeerName)
+		return err
 	}
 
-	if exec.Command("ip", "addr", "add", v.HostNet.String(), "dev", v.HostName).Run() != nil {
+	if err := nl.linkSetUp(v.PeerName); err != nil {
 		v.Cleanup()
-		return fmt.Errorf("failed to add %s to %s", v.HostNet.String(), v.HostName)
+		return fmt.Errorf("failed to set link %s up: %w", v.PeerName, err)
+	}
+
+	// Without IPv4 the host side is expected to use DHCP
+	if v.HostIP != nil {
+		if err := hostNl.addrAdd(v.HostName, v.HostIP, v.HostNet); err != nil {
+			v.Cleanup()
+			return fmt.Errorf("failed to add %s to %s: %w", v.HostIP.String(), v.HostName, err)
+		}
+	}
+
+	if v.HostIP6 != nil {
+		if err := hostNl.addrAdd(v.HostName, v.HostIP6, v.HostNet6); err != nil {
+			v.Cleanup()
+			return fmt.Errorf("failed to add %s to %s: %w", v.HostIP6.String(), v.HostName, err)
+		}
 	}
 
 	return nil
 }
 
+// moveHostToNetns moves the host side into v.Netns and returns a netlink
+// connection to configure it from there.
+func (v *Veth) moveHostToNetns(nl *netlinkConn) (*netlinkConn, error) {
+	ns, hostNl, err := moveToNetns(nl, v.HostName, v.Netns)
+	if ns != nil {
+		v.netns = ns
+		if ns.created {
+			v.Logger.Debug("network namespace created", "netns", ns.name)
+		}
+	}
+
+	return hostNl, err
+}
+
+// moveToNetns moves the link into the namespace nsName and returns a netlink
+// connection that operates inside it. The namespace is returned as soon as it
+// is opened so the caller can release it even on error.
+func moveToNetns(nl *netlinkConn, linkName string, nsName string) (*netns, *netlinkConn, error) {
+	ns, err := openNetns(nsName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := nl.linkSetNetns(linkName, ns.fd); err != nil {
+		return ns, nil, fmt.Errorf("failed to move %s to netns %s: %w", linkName, ns.name, err)
+	}
+
+	nsNl, err := ns.netlink()
+	if err != nil {
+		return ns, nil, fmt.Errorf("failed to open netlink in netns %s: %w", ns.name, err)
+	}
+
+	return ns, nsNl, nil
+}
+
 func (v *Veth) Cleanup() {
 	// Just report failure and continue
-	if exec.Command("ip", "link", "set", v.HostName, "down").Run() != nil {
-		v.Logger.Error("failed to set link down", "veth", v.HostName)
-	}
+	if nl, err := newNetlinkConn(); err != nil {
+		v.Logger.Error("failed to open netlink", "err", err)
+	} else {
+		if v.netns == nil {
+			if err := nl.linkSetDown(v.HostName); err != nil {
+				v.Logger.Error("failed to set link down", "veth", v.HostName, "err", err)
+			}
+		}
+
+		// Deleting one end of the pair also deletes the other one. The peer
+		// is always in our namespace.
+		if err := nl.linkDel(v.PeerName); err != nil {
+			v.Logger.Error("failed to delete link", "veth", v.PeerName, "err", err)
+		}
 
-	if exec.Command("ip", "link", "del", v.HostName).Run() != nil {
-		v.Logger.Error("failed to delete link", "veth", v.HostName)
+		nl.close()
 	}
 
-	if v.FD >= 0 {
-		if err := unix.Close(v.FD); err != nil {
-			v.Logger.Error("failed to close the socket")
+	if v.netns != nil {
+		if err := v.netns.close(); err != nil {
+			v.Logger.Error("failed to delete network namespace", "netns", v.netns.name, "err", err)
 		}
-		v.FD = -1
+		v.netns = nil
+	}
+
+	if err := v.Close(); err != nil {
+		v.Logger.Error("failed to close the socket", "err", err)
 	}
 }
 
 func (v *Veth) CreateSocket() error {
 	// On Linux: man packet
-	// => Set protocol to ETH_P_ALL to receive all protocols
-	proto := htons(unix.ETH_P_ALL)
-	v.Logger.Debug("proto set", "proto", proto)
-	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, int(proto))
+	// => With protocol 0 the socket receives nothing until BindPeer sets
+	// ETH_P_ALL for the peer interface only, so no frame of another
+	// interface is queued before.
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, 0)
 	if err != nil {
 		return fmt.Errorf("failed to create socket: %w", err)
 	}
 
+	// The kernel gives the VLAN tag of a frame out of band when it was
+	// offloaded, we ask for it to put it back in the frame.
+	if err := unix.SetsockoptInt(fd, unix.SOL_PACKET, unix.PACKET_AUXDATA, 1); err != nil {
+		unix.Close(fd)
+		return fmt.Errorf("failed to enable packet auxiliary data: %w", err)
+	}
+
+	// Rings are set up while the socket receives nothing so every frame goes
+	// to the ring. If the kernel refuses them frames go through recvmsg and
+	// sendto.
+	var ring *packetRing
+	if v.Ring {
+		ring, err = newPacketRing(fd)
+		if err != nil {
+			v.Logger.Warn("packet rings not available, using system calls", "err", err)
+		} else {
+			v.Logger.Debug("packet rings created", "tx", ring.hasTx())
+		}
+	}
+
+	v.mu.Lock()
 	v.FD = fd
+	v.ring = ring
+	v.mu.Unlock()
 	v.Logger.Debug("virtual pair socket created")
 	return nil
 }
@@ -144,12 +324,15 @@ func (v *Veth) BindPeer() error {
 	}
 
 	// man sockaddr
+	// => ETH_P_ALL here starts the reception of all protocols
 	sll := &unix.SockaddrLinklayer{
 		Protocol: htons(unix.ETH_P_ALL),
 		Ifindex:  iface.Index,
 	}
 
 	v.SAddr = sll
+	v.PeerMAC = iface.HardwareAddr
+	v.PeerMTU = iface.MTU
 
 	if err := unix.Bind(v.FD, sll); err != nil {
 		return fmt.Errorf("failed to bind socket: %w", err)
@@ -158,3 +341,161 @@ func (v *Veth) BindPeer() error {
 	v.Logger.Debug("bind done", "iface", v.PeerName)
 	return nil
 }
+
+// ------------------------------------------------------------------------------
+// Link implementation: frames are exchanged through the AF_PACKET socket bound
+// to the peer interface. It can be used once BindPeer is done.
+
+func (v *Veth) Name() string {
+	return v.PeerName
+}
+
+func (v *Veth) HardwareAddr() net.HardwareAddr {
+	return v.PeerMAC
+}
+
+func (v *Veth) IPs() []net.IP {
+	if v.PeerIP6 != nil {
+		return []net.IP{v.PeerIP, v.PeerIP6}
+	}
+	return []net.IP{v.PeerIP}
+}
+
+func (v *Veth) MTU() int {
+	return v.PeerMTU
+}
+
+func (v *Veth) ReadFrame(buf []byte, timeout time.Duration) (int, error) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	if v.FD < 0 {
+		return 0, ErrLinkClosed
+	}
+	if v.ring != nil {
+		return v.ring.ReadFrame(buf, timeout)
+	}
+	return readPacket(v.FD, buf, timeout)
+}
+
+// readPacket reads a frame from an AF_PACKET socket with PACKET_AUXDATA
+// enabled, waiting at most timeout.
+func readPacket(fd int, buf []byte, timeout time.Duration) (int, error) {
+	// We need to poll to avoid blocking on Recvfrom
+	pollFds := []unix.PollFd{
+		{
+			Fd:     int32(fd),
+			Events: unix.POLLIN,
+		},
+	}
+
+	n, err := unix.Poll(pollFds, int(timeout.Milliseconds()))
+	if err == unix.EINTR {
+		return 0, ErrLinkTimeout
+	}
+	if err != nil {
+		return 0, fmt.Errorf("poll error: %w", err)
+	}
+
+	if n == 0 {
+		return 0, ErrLinkTimeout
+	}
+
+	oob := make([]byte, unix.CmsgSpace(int(unsafe.Sizeof(unix.TpacketAuxdata{}))))
+	n, oobn, _, _, err := unix.Recvmsg(fd, buf, oob, 0)
+	if err == unix.EBADF || err == unix.EINVAL {
+		return 0, ErrLinkClosed
+	}
+	if err != nil {
+		return 0, fmt.Errorf("receive error: %w", err)
+	}
+
+	return insertAuxVLANTag(buf, n, oob[:oobn]), nil
+}
+
+// insertAuxVLANTag puts back in the frame the VLAN tag that the kernel gives
+// in the auxiliary data when it was stripped by VLAN offload. It returns the
+// new size of the frame.
+func insertAuxVLANTag(buf []byte, n int, oob []byte) int {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return n
+	}
+
+	for _, m := range msgs {
+		if m.Header.Level != unix.SOL_PACKET || m.Header.Type != unix.PACKET_AUXDATA ||
+			len(m.Data) < int(unsafe.Sizeof(unix.TpacketAuxdata{})) {
+			continue
+		}
+
+		aux := (*unix.TpacketAuxdata)(unsafe.Pointer(&m.Data[0]))
+		if aux.Status&unix.TP_STATUS_VLAN_VALID == 0 {
+			return n
+		}
+
+		tpid := uint16(EtherTypeVLAN)
+		if aux.Status&unix.TP_STATUS_VLAN_TPID_VALID != 0 {
+			tpid = aux.Vlan_tpid
+		}
+
+		return insertVLANTag(buf, n, tpid, aux.Vlan_tci)
+	}
+
+	return n
+}
+
+// insertVLANTag inserts a tag after the MAC addresses of the frame of size n
+// in buf. The frame is unchanged if buf is too small.
+func insertVLANTag(buf []byte, n int, tpid, tci uint16) int {
+	if n < 12 || n+4 > len(buf) {
+		return n
+	}
+
+	copy(buf[16:n+4], buf[12:n])
+	binary.BigEndian.PutUint16(buf[12:14], tpid)
+	binary.BigEndian.PutUint16(buf[14:16], tci)
+	return n + 4
+}
+
+func (v *Veth) WriteFrame(frame []byte) error {
+	if v.SAddr == nil {
+		return fmt.Errorf("peer is not bound")
+	}
+
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	if v.FD < 0 {
+		return ErrLinkClosed
+	}
+	if v.ring != nil && v.ring.hasTx() {
+		if sent, err := v.ring.WriteFrame(frame); sent {
+			return err
+		}
+	}
+
+	return unix.Sendto(v.FD, frame, 0, v.SAddr)
+}
+
+// Close only closes the socket, Cleanup must still be called to remove the
+// virtual pair. It waits for pending reads and writes, the next ones return
+// ErrLinkClosed.
+func (v *Veth) Close() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.ring != nil {
+		if err := v.ring.Close(); err != nil {
+			return err
+		}
+		v.ring = nil
+	}
+
+	if v.FD < 0 {
+		return nil
+	}
+
+	err := unix.Close(v.FD)
+	v.FD = -1
+	return err
+}
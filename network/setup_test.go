@@ -0,0 +1,44 @@
+package network
+
+import (
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Close waits for a pending read, the next reads and writes fail.
+func TestVethClose(t *testing.T) {
+	for _, ring := range []bool{false, true} {
+		v := &Veth{FD: -1, Logger: slog.New(slog.DiscardHandler), Ring: ring, SAddr: &unix.SockaddrLinklayer{}}
+		if err := v.CreateSocket(); err != nil {
+			t.Skip(err)
+		}
+
+		read := make(chan error)
+		go func() {
+			_, err := v.ReadFrame(make([]byte, 1500), 50*time.Millisecond)
+			read <- err
+		}()
+		time.Sleep(10 * time.Millisecond)
+
+		if err := v.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-read; !errors.Is(err, ErrLinkTimeout) && !errors.Is(err, ErrLinkClosed) {
+			t.Errorf("ring %v: pending read: %v", ring, err)
+		}
+
+		if _, err := v.ReadFrame(make([]byte, 1500), time.Millisecond); !errors.Is(err, ErrLinkClosed) {
+			t.Errorf("ring %v: read after Close: %v", ring, err)
+		}
+		if err := v.WriteFrame(make([]byte, 60)); !errors.Is(err, ErrLinkClosed) {
+			t.Errorf("ring %v: write after Close: %v", ring, err)
+		}
+		if err := v.Close(); err != nil {
+			t.Errorf("ring %v: second Close: %v", ring, err)
+		}
+	}
+}
@@ -0,0 +1,473 @@
+package network
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stack emulates a host plugged on a link. It answers the frames received on
+// the link and keeps the state needed between frames (neighbor table...).
+type Stack struct {
+	link      Link
+	logger    *slog.Logger
+	neighbors *NeighborTable
+	ipID      atomic.Uint32 // Identification of the IPv4 packets we originate
+	udp       udpRegistry
+	tcp       tcpTable
+	fragments fragmentTable
+	handlers  handlerRegistry
+
+	ipv4Validation IPv4Validation
+
+	mu    sync.Mutex
+	vlans map[uint16]*vlanState
+
+	// Timers that no connection or reassembly owns (ARP retries...)
+	timers    timerSet
+	closeOnce sync.Once
+	closed    atomic.Bool
+}
+
+// Host is an identity emulated by the stack besides the one of the link: its
+// VLAN (0 for untagged frames), its MAC address and its IP addresses.
+type Host struct {
+	VLAN uint16
+	MAC  net.HardwareAddr
+	IPs  []net.IP
+}
+
+// vlanState is what the stack knows about a VLAN. A tagged VLAN without hosts
+// is answered with the identity of the link.
+type vlanState struct {
+	hosts     []*Host
+	neighbors *NeighborTable
+}
+
+func NewStack(logger *slog.Logger, link Link) *Stack {
+	s := &Stack{
+		link:      link,
+		logger:    logger,
+		neighbors: NewNeighborTable(),
+		vlans:     make(map[uint16]*vlanState),
+	}
+	s.vlans[0] = &vlanState{neighbors: s.neighbors}
+
+	return s
+}
+
+func (s *Stack) Link() Link {
+	return s.link
+}
+
+// Close resets the TCP connections, closes the listeners and stops the
+// timers of the stack. The link is not closed but the stack does not use it
+// anymore: frames are not processed and sends return ErrLinkClosed.
+func (s *Stack) Close() error {
+	s.closeOnce.Do(func() {
+		// The resets are sent before the link is given up
+		s.closeTCP()
+		s.fragments.stop()
+		s.timers.stop()
+		s.closed.Store(true)
+	})
+
+	return nil
+}
+
+// writeFrame sends a frame on the link unless the stack is closed.
+func (s *Stack) writeFrame(frame []byte) error {
+	if s.closed.Load() {
+		return ErrLinkClosed
+	}
+	return s.link.WriteFrame(frame)
+}
+
+// timerSet runs functions after a delay until it is stopped.
+type timerSet struct {
+	mu      sync.Mutex
+	timers  map[*time.Timer]struct{}
+	stopped bool
+}
+
+// afterFunc calls f after d in its own goroutine, unless the set is stopped
+// before.
+func (ts *timerSet) afterFunc(d time.Duration, f func()) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.stopped {
+		return
+	}
+	if ts.timers == nil {
+		ts.timers = make(map[*time.Timer]struct{})
+	}
+
+	var t *time.Timer
+	t = time.AfterFunc(d, func() {
+		ts.mu.Lock()
+		_, pending := ts.timers[t]
+		delete(ts.timers, t)
+		ts.mu.Unlock()
+
+		if pending {
+			f()
+		}
+	})
+	ts.timers[t] = struct{}{}
+}
+
+func (ts *timerSet) stop() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	for t := range ts.timers {
+		t.Stop()
+	}
+	ts.timers = nil
+	ts.stopped = true
+}
+
+// Neighbors returns the neighbor table of the untagged network.
+func (s *Stack) Neighbors() *NeighborTable {
+	return s.neighbors
+}
+
+// AddHost adds an identity to the stack. Frames of its VLAN sent to one of
+// its addresses are answered by it, so a single stack can emulate a whole
+// subnet. On a tagged VLAN the hosts replace the identity of the link, on the
+// untagged network they come in addition to it. Without MAC address the one
+// of the link is used.
+func (s *Stack) AddHost(h Host) error {
+	if h.VLAN >= 0xFFF {
+		return fmt.Errorf("invalid VLAN ID %d", h.VLAN)
+	}
+	if h.MAC == nil {
+		h.MAC = s.link.HardwareAddr()
+	}
+	if len(h.MAC) != 6 {
+		return fmt.Errorf("invalid MAC address %s for VLAN %d", h.MAC, h.VLAN)
+	}
+	if len(h.IPs) == 0 {
+		return fmt.Errorf("host on VLAN %d has no IP address", h.VLAN)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v := s.vlan(h.VLAN)
+	for _, ip := range h.IPs {
+		used := h.VLAN == 0 && slices.ContainsFunc(s.link.IPs(), ip.Equal)
+		for _, other := range v.hosts {
+			used = used || slices.ContainsFunc(other.IPs, ip.Equal)
+		}
+		if used {
+			return fmt.Errorf("IP %s is already used on VLAN %d", ip, h.VLAN)
+		}
+	}
+
+	v.hosts = append(v.hosts, &h)
+
+	return nil
+}
+
+// Hosts returns the identities added with AddHost.
+func (s *Stack) Hosts() []Host {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var hosts []Host
+	for _, vid := range s.vlanIDs() {
+		for _, h := range s.vlans[vid].hosts {
+			hosts = append(hosts, *h)
+		}
+	}
+
+	return hosts
+}
+
+// vlan returns the state of a VLAN, it must be called with s.mu held.
+func (s *Stack) vlan(vid uint16) *vlanState {
+	v, found := s.vlans[vid]
+	if !found {
+		v = &vlanState{neighbors: NewNeighborTable()}
+		s.vlans[vid] = v
+	}
+	return v
+}
+
+// vlanIDs returns the known VLANs in order, it must be called with s.mu held.
+func (s *Stack) vlanIDs() []uint16 {
+	vids := make([]uint16, 0, len(s.vlans))
+	for vid := range s.vlans {
+		vids = append(vids, vid)
+	}
+	slices.Sort(vids)
+	return vids
+}
+
+// owns tells if ip is an address of the stack on the VLAN.
+func (s *Stack) owns(vid uint16, ip net.IP) bool {
+	var tags []VLANTag
+	if vid != 0 {
+		tags = []VLANTag{{TPID: EtherTypeVLAN, VID: vid}}
+	}
+
+	return slices.ContainsFunc(s.endpointsFor(tags), func(ep *endpoint) bool {
+		return ep.owns(ip)
+	})
+}
+
+// AnnounceARP broadcasts a gratuitous ARP request (sender and target IP are
+// ours) so neighbors update their cache with our MAC address. It is done for
+// the link and for each host.
+func (s *Stack) AnnounceARP() error {
+	if linkIPv4(s.link) == nil {
+		return fmt.Errorf("link %s has no IPv4 address", s.link.Name())
+	}
+
+	endpoints := []*endpoint{s.linkEndpoint()}
+
+	s.mu.Lock()
+	for _, vid := range s.vlanIDs() {
+		v := s.vlans[vid]
+		for _, h := range v.hosts {
+			endpoints = append(endpoints, s.hostEndpoint(h, v))
+		}
+	}
+	s.mu.Unlock()
+
+	for _, ep := range endpoints {
+		ourIP := ep.ipv4()
+		if ourIP == nil {
+			// IPv6 only host
+			continue
+		}
+
+		if err := ep.sendARPRequest(ourIP, ourIP); err != nil {
+			return fmt.Errorf("failed to send gratuitous ARP: %w", err)
+		}
+
+		s.logger.Debug("gratuitous ARP sent", "ip", ourIP.String(), "vlan", ep.vlan())
+	}
+
+	return nil
+}
+
+// SendIPv4 sends payload to dst. If the MAC address of dst is unknown the
+// packet is queued and sent once dst answers our ARP request.
+func (s *Stack) SendIPv4(dst net.IP, proto IPv4Protocol, payload []byte) error {
+	return s.linkEndpoint().sendIPv4(dst, proto, payload)
+}
+
+// ------------------------------------------------------------------------------
+// Endpoints
+
+// endpoint is the identity that handles a frame with the VLAN tags it was
+// received with. Everything it sends carries the same tags so replies stay
+// on the VLAN of the request.
+type endpoint struct {
+	stack     *Stack
+	mac       net.HardwareAddr
+	ips       []net.IP
+	tags      []VLANTag
+	neighbors *NeighborTable
+}
+
+// linkEndpoint is the identity of the link on the untagged network.
+func (s *Stack) linkEndpoint() *endpoint {
+	return &endpoint{
+		stack:     s,
+		mac:       s.link.HardwareAddr(),
+		ips:       s.link.IPs(),
+		neighbors: s.neighbors,
+	}
+}
+
+// hostEndpoint is the identity of h, tagged with the VID of its VLAN.
+func (s *Stack) hostEndpoint(h *Host, v *vlanState) *endpoint {
+	ep := &endpoint{
+		stack:     s,
+		mac:       h.MAC,
+		ips:       h.IPs,
+		neighbors: v.neighbors,
+	}
+	if h.VLAN != 0 {
+		ep.tags = []VLANTag{{TPID: EtherTypeVLAN, VID: h.VLAN}}
+	}
+	return ep
+}
+
+// endpointsFor returns the identities that can answer frames with these
+// tags. The first one is the default identity of the VLAN, used for
+// broadcasts and for addresses that belong to nobody.
+func (s *Stack) endpointsFor(tags []VLANTag) []*endpoint {
+	vid := vlanID(tags)
+
+	s.mu.Lock()
+	v := s.vlan(vid)
+	hosts := v.hosts
+	s.mu.Unlock()
+
+	var eps []*endpoint
+	if vid == 0 || len(hosts) == 0 {
+		ep := s.linkEndpoint()
+		ep.neighbors = v.neighbors
+		eps = append(eps, ep)
+	}
+	for _, h := range hosts {
+		eps = append(eps, s.hostEndpoint(h, v))
+	}
+
+	// Replies use the tags of the frame, they can be stacked or carry a
+	// priority
+	for _, ep := range eps {
+		ep.tags = tags
+	}
+
+	return eps
+}
+
+// endpointOwning returns the endpoint that has the address ip, or the
+// default one if none has it.
+func endpointOwning(eps []*endpoint, ip net.IP) *endpoint {
+	for _, ep := range eps {
+		if ep.owns(ip) {
+			return ep
+		}
+	}
+	return eps[0]
+}
+
+func (ep *endpoint) owns(ip net.IP) bool {
+	if ip.To4() != nil {
+		return slices.ContainsFunc(ep.ips, ip.Equal)
+	}
+	return slices.ContainsFunc(ep.ipv6s(), ip.Equal)
+}
+
+func (ep *endpoint) vlan() uint16 {
+	return vlanID(ep.tags)
+}
+
+// ipv4 returns the first IPv4 address of the endpoint or nil.
+func (ep *endpoint) ipv4() net.IP {
+	for _, ip := range ep.ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4
+		}
+	}
+	return nil
+}
+
+// frame builds a frame sent by the endpoint.
+func (ep *endpoint) frame(dst net.HardwareAddr, etherType EtherType, payload []byte) []byte {
+	return buildTaggedFrame(dst, ep.mac, ep.tags, etherType, payload)
+}
+
+func (ep *endpoint) send(dst net.HardwareAddr, etherType EtherType, payload []byte) error {
+	return ep.stack.writeFrame(ep.frame(dst, etherType, payload))
+}
+
+// writeIPv4 sends a marshaled IPv4 packet to dst, in fragments if it does not
+// fit in the MTU of the link.
+func (ep *endpoint) writeIPv4(dst net.HardwareAddr, packet []byte) error {
+	frags, err := fragmentIPv4(packet, ep.stack.link.MTU())
+	if err != nil {
+		return err
+	}
+
+	for _, frag := range frags {
+		if err := ep.send(dst, EtherTypeIPv4, frag); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// replyIPv4 returns the frame of a reply to give back to ProcessFrame. If the
+// packet needs to be fragmented the fragments are sent directly and nil is
+// returned.
+func (ep *endpoint) replyIPv4(dst net.HardwareAddr, packet []byte) ([]byte, error) {
+	if len(packet) <= ep.stack.link.MTU() {
+		return ep.frame(dst, EtherTypeIPv4, packet), nil
+	}
+	return nil, ep.writeIPv4(dst, packet)
+}
+
+func (ep *endpoint) sendIPv4(dst net.IP, proto IPv4Protocol, payload []byte) error {
+	ourIP := ep.ipv4()
+	if ourIP == nil {
+		return fmt.Errorf("link %s has no IPv4 address", ep.stack.link.Name())
+	}
+
+	return ep.sendIPv4From(ourIP, dst, proto, payload)
+}
+
+// sendIPv4From is sendIPv4 from one of the addresses of a host that has
+// several.
+func (ep *endpoint) sendIPv4From(src, dst net.IP, proto IPv4Protocol, payload []byte) error {
+	p := &IPv4Packet{
+		Identification: uint16(ep.stack.ipID.Add(1)),
+		TTL:            defaultTTL,
+		Protocol:       proto,
+		SourceIP:       src.To4(),
+		DestIP:         dst.To4(),
+		Payload:        payload,
+	}
+
+	return ep.sendIPv4Packet(p.DestIP, p.marshal())
+}
+
+func (ep *endpoint) sendIPv4Packet(dst net.IP, packet []byte) error {
+	// Nothing must be queued for a neighbor that is never resolved
+	if ep.stack.closed.Load() {
+		return ErrLinkClosed
+	}
+
+	mac, start := ep.neighbors.lookupOrQueue(dst, packet)
+	if mac != nil {
+		return ep.writeIPv4(mac, packet)
+	}
+
+	if start {
+		ep.resolve(dst)
+	}
+
+	return nil
+}
+
+// resolve sends an ARP request for ip and retries until the neighbor table
+// gives up.
+func (ep *endpoint) resolve(ip net.IP) {
+	logger := ep.stack.logger
+
+	if err := ep.sendARPRequest(ep.ipv4(), ip); err != nil {
+		logger.Error("failed to send ARP request", "ip", ip.String(), "err", err)
+	}
+
+	ep.stack.timers.afterFunc(arpRetryDelay, func() {
+		again, dropped := ep.neighbors.retry(ip)
+		if again {
+			ep.resolve(ip)
+		} else if dropped > 0 {
+			logger.Warn("neighbor unreachable", "ip", ip.String(), "vlan", ep.vlan(), "dropped", dropped)
+		}
+	})
+}
+
+// learn records a neighbor and sends the packets that were waiting for it.
+func (ep *endpoint) learn(ip net.IP, mac net.HardwareAddr) {
+	pending := ep.neighbors.Learn(ip, mac)
+
+	for _, packet := range pending {
+		if err := ep.writeIPv4(mac, packet); err != nil {
+			ep.stack.logger.Error("failed to send queued packet", "ip", ip.String(), "err", err)
+		}
+	}
+}
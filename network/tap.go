@@ -0,0 +1,254 @@
+package network
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// With a TAP device the kernel interface is the host side: frames sent by the
+// host are read from the file descriptor and frames we write are received by
+// the host. So unlike the veth backend there is no peer interface, the MAC
+// address of the emulated host is generated.
+//
+// On Linux: https://docs.kernel.org/networking/tuntap.html
+const tunDevice = "/dev/net/tun"
+
+type Tap struct {
+	IfName   string
+	HostIP   net.IP
+	HostNet  *net.IPNet
+	PeerIP   net.IP
+	PeerNet  *net.IPNet
+	HostIP6  net.IP // Optional IPv6 of the host side
+	HostNet6 *net.IPNet
+	PeerIP6  net.IP // Optional IPv6 of the peer
+	PeerMAC  net.HardwareAddr
+	PeerMTU  int    // Set by Setup
+	Netns    string // Namespace of the TAP interface, empty for the current one
+	FD       int
+	Logger   *slog.Logger
+
+	netns *netns
+}
+
+// NewTap uses the same configuration as the veth backend, Name is the name of
+// the TAP interface.
+func NewTap(logger *slog.Logger, vc VethConf) (*Tap, error) {
+	HostIP, HostNet, err1 := stringToOptionalIPv4(vc.HostIPStr)
+	if err1 != nil {
+		return nil, err1
+	}
+
+	PeerIP, PeerNet, err2 := stringToIPv4(vc.PeerIPStr)
+	if err2 != nil {
+		return nil, err2
+	}
+
+	HostIP6, HostNet6, err3 := stringToIPv6(vc.HostIP6Str)
+	if err3 != nil {
+		return nil, err3
+	}
+
+	PeerIP6, _, err4 := stringToIPv6(vc.PeerIP6Str)
+	if err4 != nil {
+		return nil, err4
+	}
+
+	PeerMAC, err5 := randomMAC()
+	if err5 != nil {
+		return nil, err5
+	}
+
+	return &Tap{
+		IfName:   vc.Name,
+		HostIP:   HostIP,
+		HostNet:  HostNet,
+		PeerIP:   PeerIP,
+		PeerNet:  PeerNet,
+		HostIP6:  HostIP6,
+		HostNet6: HostNet6,
+		PeerIP6:  PeerIP6,
+		PeerMAC:  PeerMAC,
+		Netns:    vc.Netns,
+		FD:       -1,
+		Logger:   logger,
+	}, nil
+}
+
+// randomMAC returns a locally administered unicast address.
+func randomMAC() (net.HardwareAddr, error) {
+	mac := make(net.HardwareAddr, 6)
+	if _, err := rand.Read(mac); err != nil {
+		return nil, fmt.Errorf("failed to generate MAC address: %w", err)
+	}
+
+	mac[0] = (mac[0] | 0x02) &^ 0x01
+	return mac, nil
+}
+
+// Setup creates the TAP interface, sets it up and assigns the host IP.
+func (t *Tap) Setup() error {
+	fd, err := unix.Open(tunDevice, unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", tunDevice, err)
+	}
+	t.FD = fd
+
+	ifr, err := unix.NewIfreq(t.IfName)
+	if err != nil {
+		t.Cleanup()
+		return fmt.Errorf("invalid TAP name %s: %w", t.IfName, err)
+	}
+
+	// IFF_NO_PI: frames are not prefixed with packet information
+	ifr.SetUint16(unix.IFF_TAP | unix.IFF_NO_PI)
+	if err := unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr); err != nil {
+		t.Cleanup()
+		return fmt.Errorf("failed to create TAP %s: %w", t.IfName, err)
+	}
+
+	// The kernel may have completed the name (e.g. "tap%d")
+	t.IfName = ifr.Name()
+	t.Logger.Debug("TAP created", "iface", t.IfName)
+
+	nl, err := newNetlinkConn()
+	if err != nil {
+		t.Cleanup()
+		return err
+	}
+	defer nl.close()
+
+	if t.Netns != "" {
+		ns, nsNl, err := moveToNetns(nl, t.IfName, t.Netns)
+		if ns != nil {
+			t.netns = ns
+		}
+		if err != nil {
+			t.Cleanup()
+			return err
+		}
+		defer nsNl.close()
+		nl = nsNl
+	}
+
+	if err := nl.linkSetUp(t.IfName); err != nil {
+		t.Cleanup()
+		return fmt.Errorf("failed to set link %s up: %w", t.IfName, err)
+	}
+
+	// Without IPv4 the host side is expected to use DHCP
+	if t.HostIP != nil {
+		if err := nl.addrAdd(t.IfName, t.HostIP, t.HostNet); err != nil {
+			t.Cleanup()
+			return fmt.Errorf("failed to add %s to %s: %w", t.HostIP.String(), t.IfName, err)
+		}
+	}
+
+	if t.HostIP6 != nil {
+		if err := nl.addrAdd(t.IfName, t.HostIP6, t.HostNet6); err != nil {
+			t.Cleanup()
+			return fmt.Errorf("failed to add %s to %s: %w", t.HostIP6.String(), t.IfName, err)
+		}
+	}
+
+	if t.PeerMTU, err = nl.linkMTU(t.IfName); err != nil {
+		t.Cleanup()
+		return fmt.Errorf("failed to get MTU of %s: %w", t.IfName, err)
+	}
+
+	return nil
+}
+
+// Cleanup closes the file descriptor, as the interface is not persistent the
+// kernel deletes it.
+func (t *Tap) Cleanup() {
+	if t.FD >= 0 {
+		if err := unix.Close(t.FD); err != nil {
+			t.Logger.Error("failed to close TAP", "err", err)
+		}
+		t.FD = -1
+	}
+
+	if t.netns != nil {
+		if err := t.netns.close(); err != nil {
+			t.Logger.Error("failed to delete network namespace", "netns", t.netns.name, "err", err)
+		}
+		t.netns = nil
+	}
+}
+
+// ------------------------------------------------------------------------------
+// Link implementation: frames are read from and written to the TAP file
+// descriptor. It can be used once Setup is done.
+
+func (t *Tap) Name() string {
+	return t.IfName
+}
+
+func (t *Tap) HardwareAddr() net.HardwareAddr {
+	return t.PeerMAC
+}
+
+func (t *Tap) IPs() []net.IP {
+	if t.PeerIP6 != nil {
+		return []net.IP{t.PeerIP, t.PeerIP6}
+	}
+	return []net.IP{t.PeerIP}
+}
+
+func (t *Tap) MTU() int {
+	return t.PeerMTU
+}
+
+func (t *Tap) ReadFrame(buf []byte, timeout time.Duration) (int, error) {
+	pollFds := []unix.PollFd{
+		{
+			Fd:     int32(t.FD),
+			Events: unix.POLLIN,
+		},
+	}
+
+	n, err := unix.Poll(pollFds, int(timeout.Milliseconds()))
+	if err == unix.EINTR {
+		return 0, ErrLinkTimeout
+	}
+	if err != nil {
+		return 0, fmt.Errorf("poll error: %w", err)
+	}
+
+	if n == 0 {
+		return 0, ErrLinkTimeout
+	}
+
+	// One read returns exactly one frame
+	n, err = unix.Read(t.FD, buf)
+	if err == unix.EBADF || err == unix.EINVAL {
+		return 0, ErrLinkClosed
+	}
+	if err != nil {
+		return 0, fmt.Errorf("read error: %w", err)
+	}
+
+	return n, nil
+}
+
+func (t *Tap) WriteFrame(frame []byte) error {
+	_, err := unix.Write(t.FD, frame)
+	return err
+}
+
+// Close closes the file descriptor which also deletes the interface.
+func (t *Tap) Close() error {
+	if t.FD < 0 {
+		return nil
+	}
+
+	err := unix.Close(t.FD)
+	t.FD = -1
+	return err
+}
@@ -0,0 +1,183 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// +--------------------------------------------------------+
+// | TCP Header (20-60 bytes, typically 20)                 |
+// |--------------------------------------------------------|
+// | Source Port (2) | Destination Port (2)                 |
+// | Sequence Number (4)                                    |
+// | Acknowledgment Number (4)                              |
+// | Data Offset (4 bits) | Reserved | Flags (1)            |
+// | Window (2) | Checksum (2) | Urgent Pointer (2)         |
+// | Options (0-40 bytes, if Data Offset > 5)               |
+// +--------------------------------------------------------+
+//
+// Like UDP the checksum covers the IPv4 pseudo-header.
+//
+// [RFC 9293] https://datatracker.ietf.org/doc/html/rfc9293
+// https://en.wikipedia.org/wiki/Transmission_Control_Protocol
+type TCPFlags uint8
+
+const (
+	TCPFin TCPFlags = 0x01
+	TCPSyn TCPFlags = 0x02
+	TCPRst TCPFlags = 0x04
+	TCPPsh TCPFlags = 0x08
+	TCPAck TCPFlags = 0x10
+	TCPUrg TCPFlags = 0x20
+)
+
+func (f TCPFlags) String() string {
+	names := []struct {
+		flag TCPFlags
+		name string
+	}{
+		{TCPSyn, "SYN"}, {TCPFin, "FIN"}, {TCPRst, "RST"},
+		{TCPPsh, "PSH"}, {TCPAck, "ACK"}, {TCPUrg, "URG"},
+	}
+
+	var set []string
+	for _, n := range names {
+		if f&n.flag != 0 {
+			set = append(set, n.name)
+		}
+	}
+
+	return strings.Join(set, "|")
+}
+
+// TCP options we are using
+const (
+	tcpOptEnd uint8 = 0
+	tcpOptNop uint8 = 1
+	tcpOptMSS uint8 = 2
+)
+
+type TCPSegment struct {
+	SrcPort    uint16
+	DstPort    uint16
+	Seq        uint32
+	Ack        uint32
+	DataOffset uint8 // Header length in 32-bit words
+	Flags      TCPFlags
+	Window     uint16
+	Checksum   uint16
+	Urgent     uint16
+	Options    []byte
+	Payload    []byte
+}
+
+func parseTCP(packet *IPv4Packet) (*TCPSegment, error) {
+	payload := packet.Payload
+
+	if len(payload) < 20 {
+		return nil, fmt.Errorf("TCP segment too short: %d bytes (minimum 20)", len(payload))
+	}
+
+	t := &TCPSegment{
+		SrcPort:    binary.BigEndian.Uint16(payload[0:2]),
+		DstPort:    binary.BigEndian.Uint16(payload[2:4]),
+		Seq:        binary.BigEndian.Uint32(payload[4:8]),
+		Ack:        binary.BigEndian.Uint32(payload[8:12]),
+		DataOffset: payload[12] >> 4,
+		Flags:      TCPFlags(payload[13] & 0x3F),
+		Window:     binary.BigEndian.Uint16(payload[14:16]),
+		Checksum:   binary.BigEndian.Uint16(payload[16:18]),
+		Urgent:     binary.BigEndian.Uint16(payload[18:20]),
+	}
+
+	headerLen := int(t.DataOffset) * 4
+	if headerLen < 20 || headerLen > len(payload) {
+		return nil, fmt.Errorf("invalid TCP data offset %d for %d bytes", t.DataOffset, len(payload))
+	}
+
+	if cs := pseudoHeaderChecksum4(packet.SourceIP, packet.DestIP, TCPProtocol, payload); cs != 0 {
+		return nil, fmt.Errorf("bad TCP checksum 0x%04X", t.Checksum)
+	}
+
+	t.Options = payload[20:headerLen]
+	t.Payload = payload[headerLen:]
+
+	return t, nil
+}
+
+// marshal serializes the segment. Options must be padded to 32 bits, Data
+// Offset and Checksum are computed.
+func (t *TCPSegment) marshal(src, dst net.IP) []byte {
+	headerLen := 20 + len(t.Options)
+	b := make([]byte, headerLen+len(t.Payload))
+
+	binary.BigEndian.PutUint16(b[0:2], t.SrcPort)
+	binary.BigEndian.PutUint16(b[2:4], t.DstPort)
+	binary.BigEndian.PutUint32(b[4:8], t.Seq)
+	binary.BigEndian.PutUint32(b[8:12], t.Ack)
+	b[12] = uint8(headerLen/4) << 4
+	b[13] = uint8(t.Flags)
+	binary.BigEndian.PutUint16(b[14:16], t.Window)
+	binary.BigEndian.PutUint16(b[18:20], t.Urgent)
+	copy(b[20:headerLen], t.Options)
+	copy(b[headerLen:], t.Payload)
+
+	binary.BigEndian.PutUint16(b[16:18], pseudoHeaderChecksum4(src, dst, TCPProtocol, b))
+
+	return b
+}
+
+// segLen is the sequence space used by the segment: SYN and FIN count for one.
+func (t *TCPSegment) segLen() uint32 {
+	n := uint32(len(t.Payload))
+	if t.Flags&TCPSyn != 0 {
+		n++
+	}
+	if t.Flags&TCPFin != 0 {
+		n++
+	}
+	return n
+}
+
+// mss returns the Maximum Segment Size option if present.
+func (t *TCPSegment) mss() (uint16, bool) {
+	opts := t.Options
+	for len(opts) > 0 {
+		switch opts[0] {
+		case tcpOptEnd:
+			return 0, false
+		case tcpOptNop:
+			opts = opts[1:]
+			continue
+		}
+
+		if len(opts) < 2 || int(opts[1]) < 2 || int(opts[1]) > len(opts) {
+			return 0, false
+		}
+
+		if opts[0] == tcpOptMSS && opts[1] == 4 {
+			return binary.BigEndian.Uint16(opts[2:4]), true
+		}
+
+		opts = opts[opts[1]:]
+	}
+
+	return 0, false
+}
+
+func mssOption(mss uint16) []byte {
+	return []byte{tcpOptMSS, 4, byte(mss >> 8), byte(mss)}
+}
+
+// ------------------------------------------------------------------------------
+// Sequence number arithmetic modulo 2^32 (RFC 9293 section 3.4)
+
+func seqLT(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+func seqLEQ(a, b uint32) bool {
+	return int32(a-b) <= 0
+}
@@ -0,0 +1,251 @@
+package network
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpTestHost plays the host side of a TCP connection over a pipe.
+type tcpTestHost struct {
+	t     *testing.T
+	stack *Stack
+	pipe  *Pipe
+	port  uint16
+	seq   uint32
+	ack   uint32
+}
+
+func (h *tcpTestHost) send(flags TCPFlags, payload string) {
+	h.t.Helper()
+
+	seg := &TCPSegment{SrcPort: h.port, DstPort: 80, Seq: h.seq, Ack: h.ack, Flags: flags, Window: 65535, Payload: []byte(payload)}
+	h.seq += seg.segLen()
+	if _, err := h.stack.ProcessFrame(testIPv4(TCPProtocol, seg.marshal(testHostIP, testPeerIP))); err != nil {
+		h.t.Fatal(err)
+	}
+}
+
+// expect returns the next segment sent by the peer, frames that are not TCP
+// are skipped.
+func (h *tcpTestHost) expect(flags TCPFlags) *TCPSegment {
+	h.t.Helper()
+
+	for {
+		f := readTestFrame(h.t, h.pipe)
+		if f == nil {
+			h.t.Fatalf("no segment with %s received", flags)
+		}
+		p, err := parseIPv4Packet(f[14:])
+		if err != nil || p.Protocol != TCPProtocol {
+			continue
+		}
+		seg, err := parseTCP(p)
+		if err != nil {
+			h.t.Fatal(err)
+		}
+		if seg.Flags != flags {
+			h.t.Fatalf("segment with %s received, want %s", seg.Flags, flags)
+		}
+		h.ack = seg.Seq + seg.segLen()
+		return seg
+	}
+}
+
+func TestTCPConnection(t *testing.T) {
+	stack, pipe := newTestStack(t)
+	h := &tcpTestHost{t: t, stack: stack, pipe: pipe, port: 40000, seq: 1000}
+
+	l, err := stack.ListenTCP(80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	h.send(TCPSyn, "")
+	synAck := h.expect(TCPSyn | TCPAck)
+	if synAck.Ack != 1001 {
+		t.Errorf("SYN-ACK acknowledges %d, want 1001", synAck.Ack)
+	}
+	if _, found := synAck.mss(); !found {
+		t.Error("SYN-ACK without MSS")
+	}
+
+	h.send(TCPAck, "")
+	c, err := l.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.State() != TCPEstablished {
+		t.Fatalf("state %s after the handshake", c.State())
+	}
+
+	// Data from the host is acknowledged and read
+	h.send(TCPAck|TCPPsh, "hello")
+	if ack := h.expect(TCPAck); ack.Ack != h.seq {
+		t.Errorf("data acknowledged up to %d, want %d", ack.Ack, h.seq)
+	}
+	buf := make([]byte, 16)
+	if n, err := c.Read(buf); err != nil || string(buf[:n]) != "hello" {
+		t.Errorf("read %q, %v", buf[:n], err)
+	}
+
+	// Data from the peer
+	if _, err := c.Write([]byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	if seg := h.expect(TCPAck | TCPPsh); string(seg.Payload) != "world" {
+		t.Errorf("peer sent %q", seg.Payload)
+	}
+	h.send(TCPAck, "")
+
+	// Passive close
+	h.send(TCPFin|TCPAck, "")
+	h.expect(TCPAck)
+	if c.State() != TCPCloseWait {
+		t.Errorf("state %s after FIN, want CLOSE-WAIT", c.State())
+	}
+	if _, err := c.Read(buf); err != io.EOF {
+		t.Errorf("read after FIN: %v, want EOF", err)
+	}
+
+	c.Close()
+	h.expect(TCPFin | TCPAck)
+	if c.State() != TCPLastAck {
+		t.Errorf("state %s after Close, want LAST-ACK", c.State())
+	}
+	h.send(TCPAck, "")
+	if c.State() != TCPClosed {
+		t.Errorf("state %s after the last ACK, want CLOSED", c.State())
+	}
+}
+
+func TestTCPReset(t *testing.T) {
+	stack, pipe := newTestStack(t)
+	h := &tcpTestHost{t: t, stack: stack, pipe: pipe, port: 40001, seq: 5000}
+
+	// No listener: the SYN is reset
+	seg := &TCPSegment{SrcPort: h.port, DstPort: 80, Seq: h.seq, Flags: TCPSyn, Window: 65535}
+	if _, err := stack.ProcessFrame(testIPv4(TCPProtocol, seg.marshal(testHostIP, testPeerIP))); err == nil {
+		t.Error("no error without listener")
+	}
+	rst := h.expect(TCPRst | TCPAck)
+	if rst.Ack != 5001 || rst.Seq != 0 {
+		t.Errorf("reset seq %d ack %d, want 0 and 5001", rst.Seq, rst.Ack)
+	}
+
+	// An ACK that belongs to no connection is reset with its ack number
+	l, _ := stack.ListenTCP(80)
+	defer l.Close()
+	h.ack = 777
+	h.send(TCPAck, "")
+	if rst := h.expect(TCPRst); rst.Seq != 777 {
+		t.Errorf("reset seq %d, want 777", rst.Seq)
+	}
+
+	// A reset is never answered
+	h.send(TCPRst, "")
+	if f := readTestFrame(t, pipe); f != nil {
+		t.Errorf("reset answered: % x", f)
+	}
+}
+
+func TestTCPResetAborts(t *testing.T) {
+	stack, pipe := newTestStack(t)
+	h := &tcpTestHost{t: t, stack: stack, pipe: pipe, port: 40002, seq: 1}
+
+	l, _ := stack.ListenTCP(80)
+	defer l.Close()
+
+	h.send(TCPSyn, "")
+	h.expect(TCPSyn | TCPAck)
+	h.send(TCPAck, "")
+	c, _ := l.AcceptTCP()
+
+	// A reset outside the expected sequence number gets a challenge ACK
+	h.seq += 10
+	h.send(TCPRst, "")
+	h.expect(TCPAck)
+	if c.State() != TCPEstablished {
+		t.Fatalf("state %s after an untrusted reset", c.State())
+	}
+
+	h.seq -= 10
+	h.send(TCPRst, "")
+	if c.State() != TCPClosed {
+		t.Errorf("state %s after a reset, want CLOSED", c.State())
+	}
+
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := c.Read(make([]byte, 1)); err == nil || err == io.EOF {
+		t.Errorf("read after reset: %v, want connection reset", err)
+	}
+}
+
+func TestSeqCompare(t *testing.T) {
+	tests := []struct {
+		a, b uint32
+		lt   bool
+	}{
+		{1, 2, true},
+		{2, 1, false},
+		{0xFFFFFFF0, 5, true}, // Wraps around
+		{5, 0xFFFFFFF0, false},
+	}
+
+	for _, tt := range tests {
+		if seqLT(tt.a, tt.b) != tt.lt {
+			t.Errorf("seqLT(%d, %d) = %v", tt.a, tt.b, !tt.lt)
+		}
+	}
+	if !seqLEQ(7, 7) || seqLT(7, 7) {
+		t.Error("equal sequence numbers")
+	}
+}
+
+func TestStackClose(t *testing.T) {
+	stack, pipe := newTestStack(t)
+	h := &tcpTestHost{t: t, stack: stack, pipe: pipe, port: 40003, seq: 1}
+
+	l, err := stack.ListenTCP(80)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A half-open connection, a datagram being reassembled and a neighbor
+	// being resolved all have a timer running
+	h.send(TCPSyn, "")
+	h.expect(TCPSyn | TCPAck)
+	_, frags := testFragments(t, 7)
+	if _, err := stack.ProcessFrame(testEthernet(EtherTypeIPv4, frags[0].marshal())); err != nil {
+		t.Fatal(err)
+	}
+	if err := stack.SendUDP(net.IP{192, 168, 35, 99}, 5000, 5000, []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := stack.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The ARP request is skipped
+	h.expect(TCPRst | TCPAck)
+	if f := readTestFrame(t, pipe); f != nil {
+		t.Errorf("frame sent after Close: % x", f)
+	}
+	if n := len(stack.fragments.pending) + len(stack.timers.timers); n != 0 {
+		t.Errorf("%d timers left", n)
+	}
+	if _, err := l.AcceptTCP(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("accept after Close: %v", err)
+	}
+
+	if _, err := stack.ProcessFrame(testIPv4(UDPProtocol, make([]byte, 8))); !errors.Is(err, ErrLinkClosed) {
+		t.Errorf("frame processed after Close: %v", err)
+	}
+	if err := stack.SendUDP(testHostIP, 5000, 5000, []byte("hi")); !errors.Is(err, ErrLinkClosed) {
+		t.Errorf("send after Close: %v", err)
+	}
+}
@@ -0,0 +1,909 @@
+package network
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// TCP connections of the peer. Only the passive side is implemented: Go code
+// listens on a port with ListenTCP and accepts the connections opened by the
+// host. TCPListener and TCPConn implement net.Listener and net.Conn so they can
+// be used with net/http and friends.
+//
+// The implementation is kept simple:
+//   - data received after a hole is dropped, the duplicate ACK we send makes
+//     the sender retransmit it,
+//   - every segment is acknowledged immediately, there is no delayed ACK,
+//   - the retransmission timer resends the oldest unacknowledged segment with
+//     an exponential backoff, there is no congestion control,
+//   - a zero window is probed when the timer fires.
+//
+// [RFC 9293] https://datatracker.ietf.org/doc/html/rfc9293#section-3.10
+const (
+	tcpInitialRTO    = time.Second
+	tcpMaxRTO        = 30 * time.Second
+	tcpMaxRetries    = 8
+	tcpTimeWait      = 2 * time.Second // 2*MSL, kept short as we are not a router
+	tcpDefaultMSS    = 536             // RFC 9293 section 3.7.1
+	tcpRecvBufSize   = 65535
+	tcpSendBufSize   = 256 * 1024
+	tcpAcceptBacklog = 16
+)
+
+type TCPState int
+
+const (
+	TCPClosed TCPState = iota
+	TCPListen
+	TCPSynReceived
+	TCPEstablished
+	TCPFinWait1
+	TCPFinWait2
+	TCPCloseWait
+	TCPClosing
+	TCPLastAck
+	TCPTimeWait
+)
+
+func (st TCPState) String() string {
+	switch st {
+	case TCPClosed:
+		return "CLOSED"
+	case TCPListen:
+		return "LISTEN"
+	case TCPSynReceived:
+		return "SYN-RECEIVED"
+	case TCPEstablished:
+		return "ESTABLISHED"
+	case TCPFinWait1:
+		return "FIN-WAIT-1"
+	case TCPFinWait2:
+		return "FIN-WAIT-2"
+	case TCPCloseWait:
+		return "CLOSE-WAIT"
+	case TCPClosing:
+		return "CLOSING"
+	case TCPLastAck:
+		return "LAST-ACK"
+	case TCPTimeWait:
+		return "TIME-WAIT"
+	default:
+		return fmt.Sprintf("TCPState(%d)", int(st))
+	}
+}
+
+type tcpKey struct {
+	vlan   uint16
+	local  netip.AddrPort
+	remote netip.AddrPort
+}
+
+type tcpTable struct {
+	mu        sync.Mutex
+	listeners map[uint16]*TCPListener
+	conns     map[tcpKey]*TCPConn
+}
+
+func (t *tcpTable) remove(c *TCPConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.conns[c.key] == c {
+		delete(t.conns, c.key)
+	}
+}
+
+// handleTCP dispatches the segment to its connection or to the listener of
+// its destination port. Segments are sent directly on the link so the reply
+// returned to ProcessFrame is always nil.
+func (s *Stack) handleTCP(ep *endpoint, p *IPv4Packet) ([]byte, error) {
+	seg, err := parseTCP(p)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse TCP segment: %w", err)
+	}
+
+	localIP, _ := netip.AddrFromSlice(p.DestIP.To4())
+	remoteIP, _ := netip.AddrFromSlice(p.SourceIP.To4())
+	key := tcpKey{
+		vlan:   ep.vlan(),
+		local:  netip.AddrPortFrom(localIP, seg.DstPort),
+		remote: netip.AddrPortFrom(remoteIP, seg.SrcPort),
+	}
+
+	s.logger.Debug("TCP segment received", "remote", key.remote.String(), "port", seg.DstPort,
+		"flags", seg.Flags.String(), "seq", seg.Seq, "ack", seg.Ack, "len", len(seg.Payload))
+
+	s.tcp.mu.Lock()
+	c := s.tcp.conns[key]
+	l := s.tcp.listeners[seg.DstPort]
+	s.tcp.mu.Unlock()
+
+	if c != nil {
+		c.input(seg)
+		return nil, nil
+	}
+
+	// A reset is never answered
+	if seg.Flags&TCPRst != 0 {
+		return nil, nil
+	}
+
+	// Only a SYN can open a connection, anything else is reset
+	if l == nil || seg.Flags&(TCPSyn|TCPAck) != TCPSyn {
+		if err := s.sendTCPReset(ep, p.DestIP, p.SourceIP, seg); err != nil {
+			return nil, fmt.Errorf("failed to send TCP reset: %w", err)
+		}
+		if l == nil {
+			return nil, fmt.Errorf("no TCP listener on port %d", seg.DstPort)
+		}
+		return nil, nil
+	}
+
+	c = s.newTCPConn(ep, l, key, p, seg)
+
+	s.tcp.mu.Lock()
+	s.tcp.conns[key] = c
+	s.tcp.mu.Unlock()
+
+	return nil, nil
+}
+
+// sendTCPReset answers a segment that does not belong to any connection
+// (RFC 9293 section 3.10.7.1). src is the address the segment was sent to.
+func (s *Stack) sendTCPReset(ep *endpoint, src, dst net.IP, seg *TCPSegment) error {
+	rst := &TCPSegment{SrcPort: seg.DstPort, DstPort: seg.SrcPort}
+	if seg.Flags&TCPAck != 0 {
+		rst.Seq = seg.Ack
+		rst.Flags = TCPRst
+	} else {
+		rst.Ack = seg.Seq + seg.segLen()
+		rst.Flags = TCPRst | TCPAck
+	}
+
+	return s.sendTCP(ep, src, dst, rst)
+}
+
+func (s *Stack) sendTCP(ep *endpoint, src, dst net.IP, seg *TCPSegment) error {
+	return ep.sendIPv4From(src, dst, TCPProtocol, seg.marshal(src, dst))
+}
+
+// ------------------------------------------------------------------------------
+// Listener
+
+// TCPListener accepts the connections opened to a port of the peer.
+type TCPListener struct {
+	stack     *Stack
+	port      uint16
+	accept    chan *TCPConn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// ListenTCP starts accepting connections on the TCP port.
+func (s *Stack) ListenTCP(port uint16) (*TCPListener, error) {
+	s.tcp.mu.Lock()
+	defer s.tcp.mu.Unlock()
+
+	if s.tcp.listeners == nil {
+		s.tcp.listeners = make(map[uint16]*TCPListener)
+		s.tcp.conns = make(map[tcpKey]*TCPConn)
+	}
+
+	if _, found := s.tcp.listeners[port]; found {
+		return nil, fmt.Errorf("TCP port %d is already listening", port)
+	}
+
+	l := &TCPListener{
+		stack:  s,
+		port:   port,
+		accept: make(chan *TCPConn, tcpAcceptBacklog),
+		done:   make(chan struct{}),
+	}
+	s.tcp.listeners[port] = l
+
+	return l, nil
+}
+
+// Accept waits for the next established connection.
+func (l *TCPListener) Accept() (net.Conn, error) {
+	c, err := l.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (l *TCPListener) AcceptTCP() (*TCPConn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops listening. Connections that were not accepted yet are reset,
+// accepted ones are not affected.
+func (l *TCPListener) Close() error {
+	l.closeOnce.Do(func() {
+		l.stack.tcp.mu.Lock()
+		if l.stack.tcp.listeners[l.port] == l {
+			delete(l.stack.tcp.listeners, l.port)
+		}
+		l.stack.tcp.mu.Unlock()
+
+		close(l.done)
+
+		for {
+			select {
+			case c := <-l.accept:
+				c.mu.Lock()
+				c.abort(net.ErrClosed)
+				c.mu.Unlock()
+			default:
+				return
+			}
+		}
+	})
+
+	return nil
+}
+
+func (l *TCPListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: linkIPv4(l.stack.link), Port: int(l.port)}
+}
+
+// enqueue makes an established connection available to Accept. It returns
+// false if the listener is closed or its backlog is full.
+func (l *TCPListener) enqueue(c *TCPConn) bool {
+	select {
+	case <-l.done:
+		return false
+	default:
+	}
+
+	select {
+	case l.accept <- c:
+		return true
+	default:
+		return false
+	}
+}
+
+// ------------------------------------------------------------------------------
+// Connection
+
+// TCPConn is a connection accepted by a TCPListener.
+type TCPConn struct {
+	stack    *Stack
+	ep       *endpoint // Identity and VLAN of the connection
+	listener *TCPListener
+	key      tcpKey
+	localIP  net.IP // One of the addresses of ep
+	remoteIP net.IP
+
+	mu    sync.Mutex
+	cond  *sync.Cond // Signaled when data, space or an error is available
+	state TCPState
+	err   error // Why the connection was closed by the stack
+
+	// Send sequence variables. sendBuf holds the data that is not
+	// acknowledged yet, its first byte has the sequence number bufSeq.
+	iss      uint32
+	sndUna   uint32
+	sndNxt   uint32
+	sndWnd   uint16
+	mss      int
+	bufSeq   uint32
+	sendBuf  []byte
+	finQueue bool // Close was called, FIN is sent after sendBuf
+	finSent  bool
+
+	// Receive sequence variables
+	rcvNxt     uint32
+	recvBuf    []byte
+	recvClosed bool // FIN received
+
+	// Retransmission timer. timerGen invalidates a timer that fired while
+	// it was stopped.
+	rto      time.Duration
+	retries  int
+	timer    *time.Timer
+	timerGen int
+
+	localClosed   bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func (s *Stack) newTCPConn(ep *endpoint, l *TCPListener, key tcpKey, p *IPv4Packet, syn *TCPSegment) *TCPConn {
+	c := &TCPConn{
+		stack:    s,
+		ep:       ep,
+		listener: l,
+		key:      key,
+		localIP:  append(net.IP(nil), p.DestIP.To4()...),
+		remoteIP: append(net.IP(nil), p.SourceIP.To4()...),
+		state:    TCPSynReceived,
+		iss:      rand.Uint32(),
+		sndWnd:   syn.Window,
+		mss:      tcpDefaultMSS,
+		rcvNxt:   syn.Seq + 1,
+		rto:      tcpInitialRTO,
+	}
+	c.cond = sync.NewCond(&c.mu)
+
+	if mss, ok := syn.mss(); ok {
+		c.mss = min(int(mss), c.localMSS())
+	}
+
+	// SYN uses one sequence number
+	c.sndUna = c.iss
+	c.sndNxt = c.iss + 1
+	c.bufSeq = c.iss + 1
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s.logger.Debug("TCP connection", "conn", c.String(), "state", c.state.String())
+	c.sendSynAck()
+	c.armTimer()
+
+	return c
+}
+
+func (c *TCPConn) String() string {
+	return fmt.Sprintf("%s <-> %s", c.LocalAddr(), c.RemoteAddr())
+}
+
+// State returns the current state of the connection.
+func (c *TCPConn) State() TCPState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.state
+}
+
+// localMSS is the largest segment that fits in our MTU.
+func (c *TCPConn) localMSS() int {
+	return c.stack.link.MTU() - 40
+}
+
+func (c *TCPConn) recvWindow() int {
+	return max(tcpRecvBufSize-len(c.recvBuf), 0)
+}
+
+// ------------------------------------------------------------------------------
+// Segments arriving (RFC 9293 section 3.10.7.4)
+
+func (c *TCPConn) input(seg *TCPSegment) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.cond.Broadcast()
+
+	if c.state == TCPClosed {
+		return
+	}
+
+	if !c.acceptable(seg) {
+		if seg.Flags&TCPRst == 0 {
+			c.sendAck()
+		}
+		return
+	}
+
+	if seg.Flags&TCPRst != 0 {
+		// Only a reset with the exact sequence number we expect is
+		// trusted, otherwise a challenge ACK is sent (RFC 5961 section 3).
+		if seg.Seq != c.rcvNxt {
+			c.sendAck()
+			return
+		}
+
+		if c.state != TCPSynReceived {
+			c.err = syscall.ECONNRESET
+		}
+		c.setState(TCPClosed)
+		return
+	}
+
+	if seg.Flags&TCPSyn != 0 {
+		// Challenge ACK (RFC 5961 section 4)
+		c.sendAck()
+		return
+	}
+
+	if seg.Flags&TCPAck == 0 {
+		return
+	}
+
+	if c.state == TCPSynReceived {
+		if seg.Ack != c.iss+1 {
+			c.stack.sendTCPReset(c.ep, c.localIP, c.remoteIP, seg)
+			return
+		}
+
+		c.sndUna = seg.Ack
+		c.sndWnd = seg.Window
+		c.retries = 0
+		c.rto = tcpInitialRTO
+		c.stopTimer()
+		c.setState(TCPEstablished)
+
+		if !c.listener.enqueue(c) {
+			c.stack.logger.Warn("TCP connection refused, listener closed or backlog full", "conn", c.String())
+			c.abort(syscall.ECONNREFUSED)
+			return
+		}
+	} else {
+		if seqLT(c.sndNxt, seg.Ack) {
+			// Acknowledges something we did not send
+			c.sendAck()
+			return
+		}
+
+		if seqLT(c.sndUna, seg.Ack) {
+			c.acknowledged(seg.Ack)
+		}
+
+		if seqLEQ(c.sndUna, seg.Ack) {
+			c.sndWnd = seg.Window
+		}
+
+		if c.finSent && seg.Ack == c.sndNxt {
+			switch c.state {
+			case TCPFinWait1:
+				c.setState(TCPFinWait2)
+			case TCPClosing:
+				c.timeWait()
+			case TCPLastAck:
+				c.setState(TCPClosed)
+				return
+			}
+		}
+	}
+
+	ackNow := false
+
+	if seqLT(c.rcvNxt, seg.Seq) {
+		// Hole before this segment, the duplicate ACK asks for it
+		ackNow = true
+	} else if len(seg.Payload) > 0 || seg.Flags&TCPFin != 0 {
+		data := seg.Payload
+		if skip := int(c.rcvNxt - seg.Seq); skip > 0 {
+			// Retransmission overlapping new data
+			data = data[min(skip, len(data)):]
+		}
+
+		switch c.state {
+		case TCPEstablished, TCPFinWait1, TCPFinWait2:
+			data = data[:min(len(data), c.recvWindow())]
+			c.recvBuf = append(c.recvBuf, data...)
+			c.rcvNxt += uint32(len(data))
+		}
+		ackNow = true
+
+		// FIN is only processed once all the data before it is received
+		if seg.Flags&TCPFin != 0 && seg.Seq+uint32(len(seg.Payload)) == c.rcvNxt {
+			c.rcvNxt++
+			c.recvClosed = true
+
+			switch c.state {
+			case TCPEstablished:
+				c.setState(TCPCloseWait)
+			case TCPFinWait1:
+				// Our FIN is not acknowledged yet
+				c.setState(TCPClosing)
+			case TCPFinWait2:
+				c.timeWait()
+			}
+		}
+	}
+
+	if ackNow {
+		c.sendAck()
+	}
+
+	c.output()
+}
+
+// acceptable implements the sequence number check of RFC 9293 section
+// 3.10.7.4: the segment must overlap the receive window.
+func (c *TCPConn) acceptable(seg *TCPSegment) bool {
+	wnd := uint32(c.recvWindow())
+	inWindow := func(seq uint32) bool {
+		return seqLEQ(c.rcvNxt, seq) && seqLT(seq, c.rcvNxt+wnd)
+	}
+
+	// With a zero window only ACK and RST with the next sequence number
+	// are accepted, their data is dropped
+	if wnd == 0 {
+		return seg.Seq == c.rcvNxt
+	}
+
+	l := seg.segLen()
+	if l == 0 {
+		return inWindow(seg.Seq)
+	}
+
+	return inWindow(seg.Seq) || inWindow(seg.Seq+l-1)
+}
+
+// acknowledged removes the data acknowledged by ack from the send buffer.
+func (c *TCPConn) acknowledged(ack uint32) {
+	if seqLT(c.bufSeq, ack) {
+		n := min(int(ack-c.bufSeq), len(c.sendBuf))
+		c.sendBuf = c.sendBuf[n:]
+		c.bufSeq += uint32(n)
+	}
+
+	c.sndUna = ack
+	c.retries = 0
+	c.rto = tcpInitialRTO
+
+	c.stopTimer()
+	if c.sndUna != c.sndNxt {
+		c.armTimer()
+	}
+}
+
+// ------------------------------------------------------------------------------
+// Sending
+
+func (c *TCPConn) send(flags TCPFlags, seq uint32, payload []byte, options []byte) {
+	seg := &TCPSegment{
+		SrcPort: c.key.local.Port(),
+		DstPort: c.key.remote.Port(),
+		Seq:     seq,
+		Flags:   flags,
+		Window:  uint16(min(c.recvWindow(), 0xFFFF)),
+		Options: options,
+		Payload: payload,
+	}
+	if flags&TCPAck != 0 {
+		seg.Ack = c.rcvNxt
+	}
+
+	if err := c.stack.sendTCP(c.ep, c.localIP, c.remoteIP, seg); err != nil {
+		c.stack.logger.Error("failed to send TCP segment", "conn", c.String(), "err", err)
+	}
+}
+
+func (c *TCPConn) sendSynAck() {
+	c.send(TCPSyn|TCPAck, c.iss, nil, mssOption(uint16(c.localMSS())))
+}
+
+func (c *TCPConn) sendAck() {
+	switch c.state {
+	case TCPSynReceived:
+		c.sendSynAck()
+	case TCPClosed:
+	default:
+		c.send(TCPAck, c.sndNxt, nil, nil)
+	}
+}
+
+// output sends the data of the send buffer allowed by the window of the remote
+// host, then FIN once everything is sent if Close was called.
+func (c *TCPConn) output() {
+	if c.state != TCPEstablished && c.state != TCPCloseWait {
+		return
+	}
+
+	wndEnd := c.sndUna + uint32(c.sndWnd)
+	for {
+		off := int(c.sndNxt - c.bufSeq)
+		n := min(len(c.sendBuf)-off, c.mss, int(int32(wndEnd-c.sndNxt)))
+		if n <= 0 {
+			break
+		}
+
+		c.send(TCPAck|TCPPsh, c.sndNxt, c.sendBuf[off:off+n], nil)
+		c.sndNxt += uint32(n)
+	}
+
+	unsent := len(c.sendBuf) - int(c.sndNxt-c.bufSeq)
+
+	if c.finQueue && !c.finSent && unsent == 0 {
+		c.send(TCPFin|TCPAck, c.sndNxt, nil, nil)
+		c.sndNxt++
+		c.finSent = true
+
+		if c.state == TCPEstablished {
+			c.setState(TCPFinWait1)
+		} else {
+			c.setState(TCPLastAck)
+		}
+	}
+
+	// The timer also probes a zero window
+	if c.sndUna != c.sndNxt || unsent > 0 {
+		c.armTimer()
+	}
+}
+
+// armTimer starts the retransmission timer if it is not running.
+func (c *TCPConn) armTimer() {
+	if c.timer != nil {
+		return
+	}
+
+	gen := c.timerGen
+	c.timer = time.AfterFunc(c.rto, func() { c.onTimeout(gen) })
+}
+
+func (c *TCPConn) stopTimer() {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	c.timerGen++
+}
+
+func (c *TCPConn) onTimeout(gen int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.cond.Broadcast()
+
+	if gen != c.timerGen {
+		return
+	}
+	c.timer = nil
+
+	if c.state == TCPClosed || c.state == TCPTimeWait {
+		return
+	}
+
+	c.retries++
+	if c.retries > tcpMaxRetries {
+		c.stack.logger.Warn("TCP connection timed out", "conn", c.String(), "state", c.state.String())
+		c.abort(syscall.ETIMEDOUT)
+		return
+	}
+	c.rto = min(2*c.rto, tcpMaxRTO)
+
+	switch {
+	case c.state == TCPSynReceived:
+		c.sendSynAck()
+	case c.sndUna != c.sndNxt && len(c.sendBuf) > 0:
+		// Only the oldest segment is resent, the ACK tells what is next
+		n := min(len(c.sendBuf), c.mss)
+		c.send(TCPAck|TCPPsh, c.sndUna, c.sendBuf[:n], nil)
+	case c.sndUna != c.sndNxt && c.finSent:
+		c.send(TCPFin|TCPAck, c.sndUna, nil, nil)
+	case c.sndWnd == 0 && len(c.sendBuf) > 0:
+		// An old sequence number forces the remote host to answer
+		// with its current window
+		c.send(TCPAck, c.sndNxt-1, nil, nil)
+	default:
+		return
+	}
+
+	c.armTimer()
+}
+
+// abort sends a reset and closes the connection with err.
+func (c *TCPConn) abort(err error) {
+	if c.state == TCPClosed {
+		return
+	}
+
+	c.send(TCPRst|TCPAck, c.sndNxt, nil, nil)
+	c.err = err
+	c.setState(TCPClosed)
+}
+
+func (c *TCPConn) timeWait() {
+	c.setState(TCPTimeWait)
+	c.stopTimer()
+
+	c.stack.timers.afterFunc(tcpTimeWait, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		if c.state == TCPTimeWait {
+			c.setState(TCPClosed)
+		}
+	})
+}
+
+// closeTCP closes the listeners and resets the connections, those in
+// TIME-WAIT are only dropped.
+func (s *Stack) closeTCP() {
+	s.tcp.mu.Lock()
+	listeners := slices.Collect(maps.Values(s.tcp.listeners))
+	conns := slices.Collect(maps.Values(s.tcp.conns))
+	s.tcp.mu.Unlock()
+
+	for _, l := range listeners {
+		l.Close()
+	}
+
+	for _, c := range conns {
+		c.mu.Lock()
+		if c.state == TCPTimeWait {
+			c.setState(TCPClosed)
+		} else {
+			c.abort(net.ErrClosed)
+		}
+		c.mu.Unlock()
+	}
+}
+
+func (c *TCPConn) setState(st TCPState) {
+	c.stack.logger.Debug("TCP state", "conn", c.String(), "from", c.state.String(), "to", st.String())
+	c.state = st
+
+	if st == TCPClosed {
+		c.stopTimer()
+		c.stack.tcp.remove(c)
+		c.cond.Broadcast()
+	}
+}
+
+// ------------------------------------------------------------------------------
+// net.Conn
+
+func (c *TCPConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for {
+		if c.localClosed {
+			return 0, net.ErrClosed
+		}
+
+		if len(c.recvBuf) > 0 {
+			before := c.recvWindow()
+			n := copy(b, c.recvBuf)
+			c.recvBuf = c.recvBuf[n:]
+
+			// Let the sender know that the window is open again
+			if before < c.mss && c.recvWindow() >= c.mss {
+				c.sendAck()
+			}
+			return n, nil
+		}
+
+		if c.recvClosed {
+			return 0, io.EOF
+		}
+
+		if c.err != nil {
+			return 0, c.err
+		}
+
+		if c.state == TCPClosed {
+			return 0, io.EOF
+		}
+
+		if deadlinePassed(c.readDeadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+
+		c.cond.Wait()
+	}
+}
+
+// Write queues b in the send buffer, it blocks while the buffer is full.
+func (c *TCPConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	written := 0
+	for written < len(b) {
+		if c.localClosed {
+			return written, net.ErrClosed
+		}
+
+		if c.err != nil {
+			return written, c.err
+		}
+
+		if c.state != TCPEstablished && c.state != TCPCloseWait {
+			return written, syscall.EPIPE
+		}
+
+		if deadlinePassed(c.writeDeadline) {
+			return written, os.ErrDeadlineExceeded
+		}
+
+		space := tcpSendBufSize - len(c.sendBuf)
+		if space <= 0 {
+			c.cond.Wait()
+			continue
+		}
+
+		n := min(space, len(b)-written)
+		c.sendBuf = append(c.sendBuf, b[written:written+n]...)
+		written += n
+
+		c.output()
+	}
+
+	return written, nil
+}
+
+// Close sends FIN once the data already written is sent. The connection
+// goes through the closing states in the background.
+func (c *TCPConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.cond.Broadcast()
+
+	if c.localClosed {
+		return net.ErrClosed
+	}
+	c.localClosed = true
+
+	switch c.state {
+	case TCPEstablished, TCPCloseWait:
+		c.finQueue = true
+		c.output()
+	case TCPSynReceived:
+		c.abort(net.ErrClosed)
+	}
+
+	return nil
+}
+
+func (c *TCPConn) LocalAddr() net.Addr {
+	return net.TCPAddrFromAddrPort(c.key.local)
+}
+
+func (c *TCPConn) RemoteAddr() net.Addr {
+	return net.TCPAddrFromAddrPort(c.key.remote)
+}
+
+func (c *TCPConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *TCPConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.readDeadline = t
+	c.wakeAt(t)
+	return nil
+}
+
+func (c *TCPConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.writeDeadline = t
+	c.wakeAt(t)
+	return nil
+}
+
+// wakeAt wakes up blocked readers and writers at t so they check their
+// deadline.
+func (c *TCPConn) wakeAt(t time.Time) {
+	c.cond.Broadcast()
+
+	if t.IsZero() {
+		return
+	}
+
+	time.AfterFunc(time.Until(t), func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		c.cond.Broadcast()
+	})
+}
+
+func deadlinePassed(t time.Time) bool {
+	return !t.IsZero() && !time.Now().Before(t)
+}
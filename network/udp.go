@@ -0,0 +1,237 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// +--------------------------------------------------------+
+// | UDP Header (8 bytes)                                   |
+// |--------------------------------------------------------|
+// | Source Port (2) | Destination Port (2)                 |
+// | Length (2)      | Checksum (2)                         |
+// +--------------------------------------------------------+
+//
+// Length covers the header and the data. The checksum covers the IPv4
+// pseudo-header, the header and the data. A checksum of 0 means that the
+// sender did not compute it, so a computed checksum of 0 is sent as 0xFFFF.
+//
+// [RFC 768] https://datatracker.ietf.org/doc/html/rfc768
+type UDPDatagram struct {
+	SrcPort  uint16
+	DstPort  uint16
+	Length   uint16
+	Checksum uint16
+	Payload  []byte
+}
+
+// UDPRequest is a datagram received on a bound port.
+type UDPRequest struct {
+	SrcMAC  net.HardwareAddr
+	VLAN    uint16 // VID of the innermost tag, 0 if untagged
+	SrcIP   net.IP
+	DstIP   net.IP
+	SrcPort uint16
+	DstPort uint16
+	Payload []byte
+	// Raw Ethernet frame the datagram came in
+	Frame []byte
+}
+
+// UDPResponse is a datagram sent back by a handler. Unset fields default to
+// the source of the request, and the source address is the destination of the
+// request (or our address if the request was broadcast).
+type UDPResponse struct {
+	DstMAC  net.HardwareAddr
+	DstIP   net.IP
+	DstPort uint16
+	SrcPort uint16
+	Payload []byte
+}
+
+// UDPHandler returns the datagrams to send in response to req, it can be
+// none.
+type UDPHandler func(req *UDPRequest) ([]UDPResponse, error)
+
+type udpRegistry struct {
+	mu       sync.RWMutex
+	handlers map[uint16]UDPHandler
+}
+
+// HandleUDP binds h to the UDP port. Only one handler can be bound to a port.
+func (s *Stack) HandleUDP(port uint16, h UDPHandler) error {
+	s.udp.mu.Lock()
+	defer s.udp.mu.Unlock()
+
+	if s.udp.handlers == nil {
+		s.udp.handlers = make(map[uint16]UDPHandler)
+	}
+
+	if _, found := s.udp.handlers[port]; found {
+		return fmt.Errorf("UDP port %d is already bound", port)
+	}
+
+	s.udp.handlers[port] = h
+	return nil
+}
+
+// UnhandleUDP releases the UDP port.
+func (s *Stack) UnhandleUDP(port uint16) {
+	s.udp.mu.Lock()
+	defer s.udp.mu.Unlock()
+
+	delete(s.udp.handlers, port)
+}
+
+func (s *Stack) udpHandler(port uint16) (UDPHandler, bool) {
+	s.udp.mu.RLock()
+	defer s.udp.mu.RUnlock()
+
+	h, found := s.udp.handlers[port]
+	return h, found
+}
+
+// handleUDP dispatches the datagram to the handler bound to its destination
+// port. Responses are sent directly on the link as there can be several of
+// them, so the reply returned to ProcessFrame is nil unless no handler is
+// bound and it is a Port Unreachable.
+func (s *Stack) handleUDP(ep *endpoint, f *EthernetFrame, p *IPv4Packet) ([]byte, error) {
+	d, err := parseUDP(p)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse UDP datagram: %w", err)
+	}
+
+	h, found := s.udpHandler(d.DstPort)
+	if !found {
+		err := fmt.Errorf("no UDP handler bound to port %d", d.DstPort)
+		return ep.icmpError(f, p, ICMPDestUnreachable, ICMPCodePortUnreachable, 0, err)
+	}
+
+	req := &UDPRequest{
+		SrcMAC:  f.SrcMAC,
+		VLAN:    ep.vlan(),
+		SrcIP:   p.SourceIP,
+		DstIP:   p.DestIP,
+		SrcPort: d.SrcPort,
+		DstPort: d.DstPort,
+		Payload: d.Payload,
+		Frame:   f.Raw,
+	}
+
+	responses, err := h(req)
+	if err != nil {
+		return nil, fmt.Errorf("UDP handler on port %d failed: %w", d.DstPort, err)
+	}
+
+	for _, r := range responses {
+		dstMAC, packet := s.buildUDPResponse(ep, req, &r)
+		if err := ep.writeIPv4(dstMAC, packet); err != nil {
+			return nil, fmt.Errorf("failed to send UDP response: %w", err)
+		}
+	}
+
+	return nil, nil
+}
+
+// buildUDPResponse returns the destination MAC address and the IPv4 packet of
+// the response.
+func (s *Stack) buildUDPResponse(ep *endpoint, req *UDPRequest, r *UDPResponse) (net.HardwareAddr, []byte) {
+	dstMAC, dstIP, dstPort, srcPort := r.DstMAC, r.DstIP, r.DstPort, r.SrcPort
+	if dstMAC == nil {
+		dstMAC = req.SrcMAC
+	}
+	if dstIP == nil {
+		dstIP = req.SrcIP
+	}
+	if dstPort == 0 {
+		dstPort = req.SrcPort
+	}
+	if srcPort == 0 {
+		srcPort = req.DstPort
+	}
+
+	srcIP := req.DstIP
+	if !ep.owns(srcIP) {
+		// Broadcast or multicast request
+		srcIP = ep.ipv4()
+	}
+
+	d := &UDPDatagram{
+		SrcPort: srcPort,
+		DstPort: dstPort,
+		Payload: r.Payload,
+	}
+
+	p := &IPv4Packet{
+		Identification: uint16(s.ipID.Add(1)),
+		TTL:            defaultTTL,
+		Protocol:       UDPProtocol,
+		SourceIP:       srcIP,
+		DestIP:         dstIP,
+		Payload:        d.marshal(srcIP, dstIP),
+	}
+
+	return dstMAC, p.marshal()
+}
+
+// SendUDP originates a datagram, dst is resolved through the neighbor table.
+func (s *Stack) SendUDP(dst net.IP, srcPort, dstPort uint16, payload []byte) error {
+	d := &UDPDatagram{
+		SrcPort: srcPort,
+		DstPort: dstPort,
+		Payload: payload,
+	}
+
+	return s.SendIPv4(dst, UDPProtocol, d.marshal(linkIPv4(s.link), dst))
+}
+
+func parseUDP(packet *IPv4Packet) (*UDPDatagram, error) {
+	payload := packet.Payload
+
+	if len(payload) < 8 {
+		return nil, fmt.Errorf("UDP datagram too short")
+	}
+
+	d := &UDPDatagram{
+		SrcPort:  binary.BigEndian.Uint16(payload[0:2]),
+		DstPort:  binary.BigEndian.Uint16(payload[2:4]),
+		Length:   binary.BigEndian.Uint16(payload[4:6]),
+		Checksum: binary.BigEndian.Uint16(payload[6:8]),
+	}
+
+	if int(d.Length) < 8 || int(d.Length) > len(payload) {
+		return nil, fmt.Errorf("invalid UDP length %d for %d bytes", d.Length, len(payload))
+	}
+
+	// Bytes after Length are padding
+	payload = payload[:d.Length]
+
+	if d.Checksum != 0 {
+		if cs := pseudoHeaderChecksum4(packet.SourceIP, packet.DestIP, UDPProtocol, payload); cs != 0 {
+			return nil, fmt.Errorf("bad UDP checksum 0x%04X", d.Checksum)
+		}
+	}
+
+	d.Payload = payload[8:]
+	return d, nil
+}
+
+// marshal serializes the datagram, Length and Checksum are computed.
+func (d *UDPDatagram) marshal(src, dst net.IP) []byte {
+	b := make([]byte, 8+len(d.Payload))
+
+	binary.BigEndian.PutUint16(b[0:2], d.SrcPort)
+	binary.BigEndian.PutUint16(b[2:4], d.DstPort)
+	binary.BigEndian.PutUint16(b[4:6], uint16(len(b)))
+	copy(b[8:], d.Payload)
+
+	cs := pseudoHeaderChecksum4(src, dst, UDPProtocol, b)
+	if cs == 0 {
+		cs = 0xFFFF
+	}
+	binary.BigEndian.PutUint16(b[6:8], cs)
+
+	return b
+}
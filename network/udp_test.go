@@ -0,0 +1,108 @@
+package network
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestUDPMarshalParse(t *testing.T) {
+	d := &UDPDatagram{SrcPort: 1234, DstPort: 53, Payload: []byte("query")}
+	b := d.marshal(testHostIP, testPeerIP)
+
+	tests := []struct {
+		name    string
+		payload []byte
+		wantErr bool
+	}{
+		{"valid", b, false},
+		{"padded", append(append([]byte(nil), b...), 0, 0), false},
+		{"no checksum", append(append([]byte(nil), b[:6]...), append([]byte{0, 0}, b[8:]...)...), false},
+		{"too short", b[:7], true},
+		{"length too large", b[:len(b)-1], true},
+		{"bad checksum", append(append([]byte(nil), b[:len(b)-1]...), b[len(b)-1]^1), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &IPv4Packet{SourceIP: testHostIP, DestIP: testPeerIP, Protocol: UDPProtocol, Payload: tt.payload}
+			got, err := parseUDP(p)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("parse succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.SrcPort != 1234 || got.DstPort != 53 || !bytes.Equal(got.Payload, d.Payload) {
+				t.Errorf("parsed %+v", got)
+			}
+		})
+	}
+}
+
+// Responses of handlers are written to the link, not returned by
+// ProcessFrame.
+func TestUDPHandlerResponses(t *testing.T) {
+	stack, host := newTestStack(t)
+
+	err := stack.HandleUDP(7, func(req *UDPRequest) ([]UDPResponse, error) {
+		return []UDPResponse{
+			{Payload: req.Payload},
+			{DstPort: 9999, Payload: bytes.Repeat(req.Payload, 1000)}, // Fragmented
+		}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stack.HandleUDP(7, nil); err == nil {
+		t.Error("port bound twice")
+	}
+
+	d := &UDPDatagram{SrcPort: 4000, DstPort: 7, Payload: []byte("echo")}
+	reply, err := stack.ProcessFrame(testIPv4(UDPProtocol, d.marshal(testHostIP, testPeerIP)))
+	if err != nil || reply != nil {
+		t.Fatalf("ProcessFrame returned %v, %v", reply, err)
+	}
+
+	f := readTestFrame(t, host)
+	if f == nil {
+		t.Fatal("no response written to the link")
+	}
+	p, _ := parseIPv4Packet(f[14:])
+	got, err := parseUDP(p)
+	if err != nil || got.DstPort != 4000 || got.SrcPort != 7 || string(got.Payload) != "echo" {
+		t.Errorf("first response %+v, %v", got, err)
+	}
+
+	// The second response is 4008 bytes of UDP in 3 fragments
+	var total int
+	for i := 0; i < 3; i++ {
+		f := readTestFrame(t, host)
+		if f == nil {
+			t.Fatalf("fragment %d not written to the link", i)
+		}
+		p, err := parseIPv4Packet(f[14:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(f) > 14+host.MTU() {
+			t.Errorf("fragment of %d bytes", len(f))
+		}
+		total += len(p.Payload)
+	}
+	if total != 8+4000 {
+		t.Errorf("fragments carry %d bytes, want %d", total, 8+4000)
+	}
+
+	stack.UnhandleUDP(7)
+	reply, _ = stack.ProcessFrame(testIPv4(UDPProtocol, d.marshal(testHostIP, testPeerIP)))
+	if reply == nil {
+		t.Fatal("no Port Unreachable after UnhandleUDP")
+	}
+	p, _ = parseIPv4Packet(reply[14:])
+	if p.Protocol != ICMPProtocol || p.Payload[0] != ICMPDestUnreachable || p.Payload[1] != ICMPCodePortUnreachable {
+		t.Errorf("unexpected reply % x", reply)
+	}
+}
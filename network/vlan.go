@@ -0,0 +1,83 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// +--------------------------------------------------------+
+// | 802.1Q Tag (4 bytes, after the source MAC)             |
+// |--------------------------------------------------------|
+// | TPID (2) | PCP (3 bits) | DEI (1 bit) | VID (12 bits)  |
+// +--------------------------------------------------------+
+//
+// TPID is 0x8100 for a customer tag. 802.1ad (QinQ) stacks a service tag with
+// TPID 0x88A8 in front of it. The EtherType of the payload follows the last
+// tag.
+//
+// A frame is handled by the host of the VLAN of its innermost tag, or by the
+// link identity if there is none. Replies carry the same tags as the frame
+// they answer.
+//
+// https://en.wikipedia.org/wiki/IEEE_802.1Q
+// https://en.wikipedia.org/wiki/IEEE_802.1ad
+type VLANTag struct {
+	TPID EtherType
+	PCP  uint8 // Priority Code Point
+	DEI  bool  // Drop Eligible Indicator
+	VID  uint16
+}
+
+func (t VLANTag) String() string {
+	return fmt.Sprintf("%s vid=%d pcp=%d", t.TPID.String(), t.VID, t.PCP)
+}
+
+func (t VLANTag) tci() uint16 {
+	tci := uint16(t.PCP&0x7)<<13 | t.VID&0x0FFF
+	if t.DEI {
+		tci |= 1 << 12
+	}
+	return tci
+}
+
+func parseVLANTag(tpid EtherType, tci uint16) VLANTag {
+	return VLANTag{
+		TPID: tpid,
+		PCP:  uint8(tci >> 13),
+		DEI:  tci&(1<<12) != 0,
+		VID:  tci & 0x0FFF,
+	}
+}
+
+func isVLANTPID(et EtherType) bool {
+	return et == EtherTypeVLAN || et == EtherTypeQinQ
+}
+
+// vlanID returns the VID of the innermost tag, 0 for an untagged frame.
+func vlanID(tags []VLANTag) uint16 {
+	if len(tags) == 0 {
+		return 0
+	}
+	return tags[len(tags)-1].VID
+}
+
+// buildTaggedFrame is buildEthernetFrame with VLAN tags, outermost first.
+func buildTaggedFrame(dst, src net.HardwareAddr, tags []VLANTag, etherType EtherType, payload []byte) []byte {
+	frame := make([]byte, 14+4*len(tags)+len(payload))
+
+	copy(frame[0:6], dst)
+	copy(frame[6:12], src)
+
+	off := 12
+	for _, t := range tags {
+		binary.BigEndian.PutUint16(frame[off:off+2], uint16(t.TPID))
+		binary.BigEndian.PutUint16(frame[off+2:off+4], t.tci())
+		off += 4
+	}
+
+	binary.BigEndian.PutUint16(frame[off:off+2], uint16(etherType))
+	copy(frame[off+2:], payload)
+
+	return frame
+}
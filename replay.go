@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"example.com/framespector/capture"
+	"example.com/framespector/network"
+)
+
+// ------------------------------------------------------------------------------
+// REPLAY MODE
+//
+// Frames are read from a capture file instead of the peer interface so the
+// protocol stack can be exercised without being root. Replies are recorded in
+// the output file with the timestamp of the frame that triggered them.
+//
+//	framespector replay --in session.pcapng --out replies.pcap
+
+type replayArgs struct {
+	inFile  string
+	outFile string
+	peerIP  net.IP
+	peerIP6 net.IP
+	peerMAC net.HardwareAddr
+}
+
+func readReplayArgs(argv []string) (*replayArgs, error) {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+
+	inFile := fs.String("in", "", "Capture file (pcap or pcapng) to replay")
+	outFile := fs.String("out", "", "Write replies to this file (pcapng if it ends with .pcapng, pcap otherwise)")
+	peerIP := fs.String("peer", "192.168.35.3/24", "IP address of the peer with CIDR")
+	peerIP6 := fs.String("peer6", "", "Optional IPv6 address of the peer with prefix length")
+	peerMAC := fs.String("mac", "02:00:00:00:00:03", "MAC address of the peer")
+
+	if err := fs.Parse(argv); err != nil {
+		return nil, err
+	}
+
+	if *inFile == "" || *outFile == "" {
+		fs.Usage()
+		return nil, fmt.Errorf("replay needs --in and --out")
+	}
+
+	ip, _, err := net.ParseCIDR(*peerIP)
+	if err != nil || ip.To4() == nil {
+		return nil, fmt.Errorf("%s is not a valid IP address with CIDR", *peerIP)
+	}
+
+	var ip6 net.IP
+	if *peerIP6 != "" {
+		if ip6, _, err = net.ParseCIDR(*peerIP6); err != nil || ip6.To4() != nil {
+			return nil, fmt.Errorf("%s is not a valid IPv6 address with prefix length", *peerIP6)
+		}
+	}
+
+	mac, err := net.ParseMAC(*peerMAC)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a valid MAC address: %w", *peerMAC, err)
+	}
+
+	return &replayArgs{
+		inFile:  *inFile,
+		outFile: *outFile,
+		peerIP:  ip.To4(),
+		peerIP6: ip6,
+		peerMAC: mac,
+	}, nil
+}
+
+func runReplay(logger *slog.Logger, argv []string) error {
+	args, err := readReplayArgs(argv)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+
+	in, err := os.Open(args.inFile)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	reader, err := capture.NewReader(in)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", args.inFile, err)
+	}
+
+	out, err := os.Create(args.outFile)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	var writer capture.Writer
+	if filepath.Ext(args.outFile) == ".pcapng" {
+		writer, err = capture.NewPcapngWriter(out, "replay")
+	} else {
+		writer, err = capture.NewPcapWriter(out)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", args.outFile, err)
+	}
+
+	ips := []net.IP{args.peerIP}
+	if args.peerIP6 != nil {
+		ips = append(ips, args.peerIP6)
+	}
+
+	// The pipe gives the identity of the peer, frames are read from the
+	// capture and frames written to the link are recorded instead of being
+	// sent to the other end.
+	peer, _ := network.NewPipe(network.PipeConf{
+		Name: "replay",
+		MAC:  args.peerMAC,
+		IPs:  ips,
+	}, network.PipeConf{})
+	defer peer.Close()
+
+	link := &replayLink{Link: peer, writer: writer}
+	stack := network.NewStack(logger, link)
+
+	var frames int
+
+	for {
+		f, err := reader.ReadFrame()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", args.inFile, err)
+		}
+
+		// Only Ethernet frames received by the peer are replayed, replies
+		// recorded by --write are skipped.
+		if f.LinkType != capture.LinkTypeEthernet || f.Direction == capture.DirectionOutbound {
+			continue
+		}
+		frames++
+
+		link.setTimestamp(f.Timestamp)
+
+		reply, err := stack.ProcessFrame(f.Data)
+		if err != nil {
+			network.LogProcessError(logger, err)
+			continue
+		}
+
+		if reply == nil {
+			continue
+		}
+
+		if err := link.WriteFrame(reply); err != nil {
+			return fmt.Errorf("failed to write %s: %w", args.outFile, err)
+		}
+	}
+
+	link.mu.Lock()
+	replies := link.replies
+	link.mu.Unlock()
+
+	logger.Info("replay done", "frames", frames, "replies", replies, "out", args.outFile)
+	return nil
+}
+
+// replayLink records the frames written by the stack, either returned by
+// ProcessFrame or sent directly to the link (TCP resets, UDP responses,
+// fragments...), with the timestamp of the frame being replayed.
+type replayLink struct {
+	network.Link
+
+	mu      sync.Mutex
+	writer  capture.Writer
+	ts      time.Time
+	replies int
+}
+
+func (r *replayLink) setTimestamp(ts time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ts = ts
+}
+
+func (r *replayLink) WriteFrame(frame []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.writer.WriteFrame(r.ts, frame, capture.DirectionOutbound); err != nil {
+		return err
+	}
+	r.replies++
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"example.com/framespector/capture"
+	"example.com/framespector/network"
+)
+
+// More SYNs than the queue of a pipe, replies written to the link must not
+// block the replay.
+const replaySyns = 70
+
+func TestReplayRecordsResets(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.pcap")
+	out := filepath.Join(dir, "out.pcapng")
+
+	hostMAC := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02}
+	peerMAC := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x03}
+	hostIP := net.IP{192, 168, 35, 2}
+	peerIP := net.IP{192, 168, 35, 3}
+
+	f, err := os.Create(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := capture.NewPcapWriter(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Unix(1700000000, 0)
+	for i := range replaySyns {
+		frame := testSYN(hostMAC, peerMAC, hostIP, peerIP, uint16(40000+i), 9)
+		if err := w.WriteFrame(start.Add(time.Duration(i)*time.Millisecond), frame, capture.DirectionInbound); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- runReplay(slog.New(slog.DiscardHandler), []string{"--in", in, "--out", out})
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("replay blocked")
+	}
+
+	o, err := os.Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+	r, err := capture.NewReader(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resets := map[uint16]bool{}
+	for {
+		frame, err := r.ReadFrame()
+		if err != nil {
+			break
+		}
+		if frame.Direction != capture.DirectionOutbound {
+			t.Errorf("reply with direction %s", frame.Direction)
+		}
+		if frame.Timestamp.Before(start) {
+			t.Errorf("reply with timestamp %v before the capture", frame.Timestamp)
+		}
+
+		// Ethernet, IPv4 without options and a TCP segment with RST
+		data := frame.Data
+		if len(data) < 14+20+20 || binary.BigEndian.Uint16(data[12:14]) != uint16(network.EtherTypeIPv4) ||
+			data[14+9] != byte(network.TCPProtocol) || data[14+20+13]&0x04 == 0 {
+			continue
+		}
+		port := binary.BigEndian.Uint16(data[14+20+2 : 14+20+4])
+		resets[port] = true
+	}
+
+	if len(resets) != replaySyns {
+		t.Errorf("%d TCP resets recorded, want %d", len(resets), replaySyns)
+	}
+}
+
+// testSYN builds a frame with a TCP SYN from the host to a port of the peer.
+func testSYN(src, dst net.HardwareAddr, srcIP, dstIP net.IP, srcPort, dstPort uint16) []byte {
+	tcp := make([]byte, 20)
+	binary.BigEndian.PutUint16(tcp[0:2], srcPort)
+	binary.BigEndian.PutUint16(tcp[2:4], dstPort)
+	binary.BigEndian.PutUint32(tcp[4:8], 1000)
+	tcp[12] = 5 << 4
+	tcp[13] = 0x02 // SYN
+	binary.BigEndian.PutUint16(tcp[14:16], 65535)
+
+	pseudo := append(append(append([]byte(nil), srcIP...), dstIP...), 0, byte(network.TCPProtocol), 0, 20)
+	binary.BigEndian.PutUint16(tcp[16:18], testChecksum(append(pseudo, tcp...)))
+
+	ip := make([]byte, 20, 40)
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:4], 40)
+	ip[8] = 64
+	ip[9] = byte(network.TCPProtocol)
+	copy(ip[12:16], srcIP)
+	copy(ip[16:20], dstIP)
+	binary.BigEndian.PutUint16(ip[10:12], testChecksum(ip))
+	ip = append(ip, tcp...)
+
+	frame := append(append([]byte(nil), dst...), src...)
+	frame = binary.BigEndian.AppendUint16(frame, uint16(network.EtherTypeIPv4))
+	return append(frame, ip...)
+}
+
+func testChecksum(data []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i : i+2]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xFFFF + sum>>16
+	}
+	return ^uint16(sum)
+}
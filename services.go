@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"example.com/framespector/network"
+)
+
+// startServices starts on the stack the services of the command line. The
+// returned function stops them.
+func startServices(logger *slog.Logger, stack *network.Stack, args *Args) (func(), error) {
+	var stops []func()
+	stopAll := func() {
+		for i := len(stops) - 1; i >= 0; i-- {
+			stops[i]()
+		}
+	}
+
+	if args.tcpEcho != 0 {
+		stop, err := startTCPEcho(logger, stack, args.tcpEcho)
+		if err != nil {
+			stopAll()
+			return nil, err
+		}
+		stops = append(stops, stop)
+		logger.Info("TCP echo listening", "port", args.tcpEcho)
+	}
+
+	if args.httpPort != 0 {
+		stop, err := startHTTP(logger, stack, args.httpPort)
+		if err != nil {
+			stopAll()
+			return nil, err
+		}
+		stops = append(stops, stop)
+		logger.Info("HTTP listening", "port", args.httpPort)
+	}
+
+	if args.dnsZone != "" {
+		zone, err := network.LoadDNSZone(args.dnsZone)
+		if err != nil {
+			stopAll()
+			return nil, err
+		}
+
+		server, err := stack.ServeDNS(zone)
+		if err != nil {
+			stopAll()
+			return nil, err
+		}
+		stops = append(stops, server.Close)
+		logger.Info("DNS server started", "zone", args.dnsZone)
+	}
+
+	if args.dhcp {
+		server, err := startDHCP(stack, args)
+		if err != nil {
+			stopAll()
+			return nil, err
+		}
+		stops = append(stops, func() {
+			for _, l := range server.Leases() {
+				logger.Debug("DHCP lease", "ip", l.IP.String(), "mac", l.MAC.String(),
+					"hostname", l.Hostname, "bound", l.Bound, "expires", l.Expires.Format(time.RFC3339))
+			}
+			server.Close()
+		})
+		logger.Info("DHCP server started")
+	}
+
+	logger.Info("Hit ctrl-c to quit")
+
+	return stopAll, nil
+}
+
+// startTCPEcho sends back everything received on the connections accepted on
+// port. The returned function stops listening.
+func startTCPEcho(logger *slog.Logger, stack *network.Stack, port uint16) (func(), error) {
+	l, err := stack.ListenTCP(port)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			logger.Info("TCP echo connection", "remote", c.RemoteAddr().String())
+			go func() {
+				defer c.Close()
+				if _, err := io.Copy(c, c); err != nil {
+					logger.Warn("TCP echo", "remote", c.RemoteAddr().String(), "err", err)
+				}
+			}()
+		}
+	}()
+
+	return func() { l.Close() }, nil
+}
+
+// startHTTP serves a small page on port. The returned function stops
+// listening.
+func startHTTP(logger *slog.Logger, stack *network.Stack, port uint16) (func(), error) {
+	l, err := stack.ListenTCP(port)
+	if err != nil {
+		return nil, err
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger.Info("HTTP request", "remote", r.RemoteAddr, "method", r.Method, "path", r.URL.Path)
+		// Every emulated host serves the page
+		local := r.Context().Value(http.LocalAddrContextKey)
+		fmt.Fprintf(w, "Hello from framespector %s, you are %s\n", local, r.RemoteAddr)
+	})
+
+	go func() {
+		if err := http.Serve(l, handler); err != nil && !errors.Is(err, net.ErrClosed) {
+			logger.Error("HTTP server stopped", "err", err)
+		}
+	}()
+
+	return func() { l.Close() }, nil
+}
+
+// startDHCP serves DHCP with the configuration of the command line. Without
+// pool, the addresses of the peer subnet are leased. Without DNS servers, the
+// peer is given when it serves DNS.
+func startDHCP(stack *network.Stack, args *Args) (*network.DHCPServer, error) {
+	peerIP, peerNet, err := net.ParseCIDR(args.peerIPStr)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := network.DHCPConf{
+		Mask:      peerNet.Mask,
+		LeaseTime: args.dhcpLease,
+	}
+
+	if args.dhcpPool != "" {
+		start, end, found := strings.Cut(args.dhcpPool, "-")
+		conf.PoolStart, conf.PoolEnd = net.ParseIP(start), net.ParseIP(end)
+		if !found || conf.PoolStart.To4() == nil || conf.PoolEnd.To4() == nil {
+			return nil, fmt.Errorf("%s is not a valid DHCP pool", args.dhcpPool)
+		}
+	} else {
+		// Skip the network and broadcast addresses
+		netIP := peerNet.IP.To4()
+		ones, bits := peerNet.Mask.Size()
+		if bits-ones < 2 {
+			return nil, fmt.Errorf("subnet of %s is too small for DHCP", peerIP)
+		}
+		first := binary.BigEndian.Uint32(netIP) + 1
+		last := first + 1<<(bits-ones) - 3
+		conf.PoolStart = binary.BigEndian.AppendUint32(nil, first)
+		conf.PoolEnd = binary.BigEndian.AppendUint32(nil, last)
+	}
+
+	if args.dhcpRouter != "" {
+		if conf.Router = net.ParseIP(args.dhcpRouter); conf.Router.To4() == nil {
+			return nil, fmt.Errorf("%s is not a valid router", args.dhcpRouter)
+		}
+	}
+
+	if args.dhcpDNS != "" {
+		for _, s := range strings.Split(args.dhcpDNS, ",") {
+			ip := net.ParseIP(strings.TrimSpace(s))
+			if ip.To4() == nil {
+				return nil, fmt.Errorf("%s is not a valid DNS server", s)
+			}
+			conf.DNS = append(conf.DNS, ip)
+		}
+	} else if args.dnsZone != "" {
+		// We are the resolver
+		conf.DNS = []net.IP{peerIP}
+	}
+
+	return stack.ServeDHCP(conf)
+}